@@ -0,0 +1,31 @@
+package main
+
+// the stratis command line tool, e.g.
+//
+//     STRATIS_DB_DRIVER=postgres ... go run github.com/abstratium-informatique-sarl/stratis/cmd/stratis migrate status
+//
+// see migration.Run() for the migrate commands
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database/migration"
+)
+
+const usage = `usage: stratis <command> [args]
+
+commands:
+  migrate    manages the database migrations, see "stratis migrate -h"
+`
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "migrate" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := migration.Run(os.Args[2:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,184 @@
+package audit
+
+// an audit trail of security events and data changes, which are recorded in an AuditSink, e.g.
+//
+//     database.SetupDb()
+//     audit.SetSink(&audit.DbSink{Db: database.GetDb()})
+//     database.GetDb().Use(&audit.Plugin{Entities: []any{&Order{}, &Account{}}})
+//     ...
+//     admin := router.Group("/admin", framework_gin.SecurityMiddleware([]string{"admin"}, nil), framework_gin.NonTxMiddleware())
+//     admin.GET("/audit", audit.QueryHandler(audit.GetSink().(audit.Querier)))
+//
+// security events, i.e. sign ins, failed sign ins, sign outs, access denied by the security and policy middlewares,
+// invalid tokens and impersonation, are recorded automatically. services can record their own using Security().
+//
+// changes to the entities given to the Plugin are recorded with the values before and after the change. fields
+// tagged with `audit:"-"`, e.g. password hashes, are left out, as are the changes made using a db returned by Skip().
+// the values of encrypted fields, see package encryption, are recorded as ENCRYPTED_VALUE.
+//
+// every event contains the user, the real user if they are being impersonated, the tenant, and the trace and
+// request ids of the call. the default sink is a LogSink. the table for the DbSink must be created by the migrations
+// of the service, using the SQL from the files in pkg/audit/migrations, or obtained using MigrationSQL().
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"time"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const KIND_SECURITY = "security"
+const KIND_DATA = "data"
+
+const ACTION_SIGN_IN = "sign-in"
+const ACTION_SIGN_IN_FAILED = "sign-in-failed"
+const ACTION_SIGN_OUT = "sign-out"
+const ACTION_ACCESS_DENIED = "access-denied"
+const ACTION_INVALID_TOKEN = "invalid-token"
+const ACTION_IMPERSONATION_STARTED = "impersonation-started"
+const ACTION_IMPERSONATION_ENDED = "impersonation-ended"
+const ACTION_IMPERSONATION_DENIED = "impersonation-denied"
+const ACTION_IMPERSONATED_CALL = "impersonated-call"
+
+const ACTION_CREATE = "create"
+const ACTION_UPDATE = "update"
+const ACTION_DELETE = "delete"
+
+var log = logging.GetLog("audit")
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+var sink AuditSink = &LogSink{}
+
+// a row of the audit table
+type Event struct {
+	Id   uint64    `json:"id" gorm:"primaryKey"`
+	Time time.Time `json:"time"`
+
+	// KIND_SECURITY or KIND_DATA
+	Kind string `json:"kind"`
+
+	// one of the ACTION_ constants, or one defined by the service
+	Action string `json:"action"`
+
+	// the user on whose behalf the call was made, empty if anonymous
+	UserId   string `json:"userId"`
+	Username string `json:"username"`
+
+	// the real user, if the user was being impersonated
+	ActorId string `json:"actorId,omitempty"`
+
+	Tenant    string `json:"tenant,omitempty"`
+	TraceId   string `json:"traceId,omitempty"`
+	RequestId string `json:"requestId,omitempty"`
+
+	// the table and primary key of the changed entity, for data events
+	Entity   string `json:"entity,omitempty"`
+	EntityId string `json:"entityId,omitempty"`
+
+	// the changed fields by column, for data events
+	Changes map[string]Change `json:"changes,omitempty" gorm:"serializer:json"`
+
+	// e.g. the method and path of the call, or the reason for a failure
+	Details map[string]string `json:"details,omitempty" gorm:"serializer:json"`
+}
+
+func (Event) TableName() string {
+	return "stratis_audit"
+}
+
+// the value of a field before and after a change. Old is nil for new entities, and New is nil for deleted ones.
+type Change struct {
+	Old any `json:"old,omitempty"`
+	New any `json:"new,omitempty"`
+}
+
+// sets the sink to which all events are sent
+func SetSink(s AuditSink) {
+	sink = s
+}
+
+func GetSink() AuditSink {
+	return sink
+}
+
+// creates an event, filled in with the user, tenant and ids of the call
+func NewEvent(ctx fwctx.ICtx, kind string, action string) Event {
+	event := Event{
+		Time:      time.Now().UTC(),
+		Kind:      kind,
+		Action:    action,
+		Tenant:    ctx.GetTenant(),
+		RequestId: ctx.GetRequestId(),
+	}
+	if user, err := ctx.GetUser(); err == nil && user != nil && !user.IsAnonymous() {
+		event.UserId = user.UserId
+		event.Username = user.Username
+		if user.IsImpersonated() {
+			event.ActorId = user.Actor.UserId
+		}
+	}
+	if c := ctx.GetGinCtx(); c != nil && c.Request != nil {
+		event.TraceId = traceIdOf(c.Request.Context())
+	}
+	return event
+}
+
+// records a security event, with the given details, e.g. the reason for a failure. the method and path of the call
+// and the IP address of the caller are added to the details. an error while recording is logged rather than
+// returned, so that it does not affect the call.
+func Security(ctx fwctx.ICtx, action string, details map[string]string) {
+	Record(SecurityEvent(ctx, action, details))
+}
+
+// creates a security event like Security(), e.g. in order to set the user before recording it with Record()
+func SecurityEvent(ctx fwctx.ICtx, action string, details map[string]string) Event {
+	event := NewEvent(ctx, KIND_SECURITY, action)
+	event.Details = map[string]string{}
+	if c := ctx.GetGinCtx(); c != nil && c.Request != nil {
+		event.Details["method"] = c.Request.Method
+		event.Details["path"] = c.Request.URL.Path
+		event.Details["ip"] = c.ClientIP()
+	}
+	for key, value := range details {
+		event.Details[key] = value
+	}
+	return event
+}
+
+// records the event in the sink immediately. an error is logged rather than returned.
+func Record(event Event) {
+	record(context.Background(), event)
+}
+
+func record(ctx context.Context, event Event) {
+	if err := sink.Record(ctx, event); err != nil {
+		log.Error().Msgf("unable to record audit event %s %s for user %s: %+v", event.Kind, event.Action, event.UserId, err)
+	}
+}
+
+func traceIdOf(ctx context.Context) string {
+	if spanCtx := trace.SpanContextFromContext(ctx); spanCtx.HasTraceID() {
+		return spanCtx.TraceID().String()
+	}
+	return ""
+}
+
+// returns the SQL for creating (up) and dropping (down) the audit table, for the given driver, i.e. "mysql",
+// "postgres" or "sqlite", to be added to the migrations of the service
+func MigrationSQL(driver string) (up string, down string, err error) {
+	upBytes, err := migrations.ReadFile("migrations/" + driver + ".up.sql")
+	if err != nil {
+		return "", "", fmt.Errorf("STRATIS-1032 there is no audit migration for driver %s", driver)
+	}
+	downBytes, err := migrations.ReadFile("migrations/" + driver + ".down.sql")
+	if err != nil {
+		return "", "", fmt.Errorf("STRATIS-1032 there is no audit migration for driver %s", driver)
+	}
+	return string(upBytes), string(downBytes), nil
+}
@@ -0,0 +1,310 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database/encryption"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database/paging"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type account struct {
+	Id           uint64
+	Username     string
+	PasswordHash string `audit:"-"`
+}
+
+type post struct {
+	Id    uint64
+	Title string
+	Tags  []string `gorm:"serializer:json"`
+}
+
+type secret struct {
+	Id    uint64
+	Note  encryption.EncryptedString
+	Email string `gorm:"serializer:encrypted"`
+}
+
+// the id of the user of the test ctx
+const testUserId = "c606cb7f-9ac5-4f10-8403-db2e83b1ae0f"
+
+var errorForTest = errors.New("for test")
+
+func setupTestDb(t *testing.T, s AuditSink) fwctx.ICtx {
+	t.Setenv(database.STRATIS_DB_DRIVER, database.DRIVER_SQLITE)
+	t.Setenv("STRATIS_DB_NAME", "file:"+filepath.Join(t.TempDir(), "test.db"))
+	database.SetupDb()
+	db := database.GetDb()
+	up, _, err := MigrationSQL("sqlite")
+	assert.Nil(t, err)
+	assert.Nil(t, db.Exec(up).Error)
+	assert.Nil(t, db.AutoMigrate(&account{}, &post{}, &secret{}))
+	assert.Nil(t, db.Use(&Plugin{Entities: []any{&account{}, &post{}, &secret{}}}))
+	if dbSink, ok := s.(*DbSink); ok {
+		dbSink.Db = db
+	}
+	previous := GetSink()
+	SetSink(s)
+	t.Cleanup(func() { SetSink(previous) })
+	return fwctx.BuildTypedCtxForTests(db, false)
+}
+
+func TestMigrationSQL(t *testing.T) {
+	assert := assert.New(t)
+	for _, driver := range []string{"mysql", "postgres", "sqlite"} {
+		up, down, err := MigrationSQL(driver)
+		assert.Nil(err)
+		assert.Contains(up, "CREATE TABLE stratis_audit")
+		assert.Contains(down, "DROP TABLE stratis_audit")
+	}
+	_, _, err := MigrationSQL("oracle")
+	assert.ErrorContains(err, "STRATIS-1032")
+}
+
+func TestSecurity(t *testing.T) {
+	assert := assert.New(t)
+	s := &MemorySink{}
+	previous := GetSink()
+	SetSink(s)
+	defer SetSink(previous)
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/admin/things?x=1", nil)
+	c.Request.Header.Set(fwctx.REQUEST_ID_HEADER, "r1")
+	ctx := fwctx.BuildTypedCtx(c, nil)
+	ctx.SetTenant("t1")
+
+	// when
+	Security(ctx, ACTION_ACCESS_DENIED, map[string]string{"permission": "things:read"})
+
+	// then
+	events := s.Events()
+	assert.Len(events, 1)
+	assert.Equal(KIND_SECURITY, events[0].Kind)
+	assert.Equal(ACTION_ACCESS_DENIED, events[0].Action)
+	assert.Equal("", events[0].UserId) // anonymous
+	assert.Equal("t1", events[0].Tenant)
+	assert.Equal("r1", events[0].RequestId)
+	assert.Equal(map[string]string{"method": "GET", "path": "/admin/things", "ip": "192.0.2.1", "permission": "things:read"}, events[0].Details)
+	assert.WithinDuration(time.Now(), events[0].Time, time.Second)
+}
+
+func TestPlugin_recordsChanges(t *testing.T) {
+	assert := assert.New(t)
+	s := &MemorySink{}
+	ctx := setupTestDb(t, s)
+	a := &account{Username: "john", PasswordHash: "secret"}
+	b := &account{Username: "jane", PasswordHash: "secret"}
+
+	// when
+	assert.Nil(ctx.GetDb().Create(a).Error)
+	assert.Nil(ctx.GetDb().Create(b).Error)
+	assert.Nil(ctx.GetDb().Model(a).Updates(map[string]any{"username": "johnny", "password_hash": "other"}).Error)
+	assert.Nil(ctx.GetDb().Model(b).Update("password_hash", "other").Error) // nothing audited changes
+	assert.Nil(ctx.GetDb().Where("username LIKE ?", "j%").Delete(&account{}).Error)
+
+	// then
+	events := s.Events()
+	assert.Len(events, 5)
+	for _, event := range events {
+		assert.Equal(KIND_DATA, event.Kind)
+		assert.Equal("accounts", event.Entity)
+		assert.Equal(testUserId, event.UserId)
+		assert.Equal("test", event.RequestId)
+	}
+	assert.Equal(ACTION_CREATE, events[0].Action)
+	assert.Equal("1", events[0].EntityId)
+	assert.Equal(map[string]Change{"id": {New: uint64(1)}, "username": {New: "john"}}, events[0].Changes)
+	assert.Equal(ACTION_UPDATE, events[2].Action)
+	assert.Equal("1", events[2].EntityId)
+	assert.Equal(map[string]Change{"username": {Old: "john", New: "johnny"}}, events[2].Changes)
+	assert.Equal(ACTION_DELETE, events[3].Action)
+	assert.Equal(ACTION_DELETE, events[4].Action)
+	assert.ElementsMatch([]string{"1", "2"}, []string{events[3].EntityId, events[4].EntityId})
+	assert.NotContains(events[3].Changes, "password_hash")
+}
+
+func TestPlugin_afterCommit(t *testing.T) {
+	assert := assert.New(t)
+	s := &MemorySink{}
+	ctx := setupTestDb(t, s)
+
+	// when
+	_, err := database.WithTx(ctx, func() (any, error) {
+		assert.Nil(ctx.GetDb().Create(&account{Username: "john"}).Error)
+		assert.Len(s.Events(), 0) // not yet
+		return nil, errorForTest
+	})
+
+	// then
+	assert.Equal(errorForTest, err)
+	assert.Len(s.Events(), 0)
+
+	// when
+	_, err = database.WithTx(ctx, func() (any, error) {
+		return nil, ctx.GetDb().Create(&account{Username: "jane"}).Error
+	})
+
+	// then
+	assert.Nil(err)
+	assert.Len(s.Events(), 1)
+}
+
+func TestDbSink_recordsInTx(t *testing.T) {
+	assert := assert.New(t)
+	s := &DbSink{}
+	ctx := setupTestDb(t, s)
+
+	// when
+	_, err := database.WithTx(ctx, func() (any, error) {
+		assert.Nil(ctx.GetDb().Create(&account{Username: "john"}).Error)
+		return nil, errorForTest
+	})
+	assert.Equal(errorForTest, err)
+	_, err = database.WithTx(ctx, func() (any, error) {
+		return nil, ctx.GetDb().Create(&account{Username: "jane"}).Error
+	})
+	assert.Nil(err)
+
+	// then
+	events := []Event{}
+	assert.Nil(s.Db.Find(&events).Error)
+	assert.Len(events, 1)
+	assert.Equal("jane", events[0].Changes["username"].New)
+	assert.Equal(testUserId, events[0].UserId)
+}
+
+func TestDbSink_recordsFieldsWithSerializer(t *testing.T) {
+	assert := assert.New(t)
+	s := &DbSink{}
+	ctx := setupTestDb(t, s)
+	p := &post{Title: "hello", Tags: []string{"a"}}
+
+	// when
+	assert.Nil(ctx.GetDb().Create(p).Error)
+	p.Tags = []string{"a", "b"}
+	assert.Nil(ctx.GetDb().Save(p).Error)
+	assert.Nil(ctx.GetDb().Delete(p).Error)
+
+	// then
+	events := []Event{}
+	assert.Nil(s.Db.Order("id").Find(&events).Error)
+	assert.Len(events, 3)
+	assert.Equal([]any{"a"}, events[0].Changes["tags"].New)
+	assert.Equal(Change{Old: []any{"a"}, New: []any{"a", "b"}}, events[1].Changes["tags"])
+	assert.Equal([]any{"a", "b"}, events[2].Changes["tags"].Old)
+}
+
+func TestPlugin_encryptedFieldsAreRedacted(t *testing.T) {
+	assert := assert.New(t)
+	k, err := encryption.NewKeyring("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")}, nil)
+	assert.Nil(err)
+	encryption.SetKeyring(k)
+	defer encryption.SetKeyring(nil)
+	s := &MemorySink{}
+	ctx := setupTestDb(t, s)
+	sec := &secret{Note: "note", Email: "john@example.com"}
+
+	// when
+	assert.Nil(ctx.GetDb().Create(sec).Error)
+	sec.Email = "jane@example.com"
+	assert.Nil(ctx.GetDb().Save(sec).Error)
+	assert.Nil(ctx.GetDb().Delete(sec).Error)
+
+	// then the changes are recorded, without the values
+	events := s.Events()
+	assert.Len(events, 3)
+	assert.Equal(map[string]Change{"id": {New: uint64(1)}, "note": {New: ENCRYPTED_VALUE}, "email": {New: ENCRYPTED_VALUE}}, events[0].Changes)
+	assert.Equal(map[string]Change{"email": {Old: ENCRYPTED_VALUE, New: ENCRYPTED_VALUE}}, events[1].Changes)
+	assert.Equal(Change{Old: ENCRYPTED_VALUE}, events[2].Changes["note"])
+	assert.Equal(Change{Old: ENCRYPTED_VALUE}, events[2].Changes["email"])
+}
+
+func TestDbSink_query(t *testing.T) {
+	assert := assert.New(t)
+	s := &DbSink{}
+	ctx := setupTestDb(t, s)
+	for _, action := range []string{ACTION_SIGN_IN, ACTION_ACCESS_DENIED, ACTION_SIGN_IN, ACTION_SIGN_OUT} {
+		Security(ctx, action, nil)
+	}
+
+	// when
+	page, err := s.Query(ctx, Filter{Action: ACTION_SIGN_IN}, paging.Request{Limit: 1})
+
+	// then
+	assert.Nil(err)
+	assert.Len(page.Items, 1)
+	assert.Equal(uint64(3), page.Items[0].Id) // newest first
+	assert.NotEmpty(page.NextCursor)
+
+	// when
+	page, err = s.Query(ctx, Filter{Action: ACTION_SIGN_IN}, paging.Request{Limit: 1, Cursor: page.NextCursor})
+
+	// then
+	assert.Nil(err)
+	assert.Len(page.Items, 1)
+	assert.Equal(uint64(1), page.Items[0].Id)
+
+	// when filtered by time
+	page, err = s.Query(ctx, Filter{To: time.Now().Add(-time.Hour)}, paging.Request{Limit: 10})
+
+	// then
+	assert.Nil(err)
+	assert.Len(page.Items, 0)
+}
+
+func TestQueryHandler(t *testing.T) {
+	s := &MemorySink{}
+	previous := GetSink()
+	SetSink(s)
+	defer SetSink(previous)
+	Security(fwctx.BuildTypedCtxForTests(nil, false), ACTION_SIGN_IN, nil)
+	Security(fwctx.BuildTypedCtxForTests(nil, false), ACTION_SIGN_OUT, nil)
+
+	tests := []struct {
+		name    string
+		query   string
+		status  int
+		actions []string
+	}{
+		{"all", "", http.StatusOK, []string{ACTION_SIGN_OUT, ACTION_SIGN_IN}},
+		{"filtered", "?action=sign-in", http.StatusOK, []string{ACTION_SIGN_IN}},
+		{"limited", "?limit=1", http.StatusOK, []string{ACTION_SIGN_OUT}},
+		{"invalid time", "?from=yesterday", http.StatusBadRequest, nil},
+		{"invalid limit", "?limit=x", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/audit", QueryHandler(s))
+			w := httptest.NewRecorder()
+
+			// when
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/audit"+tt.query, nil))
+
+			// then
+			assert.Equal(tt.status, w.Code)
+			if tt.status == http.StatusOK {
+				page := paging.Page[Event]{}
+				assert.Nil(json.Unmarshal(w.Body.Bytes(), &page))
+				actions := []string{}
+				for _, event := range page.Items {
+					actions = append(actions, event.Action)
+				}
+				assert.Equal(tt.actions, actions)
+			}
+		})
+	}
+}
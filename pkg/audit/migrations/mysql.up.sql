@@ -0,0 +1,19 @@
+CREATE TABLE stratis_audit (
+    id         BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    time       DATETIME(6) NOT NULL,
+    kind       VARCHAR(16) NOT NULL,
+    action     VARCHAR(64) NOT NULL,
+    user_id    VARCHAR(128) NOT NULL DEFAULT '',
+    username   VARCHAR(255) NOT NULL DEFAULT '',
+    actor_id   VARCHAR(128) NOT NULL DEFAULT '',
+    tenant     VARCHAR(255) NOT NULL DEFAULT '',
+    trace_id   VARCHAR(64) NOT NULL DEFAULT '',
+    request_id VARCHAR(128) NOT NULL DEFAULT '',
+    entity     VARCHAR(255) NOT NULL DEFAULT '',
+    entity_id  VARCHAR(255) NOT NULL DEFAULT '',
+    changes    LONGTEXT NULL,
+    details    TEXT NULL,
+    INDEX idx_stratis_audit_time (time),
+    INDEX idx_stratis_audit_user (user_id, time),
+    INDEX idx_stratis_audit_entity (entity, entity_id)
+);
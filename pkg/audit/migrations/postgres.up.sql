@@ -0,0 +1,19 @@
+CREATE TABLE stratis_audit (
+    id         BIGSERIAL PRIMARY KEY,
+    time       TIMESTAMPTZ NOT NULL,
+    kind       VARCHAR(16) NOT NULL,
+    action     VARCHAR(64) NOT NULL,
+    user_id    VARCHAR(128) NOT NULL DEFAULT '',
+    username   VARCHAR(255) NOT NULL DEFAULT '',
+    actor_id   VARCHAR(128) NOT NULL DEFAULT '',
+    tenant     VARCHAR(255) NOT NULL DEFAULT '',
+    trace_id   VARCHAR(64) NOT NULL DEFAULT '',
+    request_id VARCHAR(128) NOT NULL DEFAULT '',
+    entity     VARCHAR(255) NOT NULL DEFAULT '',
+    entity_id  VARCHAR(255) NOT NULL DEFAULT '',
+    changes    TEXT NULL,
+    details    TEXT NULL
+);
+CREATE INDEX idx_stratis_audit_time ON stratis_audit (time);
+CREATE INDEX idx_stratis_audit_user ON stratis_audit (user_id, time);
+CREATE INDEX idx_stratis_audit_entity ON stratis_audit (entity, entity_id);
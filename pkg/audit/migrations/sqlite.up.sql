@@ -0,0 +1,19 @@
+CREATE TABLE stratis_audit (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    time       DATETIME NOT NULL,
+    kind       TEXT NOT NULL,
+    action     TEXT NOT NULL,
+    user_id    TEXT NOT NULL DEFAULT '',
+    username   TEXT NOT NULL DEFAULT '',
+    actor_id   TEXT NOT NULL DEFAULT '',
+    tenant     TEXT NOT NULL DEFAULT '',
+    trace_id   TEXT NOT NULL DEFAULT '',
+    request_id TEXT NOT NULL DEFAULT '',
+    entity     TEXT NOT NULL DEFAULT '',
+    entity_id  TEXT NOT NULL DEFAULT '',
+    changes    TEXT NULL,
+    details    TEXT NULL
+);
+CREATE INDEX idx_stratis_audit_time ON stratis_audit (time);
+CREATE INDEX idx_stratis_audit_user ON stratis_audit (user_id, time);
+CREATE INDEX idx_stratis_audit_entity ON stratis_audit (entity, entity_id);
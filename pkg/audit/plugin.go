@@ -0,0 +1,291 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database/encryption"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"gorm.io/plugin/dbresolver"
+)
+
+const _BEFORE_SETTING = "stratis:audit:before"
+const _SKIP_SETTING = "stratis:audit:skip"
+
+// recorded instead of the values of encrypted fields, which would otherwise be kept in the audit trail in plain text
+const ENCRYPTED_VALUE = "[encrypted]"
+
+// records the changes made to the given entities, with their values before and after each change. the rows affected
+// by an update or delete are read before it is made, using the same connection, so that the changes are also
+// recorded for updates and deletes of several rows, e.g. `db.Where("status = ?", "NEW").Delete(&Order{})`.
+//
+// if the sink is a TxSink, the events are recorded in the transaction of the change, and an error when recording them
+// causes the change to fail. otherwise they are recorded once the transaction of the ICtx is committed.
+type Plugin struct {
+	// the models whose changes are recorded, e.g. `&Order{}`
+	Entities []any
+
+	tables map[string]bool
+}
+
+func (p *Plugin) Name() string {
+	return "stratis:audit"
+}
+
+func (p *Plugin) Initialize(db *gorm.DB) error {
+	p.tables = map[string]bool{}
+	for _, entity := range p.Entities {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(entity); err != nil {
+			return err
+		}
+		if stmt.Schema.PrioritizedPrimaryField == nil {
+			return fmt.Errorf("STRATIS-1033 %s needs a single primary key to be audited", stmt.Schema.Name)
+		}
+		p.tables[stmt.Schema.Table] = true
+	}
+
+	if err := db.Callback().Create().After("gorm:create").Register("stratis:audit:create", p.afterCreate); err != nil {
+		return err
+	}
+	if err := db.Callback().Update().Before("gorm:update").Register("stratis:audit:before_update", p.before); err != nil {
+		return err
+	}
+	if err := db.Callback().Update().After("gorm:update").Register("stratis:audit:after_update", p.afterUpdate); err != nil {
+		return err
+	}
+	if err := db.Callback().Delete().Before("gorm:delete").Register("stratis:audit:before_delete", p.before); err != nil {
+		return err
+	}
+	return db.Callback().Delete().After("gorm:delete").Register("stratis:audit:after_delete", p.afterDelete)
+}
+
+// leaves the changes made using the returned db out of the audit trail, e.g. when personal data is anonymised or
+// deleted, since the audit trail would otherwise keep the values which are being removed
+//
+//     audit.Skip(ctx.GetDb()).Delete(&customer)
+func Skip(db *gorm.DB) *gorm.DB {
+	return db.Set(_SKIP_SETTING, true)
+}
+
+func (p *Plugin) isAudited(db *gorm.DB) bool {
+	if skip, ok := db.Get(_SKIP_SETTING); ok && skip.(bool) {
+		return false
+	}
+	return db.Error == nil && !db.DryRun && db.Statement.Schema != nil && p.tables[db.Statement.Schema.Table]
+}
+
+func (p *Plugin) afterCreate(db *gorm.DB) {
+	if !p.isAudited(db) {
+		return
+	}
+	events := []Event{}
+	forEachStruct(db.Statement.ReflectValue, func(rv reflect.Value) {
+		changes := map[string]Change{}
+		for _, field := range auditedFields(db.Statement.Schema) {
+			changes[field.DBName] = Change{New: redact(field, valueOf(db, field, rv))}
+		}
+		events = append(events, newDataEvent(db, ACTION_CREATE, idOf(db, rv), changes))
+	})
+	p.record(db, events)
+}
+
+// reads the rows which are about to be updated or deleted
+func (p *Plugin) before(db *gorm.DB) {
+	if !p.isAudited(db) {
+		return
+	}
+	query := p.session(db)
+	conditions := false
+	if where, ok := db.Statement.Clauses["WHERE"]; ok {
+		query = query.Clauses(where.Expression)
+		conditions = true
+	}
+	if rv := db.Statement.ReflectValue; rv.Kind() == reflect.Struct {
+		pk := db.Statement.Schema.PrioritizedPrimaryField
+		if id, isZero := pk.ValueOf(db.Statement.Context, rv); !isZero {
+			query = query.Where(clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: pk.DBName}, Value: id})
+			conditions = true
+		}
+	}
+	if !conditions && !db.AllowGlobalUpdate {
+		return // gorm refuses to change all rows
+	}
+
+	before := reflect.New(reflect.SliceOf(db.Statement.Schema.ModelType))
+	if err := query.Table(db.Statement.Schema.Table).Find(before.Interface()).Error; err != nil {
+		db.AddError(fmt.Errorf("unable to read %s before auditing a change: %w", db.Statement.Schema.Table, err))
+		return
+	}
+	db.Statement.Settings.Store(_BEFORE_SETTING, before.Elem())
+}
+
+func (p *Plugin) afterUpdate(db *gorm.DB) {
+	before, ok := p.loadBefore(db)
+	if !ok || before.Len() == 0 || db.RowsAffected == 0 {
+		return
+	}
+
+	// read the rows again, since the values in memory are not complete, e.g. after an update with a map. unscoped,
+	// since the update may have soft deleted them
+	pk := db.Statement.Schema.PrioritizedPrimaryField
+	ids := []any{}
+	for i := 0; i < before.Len(); i++ {
+		ids = append(ids, idOf(db, before.Index(i)))
+	}
+	after := reflect.New(reflect.SliceOf(db.Statement.Schema.ModelType))
+	err := p.session(db).Unscoped().Table(db.Statement.Schema.Table).
+		Where(clause.IN{Column: clause.Column{Table: clause.CurrentTable, Name: pk.DBName}, Values: ids}).
+		Find(after.Interface()).Error
+	if err != nil {
+		db.AddError(fmt.Errorf("unable to read %s after auditing a change: %w", db.Statement.Schema.Table, err))
+		return
+	}
+	afterById := map[any]reflect.Value{}
+	for i := 0; i < after.Elem().Len(); i++ {
+		afterById[idOf(db, after.Elem().Index(i))] = after.Elem().Index(i)
+	}
+
+	events := []Event{}
+	for i := 0; i < before.Len(); i++ {
+		id := idOf(db, before.Index(i))
+		afterRv, ok := afterById[id]
+		if !ok {
+			continue // e.g. its primary key was changed
+		}
+		changes := map[string]Change{}
+		for _, field := range auditedFields(db.Statement.Schema) {
+			old := valueOf(db, field, before.Index(i))
+			value := valueOf(db, field, afterRv)
+			if !reflect.DeepEqual(old, value) {
+				changes[field.DBName] = Change{Old: redact(field, old), New: redact(field, value)}
+			}
+		}
+		if len(changes) > 0 {
+			events = append(events, newDataEvent(db, ACTION_UPDATE, id, changes))
+		}
+	}
+	p.record(db, events)
+}
+
+func (p *Plugin) afterDelete(db *gorm.DB) {
+	before, ok := p.loadBefore(db)
+	if !ok || db.RowsAffected == 0 {
+		return
+	}
+	events := []Event{}
+	for i := 0; i < before.Len(); i++ {
+		changes := map[string]Change{}
+		for _, field := range auditedFields(db.Statement.Schema) {
+			changes[field.DBName] = Change{Old: redact(field, valueOf(db, field, before.Index(i)))}
+		}
+		events = append(events, newDataEvent(db, ACTION_DELETE, idOf(db, before.Index(i)), changes))
+	}
+	p.record(db, events)
+}
+
+func (p *Plugin) loadBefore(db *gorm.DB) (reflect.Value, bool) {
+	before, ok := db.Statement.Settings.LoadAndDelete(_BEFORE_SETTING)
+	if !ok || !p.isAudited(db) {
+		return reflect.Value{}, false
+	}
+	return before.(reflect.Value), true
+}
+
+// a new session on the connection of the statement, i.e. in its transaction, if any, and on the primary if there are
+// read replicas
+func (p *Plugin) session(db *gorm.DB) *gorm.DB {
+	return db.Session(&gorm.Session{NewDB: true}).Clauses(dbresolver.Write)
+}
+
+func (p *Plugin) record(db *gorm.DB, events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	if txSink, ok := sink.(TxSink); ok {
+		for _, event := range events {
+			if err := txSink.RecordWith(db.Session(&gorm.Session{NewDB: true}), event); err != nil {
+				db.AddError(fmt.Errorf("unable to record audit event: %w", err))
+				return
+			}
+		}
+		return
+	}
+
+	recordAll := func() {
+		for _, event := range events {
+			record(context.Background(), event)
+		}
+	}
+	if ctx, ok := fwctx.FromContext(db.Statement.Context); ok {
+		ctx.AfterCommit(recordAll) // immediately, if there is no transaction
+	} else {
+		recordAll()
+	}
+}
+
+func newDataEvent(db *gorm.DB, action string, id any, changes map[string]Change) Event {
+	event := Event{Time: time.Now().UTC(), Kind: KIND_DATA, Action: action}
+	if ctx, ok := fwctx.FromContext(db.Statement.Context); ok {
+		event = NewEvent(ctx, KIND_DATA, action)
+	}
+	if traceId := traceIdOf(db.Statement.Context); len(traceId) > 0 {
+		event.TraceId = traceId
+	}
+	event.Entity = db.Statement.Schema.Table
+	event.EntityId = fmt.Sprint(id)
+	event.Changes = changes
+	return event
+}
+
+func idOf(db *gorm.DB, rv reflect.Value) any {
+	id, _ := db.Statement.Schema.PrioritizedPrimaryField.ValueOf(db.Statement.Context, reflect.Indirect(rv))
+	return id
+}
+
+// the value of the field, rather than the wrapper which gorm returns for fields with a serializer
+func valueOf(db *gorm.DB, field *schema.Field, rv reflect.Value) any {
+	value := reflect.Indirect(field.ReflectValueOf(db.Statement.Context, rv))
+	if !value.IsValid() {
+		return nil // a nil pointer
+	}
+	return value.Interface()
+}
+
+// ENCRYPTED_VALUE instead of the value of an encrypted field, unless it is nil
+func redact(field *schema.Field, value any) any {
+	if value != nil && encryption.IsEncrypted(field) {
+		return ENCRYPTED_VALUE
+	}
+	return value
+}
+
+// the fields with columns, except those tagged with `audit:"-"`
+func auditedFields(s *schema.Schema) []*schema.Field {
+	fields := []*schema.Field{}
+	for _, field := range s.Fields {
+		if len(field.DBName) > 0 && field.Tag.Get("audit") != "-" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// calls the function for the entity, or each entity of a slice
+func forEachStruct(rv reflect.Value, f func(rv reflect.Value)) {
+	switch rv.Kind() {
+	case reflect.Struct:
+		f(rv)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if elem := reflect.Indirect(rv.Index(i)); elem.Kind() == reflect.Struct {
+				f(elem)
+			}
+		}
+	}
+}
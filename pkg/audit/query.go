@@ -0,0 +1,130 @@
+package audit
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database/paging"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+	"github.com/gin-gonic/gin"
+)
+
+// restricts the events returned by a Querier. empty fields are ignored.
+type Filter struct {
+	Kind     string
+	Action   string
+	UserId   string
+	Tenant   string
+	Entity   string
+	EntityId string
+
+	// inclusive
+	From time.Time
+
+	// exclusive
+	To time.Time
+}
+
+// a sink whose events can be queried, e.g. by admins
+type Querier interface {
+	// returns a page of the events matching the filter, newest first unless the request is sorted otherwise
+	Query(ctx fwctx.ICtx, filter Filter, request paging.Request) (paging.Page[Event], error)
+}
+
+var events = database.NewRepository[Event, uint64]("Time")
+
+// uses the connection of the ctx, which must be to the database of the sink
+func (s *DbSink) Query(ctx fwctx.ICtx, filter Filter, request paging.Request) (paging.Page[Event], error) {
+	if len(request.Sort) == 0 {
+		request.Sort = []paging.Sort{{Field: "id", Desc: true}}
+	}
+	filters := []database.Filter{}
+	for column, value := range map[string]string{
+		"kind":      filter.Kind,
+		"action":    filter.Action,
+		"user_id":   filter.UserId,
+		"tenant":    filter.Tenant,
+		"entity":    filter.Entity,
+		"entity_id": filter.EntityId,
+	} {
+		if len(value) > 0 {
+			filters = append(filters, database.Where(column+" = ?", value))
+		}
+	}
+	if !filter.From.IsZero() {
+		filters = append(filters, database.Where("time >= ?", filter.From.UTC()))
+	}
+	if !filter.To.IsZero() {
+		filters = append(filters, database.Where("time < ?", filter.To.UTC()))
+	}
+	return events.FindPage(ctx, request, filters...)
+}
+
+// returns the newest events matching the filter, up to the limit of the request. the cursor and sort of the request
+// are ignored.
+func (s *MemorySink) Query(ctx fwctx.ICtx, filter Filter, request paging.Request) (paging.Page[Event], error) {
+	page := paging.Page[Event]{Items: []Event{}}
+	all := s.Events()
+	slices.Reverse(all)
+	for _, event := range all {
+		if len(page.Items) < request.Limit && filter.matches(event) {
+			page.Items = append(page.Items, event)
+		}
+	}
+	return page, nil
+}
+
+func (f Filter) matches(event Event) bool {
+	matches := func(expected string, actual string) bool {
+		return len(expected) == 0 || expected == actual
+	}
+	return matches(f.Kind, event.Kind) &&
+		matches(f.Action, event.Action) &&
+		matches(f.UserId, event.UserId) &&
+		matches(f.Tenant, event.Tenant) &&
+		matches(f.Entity, event.Entity) &&
+		matches(f.EntityId, event.EntityId) &&
+		(f.From.IsZero() || !event.Time.Before(f.From)) &&
+		(f.To.IsZero() || event.Time.Before(f.To))
+}
+
+// a handler which returns a page of events, filtered by the query params kind, action, userId, tenant, entity,
+// entityId, from and to (RFC 3339), and paged using limit (default 50, max 500), cursor and sort (see package paging).
+// it must be protected, e.g. using `framework_gin.SecurityMiddleware` with an admin role, and needs a connection to
+// the database, e.g. using `framework_gin.NonTxMiddleware`.
+func QueryHandler(querier Querier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := fwctx.BuildTypedCtx(c, nil)
+		request, err := ctx.PageRequest(50, 500)
+		if err != nil {
+			ctx.HandleError(err, "invalid audit query", log)
+			return
+		}
+		filter := Filter{
+			Kind:     c.Query("kind"),
+			Action:   c.Query("action"),
+			UserId:   c.Query("userId"),
+			Tenant:   c.Query("tenant"),
+			Entity:   c.Query("entity"),
+			EntityId: c.Query("entityId"),
+		}
+		for param, t := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+			if s := c.Query(param); len(s) > 0 {
+				if *t, err = time.Parse(time.RFC3339, s); err != nil {
+					ctx.HandleError(fmt.Errorf("STRATIS-1034 %s must be a time like 2006-01-02T15:04:05Z", param), "invalid audit query", log)
+					return
+				}
+			}
+		}
+
+		page, err := querier.Query(ctx, filter, request)
+		if err != nil {
+			ctx.HandleError(err, "unable to query audit events", log)
+			return
+		}
+		c.JSON(http.StatusOK, page)
+	}
+}
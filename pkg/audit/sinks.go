@@ -0,0 +1,74 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// where audit events are recorded
+type AuditSink interface {
+	Record(ctx context.Context, event Event) error
+}
+
+// a sink which can record an event using a given connection, so that a data event is recorded in the same
+// transaction as the change itself. other sinks are only given data events once the transaction has been committed.
+type TxSink interface {
+	AuditSink
+	RecordWith(db *gorm.DB, event Event) error
+}
+
+// ================================================================================================
+
+// records events in the stratis_audit table
+type DbSink struct {
+	Db *gorm.DB
+}
+
+func (s *DbSink) Record(ctx context.Context, event Event) error {
+	return s.RecordWith(s.Db.WithContext(ctx), event)
+}
+
+func (s *DbSink) RecordWith(db *gorm.DB, event Event) error {
+	return db.Session(&gorm.Session{NewDB: true}).Create(&event).Error
+}
+
+// ================================================================================================
+
+// writes each event as JSON to the "audit" log, at info level, so that it can be shipped with the other logs
+type LogSink struct{}
+
+func (s *LogSink) Record(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	log.Info().RawJSON("audit", data).Msgf("%s %s", event.Kind, event.Action)
+	return nil
+}
+
+// ================================================================================================
+
+// keeps events in memory, for tests
+type MemorySink struct {
+	mutex  sync.Mutex
+	events []Event
+}
+
+func (s *MemorySink) Record(ctx context.Context, event Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	event.Id = uint64(len(s.events) + 1)
+	s.events = append(s.events, event)
+	return nil
+}
+
+// returns a copy of the events recorded so far, in order
+func (s *MemorySink) Events() []Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return slices.Clone(s.events)
+}
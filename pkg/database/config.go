@@ -0,0 +1,165 @@
+package database
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "net/url"
+    "os"
+    "strconv"
+    "time"
+)
+
+// the configuration of the connection pool, the DSN and the logging of slow queries. read from env by ConfigFromEnv(),
+// or passed to SetupDbWithConfig() directly, in which case it should start from ConfigFromEnv(), since the zero value
+// of a field is used as it is, rather than its default:
+//
+//   - STRATIS_DB_POOL_MAX_OPEN - the maximum number of open connections, default 10
+//   - STRATIS_DB_POOL_MAX_IDLE - the maximum number of idle connections, default 5
+//   - STRATIS_DB_POOL_MAX_LIFETIME - the maximum time a connection is reused, e.g. "30m" (the default), or "0" for forever
+//   - STRATIS_DB_POOL_MAX_IDLE_TIME - the maximum time a connection may be idle, e.g. "5m" (the default), or "0" for forever
+//   - STRATIS_DB_SLOW_THRESHOLD - queries taking longer are logged as slow, default "3ms"
+//   - STRATIS_DB_REQUEST_MAX_QUERIES - a warning is logged for calls running more statements, default 50, or 0 for none
+//   - STRATIS_DB_REQUEST_MAX_TIME - a warning is logged for calls whose statements take longer in total, default "500ms", or "0" for none
+//   - STRATIS_DB_REQUEST_MAX_REPEATS - a warning is logged for calls running the same statement this often, e.g. because of the N+1 problem, default 10, or 0 for none
+//   - STRATIS_DB_TX_TIMEOUT - the default maximum duration of a transaction, e.g. "30s", see TxOptions.Timeout. default "0", i.e. none
+//   - STRATIS_DB_STATEMENT_TIMEOUT - the default maximum duration of a statement within a transaction, see TxOptions.StatementTimeout. default "0", i.e. none
+//   - STRATIS_DB_PARAMS - additional DSN parameters in query string form, which override the defaults, e.g. "loc=UTC&timeout=5s"
+//   - STRATIS_DB_TLS_CA - the path to a PEM file containing the CA of the server, which enables TLS
+//   - STRATIS_DB_TLS_CERT and STRATIS_DB_TLS_KEY - the paths to the PEM files of the client certificate and its key
+//   - STRATIS_DB_TLS_SERVER_NAME - the name expected in the server certificate, if it differs from STRATIS_DB_HOST (mysql only)
+type Config struct {
+    MaxOpenConns    int
+    MaxIdleConns    int
+    ConnMaxLifetime time.Duration
+    ConnMaxIdleTime time.Duration
+
+    SlowThreshold time.Duration
+
+    // the thresholds of the statements of a call, above which a warning is logged, see QueryStatsWarnings()
+    RequestMaxQueries int
+    RequestMaxTime    time.Duration
+    RequestMaxRepeats int
+
+    // the defaults for TxOptions.Timeout and TxOptions.StatementTimeout, zero for none
+    TxTimeout        time.Duration
+    StatementTimeout time.Duration
+
+    // added to the DSN, overriding the defaults of the dialect
+    Params map[string]string
+
+    // nil if TLS is not configured
+    TLS *TLSConfig
+}
+
+type TLSConfig struct {
+    CAFile     string
+    CertFile   string
+    KeyFile    string
+    ServerName string
+}
+
+// the config used by the dialects, set by SetupDbWithConfig. nil means it is read from env.
+var config *Config
+
+func getConfig() Config {
+    if config != nil {
+        return *config
+    }
+    return ConfigFromEnv()
+}
+
+// reads the config from env, using the defaults for anything that is not set
+func ConfigFromEnv() Config {
+    cfg := Config{
+        MaxOpenConns:      getEnvInt("STRATIS_DB_POOL_MAX_OPEN", 10),
+        MaxIdleConns:      getEnvInt("STRATIS_DB_POOL_MAX_IDLE", 5),
+        ConnMaxLifetime:   getEnvDuration("STRATIS_DB_POOL_MAX_LIFETIME", 30*time.Minute),
+        ConnMaxIdleTime:   getEnvDuration("STRATIS_DB_POOL_MAX_IDLE_TIME", 5*time.Minute),
+        SlowThreshold:     getEnvDuration("STRATIS_DB_SLOW_THRESHOLD", 3*time.Millisecond),
+        RequestMaxQueries: getEnvInt("STRATIS_DB_REQUEST_MAX_QUERIES", 50),
+        RequestMaxTime:    getEnvDuration("STRATIS_DB_REQUEST_MAX_TIME", 500*time.Millisecond),
+        RequestMaxRepeats: getEnvInt("STRATIS_DB_REQUEST_MAX_REPEATS", 10),
+        TxTimeout:         getEnvDuration("STRATIS_DB_TX_TIMEOUT", 0),
+        StatementTimeout:  getEnvDuration("STRATIS_DB_STATEMENT_TIMEOUT", 0),
+        Params:            map[string]string{},
+    }
+
+    if params := os.Getenv("STRATIS_DB_PARAMS"); len(params) > 0 {
+        values, err := url.ParseQuery(params)
+        if err != nil {
+            panic(fmt.Sprintf("please set env var for db params in the form 'a=b&c=d', rather than '%s'", params))
+        }
+        for key := range values {
+            cfg.Params[key] = values.Get(key)
+        }
+    }
+
+    if ca := os.Getenv("STRATIS_DB_TLS_CA"); len(ca) > 0 {
+        cfg.TLS = &TLSConfig{
+            CAFile:     ca,
+            CertFile:   os.Getenv("STRATIS_DB_TLS_CERT"),
+            KeyFile:    os.Getenv("STRATIS_DB_TLS_KEY"),
+            ServerName: os.Getenv("STRATIS_DB_TLS_SERVER_NAME"),
+        }
+        if (len(cfg.TLS.CertFile) == 0) != (len(cfg.TLS.KeyFile) == 0) {
+            panic("please set env vars for db tls cert and key together")
+        }
+    }
+    return cfg
+}
+
+// builds the tls config, by reading the CA and the client certificate
+func (c *TLSConfig) build(host string) (*tls.Config, error) {
+    ca, err := os.ReadFile(c.CAFile)
+    if err != nil {
+        return nil, fmt.Errorf("STRATIS-1020 unable to read db tls CA %s: %w", c.CAFile, err)
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(ca) {
+        return nil, fmt.Errorf("STRATIS-1020 no certificates found in db tls CA %s", c.CAFile)
+    }
+
+    serverName := c.ServerName
+    if len(serverName) == 0 {
+        serverName = host
+    }
+    tlsConfig := &tls.Config{
+        RootCAs:    pool,
+        ServerName: serverName,
+        MinVersion: tls.VersionTLS12,
+    }
+
+    if len(c.CertFile) > 0 {
+        cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("STRATIS-1020 unable to read db tls client certificate %s: %w", c.CertFile, err)
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+    return tlsConfig, nil
+}
+
+func getEnvInt(name string, defaultValue int) int {
+    s := os.Getenv(name)
+    if len(s) == 0 {
+        return defaultValue
+    }
+    i, err := strconv.Atoi(s)
+    if err != nil {
+        panic(fmt.Sprintf("please set env var %s to a number, rather than '%s'", name, s))
+    }
+    return i
+}
+
+func getEnvDuration(name string, defaultValue time.Duration) time.Duration {
+    s := os.Getenv(name)
+    if len(s) == 0 {
+        return defaultValue
+    }
+    d, err := time.ParseDuration(s)
+    if err != nil {
+        panic(fmt.Sprintf("please set env var %s to a duration like 30s, rather than '%s'", name, s))
+    }
+    return d
+}
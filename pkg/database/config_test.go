@@ -0,0 +1,158 @@
+package database
+
+import (
+    "encoding/pem"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestConfigFromEnv_defaults(t *testing.T) {
+    assert := assert.New(t)
+
+    cfg := ConfigFromEnv()
+
+    assert.Equal(10, cfg.MaxOpenConns)
+    assert.Equal(5, cfg.MaxIdleConns)
+    assert.Equal(30*time.Minute, cfg.ConnMaxLifetime)
+    assert.Equal(5*time.Minute, cfg.ConnMaxIdleTime)
+    assert.Equal(3*time.Millisecond, cfg.SlowThreshold)
+    assert.Equal(50, cfg.RequestMaxQueries)
+    assert.Equal(500*time.Millisecond, cfg.RequestMaxTime)
+    assert.Equal(10, cfg.RequestMaxRepeats)
+    assert.Equal(time.Duration(0), cfg.TxTimeout)
+    assert.Equal(time.Duration(0), cfg.StatementTimeout)
+    assert.Empty(cfg.Params)
+    assert.Nil(cfg.TLS)
+}
+
+func TestConfigFromEnv(t *testing.T) {
+    assert := assert.New(t)
+    t.Setenv("STRATIS_DB_POOL_MAX_OPEN", "20")
+    t.Setenv("STRATIS_DB_POOL_MAX_IDLE", "2")
+    t.Setenv("STRATIS_DB_POOL_MAX_LIFETIME", "0")
+    t.Setenv("STRATIS_DB_POOL_MAX_IDLE_TIME", "1m")
+    t.Setenv("STRATIS_DB_SLOW_THRESHOLD", "200ms")
+    t.Setenv("STRATIS_DB_REQUEST_MAX_QUERIES", "0")
+    t.Setenv("STRATIS_DB_REQUEST_MAX_TIME", "1s")
+    t.Setenv("STRATIS_DB_REQUEST_MAX_REPEATS", "3")
+    t.Setenv("STRATIS_DB_TX_TIMEOUT", "30s")
+    t.Setenv("STRATIS_DB_STATEMENT_TIMEOUT", "5s")
+    t.Setenv("STRATIS_DB_PARAMS", "loc=UTC&timeout=5s")
+    t.Setenv("STRATIS_DB_TLS_CA", "/ca.pem")
+
+    cfg := ConfigFromEnv()
+
+    assert.Equal(20, cfg.MaxOpenConns)
+    assert.Equal(2, cfg.MaxIdleConns)
+    assert.Equal(time.Duration(0), cfg.ConnMaxLifetime)
+    assert.Equal(time.Minute, cfg.ConnMaxIdleTime)
+    assert.Equal(200*time.Millisecond, cfg.SlowThreshold)
+    assert.Equal(0, cfg.RequestMaxQueries)
+    assert.Equal(time.Second, cfg.RequestMaxTime)
+    assert.Equal(3, cfg.RequestMaxRepeats)
+    assert.Equal(30*time.Second, cfg.TxTimeout)
+    assert.Equal(5*time.Second, cfg.StatementTimeout)
+    assert.Equal(map[string]string{"loc": "UTC", "timeout": "5s"}, cfg.Params)
+    assert.Equal(&TLSConfig{CAFile: "/ca.pem"}, cfg.TLS)
+}
+
+func TestConfigFromEnv_invalid(t *testing.T) {
+    tests := []struct {
+        name  string
+        value string
+    }{
+        {"STRATIS_DB_POOL_MAX_OPEN", "lots"},
+        {"STRATIS_DB_POOL_MAX_LIFETIME", "30"},
+        {"STRATIS_DB_PARAMS", "a=%zz"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            t.Setenv(test.name, test.value)
+            assert.Panics(t, func() { ConfigFromEnv() })
+        })
+    }
+}
+
+func TestConfigFromEnv_certWithoutKey(t *testing.T) {
+    t.Setenv("STRATIS_DB_TLS_CA", "/ca.pem")
+    t.Setenv("STRATIS_DB_TLS_CERT", "/cert.pem")
+
+    assert.Panics(t, func() { ConfigFromEnv() })
+}
+
+func TestGetDatabaseConfig_paramsAndTls(t *testing.T) {
+    assert := assert.New(t)
+    setConnectionEnv(t, DRIVER_MYSQL)
+    server := httptest.NewTLSServer(nil)
+    defer server.Close()
+    ca := filepath.Join(t.TempDir(), "ca.pem")
+    os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+    t.Setenv("STRATIS_DB_PARAMS", "loc=UTC")
+    t.Setenv("STRATIS_DB_TLS_CA", ca)
+
+    cfg := GetDatabaseConfig()
+
+    assert.Equal("UTC", cfg.Params["loc"])
+    assert.Equal("utf8mb4", cfg.Params["charset"])
+    assert.Equal(_TLS_CONFIG_NAME, cfg.TLSConfig)
+    assert.Contains(cfg.FormatDSN(), "tls=stratis")
+}
+
+func TestGetDatabaseConfig_tlsIsBuiltOnce(t *testing.T) {
+    assert := assert.New(t)
+    setConnectionEnv(t, DRIVER_MYSQL)
+    server := httptest.NewTLSServer(nil)
+    defer server.Close()
+    ca := filepath.Join(t.TempDir(), "ca.pem")
+    os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+    t.Setenv("STRATIS_DB_TLS_CA", ca)
+    resetTLS()
+    GetDatabaseConfig()
+
+    // when the file is no longer there
+    os.Remove(ca)
+
+    // then it is not read again
+    assert.Equal(_TLS_CONFIG_NAME, GetDatabaseConfig().TLSConfig)
+    assert.Equal(_TLS_CONFIG_NAME, GetDatabaseConfig().TLSConfig)
+
+    // until it is reset, e.g. by setting up the database again
+    resetTLS()
+    assert.Panics(func() { GetDatabaseConfig() })
+}
+
+func TestGetDatabaseConfig_missingCa(t *testing.T) {
+    setConnectionEnv(t, DRIVER_MYSQL)
+    t.Setenv("STRATIS_DB_TLS_CA", filepath.Join(t.TempDir(), "missing.pem"))
+
+    assert.PanicsWithError(t, "STRATIS-1020 unable to read db tls CA "+os.Getenv("STRATIS_DB_TLS_CA")+": open "+os.Getenv("STRATIS_DB_TLS_CA")+": no such file or directory", func() {
+        GetDatabaseConfig()
+    })
+}
+
+func TestPostgresDSN_paramsAndTls(t *testing.T) {
+    assert := assert.New(t)
+    setConnectionEnv(t, DRIVER_POSTGRES)
+    t.Setenv("STRATIS_DB_PARAMS", "connect_timeout=5")
+    t.Setenv("STRATIS_DB_TLS_CA", "/ca.pem")
+    t.Setenv("STRATIS_DB_TLS_CERT", "/cert.pem")
+    t.Setenv("STRATIS_DB_TLS_KEY", "/key.pem")
+
+    dsn := GetDialect().DSN()
+
+    assert.True(strings.HasSuffix(dsn, "/app?connect_timeout=5&sslcert=%2Fcert.pem&sslkey=%2Fkey.pem&sslmode=verify-full&sslrootcert=%2Fca.pem"), dsn)
+}
+
+func TestSqliteDSN_params(t *testing.T) {
+    t.Setenv(STRATIS_DB_DRIVER, DRIVER_SQLITE)
+    t.Setenv("STRATIS_DB_NAME", "test.db")
+    t.Setenv("STRATIS_DB_PARAMS", "_pragma=journal_mode(WAL)")
+
+    assert.Equal(t, "test.db?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode%28WAL%29", GetDialect().DSN())
+}
@@ -0,0 +1,377 @@
+package database
+
+import (
+    "fmt"
+    "net"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+
+    "github.com/glebarez/sqlite"
+    "github.com/go-sql-driver/mysql"
+    _ "github.com/jackc/pgx/v5/stdlib" // registers the "pgx" driver
+    gorm_mysql "gorm.io/driver/mysql"
+    "gorm.io/driver/postgres"
+    "gorm.io/gorm"
+    "gorm.io/plugin/prometheus"
+)
+
+// selects the database, one of DRIVER_MYSQL (default), DRIVER_POSTGRES or DRIVER_SQLITE
+const STRATIS_DB_DRIVER = "STRATIS_DB_DRIVER"
+
+const DRIVER_MYSQL = "mysql"
+const DRIVER_POSTGRES = "postgres"
+const DRIVER_SQLITE = "sqlite"
+
+// the things which differ between the supported databases. the migration driver is chosen by the migration package,
+// based on the Name().
+type Dialect interface {
+    // one of DRIVER_MYSQL, DRIVER_POSTGRES or DRIVER_SQLITE
+    Name() string
+
+    // the name of the database/sql driver used to open the connection
+    DriverName() string
+
+    DSN() string
+
+    // the DSN without the password, so that it can be logged
+    RedactedDSN() string
+
+    // used as the metrics label and by migrations
+    DatabaseName() string
+
+    // the DSN of a read replica, at the given address, which is "host" or "host:port" (or the file name for sqlite).
+    // the other parameters are the same as those of the primary.
+    ReplicaDSN(address string) string
+
+    // the gorm dialector which uses the given connection
+    Dialector(conn gorm.ConnPool) gorm.Dialector
+
+    // database specific metrics, in addition to the connection pool metrics
+    MetricsCollectors() []prometheus.MetricsCollector
+}
+
+// returns the dialect selected by STRATIS_DB_DRIVER
+func GetDialect() Dialect {
+    driver := os.Getenv(STRATIS_DB_DRIVER)
+    switch driver {
+    case "", DRIVER_MYSQL:
+        return &mysqlDialect{}
+    case DRIVER_POSTGRES:
+        return &postgresDialect{}
+    case DRIVER_SQLITE:
+        return &sqliteDialect{}
+    default:
+        panic(fmt.Sprintf("please set env var %s to one of %s, %s or %s, rather than '%s'", STRATIS_DB_DRIVER, DRIVER_MYSQL, DRIVER_POSTGRES, DRIVER_SQLITE, driver))
+    }
+}
+
+// reads the env vars needed to connect to a database server. the port is empty if it is not set.
+func getConnectionEnv() (username string, password string, host string, name string, port string) {
+    username = os.Getenv("STRATIS_DB_USERNAME")
+    password = os.Getenv("STRATIS_DB_PASSWORD")
+    host = os.Getenv("STRATIS_DB_HOST")
+    name = os.Getenv("STRATIS_DB_NAME")
+    port = os.Getenv("STRATIS_DB_PORT")
+
+    if len(username) == 0 {
+        // only the names, since the values include secrets, e.g. the encryption keys
+        fmt.Printf("===== ENVS =====\n")
+        for i, value := range os.Environ() {
+            if name, _, _ := strings.Cut(value, "="); strings.Contains(name, "STRATIS") {
+                fmt.Printf("ENV %d) %s\n", i, name)
+            }
+        }
+        panic("please set env var for db username")
+    } else if len(password) == 0 {
+        panic("please set env var for db password")
+    } else if len(host) == 0 {
+        panic("please set env var for db host")
+    } else if len(name) == 0 {
+        panic("please set env var for db name")
+    }
+    return
+}
+
+// ================================================================================================
+// mysql
+// ================================================================================================
+
+type mysqlDialect struct{}
+
+func (d *mysqlDialect) Name() string {
+    return DRIVER_MYSQL
+}
+
+func (d *mysqlDialect) DriverName() string {
+    return "mysql"
+}
+
+func (d *mysqlDialect) DSN() string {
+    return GetDatabaseConfig().FormatDSN()
+}
+
+func (d *mysqlDialect) RedactedDSN() string {
+    cfg := GetDatabaseConfig()
+    cfg.Passwd = "***"
+    return cfg.FormatDSN()
+}
+
+func (d *mysqlDialect) ReplicaDSN(address string) string {
+    cfg := GetDatabaseConfig()
+    cfg.Addr = withDefaultPort(address, "3306")
+    return cfg.FormatDSN()
+}
+
+func (d *mysqlDialect) DatabaseName() string {
+    cfg := GetDatabaseConfig()
+    return cfg.Addr + "/" + cfg.DBName
+}
+
+func (d *mysqlDialect) Dialector(conn gorm.ConnPool) gorm.Dialector {
+    return gorm_mysql.New(gorm_mysql.Config{
+        Conn: conn,
+    })
+}
+
+func (d *mysqlDialect) MetricsCollectors() []prometheus.MetricsCollector {
+    return []prometheus.MetricsCollector{
+        &prometheus.MySQL{
+            VariableNames: []string{"Threads_running"}, // taken from "show status", or leave blank to get all
+        },
+    }
+}
+
+// only valid for mysql. the params and TLS are taken from the Config.
+func GetDatabaseConfig() *mysql.Config {
+    username, password, host, name, port := getConnectionEnv()
+
+    if len(port) == 0 {
+        port = "3306"
+    }
+
+    cfg := mysql.Config{
+        User:   username,
+        Passwd: password,
+        Net:    "tcp",
+        Addr:   host + ":" + port,
+        DBName: name,
+        Params: map[string]string{
+            "charset": "utf8mb4",
+            "parseTime": "True",
+            "loc": "Local",
+            "multiStatements": "true",
+        },
+    }
+
+    config := getConfig()
+    for key, value := range config.Params {
+        cfg.Params[key] = value
+    }
+    if config.TLS != nil {
+        if err := registerTLS(config.TLS, host); err != nil {
+            panic(err)
+        }
+        cfg.TLSConfig = _TLS_CONFIG_NAME
+    }
+
+    return &cfg
+}
+
+const _TLS_CONFIG_NAME = "stratis"
+
+var tlsMutex sync.Mutex
+
+// the TLS config and host which were last registered, so that the files are only read once, rather than each time a
+// DSN is formatted, e.g. for each replica
+var registeredTLS string
+
+// builds the TLS config and registers it by name, so that it is also used when the DSN is formatted and parsed again,
+// e.g. by migrations. does nothing if the same config has already been registered.
+func registerTLS(c *TLSConfig, host string) error {
+    key := fmt.Sprintf("%+v %s", *c, host)
+    tlsMutex.Lock()
+    defer tlsMutex.Unlock()
+    if registeredTLS == key {
+        return nil
+    }
+    tlsConfig, err := c.build(host)
+    if err != nil {
+        return err
+    }
+    if err := mysql.RegisterTLSConfig(_TLS_CONFIG_NAME, tlsConfig); err != nil {
+        return err
+    }
+    registeredTLS = key
+    return nil
+}
+
+// forgets the registered TLS config, so that the files are read again, e.g. when the database is set up again after
+// the certificates were renewed
+func resetTLS() {
+    tlsMutex.Lock()
+    defer tlsMutex.Unlock()
+    registeredTLS = ""
+}
+
+// adds the port, if the address doesn't contain one
+func withDefaultPort(address string, port string) string {
+    if _, _, err := net.SplitHostPort(address); err == nil {
+        return address
+    }
+    return net.JoinHostPort(address, port)
+}
+
+// ================================================================================================
+// postgres
+// ================================================================================================
+
+type postgresDialect struct{}
+
+func (d *postgresDialect) Name() string {
+    return DRIVER_POSTGRES
+}
+
+func (d *postgresDialect) DriverName() string {
+    return "pgx"
+}
+
+// uses STRATIS_DB_SSLMODE, default "prefer", or "verify-full" if a CA is configured
+func (d *postgresDialect) DSN() string {
+    return d.url("", false)
+}
+
+func (d *postgresDialect) RedactedDSN() string {
+    return d.url("", true)
+}
+
+func (d *postgresDialect) ReplicaDSN(address string) string {
+    return d.url(withDefaultPort(address, "5432"), false)
+}
+
+// uses the primary if address is empty
+func (d *postgresDialect) url(address string, redacted bool) string {
+    username, password, host, name, port := getConnectionEnv()
+    if len(port) == 0 {
+        port = "5432"
+    }
+    if len(address) == 0 {
+        address = host + ":" + port
+    }
+    config := getConfig()
+    query := url.Values{}
+    query.Set("sslmode", "prefer")
+    if config.TLS != nil {
+        // pgx reads the files itself. the server name is always the host.
+        query.Set("sslmode", "verify-full")
+        query.Set("sslrootcert", config.TLS.CAFile)
+        if len(config.TLS.CertFile) > 0 {
+            query.Set("sslcert", config.TLS.CertFile)
+            query.Set("sslkey", config.TLS.KeyFile)
+        }
+    }
+    if sslMode := os.Getenv("STRATIS_DB_SSLMODE"); len(sslMode) > 0 {
+        query.Set("sslmode", sslMode)
+    }
+    for key, value := range config.Params {
+        query.Set(key, value)
+    }
+    if redacted {
+        password = "***"
+    }
+    u := url.URL{
+        Scheme:   "postgres",
+        User:     url.UserPassword(username, password),
+        Host:     address,
+        Path:     name,
+        RawQuery: query.Encode(),
+    }
+    if redacted {
+        return strings.Replace(u.String(), ":%2A%2A%2A@", ":***@", 1)
+    }
+    return u.String()
+}
+
+func (d *postgresDialect) DatabaseName() string {
+    _, _, host, name, port := getConnectionEnv()
+    if len(port) == 0 {
+        port = "5432"
+    }
+    return host + ":" + port + "/" + name
+}
+
+func (d *postgresDialect) Dialector(conn gorm.ConnPool) gorm.Dialector {
+    return postgres.New(postgres.Config{
+        Conn: conn,
+    })
+}
+
+func (d *postgresDialect) MetricsCollectors() []prometheus.MetricsCollector {
+    return []prometheus.MetricsCollector{
+        &prometheus.Postgres{
+            VariableNames: []string{"numbackends"}, // taken from pg_stat_database
+        },
+    }
+}
+
+// ================================================================================================
+// sqlite
+// ================================================================================================
+
+// a pure go sqlite, which needs no server, e.g. for tests. STRATIS_DB_NAME is the path to the database file,
+// or e.g. "file:test?mode=memory&cache=shared" for an in-memory database which is shared by all connections in the pool.
+type sqliteDialect struct{}
+
+func (d *sqliteDialect) Name() string {
+    return DRIVER_SQLITE
+}
+
+func (d *sqliteDialect) DriverName() string {
+    return "sqlite"
+}
+
+func (d *sqliteDialect) DSN() string {
+    name := os.Getenv("STRATIS_DB_NAME")
+    if len(name) == 0 {
+        panic("please set env var for db name")
+    }
+    return d.dsn(name)
+}
+
+// the address is the name of the replica's database file
+func (d *sqliteDialect) ReplicaDSN(address string) string {
+    return d.dsn(address)
+}
+
+func (d *sqliteDialect) dsn(name string) string {
+    separator := "?"
+    if strings.Contains(name, "?") {
+        separator = "&"
+    }
+    dsn := name + separator + "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"
+    if params := getConfig().Params; len(params) > 0 {
+        query := url.Values{}
+        for key, value := range params {
+            query.Set(key, value)
+        }
+        dsn += "&" + query.Encode()
+    }
+    return dsn
+}
+
+func (d *sqliteDialect) RedactedDSN() string {
+    return d.DSN()
+}
+
+func (d *sqliteDialect) DatabaseName() string {
+    return os.Getenv("STRATIS_DB_NAME")
+}
+
+func (d *sqliteDialect) Dialector(conn gorm.ConnPool) gorm.Dialector {
+    return &sqlite.Dialector{Conn: conn}
+}
+
+func (d *sqliteDialect) MetricsCollectors() []prometheus.MetricsCollector {
+    return []prometheus.MetricsCollector{}
+}
@@ -0,0 +1,295 @@
+package encryption
+
+// field level encryption of sensitive columns, using AES-256-GCM envelope encryption: each value is encrypted with its
+// own random data key, which is itself encrypted with a master key, whose id is stored with the value, e.g.
+//
+//     type Account struct {
+//         Id           uint64
+//         TotpSecret   encryption.EncryptedString
+//         Address      encryption.EncryptedJSON[Address]
+//         PasswordHash string `gorm:"serializer:encrypted"`
+//         Email        string `gorm:"serializer:encrypted"`
+//         EmailIndex   string `gorm:"index"` // encryption.BlindIndex(encryption.NormaliseEmail(email))
+//     }
+//
+// the master keys are read by Setup() from the following env vars:
+//
+//   - STRATIS_ENCRYPTION_KEYS - a comma separated list of "id:key", where the key is 32 bytes encoded in base64. the
+//     first key is used to encrypt, and the others, e.g. retired ones, only to decrypt.
+//   - STRATIS_ENCRYPTION_KEYS_FILE - the path of a file containing the same, one per line, used if the above is not
+//     set, e.g. a mounted secret. empty lines and lines starting with # are ignored.
+//   - STRATIS_ENCRYPTION_BLIND_INDEX_KEY - a key of at least 32 bytes encoded in base64, for BlindIndex(). it must not
+//     change, or the blind indexes must be recomputed.
+//
+// to rotate the master key, add a new one at the start of the list, and run ReEncrypt(), after which the old one can
+// be removed. an encrypted value is stored as text, so the columns need to be e.g. TEXT or VARCHAR(255), allowing for
+// a value about twice the size of the plain one, plus 100 characters.
+//
+// a value is not bound to the row or column it is stored in, since e.g. EncryptedString does not know where it is
+// written to. tampering with a value is detected, but someone with write access to the database can copy a valid
+// value from one row or column to another, where it is decrypted without an error. where that matters, store e.g.
+// the BlindIndex() of the plain value together with the primary key in another column, and check it after reading.
+
+import (
+    "bufio"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+)
+
+const STRATIS_ENCRYPTION_KEYS = "STRATIS_ENCRYPTION_KEYS"
+const STRATIS_ENCRYPTION_KEYS_FILE = "STRATIS_ENCRYPTION_KEYS_FILE"
+const STRATIS_ENCRYPTION_BLIND_INDEX_KEY = "STRATIS_ENCRYPTION_BLIND_INDEX_KEY"
+
+// the prefix of encrypted values, so that the format can be changed in future
+const _VERSION = "v1"
+
+const _KEY_SIZE = 32
+
+var ErrorUnknownKey = errors.New("STRATIS-1045 the value was encrypted with an unknown key")
+var ErrorInvalidCiphertext = errors.New("STRATIS-1046 the encrypted value is invalid or has been tampered with")
+
+var keyringMutex sync.RWMutex
+var keyring *Keyring
+
+// the master keys
+type Keyring struct {
+    activeId      string
+    keys          map[string]cipher.AEAD
+    blindIndexKey []byte
+}
+
+// creates a keyring which encrypts with the key with the given id, and decrypts with any of the keys. the keys must be
+// 32 bytes long. the blind index key is optional, and must be at least 32 bytes long, if given.
+func NewKeyring(activeId string, keys map[string][]byte, blindIndexKey []byte) (*Keyring, error) {
+    k := &Keyring{activeId: activeId, keys: map[string]cipher.AEAD{}, blindIndexKey: blindIndexKey}
+    if _, ok := keys[activeId]; !ok {
+        return nil, fmt.Errorf("STRATIS-1044 there is no key with the active id '%s'", activeId)
+    }
+    for id, key := range keys {
+        if len(id) == 0 || strings.ContainsAny(id, ":,") {
+            return nil, fmt.Errorf("STRATIS-1044 the key id '%s' must not be empty, nor contain ':' or ','", id)
+        }
+        if len(key) != _KEY_SIZE {
+            return nil, fmt.Errorf("STRATIS-1044 the key '%s' must be %d bytes long, rather than %d", id, _KEY_SIZE, len(key))
+        }
+        aead, err := newAEAD(key)
+        if err != nil {
+            return nil, err
+        }
+        k.keys[id] = aead
+    }
+    if blindIndexKey != nil && len(blindIndexKey) < _KEY_SIZE {
+        return nil, fmt.Errorf("STRATIS-1044 the blind index key must be at least %d bytes long", _KEY_SIZE)
+    }
+    return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// reads the keys from the env vars, see the package doc, and uses them for the encrypted types and serializer
+func Setup() error {
+    k, err := KeyringFromEnv()
+    if err != nil {
+        return err
+    }
+    SetKeyring(k)
+    return nil
+}
+
+// sets the keyring used by the encrypted types and serializer, e.g. in tests
+func SetKeyring(k *Keyring) {
+    keyringMutex.Lock()
+    defer keyringMutex.Unlock()
+    keyring = k
+}
+
+func getKeyring() (*Keyring, error) {
+    keyringMutex.RLock()
+    defer keyringMutex.RUnlock()
+    if keyring == nil {
+        return nil, fmt.Errorf("STRATIS-1044 encryption is not set up, please set env var %s or %s and call encryption.Setup()", STRATIS_ENCRYPTION_KEYS, STRATIS_ENCRYPTION_KEYS_FILE)
+    }
+    return keyring, nil
+}
+
+// reads the keys from the env vars, see the package doc
+func KeyringFromEnv() (*Keyring, error) {
+    entries := strings.Split(os.Getenv(STRATIS_ENCRYPTION_KEYS), ",")
+    source := "env var " + STRATIS_ENCRYPTION_KEYS
+    if len(os.Getenv(STRATIS_ENCRYPTION_KEYS)) == 0 {
+        file := os.Getenv(STRATIS_ENCRYPTION_KEYS_FILE)
+        if len(file) == 0 {
+            return nil, fmt.Errorf("STRATIS-1044 please set env var %s or %s", STRATIS_ENCRYPTION_KEYS, STRATIS_ENCRYPTION_KEYS_FILE)
+        }
+        var err error
+        entries, err = readKeysFile(file)
+        if err != nil {
+            return nil, fmt.Errorf("STRATIS-1044 unable to read the keys from %s: %w", file, err)
+        }
+        source = "file " + file
+    }
+
+    activeId := ""
+    keys := map[string][]byte{}
+    for _, entry := range entries {
+        id, encoded, found := strings.Cut(strings.TrimSpace(entry), ":")
+        key, err := base64.StdEncoding.DecodeString(encoded)
+        if !found || err != nil {
+            return nil, fmt.Errorf("STRATIS-1044 the keys in %s must be a list of id:base64-key, the entry '%s' is invalid", source, id)
+        }
+        if _, exists := keys[id]; exists {
+            return nil, fmt.Errorf("STRATIS-1044 the key id '%s' is used more than once", id)
+        }
+        if len(activeId) == 0 {
+            activeId = id
+        }
+        keys[id] = key
+    }
+
+    var blindIndexKey []byte
+    if encoded := os.Getenv(STRATIS_ENCRYPTION_BLIND_INDEX_KEY); len(encoded) > 0 {
+        var err error
+        if blindIndexKey, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+            return nil, fmt.Errorf("STRATIS-1044 please set env var %s to a base64 encoded key: %w", STRATIS_ENCRYPTION_BLIND_INDEX_KEY, err)
+        }
+    }
+    return NewKeyring(activeId, keys, blindIndexKey)
+}
+
+func readKeysFile(file string) ([]string, error) {
+    f, err := os.Open(file)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    entries := []string{}
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if len(line) > 0 && !strings.HasPrefix(line, "#") {
+            entries = append(entries, line)
+        }
+    }
+    if len(entries) == 0 {
+        return nil, errors.New("the file contains no keys")
+    }
+    return entries, scanner.Err()
+}
+
+// ================================================================================================
+
+// returns "v1:<key id>:<encrypted data key>:<encrypted value>", with a new data key, encrypted using the active key.
+// no associated data is used, so the value can be moved to another row or column without being detected, see the
+// package doc.
+func (k *Keyring) Encrypt(plain []byte) (string, error) {
+    dataKey := make([]byte, _KEY_SIZE)
+    if _, err := rand.Read(dataKey); err != nil {
+        return "", err
+    }
+    wrapped, err := seal(k.keys[k.activeId], dataKey)
+    if err != nil {
+        return "", err
+    }
+    aead, err := newAEAD(dataKey)
+    if err != nil {
+        return "", err
+    }
+    sealed, err := seal(aead, plain)
+    if err != nil {
+        return "", err
+    }
+    return strings.Join([]string{_VERSION, k.activeId, wrapped, sealed}, ":"), nil
+}
+
+// decrypts a value returned by Encrypt(), using whichever key it was encrypted with
+func (k *Keyring) Decrypt(encrypted string) ([]byte, error) {
+    parts := strings.Split(encrypted, ":")
+    if len(parts) != 4 || parts[0] != _VERSION {
+        return nil, ErrorInvalidCiphertext
+    }
+    master, ok := k.keys[parts[1]]
+    if !ok {
+        return nil, fmt.Errorf("%w '%s'", ErrorUnknownKey, parts[1])
+    }
+    dataKey, err := open(master, parts[2])
+    if err != nil {
+        return nil, err
+    }
+    aead, err := newAEAD(dataKey)
+    if err != nil {
+        return nil, ErrorInvalidCiphertext
+    }
+    return open(aead, parts[3])
+}
+
+// true if the value was encrypted with a key other than the active one, and should be encrypted again
+func (k *Keyring) NeedsReEncryption(encrypted string) bool {
+    return !strings.HasPrefix(encrypted, _VERSION+":"+k.activeId+":")
+}
+
+// true if the value looks like one returned by Encrypt(), rather than e.g. plain text written before a column was
+// encrypted
+func isCiphertext(value string) bool {
+    return strings.HasPrefix(value, _VERSION+":")
+}
+
+// the nonce followed by the sealed data, in base64
+func seal(aead cipher.AEAD, plain []byte) (string, error) {
+    nonce := make([]byte, aead.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        return "", err
+    }
+    return base64.RawStdEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, nil)), nil
+}
+
+func open(aead cipher.AEAD, encoded string) ([]byte, error) {
+    sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+    if err != nil || len(sealed) < aead.NonceSize() {
+        return nil, ErrorInvalidCiphertext
+    }
+    plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+    if err != nil {
+        return nil, ErrorInvalidCiphertext
+    }
+    return plain, nil
+}
+
+// ================================================================================================
+
+// returns a keyed hash of the value, which can be stored in an indexed column next to the encrypted one, so that rows
+// can be found by the value, e.g. `db.Where("email_index = ?", index)`. since equal values have equal hashes, it
+// reveals which rows have the same value, so normalise the value first, e.g. using NormaliseEmail(), but only use it
+// where such lookups are needed.
+func BlindIndex(value string) (string, error) {
+    k, err := getKeyring()
+    if err != nil {
+        return "", err
+    }
+    if k.blindIndexKey == nil {
+        return "", fmt.Errorf("STRATIS-1044 please set env var %s", STRATIS_ENCRYPTION_BLIND_INDEX_KEY)
+    }
+    mac := hmac.New(sha256.New, k.blindIndexKey)
+    mac.Write([]byte(value))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// trims and lower cases an email address, so that e.g. " Jane@Example.com" and "jane@example.com" have the same blind
+// index
+func NormaliseEmail(email string) string {
+    return strings.ToLower(strings.TrimSpace(email))
+}
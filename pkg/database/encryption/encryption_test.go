@@ -0,0 +1,268 @@
+package encryption
+
+import (
+    "bytes"
+    "context"
+    "encoding/base64"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database"
+    "github.com/stretchr/testify/assert"
+)
+
+type address struct {
+    Street string
+    City   string
+}
+
+type account struct {
+    Id           uint64
+    TotpSecret   EncryptedString
+    Address      EncryptedJSON[address]
+    PasswordHash string `gorm:"serializer:encrypted"`
+    Email        string `gorm:"serializer:encrypted"`
+    EmailIndex   string `gorm:"index"`
+    Plain        string
+}
+
+var oldKey = bytes.Repeat([]byte{1}, 32)
+var newKey = bytes.Repeat([]byte{2}, 32)
+var blindKey = bytes.Repeat([]byte{3}, 32)
+
+func setKeys(t *testing.T, activeId string, keys map[string][]byte) *Keyring {
+    k, err := NewKeyring(activeId, keys, blindKey)
+    assert.Nil(t, err)
+    SetKeyring(k)
+    t.Cleanup(func() { SetKeyring(nil) })
+    return k
+}
+
+func setupAccounts(t *testing.T) {
+    t.Setenv(database.STRATIS_DB_DRIVER, database.DRIVER_SQLITE)
+    t.Setenv("STRATIS_DB_NAME", "file:"+filepath.Join(t.TempDir(), "test.db"))
+    database.SetupDb()
+    assert.Nil(t, database.GetDb().AutoMigrate(&account{}))
+}
+
+func rawColumn(t *testing.T, column string, id uint64) string {
+    var value string
+    assert.Nil(t, database.GetDb().Table("accounts").Where("id = ?", id).Pluck(column, &value).Error)
+    return value
+}
+
+func TestKeyring_encrypt(t *testing.T) {
+    assert := assert.New(t)
+    k := setKeys(t, "old", map[string][]byte{"old": oldKey})
+
+    // when
+    first, err := k.Encrypt([]byte("secret"))
+    assert.Nil(err)
+    second, _ := k.Encrypt([]byte("secret"))
+
+    // then each value has its own data key and nonce
+    assert.True(strings.HasPrefix(first, "v1:old:"))
+    assert.NotEqual(first, second)
+    plain, err := k.Decrypt(first)
+    assert.Nil(err)
+    assert.Equal("secret", string(plain))
+    assert.False(k.NeedsReEncryption(first))
+
+    // when tampered with
+    tampered := first[:len(first)-2] + "AA"
+    _, err = k.Decrypt(tampered)
+
+    // then
+    assert.ErrorIs(err, ErrorInvalidCiphertext)
+
+    // when the key is unknown
+    other := setKeys(t, "new", map[string][]byte{"new": newKey})
+    _, err = other.Decrypt(first)
+
+    // then
+    assert.ErrorIs(err, ErrorUnknownKey)
+    assert.True(other.NeedsReEncryption(first))
+}
+
+func TestTypes(t *testing.T) {
+    assert := assert.New(t)
+    setupAccounts(t)
+    setKeys(t, "old", map[string][]byte{"old": oldKey})
+    index, err := BlindIndex(NormaliseEmail(" Jane@Example.com"))
+    assert.Nil(err)
+    a := account{
+        TotpSecret:   "totp",
+        Address:      EncryptedJSON[address]{Data: address{Street: "Main Street 1", City: "Bern"}},
+        PasswordHash: "hash",
+        Email:        "jane@example.com",
+        EmailIndex:   index,
+        Plain:        "plain",
+    }
+
+    // when
+    assert.Nil(database.GetDb().Create(&a).Error)
+
+    // then the columns are encrypted
+    for _, column := range []string{"totp_secret", "address", "password_hash", "email"} {
+        assert.True(strings.HasPrefix(rawColumn(t, column, a.Id), "v1:old:"), column)
+    }
+    assert.Equal("plain", rawColumn(t, "plain", a.Id))
+
+    // when found using the blind index
+    lookup, _ := BlindIndex(NormaliseEmail("jane@example.com"))
+    found := account{}
+    assert.Nil(database.GetDb().Where("email_index = ?", lookup).First(&found).Error)
+
+    // then
+    assert.Equal(a, found)
+}
+
+func TestReEncrypt(t *testing.T) {
+    assert := assert.New(t)
+    setupAccounts(t)
+    setKeys(t, "old", map[string][]byte{"old": oldKey})
+    for _, secret := range []string{"a", "b", "c"} {
+        assert.Nil(database.GetDb().Create(&account{TotpSecret: EncryptedString(secret), Email: secret + "@example.com"}).Error)
+    }
+
+    // when the key is rotated, the old one is retired but still decrypts
+    setKeys(t, "new", map[string][]byte{"new": newKey, "old": oldKey})
+    assert.Nil(database.GetDb().Create(&account{TotpSecret: "d"}).Error)
+    accounts := []account{}
+    assert.Nil(database.GetDb().Order("id").Find(&accounts).Error)
+    assert.Equal(EncryptedString("a"), accounts[0].TotpSecret)
+    assert.True(strings.HasPrefix(rawColumn(t, "totp_secret", 4), "v1:new:"))
+
+    // when
+    n, err := ReEncrypt(context.Background(), ReEncryptOptions{BatchSize: 2}, &account{})
+
+    // then
+    assert.Nil(err)
+    assert.Equal(int64(3), n)
+    setKeys(t, "new", map[string][]byte{"new": newKey})
+    accounts = []account{}
+    assert.Nil(database.GetDb().Order("id").Find(&accounts).Error)
+    assert.Equal(EncryptedString("c"), accounts[2].TotpSecret)
+    assert.Equal("c@example.com", accounts[2].Email)
+    assert.Equal(EncryptedString("d"), accounts[3].TotpSecret)
+
+    // nothing left to do
+    n, err = ReEncrypt(context.Background(), ReEncryptOptions{}, &account{})
+    assert.Nil(err)
+    assert.Equal(int64(0), n)
+}
+
+func TestReEncrypt_cancelledWhilePausing(t *testing.T) {
+    assert := assert.New(t)
+    setupAccounts(t)
+    setKeys(t, "old", map[string][]byte{"old": oldKey})
+    for _, secret := range []string{"a", "b", "c"} {
+        assert.Nil(database.GetDb().Create(&account{TotpSecret: EncryptedString(secret)}).Error)
+    }
+    setKeys(t, "new", map[string][]byte{"new": newKey, "old": oldKey})
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    start := time.Now()
+
+    // when
+    n, err := ReEncrypt(ctx, ReEncryptOptions{BatchSize: 2, Pause: time.Hour}, &account{})
+
+    // then it stops without waiting for the pause to end
+    assert.Equal(context.DeadlineExceeded, err)
+    assert.Equal(int64(2), n)
+    assert.Less(time.Since(start), 10*time.Second)
+}
+
+func TestReEncrypt_plaintext(t *testing.T) {
+    assert := assert.New(t)
+    setupAccounts(t)
+    setKeys(t, "old", map[string][]byte{"old": oldKey})
+    for _, secret := range []string{"a", "b"} {
+        assert.Nil(database.GetDb().Create(&account{TotpSecret: EncryptedString(secret), Email: secret + "@example.com"}).Error)
+    }
+    // e.g. written before the column was encrypted
+    assert.Nil(database.GetDb().Table("accounts").Where("id = ?", 1).Update("email", "legacy@example.com").Error)
+    setKeys(t, "new", map[string][]byte{"new": newKey, "old": oldKey})
+
+    // when
+    n, err := ReEncrypt(context.Background(), ReEncryptOptions{}, &account{})
+
+    // then the other values are encrypted again, and the plain text is left as it is
+    assert.Nil(err)
+    assert.Equal(int64(2), n)
+    assert.True(strings.HasPrefix(rawColumn(t, "totp_secret", 1), "v1:new:"))
+    assert.Equal("legacy@example.com", rawColumn(t, "email", 1))
+
+    // when
+    n, err = ReEncrypt(context.Background(), ReEncryptOptions{EncryptPlaintext: true}, &account{})
+
+    // then
+    assert.Nil(err)
+    assert.Equal(int64(1), n)
+    assert.True(strings.HasPrefix(rawColumn(t, "email", 1), "v1:new:"))
+    a := account{}
+    assert.Nil(database.GetDb().First(&a, 1).Error)
+    assert.Equal("legacy@example.com", a.Email)
+}
+
+func TestKeyringFromEnv(t *testing.T) {
+    encode := base64.StdEncoding.EncodeToString
+    file := filepath.Join(t.TempDir(), "keys")
+    os.WriteFile(file, []byte("# the active key first\nnew:"+encode(newKey)+"\n\nold:"+encode(oldKey)+"\n"), 0600)
+    invalidFile := filepath.Join(t.TempDir(), "invalid-keys")
+    os.WriteFile(invalidFile, []byte("new\n"), 0600)
+    tests := []struct {
+        name     string
+        keys     string
+        file     string
+        blind    string
+        expected string
+    }{
+        {name: "env", keys: "new:" + encode(newKey) + ",old:" + encode(oldKey)},
+        {name: "file", file: file, blind: encode(blindKey)},
+        {name: "missing", expected: "STRATIS-1044 please set env var STRATIS_ENCRYPTION_KEYS or STRATIS_ENCRYPTION_KEYS_FILE"},
+        {name: "missing file", file: file + "-missing", expected: "STRATIS-1044 unable to read the keys from"},
+        {name: "invalid entry", keys: "new", expected: "the keys in env var STRATIS_ENCRYPTION_KEYS must be a list of id:base64-key, the entry 'new' is invalid"},
+        {name: "invalid entry in file", file: invalidFile, expected: "the keys in file " + invalidFile + " must be a list of id:base64-key, the entry 'new' is invalid"},
+        {name: "short key", keys: "new:" + encode([]byte("short")), expected: "STRATIS-1044 the key 'new' must be 32 bytes long, rather than 5"},
+        {name: "duplicate", keys: "new:" + encode(newKey) + ",new:" + encode(oldKey), expected: "the key id 'new' is used more than once"},
+        {name: "short blind index key", keys: "new:" + encode(newKey), blind: encode([]byte("short")), expected: "the blind index key must be at least 32 bytes long"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            assert := assert.New(t)
+            t.Setenv(STRATIS_ENCRYPTION_KEYS, tt.keys)
+            t.Setenv(STRATIS_ENCRYPTION_KEYS_FILE, tt.file)
+            t.Setenv(STRATIS_ENCRYPTION_BLIND_INDEX_KEY, tt.blind)
+
+            // when
+            k, err := KeyringFromEnv()
+
+            // then
+            if len(tt.expected) > 0 {
+                assert.ErrorContains(err, tt.expected)
+                return
+            }
+            assert.Nil(err)
+            encrypted, _ := k.Encrypt([]byte("x"))
+            assert.True(strings.HasPrefix(encrypted, "v1:new:"))
+            old, _ := NewKeyring("old", map[string][]byte{"old": oldKey}, nil)
+            encrypted, _ = old.Encrypt([]byte("y"))
+            plain, err := k.Decrypt(encrypted)
+            assert.Nil(err)
+            assert.Equal("y", string(plain))
+        })
+    }
+}
+
+func TestNotSetUp(t *testing.T) {
+    SetKeyring(nil)
+
+    _, err := EncryptedString("x").Value()
+    assert.ErrorContains(t, err, "STRATIS-1044 encryption is not set up")
+    _, err = BlindIndex("x")
+    assert.ErrorContains(t, err, "STRATIS-1044 encryption is not set up")
+}
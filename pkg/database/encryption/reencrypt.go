@@ -0,0 +1,201 @@
+package encryption
+
+import (
+    "context"
+    "fmt"
+    "reflect"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/tenancy"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+    "gorm.io/gorm/schema"
+)
+
+var log = logging.GetLog("encryption")
+
+// implemented by the encrypted types, so that their columns can be found
+type encryptedType interface {
+    encrypted()
+}
+
+var encryptedInterface = reflect.TypeOf((*encryptedType)(nil)).Elem()
+
+type ReEncryptOptions struct {
+    // the maximum number of rows read and updated in one transaction, default 100
+    BatchSize int
+
+    // the wait between batches, to limit the load on the database, default none
+    Pause time.Duration
+
+    // encrypts values which are not encrypted yet, e.g. those written before the column was encrypted. otherwise the
+    // rows containing such values are logged and left as they are.
+    EncryptPlaintext bool
+}
+
+func (o ReEncryptOptions) withDefaults() ReEncryptOptions {
+    if o.BatchSize <= 0 {
+        o.BatchSize = 100
+    }
+    return o
+}
+
+// encrypts the values of the given models which were encrypted with a key other than the active one again, using the
+// active one, e.g. in the background after the key has been rotated:
+//
+//     go func() {
+//         n, err := encryption.ReEncrypt(context.Background(), encryption.ReEncryptOptions{}, &Account{}, &Customer{})
+//         ...
+//     }()
+//
+// the encrypted columns are those of the types EncryptedString and EncryptedJSON, and those using the encrypted
+// serializer. the rows are read in order of their primary key, in batches, each in its own transaction, so that it can
+// be stopped using the context and simply run again. returns the number of rows which were changed. values which are
+// not encrypted at all are only encrypted if the option EncryptPlaintext is set, e.g. once after encrypting a column
+// which already contains data.
+func ReEncrypt(ctx context.Context, opts ReEncryptOptions, models ...any) (int64, error) {
+    opts = opts.withDefaults()
+    k, err := getKeyring()
+    if err != nil {
+        return 0, err
+    }
+    total := int64(0)
+    for _, model := range models {
+        n, err := reEncryptModel(ctx, k, opts, model)
+        total += n
+        if err != nil {
+            return total, err
+        }
+    }
+    return total, nil
+}
+
+func reEncryptModel(ctx context.Context, k *Keyring, opts ReEncryptOptions, model any) (int64, error) {
+    stmt := &gorm.Statement{DB: database.GetDb()}
+    if err := stmt.Parse(model); err != nil {
+        return 0, err
+    }
+    pk := stmt.Schema.PrioritizedPrimaryField
+    if pk == nil {
+        return 0, fmt.Errorf("STRATIS-1047 %s needs a single primary key to be encrypted again", stmt.Schema.Name)
+    }
+    columns := encryptedColumns(stmt.Schema)
+    if len(columns) == 0 {
+        return 0, nil
+    }
+    table := stmt.Schema.Table
+    log.Info().Msgf("encrypting the columns %v of %s again", columns, table)
+
+    fwCtx := fwctx.BuildTypedCtxNoDbNoGin("encryption", "encryption", []string{})
+    // the rows of all tenants are re-encrypted, using the table, since the values must not be decrypted
+    db := func() *gorm.DB { return tenancy.CrossTenant(fwCtx.GetDb()) }
+    var last any
+    total := int64(0)
+    for {
+        if err := ctx.Err(); err != nil {
+            return total, err
+        }
+        rows := []map[string]any{}
+        changed := int64(0)
+        _, err := database.WithTx(fwCtx, func() (any, error) {
+            query := db().Table(table).Select(append([]string{pk.DBName}, columns...)).Order(pk.DBName).Limit(opts.BatchSize)
+            if last != nil {
+                query = query.Where(clause.Gt{Column: clause.Column{Name: pk.DBName}, Value: last})
+            }
+            if fwCtx.GetDb().Dialector.Name() != database.DRIVER_SQLITE {
+                query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+            }
+            if err := query.Find(&rows).Error; err != nil {
+                return nil, err
+            }
+            for _, row := range rows {
+                updates, plaintext, err := reEncryptRow(k, row, columns, opts.EncryptPlaintext)
+                if err != nil {
+                    return nil, fmt.Errorf("row %v of %s: %w", row[pk.DBName], table, err)
+                }
+                if len(plaintext) > 0 {
+                    log.Warn().Msgf("row %v of %s is not encrypted in the columns %v, use the option EncryptPlaintext to encrypt it", row[pk.DBName], table, plaintext)
+                }
+                if len(updates) > 0 {
+                    if err := db().Table(table).Where(clause.Eq{Column: clause.Column{Name: pk.DBName}, Value: row[pk.DBName]}).Updates(updates).Error; err != nil {
+                        return nil, err
+                    }
+                    changed++
+                }
+            }
+            return nil, nil
+        })
+        if err != nil {
+            return total, err
+        }
+        total += changed
+        if len(rows) < opts.BatchSize {
+            break
+        }
+        last = rows[len(rows)-1][pk.DBName]
+        select {
+        case <-ctx.Done():
+            return total, ctx.Err()
+        case <-time.After(opts.Pause):
+        }
+    }
+    log.Info().Msgf("encrypted %d rows of %s again", total, table)
+    return total, nil
+}
+
+// true if the values of the field are stored encrypted, i.e. it is of type EncryptedString or EncryptedJSON, or uses
+// the encrypted serializer
+func IsEncrypted(field *schema.Field) bool {
+    _, serialized := field.Serializer.(Serializer)
+    return serialized || field.FieldType.Implements(encryptedInterface)
+}
+
+func encryptedColumns(s *schema.Schema) []string {
+    columns := []string{}
+    for _, field := range s.Fields {
+        if len(field.DBName) > 0 && IsEncrypted(field) {
+            columns = append(columns, field.DBName)
+        }
+    }
+    return columns
+}
+
+// the columns of the row which need to be encrypted again, with their new values, and the columns which are not
+// encrypted at all, unless they are to be encrypted too
+func reEncryptRow(k *Keyring, row map[string]any, columns []string, encryptPlaintext bool) (map[string]any, []string, error) {
+    updates := map[string]any{}
+    plaintext := []string{}
+    for _, column := range columns {
+        var encrypted string
+        switch v := row[column].(type) {
+        case string:
+            encrypted = v
+        case []byte:
+            encrypted = string(v)
+        default:
+            continue
+        }
+        if !k.NeedsReEncryption(encrypted) {
+            continue
+        }
+        var plain []byte
+        var err error
+        if isCiphertext(encrypted) {
+            if plain, err = k.Decrypt(encrypted); err != nil {
+                return nil, nil, err
+            }
+        } else if encryptPlaintext {
+            plain = []byte(encrypted)
+        } else {
+            plaintext = append(plaintext, column)
+            continue
+        }
+        if updates[column], err = k.Encrypt(plain); err != nil {
+            return nil, nil, err
+        }
+    }
+    return updates, plaintext, nil
+}
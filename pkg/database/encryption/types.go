@@ -0,0 +1,140 @@
+package encryption
+
+import (
+    "context"
+    "database/sql/driver"
+    "encoding/json"
+    "fmt"
+    "reflect"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/schema"
+)
+
+func init() {
+    schema.RegisterSerializer("encrypted", Serializer{})
+}
+
+// a string which is stored encrypted. NULL is read as "".
+type EncryptedString string
+
+func (s EncryptedString) Value() (driver.Value, error) {
+    return encrypt([]byte(s))
+}
+
+func (s *EncryptedString) Scan(value any) error {
+    plain, err := decrypt(value)
+    if err != nil {
+        return err
+    }
+    *s = EncryptedString(plain)
+    return nil
+}
+
+func (EncryptedString) encrypted() {}
+
+func (EncryptedString) GormDataType() string {
+    return "string"
+}
+
+func (EncryptedString) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+    return "TEXT"
+}
+
+// a value which is stored as encrypted JSON. NULL is read as the zero value.
+type EncryptedJSON[T any] struct {
+    Data T
+}
+
+func (j EncryptedJSON[T]) Value() (driver.Value, error) {
+    plain, err := json.Marshal(j.Data)
+    if err != nil {
+        return nil, err
+    }
+    return encrypt(plain)
+}
+
+func (j *EncryptedJSON[T]) Scan(value any) error {
+    plain, err := decrypt(value)
+    if err != nil {
+        return err
+    }
+    var data T
+    if len(plain) > 0 {
+        if err := json.Unmarshal(plain, &data); err != nil {
+            return err
+        }
+    }
+    j.Data = data
+    return nil
+}
+
+func (EncryptedJSON[T]) encrypted() {}
+
+func (EncryptedJSON[T]) GormDataType() string {
+    return "string"
+}
+
+func (EncryptedJSON[T]) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+    return "TEXT"
+}
+
+// a gorm serializer which encrypts fields tagged `gorm:"serializer:encrypted"`, e.g. for existing models. strings
+// are encrypted as they are, other types as JSON.
+type Serializer struct{}
+
+func (Serializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue any) error {
+    plain, err := decrypt(dbValue)
+    if err != nil {
+        return err
+    }
+    value := reflect.New(field.FieldType)
+    if field.FieldType.Kind() == reflect.String {
+        value.Elem().SetString(string(plain))
+    } else if len(plain) > 0 {
+        if err := json.Unmarshal(plain, value.Interface()); err != nil {
+            return err
+        }
+    }
+    field.ReflectValueOf(ctx, dst).Set(value.Elem())
+    return nil
+}
+
+func (Serializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue any) (any, error) {
+    if field.FieldType.Kind() == reflect.String {
+        return encrypt([]byte(reflect.ValueOf(fieldValue).String()))
+    }
+    plain, err := json.Marshal(fieldValue)
+    if err != nil {
+        return nil, err
+    }
+    return encrypt(plain)
+}
+
+func encrypt(plain []byte) (driver.Value, error) {
+    k, err := getKeyring()
+    if err != nil {
+        return nil, err
+    }
+    return k.Encrypt(plain)
+}
+
+// decrypts the value read from the database, which is nil, a string or bytes
+func decrypt(value any) ([]byte, error) {
+    var encrypted string
+    switch v := value.(type) {
+    case nil:
+        return nil, nil
+    case string:
+        encrypted = v
+    case []byte:
+        encrypted = string(v)
+    default:
+        return nil, fmt.Errorf("%w: unexpected type %T", ErrorInvalidCiphertext, value)
+    }
+    k, err := getKeyring()
+    if err != nil {
+        return nil, err
+    }
+    return k.Decrypt(encrypted)
+}
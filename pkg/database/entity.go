@@ -0,0 +1,248 @@
+package database
+
+// optimistic locking and audit columns, for entities which opt in by embedding Versioned and/or Audited, e.g.
+//
+//     type Order struct {
+//         Id uint64
+//         database.Versioned
+//         database.Audited
+//         ...
+//     }
+//
+// the EntityPlugin, which is registered by SetupDb, then
+//
+//   - sets the version of a new entity to 1, and increments it with every update. an update or delete of an entity
+//     with a version only succeeds if the version in the database is still the same, i.e. nobody else has changed it
+//     since it was read, and otherwise fails with ErrorConflict, which `ctx.HandleError()` turns into a 409. an entity
+//     whose version is zero, e.g. one created with only its id, is updated without being checked.
+//   - sets CreatedBy and UpdatedBy to `GetUser().UserId` of the ICtx of the statement, i.e. when using `ctx.GetDb()`
+//   - sets the CreatedAt and UpdatedAt timestamps, as gorm does for any fields with those names
+//
+// `UpdateColumn` and `UpdateColumns` are treated like any other update.
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "reflect"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "gorm.io/gorm"
+    "gorm.io/gorm/callbacks"
+    "gorm.io/gorm/clause"
+    "gorm.io/gorm/schema"
+)
+
+const _VERSION_SETTING = "stratis:entity:version"
+const _SET_SETTING = "stratis:entity:set"
+
+// an error which is returned to the caller with a specific http status by `ICtx.HandleError()`
+type statusError struct {
+    status  int
+    message string
+}
+
+func (e *statusError) Error() string {
+    return e.message
+}
+
+func (e *statusError) HTTPStatus() int {
+    return e.status
+}
+
+var ErrorConflict error = &statusError{http.StatusConflict, "STRATIS-1031 the entity was changed or deleted concurrently"}
+
+// embed to opt in to optimistic locking
+type Versioned struct {
+    Version int64 `json:"version" gorm:"not null;default:0"`
+}
+
+// embed to opt in to audit columns
+type Audited struct {
+    CreatedAt time.Time `json:"createdAt"`
+    CreatedBy string    `json:"createdBy"`
+    UpdatedAt time.Time `json:"updatedAt"`
+    UpdatedBy string    `json:"updatedBy"`
+}
+
+type EntityPlugin struct{}
+
+func (p *EntityPlugin) Name() string {
+    return "stratis:entity"
+}
+
+func (p *EntityPlugin) Initialize(db *gorm.DB) error {
+    if err := db.Callback().Create().Before("gorm:create").Register("stratis:entity:create", beforeCreate); err != nil {
+        return err
+    }
+    if err := db.Callback().Update().Before("gorm:update").Register("stratis:entity:before_update", beforeUpdate); err != nil {
+        return err
+    }
+    if err := db.Callback().Update().After("gorm:update").Register("stratis:entity:after_update", afterUpdate); err != nil {
+        return err
+    }
+    if err := db.Callback().Delete().Before("gorm:delete").Register("stratis:entity:before_delete", beforeDelete); err != nil {
+        return err
+    }
+    return db.Callback().Delete().After("gorm:delete").Register("stratis:entity:after_delete", afterDelete)
+}
+
+// the id of the user of the ICtx of the statement, or "" if there is none
+func userIdOf(db *gorm.DB) string {
+    if ctx, ok := fwctx.FromContext(db.Statement.Context); ok {
+        if user, err := ctx.GetUser(); err == nil && user != nil {
+            return user.UserId
+        }
+    }
+    return ""
+}
+
+func beforeCreate(db *gorm.DB) {
+    if db.Error != nil || db.Statement.Schema == nil {
+        return
+    }
+    version, createdBy, updatedBy := entityFields(db.Statement.Schema)
+    if version == nil && createdBy == nil && updatedBy == nil {
+        return
+    }
+    userId := userIdOf(db)
+    forEachStruct(db, func(rv reflect.Value) {
+        setIfZero(db, version, rv, int64(1))
+        setIfZero(db, createdBy, rv, userId)
+        setIfZero(db, updatedBy, rv, userId)
+    })
+}
+
+func beforeUpdate(db *gorm.DB) {
+    if db.Error != nil || db.Statement.Schema == nil {
+        return
+    }
+    version, _, updatedBy := entityFields(db.Statement.Schema)
+    if version == nil && updatedBy == nil {
+        return
+    }
+    if _, ok := db.Statement.Clauses["SET"]; ok {
+        return // e.g. set using clause.Set, which is left alone
+    }
+
+    // build the assignments which gorm would otherwise build, so that the version can be incremented by the database
+    set := callbacks.ConvertToAssignments(db.Statement)
+    if len(set) == 0 {
+        return
+    }
+    if userId := userIdOf(db); updatedBy != nil && len(userId) > 0 {
+        set = withAssignment(set, updatedBy, userId)
+        if db.Statement.ReflectValue.Kind() == reflect.Struct {
+            db.AddError(updatedBy.Set(db.Statement.Context, db.Statement.ReflectValue, userId))
+        }
+    }
+    if version != nil {
+        set = withAssignment(set, version, clause.Expr{SQL: "? + 1", Vars: []any{clause.Column{Name: version.DBName}}})
+        if db.Statement.ReflectValue.Kind() == reflect.Struct {
+            current, isZero := version.ValueOf(db.Statement.Context, db.Statement.ReflectValue)
+            if !isZero {
+                db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+                    clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: version.DBName}, Value: current},
+                }})
+                db.Statement.Settings.Store(_VERSION_SETTING, current)
+            }
+        }
+    }
+    db.Statement.AddClause(set)
+    db.Statement.Settings.Store(_SET_SETTING, true)
+}
+
+func afterUpdate(db *gorm.DB) {
+    if _, ok := db.Statement.Settings.LoadAndDelete(_SET_SETTING); ok {
+        delete(db.Statement.Clauses, "SET") // as gorm does for the assignments it builds itself
+    }
+    checkVersion(db, true)
+}
+
+func beforeDelete(db *gorm.DB) {
+    if db.Error != nil || db.Statement.Schema == nil || db.Statement.ReflectValue.Kind() != reflect.Struct {
+        return
+    }
+    version, _, _ := entityFields(db.Statement.Schema)
+    if version == nil {
+        return
+    }
+    if current, isZero := version.ValueOf(db.Statement.Context, db.Statement.ReflectValue); !isZero {
+        db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+            clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: version.DBName}, Value: current},
+        }})
+        db.Statement.Settings.Store(_VERSION_SETTING, current)
+    }
+}
+
+func afterDelete(db *gorm.DB) {
+    checkVersion(db, false)
+}
+
+// fails with ErrorConflict if a versioned entity was not updated or deleted, and otherwise updates its version
+func checkVersion(db *gorm.DB, updated bool) {
+    current, ok := db.Statement.Settings.LoadAndDelete(_VERSION_SETTING)
+    if !ok || db.Error != nil || db.DryRun {
+        return
+    }
+    if db.RowsAffected == 0 {
+        db.AddError(fmt.Errorf("%w: %s with version %d", ErrorConflict, db.Statement.Schema.Name, current))
+        return
+    }
+    if updated {
+        version, _, _ := entityFields(db.Statement.Schema)
+        db.AddError(version.Set(db.Statement.Context, db.Statement.ReflectValue, current.(int64)+1))
+    }
+}
+
+// the fields handled by the plugin, or nil for those which the model does not have, or which have another type
+func entityFields(s *schema.Schema) (version *schema.Field, createdBy *schema.Field, updatedBy *schema.Field) {
+    ofKind := func(name string, kind reflect.Kind) *schema.Field {
+        if field := s.LookUpField(name); field != nil && field.FieldType.Kind() == kind && len(field.DBName) > 0 {
+            return field
+        }
+        return nil
+    }
+    return ofKind("Version", reflect.Int64), ofKind("CreatedBy", reflect.String), ofKind("UpdatedBy", reflect.String)
+}
+
+// calls the function for the entity, or each entity of a slice
+func forEachStruct(db *gorm.DB, f func(rv reflect.Value)) {
+    rv := db.Statement.ReflectValue
+    switch rv.Kind() {
+    case reflect.Struct:
+        f(rv)
+    case reflect.Slice, reflect.Array:
+        for i := 0; i < rv.Len(); i++ {
+            if elem := reflect.Indirect(rv.Index(i)); elem.Kind() == reflect.Struct {
+                f(elem)
+            }
+        }
+    }
+}
+
+func setIfZero(db *gorm.DB, field *schema.Field, rv reflect.Value, value any) {
+    if field == nil {
+        return
+    }
+    if _, isZero := field.ValueOf(db.Statement.Context, rv); isZero {
+        db.AddError(field.Set(db.Statement.Context, rv, value))
+    }
+}
+
+// replaces the assignment of the field, or adds it
+func withAssignment(set clause.Set, field *schema.Field, value any) clause.Set {
+    for i := range set {
+        if set[i].Column.Name == field.DBName {
+            set[i].Value = value
+            return set
+        }
+    }
+    return append(set, clause.Assignment{Column: clause.Column{Name: field.DBName}, Value: value})
+}
+
+// returns true if the error means that an entity was changed concurrently
+func IsConflict(err error) bool {
+    return errors.Is(err, ErrorConflict)
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+    "net/http"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/test/dbtest"
+    "github.com/glebarez/sqlite"
+    "github.com/stretchr/testify/assert"
+    "gorm.io/gorm"
+)
+
+type order struct {
+    Id     uint64
+    Status string
+    Versioned
+    Audited
+}
+
+var orders = NewRepository[order, uint64]()
+
+// the id of the user of the test ctx
+const testUserId = "c606cb7f-9ac5-4f10-8403-db2e83b1ae0f"
+
+func setupOrders(t *testing.T) (fwctx.ICtx, *order) {
+    testDb, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{SkipDefaultTransaction: true})
+    assert.Nil(t, err)
+    assert.Nil(t, testDb.Use(&EntityPlugin{}))
+    assert.Nil(t, testDb.AutoMigrate(&order{}))
+    ctx := fwctx.BuildTypedCtxForTests(testDb, false)
+    o := &order{Status: "NEW"}
+    assert.Nil(t, orders.Save(ctx, o))
+    return ctx, o
+}
+
+func TestEntityPlugin_create(t *testing.T) {
+    assert := assert.New(t)
+    ctx, o := setupOrders(t)
+
+    assert.Equal(int64(1), o.Version)
+    assert.Equal(testUserId, o.CreatedBy)
+    assert.Equal(testUserId, o.UpdatedBy)
+    assert.False(o.CreatedAt.IsZero())
+    stored, err := orders.FindByID(ctx, o.Id)
+    assert.Nil(err)
+    assert.Equal(o.Version, stored.Version)
+    assert.Equal(testUserId, stored.CreatedBy)
+    assert.WithinDuration(o.CreatedAt, stored.CreatedAt, time.Millisecond)
+
+    // without a user, e.g. when not using the ctx
+    other := &order{Status: "NEW"}
+    assert.Nil(ctx.GetDb().Session(&gorm.Session{NewDB: true, Context: t.Context()}).Create(other).Error)
+    assert.Equal(int64(1), other.Version)
+    assert.Equal("", other.CreatedBy)
+}
+
+func TestEntityPlugin_update(t *testing.T) {
+    tests := []struct {
+        name   string
+        update func(ctx fwctx.ICtx, o *order) error
+    }{
+        {name: "save", update: func(ctx fwctx.ICtx, o *order) error {
+            o.Status = "PAID"
+            return orders.Save(ctx, o)
+        }},
+        {name: "updates with a map", update: func(ctx fwctx.ICtx, o *order) error {
+            return ctx.GetDb().Model(o).Updates(map[string]any{"status": "PAID"}).Error
+        }},
+        {name: "update", update: func(ctx fwctx.ICtx, o *order) error {
+            return ctx.GetDb().Model(o).Update("status", "PAID").Error
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            assert := assert.New(t)
+            ctx, o := setupOrders(t)
+            assert.Nil(ctx.GetDb().Exec("UPDATE orders SET updated_by = ?", "someone else").Error)
+
+            // when
+            err := tt.update(ctx, o)
+
+            // then the version is incremented
+            assert.Nil(err)
+            assert.Equal(int64(2), o.Version)
+            stored, _ := orders.FindByID(ctx, o.Id)
+            assert.Equal("PAID", stored.Status)
+            assert.Equal(int64(2), stored.Version)
+            assert.Equal(testUserId, stored.UpdatedBy)
+
+            // when updated concurrently
+            assert.Nil(dbtest.ConcurrentUpdate(ctx.GetDb(), o, map[string]any{"status": "CANCELLED"}))
+            err = tt.update(ctx, o)
+
+            // then
+            assert.ErrorIs(err, ErrorConflict)
+            assert.True(IsConflict(err))
+            assert.Equal(int64(2), o.Version)
+            stored, _ = orders.FindByID(ctx, o.Id)
+            assert.Equal("CANCELLED", stored.Status)
+            assert.Equal(int64(3), stored.Version)
+        })
+    }
+}
+
+func TestEntityPlugin_updateWithoutVersion(t *testing.T) {
+    assert := assert.New(t)
+    ctx, o := setupOrders(t)
+
+    // an update of an entity which was not read is not checked
+    err := ctx.GetDb().Model(&order{Id: o.Id}).Update("status", "PAID").Error
+
+    assert.Nil(err)
+    stored, _ := orders.FindByID(ctx, o.Id)
+    assert.Equal("PAID", stored.Status)
+    assert.Equal(int64(2), stored.Version)
+}
+
+func TestEntityPlugin_delete(t *testing.T) {
+    assert := assert.New(t)
+    ctx, o := setupOrders(t)
+    assert.Nil(dbtest.ConcurrentUpdate(ctx.GetDb(), o, nil))
+
+    // when
+    err := ctx.GetDb().Delete(o).Error
+
+    // then
+    assert.ErrorIs(err, ErrorConflict)
+    assert.Nil(orders.Delete(ctx, o.Id)) // without a version
+}
+
+func TestErrorConflict_status(t *testing.T) {
+    var withStatus interface{ HTTPStatus() int }
+    assert.ErrorAs(t, ErrorConflict, &withStatus)
+    assert.Equal(t, http.StatusConflict, withStatus.HTTPStatus())
+}
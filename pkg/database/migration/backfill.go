@@ -0,0 +1,124 @@
+package migration
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+)
+
+// processes the next batch of a backfill: up to limit rows whose key follows the given one, which is empty for the
+// first batch, in order of key. returns the key of the last row processed, and the number of rows processed, which is
+// zero when there are none left. it is called within a transaction, using `ctx.GetDb()`.
+type BatchFunc func(ctx fwctx.ICtx, after string, limit int) (last string, n int, err error)
+
+// the progress of a backfill, in the stratis_backfill table, which is created as needed
+type BackfillProgress struct {
+    Version   uint `gorm:"primaryKey;autoIncrement:false"`
+    Name      string
+    LastKey   string
+    Rows      int64
+    Done      bool
+    UpdatedAt time.Time
+}
+
+func (BackfillProgress) TableName() string {
+    return "stratis_backfill"
+}
+
+type backfill struct {
+    batchSize int
+    batch     BatchFunc
+}
+
+// registers a backfill, i.e. a go migration which changes many rows in batches, each in its own transaction, e.g.
+//
+//     migration.RegisterBackfill(20250103000000, 500, func(ctx fwctx.ICtx, after string, limit int) (string, int, error) {
+//         users := []User{}
+//         if err := ctx.GetDb().Where("id > ?", after).Order("id").Limit(limit).Find(&users).Error; err != nil {
+//             return "", 0, err
+//         }
+//         for _, u := range users {
+//             ... ctx.GetDb().Model(&u).Update("display_name", ...)
+//         }
+//         if len(users) == 0 {
+//             return "", 0, nil
+//         }
+//         return users[len(users)-1].Id, len(users), nil
+//     })
+//
+// the key of the last row is saved in the same transaction as each batch, so if the instance is stopped part way, the
+// backfill resumes after the last batch which was committed. the progress is logged regularly, and can be read using
+// Backfills(). reverting it only resets its progress, so that it runs again in full if it is re-applied.
+func RegisterBackfill(version uint, batchSize int, batch BatchFunc) {
+    if batch == nil || batchSize < 1 {
+        panic(fmt.Sprintf("the backfill %d needs a batch function and a batch size of at least 1", version))
+    }
+    register(version, goMigration{name: funcName(batch), backfill: &backfill{batchSize: batchSize, batch: batch}})
+}
+
+// returns the progress of all backfills which have been started
+func Backfills() ([]BackfillProgress, error) {
+    progress := []BackfillProgress{}
+    if !database.GetDb().Migrator().HasTable(&BackfillProgress{}) {
+        return progress, nil
+    }
+    return progress, database.GetDb().Order("version").Find(&progress).Error
+}
+
+func (b *backfill) run(ctx fwctx.ICtx, version uint, name string) error {
+    if err := database.GetDb().AutoMigrate(&BackfillProgress{}); err != nil {
+        return fmt.Errorf("unable to create the backfill table: %w", err)
+    }
+    progress := BackfillProgress{Version: version, Name: name}
+    if err := database.GetDb().FirstOrCreate(&progress, BackfillProgress{Version: version}).Error; err != nil {
+        return err
+    }
+    if progress.Done {
+        log.Info().Msgf("backfill %d %s is already done", version, name)
+        return nil
+    }
+    if len(progress.LastKey) > 0 {
+        log.Info().Msgf("resuming backfill %d %s after key %s, with %d rows already done", version, name, progress.LastKey, progress.Rows)
+    }
+
+    start := time.Now()
+    lastProgress := start
+    for !progress.Done {
+        _, err := database.WithTx(ctx, func() (any, error) {
+            last, n, err := b.batch(ctx, progress.LastKey, b.batchSize)
+            if err != nil {
+                return nil, err
+            }
+            next := progress
+            if n == 0 {
+                next.Done = true
+            } else {
+                next.LastKey = last
+                next.Rows += int64(n)
+            }
+            if err := ctx.GetDb().Save(&next).Error; err != nil {
+                return nil, err
+            }
+            progress = next
+            return nil, nil
+        })
+        if err != nil {
+            return fmt.Errorf("backfill %d %s failed after key %s: %w", version, name, progress.LastKey, err)
+        }
+        if time.Since(lastProgress) >= 10*time.Second {
+            log.Info().Msgf("backfill %d %s has processed %d rows, up to key %s, in %s", version, name, progress.Rows, progress.LastKey, time.Since(start).Round(time.Second))
+            lastProgress = time.Now()
+        }
+    }
+    log.Info().Msgf("backfill %d %s is done, having processed %d rows in %s", version, name, progress.Rows, time.Since(start).Round(time.Second))
+    return nil
+}
+
+func (b *backfill) reset(ctx fwctx.ICtx, version uint) error {
+    if !database.GetDb().Migrator().HasTable(&BackfillProgress{}) {
+        return nil
+    }
+    return database.GetDb().Delete(&BackfillProgress{}, version).Error
+}
@@ -0,0 +1,193 @@
+package migration
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database"
+)
+
+const usage = `usage: migrate [-dry-run] [-dir <dir>] <command>
+
+commands:
+  up [n]             applies the next n pending migrations, or all of them
+  down [n]           reverts the last n applied migrations, by default 1
+  goto <version>     applies or reverts migrations until the database is at the version
+  force <version>    sets the version without running any migrations, e.g. after repairing a failed migration
+  status             lists the migrations and whether they have been applied
+  create <name>      creates an empty pair of up and down migrations, named with a timestamp
+
+the migrations are read from the directory given by -dir, or STRATIS_DB_MIGRATION_LOCATION, or else those embedded
+in the binary. the database is configured using the usual STRATIS_DB_ env vars.
+`
+
+var migrationName = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// runs a migrate command, so that services can offer it as a subcommand, e.g. `myservice migrate status`:
+//
+//     if len(os.Args) > 1 && os.Args[1] == "migrate" {
+//         if err := migration.Run(os.Args[2:], os.Stdout); err != nil {
+//             fmt.Fprintln(os.Stderr, err)
+//             os.Exit(1)
+//         }
+//         return
+//     }
+//
+// the database is set up, unless it already has been. the migrations which are about to be applied or reverted are
+// listed before that is done. with -dry-run, only the list is printed.
+func Run(args []string, out io.Writer) error {
+    flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+    flags.SetOutput(out)
+    flags.Usage = func() { fmt.Fprint(out, usage) }
+    dryRun := flags.Bool("dry-run", false, "only list the migrations which would be applied or reverted")
+    dir := flags.String("dir", os.Getenv(STRATIS_DB_MIGRATION_LOCATION), "the directory containing the migrations")
+    if err := flags.Parse(args); err != nil {
+        if errors.Is(err, flag.ErrHelp) {
+            return nil
+        }
+        return err
+    }
+    if flags.NArg() == 0 {
+        flags.Usage()
+        return errors.New("STRATIS-1037 missing command")
+    }
+    command, params := flags.Arg(0), flags.Args()[1:]
+
+    if command == "create" {
+        if len(params) != 1 {
+            return fmt.Errorf("STRATIS-1037 usage: create <name>")
+        }
+        files, err := Create(*dir, params[0], time.Now())
+        if err != nil {
+            return err
+        }
+        for _, file := range files {
+            fmt.Fprintf(out, "created %s\n", file)
+        }
+        return nil
+    }
+
+    if database.GetRawDb() == nil {
+        database.SetupDb()
+    }
+    var m *Migrator
+    var err error
+    if len(*dir) > 0 {
+        m, err = NewFromDir(*dir)
+    } else {
+        m, err = New() // embedded
+    }
+    if err != nil {
+        return err
+    }
+    defer m.Close()
+    m.DryRun = *dryRun
+    m.Out = out
+
+    switch command {
+    case "up":
+        n, err := optionalInt(params, 0)
+        if err != nil {
+            return err
+        }
+        return m.Up(n)
+    case "down":
+        n, err := optionalInt(params, 1)
+        if err != nil {
+            return err
+        }
+        return m.Down(n)
+    case "goto":
+        if len(params) != 1 {
+            return fmt.Errorf("STRATIS-1037 usage: goto <version>")
+        }
+        version, err := strconv.ParseUint(params[0], 10, 0)
+        if err != nil {
+            return fmt.Errorf("STRATIS-1037 invalid version %s", params[0])
+        }
+        return m.Goto(uint(version))
+    case "force":
+        if len(params) != 1 {
+            return fmt.Errorf("STRATIS-1037 usage: force <version>")
+        }
+        version, err := strconv.Atoi(params[0])
+        if err != nil {
+            return fmt.Errorf("STRATIS-1037 invalid version %s", params[0])
+        }
+        return m.Force(version)
+    case "status":
+        status, err := m.Status()
+        if err != nil {
+            return err
+        }
+        printStatus(out, status)
+        return nil
+    default:
+        flags.Usage()
+        return fmt.Errorf("STRATIS-1037 unknown command %s", command)
+    }
+}
+
+// creates an empty pair of up and down migrations in the directory, named with the timestamp as the version,
+// e.g. 20250102150405_add_orders.up.sql, and returns their paths. existing files are not overwritten.
+func Create(dir string, name string, now time.Time) ([]string, error) {
+    if len(dir) == 0 {
+        return nil, fmt.Errorf("STRATIS-1035 please set env var %s", STRATIS_DB_MIGRATION_LOCATION)
+    }
+    if !migrationName.MatchString(name) {
+        return nil, fmt.Errorf("STRATIS-1037 invalid migration name %q, only letters, digits and underscores are allowed", name)
+    }
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+    base := filepath.Join(dir, now.UTC().Format("20060102150405")+"_"+name)
+    files := []string{}
+    for _, file := range []string{base + ".up.sql", base + ".down.sql"} {
+        f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+        if err != nil {
+            return files, err
+        }
+        f.Close()
+        files = append(files, file)
+    }
+    return files, nil
+}
+
+func optionalInt(params []string, defaultValue int) (int, error) {
+    switch len(params) {
+    case 0:
+        return defaultValue, nil
+    case 1:
+        n, err := strconv.Atoi(params[0])
+        if err != nil || n < 1 {
+            return 0, fmt.Errorf("STRATIS-1037 invalid number of migrations %s", params[0])
+        }
+        return n, nil
+    default:
+        return 0, fmt.Errorf("STRATIS-1037 too many arguments %v", params)
+    }
+}
+
+func printStatus(out io.Writer, status Status) {
+    if status.Version == NO_VERSION {
+        fmt.Fprintln(out, "version: none")
+    } else if status.Dirty {
+        fmt.Fprintf(out, "version: %d (dirty, repair the database and then force the version)\n", status.Version)
+    } else {
+        fmt.Fprintf(out, "version: %d\n", status.Version)
+    }
+    for _, m := range status.Migrations {
+        state := "pending"
+        if m.Applied {
+            state = "applied"
+        }
+        fmt.Fprintf(out, "%-8s %d %s\n", state, m.Version, m.Name)
+    }
+}
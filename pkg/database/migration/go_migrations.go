@@ -0,0 +1,242 @@
+package migration
+
+// migrations written in go, e.g. for changing data using application logic, which are applied in order of version
+// together with the SQL files, e.g.
+//
+//     func init() {
+//         migration.Register(20250102150405, rehashPasswords, nil)
+//         migration.RegisterBackfill(20250103000000, 500, fillDisplayNames)
+//     }
+//
+// golang-migrate only knows SQL, so the go migrations are added to its source as placeholders, which are recognised
+// and run by a wrapper around its database driver. each one runs in a transaction, which also records that it was
+// applied, in the stratis_go_migration table. golang-migrate only clears the dirty version after that, in a separate
+// step, so if the instance stops in between, the record shows that the migration need not be run again. otherwise a
+// go migration which failed left nothing behind, and is simply run again next time.
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "reflect"
+    "runtime"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    migratedb "github.com/golang-migrate/migrate/v4/database"
+    "github.com/golang-migrate/migrate/v4/source"
+    "gorm.io/gorm"
+)
+
+const goMigrationMarker = "-- stratis:go-migration "
+
+type goMigration struct {
+    name     string
+    up       func(fwctx.ICtx) error
+    down     func(fwctx.ICtx) error
+    backfill *backfill
+}
+
+// a go migration which has been applied, in the stratis_go_migration table, which is created as needed
+type goMigrationRecord struct {
+    Version   uint `gorm:"primaryKey;autoIncrement:false"`
+    Name      string
+    AppliedAt time.Time
+}
+
+func (goMigrationRecord) TableName() string {
+    return "stratis_go_migration"
+}
+
+// true if the go migration with the given version has been applied, according to the stratis_go_migration table
+func isApplied(db *gorm.DB, version uint) (bool, error) {
+    if !db.Migrator().HasTable(&goMigrationRecord{}) {
+        return false, nil
+    }
+    var count int64
+    err := db.Model(&goMigrationRecord{}).Where("version = ?", version).Count(&count).Error
+    return count > 0, err
+}
+
+var goMigrationsMutex sync.Mutex
+var goMigrations = map[uint]goMigration{}
+
+// registers a migration written in go, which is applied in order of version together with the SQL migrations, e.g.
+// from an init function. each function is called within `database.WithTx`, using a ctx with the user "migration".
+// down may be nil, in which case reverting the migration only changes the version, and forgets that it was applied.
+// panics if the version is already registered.
+func Register(version uint, up func(fwctx.ICtx) error, down func(fwctx.ICtx) error) {
+    if up == nil {
+        panic(fmt.Sprintf("the go migration %d needs an up function", version))
+    }
+    register(version, goMigration{name: funcName(up), up: up, down: down})
+}
+
+func register(version uint, m goMigration) {
+    goMigrationsMutex.Lock()
+    defer goMigrationsMutex.Unlock()
+    if _, exists := goMigrations[version]; exists {
+        panic(fmt.Sprintf("a go migration with version %d is already registered", version))
+    }
+    goMigrations[version] = m
+}
+
+func registeredGoMigrations() map[uint]goMigration {
+    goMigrationsMutex.Lock()
+    defer goMigrationsMutex.Unlock()
+    result := map[uint]goMigration{}
+    for version, m := range goMigrations {
+        result[version] = m
+    }
+    return result
+}
+
+// e.g. "rehashPasswords" for "github.com/x/y/pkg/migrations.rehashPasswords"
+func funcName(f any) string {
+    name := runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+    return name[strings.LastIndex(name, ".")+1:]
+}
+
+// ================================================================================================
+
+// a source containing the migrations of another source, and the go migrations
+type goSource struct {
+    source.Driver
+    migrations map[uint]goMigration
+    versions   []uint
+}
+
+func newGoSource(inner source.Driver) (*goSource, error) {
+    s := &goSource{Driver: inner, migrations: registeredGoMigrations(), versions: []uint{}}
+    v, err := inner.First()
+    for err == nil {
+        if _, exists := s.migrations[v]; exists {
+            return nil, fmt.Errorf("STRATIS-1041 the go migration %d has the same version as a SQL migration", v)
+        }
+        s.versions = append(s.versions, v)
+        v, err = inner.Next(v)
+    }
+    if !errors.Is(err, os.ErrNotExist) {
+        return nil, fmt.Errorf("unable to list migrations: %w", err)
+    }
+    for version := range s.migrations {
+        s.versions = append(s.versions, version)
+    }
+    slices.Sort(s.versions)
+    return s, nil
+}
+
+func (s *goSource) First() (uint, error) {
+    if len(s.versions) == 0 {
+        return 0, &os.PathError{Op: "first", Path: "migrations", Err: os.ErrNotExist}
+    }
+    return s.versions[0], nil
+}
+
+func (s *goSource) Prev(version uint) (uint, error) {
+    i, found := slices.BinarySearch(s.versions, version)
+    if !found || i == 0 {
+        return 0, &os.PathError{Op: "prev", Path: strconv.FormatUint(uint64(version), 10), Err: os.ErrNotExist}
+    }
+    return s.versions[i-1], nil
+}
+
+func (s *goSource) Next(version uint) (uint, error) {
+    i, found := slices.BinarySearch(s.versions, version)
+    if !found || i == len(s.versions)-1 {
+        return 0, &os.PathError{Op: "next", Path: strconv.FormatUint(uint64(version), 10), Err: os.ErrNotExist}
+    }
+    return s.versions[i+1], nil
+}
+
+func (s *goSource) ReadUp(version uint) (io.ReadCloser, string, error) {
+    if m, ok := s.migrations[version]; ok {
+        return marker(version, "up"), m.name, nil
+    }
+    return s.Driver.ReadUp(version)
+}
+
+func (s *goSource) ReadDown(version uint) (io.ReadCloser, string, error) {
+    if m, ok := s.migrations[version]; ok {
+        return marker(version, "down"), m.name, nil // even without a down function, its record must be removed
+    }
+    return s.Driver.ReadDown(version)
+}
+
+func (s *goSource) isGo(version uint) bool {
+    _, ok := s.migrations[version]
+    return ok
+}
+
+func marker(version uint, direction string) io.ReadCloser {
+    return io.NopCloser(strings.NewReader(fmt.Sprintf("%s%d %s", goMigrationMarker, version, direction)))
+}
+
+// ================================================================================================
+
+// a database driver which runs go migrations, and passes SQL migrations to the real driver
+type goDriver struct {
+    migratedb.Driver
+    source *goSource
+}
+
+func (d *goDriver) Run(migration io.Reader) error {
+    body, err := io.ReadAll(migration)
+    if err != nil {
+        return err
+    }
+    if !bytes.HasPrefix(body, []byte(goMigrationMarker)) {
+        return d.Driver.Run(bytes.NewReader(body))
+    }
+
+    var version uint
+    var direction string
+    if _, err := fmt.Sscanf(string(body), goMigrationMarker+"%d %s", &version, &direction); err != nil {
+        return fmt.Errorf("invalid go migration placeholder %q: %w", body, err)
+    }
+    m := d.source.migrations[version]
+    ctx := fwctx.BuildTypedCtxNoDbNoGin("migration", "migration", []string{})
+    log.Info().Msgf("running go migration %d %s (%s)", version, m.name, direction)
+
+    if m.backfill != nil {
+        if direction == "up" {
+            return m.backfill.run(ctx, version, m.name)
+        }
+        return m.backfill.reset(ctx, version)
+    }
+    if err := database.GetDb().AutoMigrate(&goMigrationRecord{}); err != nil {
+        return fmt.Errorf("unable to create the go migration table: %w", err)
+    }
+    _, err = database.WithTx(ctx, func() (any, error) {
+        if direction == "down" {
+            if m.down != nil {
+                if err := m.down(ctx); err != nil {
+                    return nil, err
+                }
+            }
+            return nil, ctx.GetDb().Delete(&goMigrationRecord{}, version).Error
+        }
+        applied, err := isApplied(ctx.GetDb(), version)
+        if err != nil || applied {
+            if applied {
+                log.Warn().Msgf("go migration %d %s was already applied, delete it from the stratis_go_migration table to run it again", version, m.name)
+            }
+            return nil, err
+        }
+        if err := m.up(ctx); err != nil {
+            return nil, err
+        }
+        return nil, ctx.GetDb().Create(&goMigrationRecord{Version: version, Name: m.name, AppliedAt: time.Now().UTC()}).Error
+    })
+    if err != nil {
+        return fmt.Errorf("go migration %d %s (%s) failed: %w", version, m.name, direction, err)
+    }
+    return nil
+}
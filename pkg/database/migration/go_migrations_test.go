@@ -0,0 +1,222 @@
+package migration
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "testing"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "github.com/stretchr/testify/assert"
+)
+
+var errorForTest = errors.New("for test")
+
+// sets up a sqlite database and a directory with two SQL migrations, 1 and 3, leaving 2 for go
+func setupGoMigrations(t *testing.T) {
+    dir := t.TempDir()
+    os.WriteFile(filepath.Join(dir, "000001_create_thing.up.sql"), []byte("CREATE TABLE thing (id INTEGER PRIMARY KEY, name TEXT NOT NULL);"), 0644)
+    os.WriteFile(filepath.Join(dir, "000001_create_thing.down.sql"), []byte("DROP TABLE thing;"), 0644)
+    os.WriteFile(filepath.Join(dir, "000003_add_sql.up.sql"), []byte("INSERT INTO thing (name) VALUES ('sql');"), 0644)
+    os.WriteFile(filepath.Join(dir, "000003_add_sql.down.sql"), []byte("DELETE FROM thing WHERE name = 'sql';"), 0644)
+    t.Setenv(database.STRATIS_DB_DRIVER, database.DRIVER_SQLITE)
+    t.Setenv("STRATIS_DB_NAME", "file:"+filepath.Join(dir, "test.db"))
+    t.Setenv(STRATIS_DB_MIGRATION_LOCATION, dir)
+    database.SetupDb()
+    t.Cleanup(func() { goMigrations = map[uint]goMigration{} })
+}
+
+func thingNames(t *testing.T) []string {
+    names := []string{}
+    assert.Nil(t, database.GetDb().Table("thing").Order("id").Pluck("name", &names).Error)
+    return names
+}
+
+func addGo(ctx fwctx.ICtx) error {
+    if ctx.GetTx() == nil {
+        return errors.New("not in a transaction")
+    }
+    return ctx.GetDb().Exec("INSERT INTO thing (name) VALUES ('go')").Error
+}
+
+func removeGo(ctx fwctx.ICtx) error {
+    return ctx.GetDb().Exec("DELETE FROM thing WHERE name = 'go'").Error
+}
+
+func TestRegister_interleavesWithSQL(t *testing.T) {
+    assert := assert.New(t)
+    setupGoMigrations(t)
+    Register(2, addGo, removeGo)
+
+    // when
+    err := Migrate()
+
+    // then
+    assert.Nil(err)
+    assert.Equal([]string{"go", "sql"}, thingNames(t))
+    m, err := New()
+    assert.Nil(err)
+    defer m.Close()
+    status, err := m.Status()
+    assert.Nil(err)
+    assert.Equal([]Migration{{1, "create_thing", true}, {2, "addGo", true}, {3, "add_sql", true}}, status.Migrations)
+
+    // when
+    assert.Nil(m.Down(2))
+
+    // then
+    assert.Equal([]string{}, thingNames(t))
+    assert.Equal(1, mustStatus(t, m).Version)
+}
+
+func TestRegister_failureIsRetried(t *testing.T) {
+    assert := assert.New(t)
+    setupGoMigrations(t)
+    fail := true
+    Register(2, func(ctx fwctx.ICtx) error {
+        assert.Nil(addGo(ctx))
+        if fail {
+            return errorForTest
+        }
+        return nil
+    }, nil)
+
+    // when
+    err := Migrate()
+
+    // then the change is rolled back
+    assert.ErrorIs(err, errorForTest)
+    assert.Equal([]string{}, thingNames(t))
+
+    // when it succeeds the next time
+    fail = false
+    err = Migrate()
+
+    // then
+    assert.Nil(err)
+    assert.Equal([]string{"go", "sql"}, thingNames(t))
+}
+
+func TestRegister_appliedButDirtyIsNotRunAgain(t *testing.T) {
+    assert := assert.New(t)
+    setupGoMigrations(t)
+    calls := 0
+    Register(2, func(ctx fwctx.ICtx) error {
+        calls++
+        return addGo(ctx)
+    }, nil)
+    assert.Nil(Migrate())
+
+    // when the instance stopped after the go migration was committed, but before its version was cleared
+    assert.Nil(database.GetDb().Exec("UPDATE schema_migrations SET version = 2, dirty = 1").Error)
+    assert.Nil(database.GetDb().Exec("DELETE FROM thing WHERE id > 1").Error)
+    err := Migrate()
+
+    // then it is not run again, but the following ones are
+    assert.Nil(err)
+    assert.Equal(1, calls)
+    assert.Equal([]string{"go", "sql"}, thingNames(t))
+}
+
+func TestRegister_revertedWithoutDownIsRunAgain(t *testing.T) {
+    assert := assert.New(t)
+    setupGoMigrations(t)
+    Register(2, addGo, nil)
+    assert.Nil(Migrate())
+    m, err := New()
+    assert.Nil(err)
+    defer m.Close()
+
+    // when
+    assert.Nil(m.Down(2))
+    assert.Nil(m.Up(0))
+
+    // then, since it has no down function, its change is kept
+    assert.Equal([]string{"go", "go", "sql"}, thingNames(t))
+}
+
+func TestRegister_conflictsWithSQL(t *testing.T) {
+    setupGoMigrations(t)
+    Register(3, addGo, nil)
+
+    _, err := New()
+
+    assert.ErrorContains(t, err, "STRATIS-1041")
+}
+
+func TestRegister_twice(t *testing.T) {
+    setupGoMigrations(t)
+    Register(2, addGo, nil)
+
+    assert.Panics(t, func() { Register(2, addGo, nil) })
+}
+
+func TestRegisterBackfill_resumes(t *testing.T) {
+    assert := assert.New(t)
+    setupGoMigrations(t)
+    Register(2, func(ctx fwctx.ICtx) error {
+        for i := 0; i < 25; i++ {
+            if err := ctx.GetDb().Exec("INSERT INTO thing (name) VALUES (?)", fmt.Sprintf("n%d", i)).Error; err != nil {
+                return err
+            }
+        }
+        return nil
+    }, nil)
+    calls := []string{}
+    failAfter := "10"
+    RegisterBackfill(4, 10, func(ctx fwctx.ICtx, after string, limit int) (string, int, error) {
+        calls = append(calls, after)
+        if after == failAfter {
+            return "", 0, errorForTest
+        }
+        from, _ := strconv.Atoi(after)
+        ids := []int{}
+        if err := ctx.GetDb().Table("thing").Where("id > ?", from).Order("id").Limit(limit).Pluck("id", &ids).Error; err != nil {
+            return "", 0, err
+        }
+        if len(ids) == 0 {
+            return "", 0, nil
+        }
+        if err := ctx.GetDb().Exec("UPDATE thing SET name = 'done' WHERE id IN ?", ids).Error; err != nil {
+            return "", 0, err
+        }
+        return strconv.Itoa(ids[len(ids)-1]), len(ids), nil
+    })
+
+    // when it fails part way
+    err := Migrate()
+
+    // then the first batch is kept
+    assert.ErrorIs(err, errorForTest)
+    progress, err := Backfills()
+    assert.Nil(err)
+    assert.Len(progress, 1)
+    assert.Equal("10", progress[0].LastKey)
+    assert.Equal(int64(10), progress[0].Rows)
+    assert.False(progress[0].Done)
+
+    // when it is resumed
+    failAfter = ""
+    calls = []string{}
+    err = Migrate()
+
+    // then
+    assert.Nil(err)
+    assert.Equal([]string{"10", "20", "26"}, calls) // 26 rows including "sql"
+    progress, err = Backfills()
+    assert.Nil(err)
+    assert.Equal(int64(26), progress[0].Rows)
+    assert.True(progress[0].Done)
+
+    // when it is reverted, its progress is reset
+    m, err := New()
+    assert.Nil(err)
+    defer m.Close()
+    assert.Nil(m.Down(1))
+    progress, err = Backfills()
+    assert.Nil(err)
+    assert.Len(progress, 0)
+}
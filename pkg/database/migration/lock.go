@@ -0,0 +1,132 @@
+package migration
+
+// an advisory lock which is held while migrations are applied or reverted, so that replicas starting at the same time
+// do not race each other. it is held by a dedicated connection, since advisory locks belong to the session which took
+// them, and released when the migrations are done.
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "hash/fnv"
+    "sync"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database"
+)
+
+// how often the lock is tried, and the status is read while waiting for another instance
+var pollInterval = time.Second
+
+// sqlite databases belong to a single process, so an in process lock suffices
+var sqliteLock sync.Mutex
+
+type advisoryLock interface {
+    // tries to take the lock without waiting
+    tryLock(ctx context.Context, conn *sql.Conn) (bool, error)
+    unlock(ctx context.Context, conn *sql.Conn) error
+}
+
+// returns the lock matching the driver. the name is hashed, since postgres needs a number, and mysql limits names to
+// 64 characters, which e.g. the host names of managed databases exceed.
+func newAdvisoryLock(driver string, name string) advisoryLock {
+    h := fnv.New64a()
+    h.Write([]byte(name))
+    switch driver {
+    case database.DRIVER_POSTGRES:
+        return &postgresLock{key: int64(h.Sum64())}
+    case database.DRIVER_SQLITE:
+        return &inProcessLock{}
+    default:
+        return &mysqlLock{name: fmt.Sprintf("stratis-migrate-%016x", h.Sum64())}
+    }
+}
+
+// takes the advisory lock, waiting at most the timeout, and logging progress while it is held by another instance.
+// returns a function to release it.
+func (m *Migrator) lock() (func(), error) {
+    ctx := context.Background()
+    conn, err := m.db.Conn(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("unable to get a connection for the migration lock: %w", err)
+    }
+    lock := newAdvisoryLock(database.GetDialect().Name(), "stratis-migrate-"+database.GetDialect().DatabaseName())
+
+    start := time.Now()
+    lastProgress := start
+    for {
+        locked, err := lock.tryLock(ctx, conn)
+        if err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("unable to take the migration lock: %w", err)
+        }
+        if locked {
+            log.Debug().Msgf("took the migration lock after %s", time.Since(start).Round(time.Millisecond))
+            return func() {
+                if err := lock.unlock(ctx, conn); err != nil {
+                    log.Warn().Msgf("unable to release the migration lock, it is released when the connection is closed: %+v", err)
+                }
+                conn.Close()
+            }, nil
+        }
+        waited := time.Since(start)
+        if waited >= m.LockTimeout {
+            conn.Close()
+            return nil, fmt.Errorf("STRATIS-1040 timed out after %s waiting for the migration lock, which is held by another instance", waited.Round(time.Second))
+        }
+        if time.Since(lastProgress) >= m.ProgressInterval {
+            log.Info().Msgf("waiting for the migration lock, which is held by another instance, since %s", waited.Round(time.Second))
+            lastProgress = time.Now()
+        }
+        time.Sleep(pollInterval)
+    }
+}
+
+// ================================================================================================
+
+type mysqlLock struct {
+    name string
+}
+
+func (l *mysqlLock) tryLock(ctx context.Context, conn *sql.Conn) (bool, error) {
+    var locked sql.NullInt64
+    if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", l.name).Scan(&locked); err != nil {
+        return false, err
+    }
+    return locked.Valid && locked.Int64 == 1, nil
+}
+
+func (l *mysqlLock) unlock(ctx context.Context, conn *sql.Conn) error {
+    _, err := conn.ExecContext(ctx, "DO RELEASE_LOCK(?)", l.name)
+    return err
+}
+
+// ================================================================================================
+
+type postgresLock struct {
+    key int64
+}
+
+func (l *postgresLock) tryLock(ctx context.Context, conn *sql.Conn) (bool, error) {
+    var locked bool
+    err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&locked)
+    return locked, err
+}
+
+func (l *postgresLock) unlock(ctx context.Context, conn *sql.Conn) error {
+    _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.key)
+    return err
+}
+
+// ================================================================================================
+
+type inProcessLock struct{}
+
+func (l *inProcessLock) tryLock(ctx context.Context, conn *sql.Conn) (bool, error) {
+    return sqliteLock.TryLock(), nil
+}
+
+func (l *inProcessLock) unlock(ctx context.Context, conn *sql.Conn) error {
+    sqliteLock.Unlock()
+    return nil
+}
@@ -1,96 +1,559 @@
 package migration
 
+// applies the migrations embedded in the binary, or found in the directory given by STRATIS_DB_MIGRATION_LOCATION,
+// e.g. at start up:
+//
+//     //go:embed migrations
+//     var migrations embed.FS
+//     ...
+//     database.SetupDb()
+//     sub, _ := fs.Sub(migrations, "migrations")
+//     if err := migration.MigrateFS(sub); err != nil {
+//         panic(err)
+//     }
+//
+// STRATIS_DB_MIGRATION_LOCATION takes precedence over the embedded migrations, so that they can be changed during
+// development without rebuilding.
+//
+// while migrations are applied or reverted, an advisory lock is held (GET_LOCK with mysql, pg_try_advisory_lock with
+// postgres), so that replicas which start at the same time wait for each other. the following env vars are used:
+//
+//   - STRATIS_DB_MIGRATION_MODE - "migrate" (the default) applies the pending migrations. "wait" only waits until
+//     another instance, the designated migrator, has applied all known migrations
+//   - STRATIS_DB_MIGRATION_LOCK_TIMEOUT - the maximum time to wait for the lock or for the migrator, default "5m"
+//
+// while Migrate() is running, IsMigrating() returns true and the ping reports that the instance is not ready, so the
+// server can be started before migrating.
+//
+// or using a Migrator, which can also revert migrations, go to a given version, force the version after a failure,
+// and report the status, e.g. as a subcommand of the service, see Run().
+
 import (
-	"os"
+    "database/sql"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "slices"
+    "sync/atomic"
+    "time"
 
-	"github.com/abstratium-informatique-sarl/stratis/pkg/database"
-	"github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/logging"
 
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/mysql"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
-	"github.com/rs/zerolog"
+    _ "github.com/go-sql-driver/mysql"
+    "github.com/golang-migrate/migrate/v4"
+    migratedb "github.com/golang-migrate/migrate/v4/database"
+    "github.com/golang-migrate/migrate/v4/database/mysql"
+    "github.com/golang-migrate/migrate/v4/database/pgx/v5"
+    "github.com/golang-migrate/migrate/v4/source"
+    _ "github.com/golang-migrate/migrate/v4/source/file"
+    "github.com/golang-migrate/migrate/v4/source/iofs"
+    "github.com/rs/zerolog"
 
-	sqldblogger "github.com/simukti/sqldb-logger"
-	"github.com/simukti/sqldb-logger/logadapter/zerologadapter"
+    sqldblogger "github.com/simukti/sqldb-logger"
+    "github.com/simukti/sqldb-logger/logadapter/zerologadapter"
 )
 
+const STRATIS_DB_MIGRATION_LOCATION = "STRATIS_DB_MIGRATION_LOCATION"
+const STRATIS_DB_MIGRATION_MODE = "STRATIS_DB_MIGRATION_MODE"
+const STRATIS_DB_MIGRATION_LOCK_TIMEOUT = "STRATIS_DB_MIGRATION_LOCK_TIMEOUT"
+
+// the instance applies the pending migrations
+const MODE_MIGRATE = "migrate"
+
+// the instance waits for another one to apply the pending migrations
+const MODE_WAIT = "wait"
+
+// the version of a database to which no migration has been applied
+const NO_VERSION = migratedb.NilVersion
+
 var log zerolog.Logger
 
+var embedded fs.FS
+
+var migrating atomic.Bool
+
 func init() {
     log = logging.GetLog("migration")
 }
 
-func Migrate() {
+// a migration found in the migration location
+type Migration struct {
+    Version uint   `json:"version"`
+    Name    string `json:"name"`
+    Applied bool   `json:"applied"`
+}
+
+// the state of the database and the known migrations
+type Status struct {
+    // the version of the last migration applied, or NO_VERSION
+    Version int `json:"version"`
+
+    // true if the last migration failed part way, in which case the database must be repaired by hand and the
+    // version set using Force()
+    Dirty bool `json:"dirty"`
+
+    // all migrations, in order
+    Migrations []Migration `json:"migrations"`
+}
+
+// the migrations which have not been applied yet
+func (s Status) Pending() []Migration {
+    pending := []Migration{}
+    for _, m := range s.Migrations {
+        if !m.Applied {
+            pending = append(pending, m)
+        }
+    }
+    return pending
+}
+
+// applies all pending migrations in the directory given by STRATIS_DB_MIGRATION_LOCATION, or else those set using
+// SetFS(), see MigrateFS()
+func Migrate() error {
+    return MigrateFS(embedded)
+}
+
+// applies all pending migrations at the root of the fs, e.g. ones embedded in the binary, or those in the directory
+// given by STRATIS_DB_MIGRATION_LOCATION, if it is set. fsys may be nil, if the env var is set. does nothing if
+// STRATIS_SKIP_DB is true. the database must have been set up, e.g. using database.SetupDb().
+func MigrateFS(fsys fs.FS) error {
     if os.Getenv(database.STRATIS_SKIP_DB) == "true" {
         log.Info().Msgf("Skipping DB migrations because %s is set to true", database.STRATIS_SKIP_DB)
-        return
+        return nil
+    }
+    mode := os.Getenv(STRATIS_DB_MIGRATION_MODE)
+    if len(mode) == 0 {
+        mode = MODE_MIGRATE
+    }
+    if mode != MODE_MIGRATE && mode != MODE_WAIT {
+        return fmt.Errorf("STRATIS-1035 please set env var %s to %s or %s, rather than '%s'", STRATIS_DB_MIGRATION_MODE, MODE_MIGRATE, MODE_WAIT, mode)
+    }
+    log.Info().Msgf("Starting DB migrations in mode %s...", mode)
+    migrating.Store(true)
+    defer migrating.Store(false)
+
+    m, err := newWithFS(fsys)
+    if err != nil {
+        return err
+    }
+    defer m.Close()
+
+    if mode == MODE_WAIT {
+        return m.WaitForLatest()
+    }
+    if err := m.Up(0); err != nil {
+        return err
+    }
+    log.Info().Msgf("DB Stats: %+v", m.db.Stats())
+    return nil
+}
+
+// true while Migrate() is running, i.e. the instance is not ready yet
+func IsMigrating() bool {
+    return migrating.Load()
+}
+
+// applies, reverts and reports on migrations. it must be closed after use.
+type Migrator struct {
+    // if true, the migrations which would be applied or reverted are listed, but nothing is changed
+    DryRun bool
+
+    // where the migrations which are about to be applied or reverted are listed. if nil, they are logged.
+    Out io.Writer
+
+    // the maximum time to wait for the advisory lock, or for another instance to apply the migrations. read from
+    // STRATIS_DB_MIGRATION_LOCK_TIMEOUT
+    LockTimeout time.Duration
+
+    // how often progress is logged while waiting, default 10s
+    ProgressInterval time.Duration
+
+    m      *migrate.Migrate
+    source *goSource
+    db     *sql.DB
+}
+
+// sets the migrations used by Run(), New() and Migrate(), e.g. ones embedded in the binary, so that they need not be
+// shipped alongside it. the files must be at the root of the fs, see fs.Sub(). at start up, use MigrateFS() instead.
+func SetFS(fsys fs.FS) {
+    embedded = fsys
+}
+
+// creates a Migrator for the database set up by the database package, using the migrations in the directory given
+// by STRATIS_DB_MIGRATION_LOCATION, or else those set using SetFS()
+func New() (*Migrator, error) {
+    return newWithFS(embedded)
+}
+
+// the env var takes precedence over the fs
+func newWithFS(fsys fs.FS) (*Migrator, error) {
+    dir := os.Getenv(STRATIS_DB_MIGRATION_LOCATION)
+    if len(dir) == 0 && fsys != nil {
+        return NewFromFS(fsys)
     }
-    log.Info().Msg("Starting DB migrations...")
+    return NewFromDir(dir)
+}
+
+// creates a Migrator for the database set up by the database package, using the migrations at the root of the fs
+func NewFromFS(fsys fs.FS) (*Migrator, error) {
+    log.Debug().Msg("using embedded migrations")
+    src, err := iofs.New(fsys, ".")
+    if err != nil {
+        return nil, fmt.Errorf("unable to read embedded migrations: %w", err)
+    }
+    return newMigrator("iofs", src)
+}
 
-    db := database.GetRawDb()
+// creates a Migrator for the database set up by the database package, using the migrations in the given directory
+func NewFromDir(migLoc string) (*Migrator, error) {
+    if len(migLoc) == 0 {
+        return nil, fmt.Errorf("STRATIS-1035 please set env var %s or use MigrateFS() or SetFS()", STRATIS_DB_MIGRATION_LOCATION)
+    }
+    sourceURL := "file://" + migLoc
+    log.Debug().Msgf("migrations url %s", sourceURL)
+
+    src, err := source.Open(sourceURL)
+    if err != nil {
+        return nil, fmt.Errorf("unable to read migrations from %s: %w", migLoc, err)
+    }
+    return newMigrator("file", src)
+}
+
+func newMigrator(sourceName string, src source.Driver) (*Migrator, error) {
+    if database.GetRawDb() == nil {
+        src.Close()
+        return nil, errors.New("STRATIS-1036 the database must be set up before migrating it")
+    }
+    lockTimeout := 5 * time.Minute
+    if s := os.Getenv(STRATIS_DB_MIGRATION_LOCK_TIMEOUT); len(s) > 0 {
+        d, err := time.ParseDuration(s)
+        if err != nil {
+            src.Close()
+            return nil, fmt.Errorf("STRATIS-1035 please set env var %s to a duration like 5m, rather than '%s'", STRATIS_DB_MIGRATION_LOCK_TIMEOUT, s)
+        }
+        lockTimeout = d
+    }
 
     // https://github.com/golang-migrate/migrate/blob/master/database/mysql/README.md
 
     // https://pkg.go.dev/github.com/simukti/sqldb-logger#section-readme
     sqlLog := logging.GetLog("sql-migr")
     loggerAdapter := zerologadapter.New(sqlLog)
-    db = sqldblogger.OpenDriver(database.GetDatabaseSourceName(), db.Driver(), loggerAdapter /*, using_default_options*/) // db is STILL *sql.DB
+    db := sqldblogger.OpenDriver(database.GetDatabaseSourceName(), database.GetRawDb().Driver(), loggerAdapter /*, using_default_options*/) // db is STILL *sql.DB
 
     log.Debug().Msg("Pinging DB...")
-    err := db.Ping() // to check connectivity and DSN correctness
-    if err != nil {
-        log.Fatal().Msgf("Failed %+v", err)
+    if err := db.Ping(); err != nil { // to check connectivity and DSN correctness
+        src.Close()
+        db.Close()
+        return nil, fmt.Errorf("unable to connect to the database for migrations: %w", err)
     }
     log.Debug().Msg("Pinged DB")
 
-    driver, err := mysql.WithInstance(db, &mysql.Config{})
+    goSrc, err := newGoSource(src)
+    if err != nil {
+        src.Close()
+        db.Close()
+        return nil, err
+    }
+    driver, err := newDriver(db)
     if err != nil {
-        log.Fatal().Msgf("Failed %+v", err)
+        src.Close()
+        db.Close()
+        return nil, err
     }
 
-    dir, err := os.Getwd()
+    dbName := database.GetDialect().DatabaseName()
+    m, err := migrate.NewWithInstance(sourceName, goSrc, dbName, &goDriver{Driver: driver, source: goSrc})
     if err != nil {
-        log.Fatal().Msgf("Error getting working directory: %+v", err)
+        src.Close()
+        driver.Close()
+        return nil, fmt.Errorf("unable to prepare migrations: %w", err)
     }
+    m.Log = &myLogger{verbose: true, log: log} // provide a log impl so that we get details about the migration
+    return &Migrator{LockTimeout: lockTimeout, ProgressInterval: 10 * time.Second, m: m, source: goSrc, db: db}, nil
+}
 
-    // Print the working directory.
-    log.Info().Msgf("Working directory: %s", dir)
+// closes the migrations and the connection used to apply them
+func (m *Migrator) Close() error {
+    sourceErr, driverErr := m.m.Close()
+    return errors.Join(sourceErr, driverErr, m.db.Close())
+}
 
-    migLoc := os.Getenv("STRATIS_DB_MIGRATION_LOCATION")
-    if len(migLoc) == 0 {
-        log.Fatal().Msg("Please set the migration location env var")
+// returns the version of the database and all known migrations
+func (m *Migrator) Status() (Status, error) {
+    version, dirty, err := m.m.Version()
+    if errors.Is(err, migrate.ErrNilVersion) {
+        return m.status(NO_VERSION, false)
     }
-    sourceURL := "file://" + migLoc
-    dbName := database.GetDatabaseConfig().DBName
-    log.Debug().Msgf("migrations url %s and dbName %s", sourceURL, dbName)
-
-    m, err := migrate.NewWithDatabaseInstance(
-        sourceURL,
-        dbName,
-        driver,
-    )
     if err != nil {
-        log.Fatal().Msgf("DB migrations failed %+v", err)
+        return Status{}, err
     }
+    return m.status(int(version), dirty)
+}
 
-    m.Log = &myLogger{verbose: true, log: log} // provide a log impl so that we get details about the migration
-    err = m.Up() // do as many as possible
+func (m *Migrator) status(version int, dirty bool) (Status, error) {
+    status := Status{Version: version, Dirty: dirty, Migrations: []Migration{}}
+    v, err := m.source.First()
+    for err == nil {
+        name, nameErr := m.nameOf(v)
+        if nameErr != nil {
+            return Status{}, nameErr
+        }
+        applied := version != NO_VERSION && v <= uint(version)
+        status.Migrations = append(status.Migrations, Migration{Version: v, Name: name, Applied: applied})
+        v, err = m.source.Next(v)
+    }
+    if !errors.Is(err, os.ErrNotExist) {
+        return Status{}, fmt.Errorf("unable to list migrations: %w", err)
+    }
+    return status, nil
+}
 
+// the identifier of the migration, e.g. "create_thing" for "000001_create_thing.up.sql"
+func (m *Migrator) nameOf(version uint) (string, error) {
+    r, identifier, err := m.source.ReadUp(version)
+    if errors.Is(err, os.ErrNotExist) {
+        r, identifier, err = m.source.ReadDown(version) // a migration without an up file
+    }
     if err != nil {
-        if err.Error() == "no change" {
-            version, dirty, err := m.Version()
-            log.Info().Msgf("No DB migrations necessary. Version is %d, dirty %t, error: %+v", version, dirty, err)
-        } else {
-            log.Fatal().Msgf("DB migrations failed: %+v", err)
+        return "", err
+    }
+    r.Close()
+    return identifier, nil
+}
+
+// applies the next n pending migrations, or all of them if n is not positive
+func (m *Migrator) Up(n int) error {
+    return m.locked(func() error {
+        status, err := m.checkedStatus()
+        if err != nil {
+            return err
+        }
+        plan := status.Pending()
+        if n > 0 && n < len(plan) {
+            plan = plan[:n]
+        }
+        return m.apply("up", plan, func() error {
+            if n > 0 {
+                return m.m.Steps(len(plan))
+            }
+            return m.m.Up()
+        })
+    })
+}
+
+// reverts the last n applied migrations. n must be at least 1, so that all migrations cannot be reverted by mistake.
+func (m *Migrator) Down(n int) error {
+    if n < 1 {
+        return fmt.Errorf("STRATIS-1037 the number of migrations to revert must be at least 1, but was %d", n)
+    }
+    return m.locked(func() error {
+        status, err := m.checkedStatus()
+        if err != nil {
+            return err
         }
+        plan := applied(status)
+        if n < len(plan) {
+            plan = plan[:n]
+        }
+        return m.apply("down", plan, func() error {
+            return m.m.Steps(-len(plan))
+        })
+    })
+}
+
+// applies or reverts migrations until the database is at the given version
+func (m *Migrator) Goto(version uint) error {
+    return m.locked(func() error {
+        status, err := m.checkedStatus()
+        if err != nil {
+            return err
+        }
+        if !slices.ContainsFunc(status.Migrations, func(mig Migration) bool { return mig.Version == version }) {
+            return fmt.Errorf("STRATIS-1038 there is no migration with version %d", version)
+        }
+        if status.Version != NO_VERSION && version < uint(status.Version) {
+            plan := []Migration{}
+            for _, mig := range applied(status) {
+                if mig.Version > version {
+                    plan = append(plan, mig)
+                }
+            }
+            return m.apply("down", plan, func() error { return m.m.Migrate(version) })
+        }
+        plan := []Migration{}
+        for _, mig := range status.Pending() {
+            if mig.Version <= version {
+                plan = append(plan, mig)
+            }
+        }
+        return m.apply("up", plan, func() error { return m.m.Migrate(version) })
+    })
+}
+
+// sets the version without running any migrations and clears the dirty flag, e.g. after repairing the database by
+// hand following a failed migration. use NO_VERSION if no migration has been applied.
+func (m *Migrator) Force(version int) error {
+    if version < NO_VERSION {
+        return fmt.Errorf("STRATIS-1037 invalid version %d", version)
+    }
+    if m.DryRun {
+        m.print("would force version %d", version)
+        return nil
+    }
+    return m.locked(func() error {
+        if err := m.m.Force(version); err != nil {
+            return err
+        }
+        m.print("forced version %d", version)
+        return nil
+    })
+}
+
+// runs the function while holding the advisory lock, unless this is a dry run
+func (m *Migrator) locked(f func() error) error {
+    if m.DryRun {
+        return f()
+    }
+    unlock, err := m.lock()
+    if err != nil {
+        return err
+    }
+    defer unlock()
+    return f()
+}
+
+// waits until another instance has applied all known migrations, e.g. in MODE_WAIT, checking the version of the
+// database regularly. fails if that takes longer than the LockTimeout. the database is dirty while a migration is
+// being applied, so that is only reported if it remains so until the timeout.
+func (m *Migrator) WaitForLatest() error {
+    start := time.Now()
+    lastProgress := start
+    for {
+        status, err := m.Status()
+        if err != nil {
+            return err
+        }
+        pending := status.Pending()
+        if len(pending) == 0 && !status.Dirty {
+            log.Info().Msgf("DB migrations were completed by another instance. Version is %d", status.Version)
+            return nil
+        }
+        waited := time.Since(start)
+        if waited >= m.LockTimeout && status.Dirty {
+            return fmt.Errorf("STRATIS-1040 timed out after %s waiting for another instance to apply the migrations. the database is dirty at version %d, repair it by hand and then force the version", waited.Round(time.Second), status.Version)
+        } else if waited >= m.LockTimeout {
+            return fmt.Errorf("STRATIS-1040 timed out after %s waiting for another instance to apply %d migrations, up to version %d", waited.Round(time.Second), len(pending), pending[len(pending)-1].Version)
+        }
+        if time.Since(lastProgress) >= m.ProgressInterval && len(pending) > 0 {
+            log.Info().Msgf("waiting for another instance to apply %d migrations, up to version %d, since %s", len(pending), pending[len(pending)-1].Version, waited.Round(time.Second))
+            lastProgress = time.Now()
+        }
+        time.Sleep(pollInterval)
+    }
+}
+
+// the status, unless the database is dirty, since no migrations can be run until it has been repaired. a go migration
+// runs in a transaction, so if it was recorded as applied, the dirty flag is just cleared, and otherwise the version is
+// reset in order to run it again.
+func (m *Migrator) checkedStatus() (Status, error) {
+    status, err := m.Status()
+    if err != nil {
+        return Status{}, err
+    }
+    if status.Dirty && status.Version != NO_VERSION && m.source.isGo(uint(status.Version)) {
+        applied, err := isApplied(database.GetDb(), uint(status.Version))
+        if err != nil {
+            return Status{}, err
+        }
+        if applied {
+            log.Warn().Msgf("the go migration %d was applied, but its version was not cleared, so it is cleared now", status.Version)
+            if !m.DryRun {
+                if err := m.m.Force(status.Version); err != nil {
+                    return Status{}, err
+                }
+            }
+            return m.status(status.Version, false)
+        }
+        previous := NO_VERSION
+        if v, err := m.source.Prev(uint(status.Version)); err == nil {
+            previous = int(v)
+        }
+        log.Warn().Msgf("the go migration %d did not complete, so it will be run again", status.Version)
+        if !m.DryRun {
+            if err := m.m.Force(previous); err != nil {
+                return Status{}, err
+            }
+        }
+        return m.status(previous, false)
+    }
+    if status.Dirty {
+        return Status{}, fmt.Errorf("STRATIS-1039 the database is dirty at version %d, because a migration failed. repair it by hand and then force the version", status.Version)
+    }
+    return status, nil
+}
+
+// lists the plan, and runs it, unless it is empty or this is a dry run
+func (m *Migrator) apply(direction string, plan []Migration, run func() error) error {
+    if len(plan) == 0 {
+        m.print("no migrations to apply")
+        return nil
+    }
+    verb := "applying"
+    if m.DryRun {
+        verb = "would apply"
+    }
+    for _, mig := range plan {
+        m.print("%s %d %s (%s)", verb, mig.Version, mig.Name, direction)
+    }
+    if m.DryRun {
+        return nil
+    }
+    if err := run(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+        return fmt.Errorf("DB migrations failed: %w", err)
+    }
+    version, dirty, err := m.m.Version()
+    if errors.Is(err, migrate.ErrNilVersion) {
+        m.print("DB migrations completed. No version is applied")
+        return nil
+    }
+    m.print("DB migrations completed. Version is %d, dirty %t", version, dirty)
+    return err
+}
+
+func (m *Migrator) print(format string, a ...any) {
+    if m.Out == nil {
+        log.Info().Msgf(format, a...)
     } else {
-        version, dirty, err := m.Version()
-        log.Info().Msgf("DB migrations completed. Version is %d, dirty %t, error: %+v", version, dirty, err)
+        fmt.Fprintf(m.Out, format+"\n", a...)
+    }
+}
+
+// the applied migrations, newest first
+func applied(status Status) []Migration {
+    result := []Migration{}
+    for _, mig := range status.Migrations {
+        if mig.Applied {
+            result = append(result, mig)
+        }
     }
+    slices.Reverse(result)
+    return result
+}
 
-    log.Info().Msgf("DB Stats: %+v", db.Stats())
+// returns the migration driver matching the database dialect
+func newDriver(db *sql.DB) (migratedb.Driver, error) {
+    switch database.GetDialect().Name() {
+    case database.DRIVER_POSTGRES:
+        return pgx.WithInstance(db, &pgx.Config{})
+    case database.DRIVER_SQLITE:
+        return newSqliteDriver(db)
+    default:
+        return mysql.WithInstance(db, &mysql.Config{})
+    }
 }
 
 // myLogger struct implements the Logger interface
@@ -0,0 +1,326 @@
+package migration
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "testing/fstest"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database"
+    "github.com/stretchr/testify/assert"
+)
+
+// sets up a sqlite database and a directory with three migrations
+func setupMigrations(t *testing.T) string {
+    dir := t.TempDir()
+    os.WriteFile(filepath.Join(dir, "000001_create_thing.up.sql"), []byte("CREATE TABLE thing (id INTEGER PRIMARY KEY, name TEXT NOT NULL);"), 0644)
+    os.WriteFile(filepath.Join(dir, "000001_create_thing.down.sql"), []byte("DROP TABLE thing;"), 0644)
+    os.WriteFile(filepath.Join(dir, "000002_add_thing.up.sql"), []byte("INSERT INTO thing (name) VALUES ('a'); INSERT INTO thing (name) VALUES ('b');"), 0644)
+    os.WriteFile(filepath.Join(dir, "000002_add_thing.down.sql"), []byte("DELETE FROM thing;"), 0644)
+    os.WriteFile(filepath.Join(dir, "000003_add_other.up.sql"), []byte("INSERT INTO thing (name) VALUES ('c');"), 0644)
+    os.WriteFile(filepath.Join(dir, "000003_add_other.down.sql"), []byte("DELETE FROM thing WHERE name = 'c';"), 0644)
+    t.Setenv(database.STRATIS_DB_DRIVER, database.DRIVER_SQLITE)
+    t.Setenv("STRATIS_DB_NAME", "file:"+filepath.Join(dir, "test.db"))
+    t.Setenv(STRATIS_DB_MIGRATION_LOCATION, dir)
+    t.Setenv("STRATIS_DB_POOL_MAX_OPEN", "3")
+    database.SetupDb()
+    return dir
+}
+
+func countThings(t *testing.T) int64 {
+    var count int64
+    assert.Nil(t, database.GetDb().Table("thing").Count(&count).Error)
+    return count
+}
+
+func TestMigrate_sqlite(t *testing.T) {
+    assert := assert.New(t)
+    setupMigrations(t)
+
+    // when
+    err := Migrate()
+
+    // then
+    assert.Nil(err)
+    assert.Equal(int64(3), countThings(t))
+
+    var version int
+    assert.Nil(database.GetRawDb().QueryRow("SELECT version FROM schema_migrations").Scan(&version))
+    assert.Equal(3, version)
+    assert.Equal(3, database.GetRawDb().Stats().MaxOpenConnections)
+
+    // nothing to do the second time
+    assert.Nil(Migrate())
+}
+
+func TestMigrate_returnsErrors(t *testing.T) {
+    assert := assert.New(t)
+    dir := setupMigrations(t)
+    os.WriteFile(filepath.Join(dir, "000004_broken.up.sql"), []byte("INSERT INTO missing VALUES (1);"), 0644)
+
+    // when
+    err := Migrate()
+
+    // then
+    assert.ErrorContains(err, "no such table: missing")
+
+    // when
+    err = Migrate()
+
+    // then
+    assert.ErrorContains(err, "STRATIS-1039")
+
+    // when
+    t.Setenv(STRATIS_DB_MIGRATION_LOCATION, "")
+    err = Migrate()
+
+    // then
+    assert.ErrorContains(err, "STRATIS-1035")
+}
+
+func TestMigrate_embedded(t *testing.T) {
+    assert := assert.New(t)
+    setupMigrations(t)
+    t.Setenv(STRATIS_DB_MIGRATION_LOCATION, "")
+    fsys := fstest.MapFS{
+        "000001_create_thing.up.sql":   {Data: []byte("CREATE TABLE thing (id INTEGER PRIMARY KEY, name TEXT NOT NULL);")},
+        "000001_create_thing.down.sql": {Data: []byte("DROP TABLE thing;")},
+        "000002_add_thing.up.sql":      {Data: []byte("INSERT INTO thing (name) VALUES ('embedded');")},
+    }
+
+    // when
+    err := MigrateFS(fsys)
+
+    // then
+    assert.Nil(err)
+    assert.Equal(int64(1), countThings(t))
+
+    // the commands use the fs which is set
+    SetFS(fsys)
+    defer SetFS(nil)
+    out := &bytes.Buffer{}
+    assert.Nil(Run([]string{"status"}, out))
+    assert.Equal("version: 2\napplied  1 create_thing\napplied  2 add_thing\n", out.String())
+}
+
+func TestNew_envTakesPrecedence(t *testing.T) {
+    assert := assert.New(t)
+    setupMigrations(t)
+    SetFS(fstest.MapFS{"000001_other.up.sql": {Data: []byte("SELECT 1;")}})
+    defer SetFS(nil)
+
+    // when
+    m, err := New()
+
+    // then
+    assert.Nil(err)
+    defer m.Close()
+    status, err := m.Status()
+    assert.Nil(err)
+    assert.Len(status.Migrations, 3)
+    assert.Equal("create_thing", status.Migrations[0].Name)
+}
+
+func TestMigrator(t *testing.T) {
+    assert := assert.New(t)
+    setupMigrations(t)
+    out := &bytes.Buffer{}
+    m, err := New()
+    assert.Nil(err)
+    defer m.Close()
+    m.Out = out
+
+    status, err := m.Status()
+    assert.Nil(err)
+    assert.Equal(NO_VERSION, status.Version)
+    assert.Equal([]Migration{{1, "create_thing", false}, {2, "add_thing", false}, {3, "add_other", false}}, status.Migrations)
+
+    // a dry run changes nothing
+    m.DryRun = true
+    assert.Nil(m.Up(2))
+    assert.Equal("would apply 1 create_thing (up)\nwould apply 2 add_thing (up)\n", out.String())
+    status, err = m.Status()
+    assert.Nil(err)
+    assert.Equal(NO_VERSION, status.Version)
+    m.DryRun = false
+
+    // up
+    out.Reset()
+    assert.Nil(m.Up(2))
+    assert.Contains(out.String(), "applying 1 create_thing (up)\napplying 2 add_thing (up)\n")
+    assert.Equal(int64(2), countThings(t))
+    status, err = m.Status()
+    assert.Nil(err)
+    assert.Equal(2, status.Version)
+    assert.Equal([]Migration{{3, "add_other", false}}, status.Pending())
+
+    // down
+    out.Reset()
+    assert.Nil(m.Down(1))
+    assert.Contains(out.String(), "applying 2 add_thing (down)\n")
+    assert.Equal(int64(0), countThings(t))
+    assert.ErrorContains(m.Down(0), "STRATIS-1037")
+
+    // goto
+    assert.Nil(m.Goto(3))
+    assert.Equal(int64(3), countThings(t))
+    out.Reset()
+    assert.Nil(m.Goto(1))
+    assert.Contains(out.String(), "applying 3 add_other (down)\napplying 2 add_thing (down)\n")
+    assert.Equal(int64(0), countThings(t))
+    assert.ErrorContains(m.Goto(7), "STRATIS-1038")
+
+    // force
+    assert.Nil(m.Force(3))
+    status, err = m.Status()
+    assert.Nil(err)
+    assert.Equal(3, status.Version)
+    assert.Len(status.Pending(), 0)
+    assert.Equal(int64(0), countThings(t))
+}
+
+func TestRun(t *testing.T) {
+    assert := assert.New(t)
+    setupMigrations(t)
+    out := &bytes.Buffer{}
+
+    assert.Nil(Run([]string{"-dry-run", "up"}, out))
+    assert.Equal(3, strings.Count(out.String(), "would apply"))
+
+    assert.Nil(Run([]string{"up", "1"}, out))
+    out.Reset()
+    assert.Nil(Run([]string{"status"}, out))
+    assert.Equal("version: 1\napplied  1 create_thing\npending  2 add_thing\npending  3 add_other\n", out.String())
+
+    assert.Nil(Run([]string{"goto", "3"}, out))
+    assert.Nil(Run([]string{"down"}, out))
+    assert.Equal(int64(2), countThings(t))
+    assert.Nil(Run([]string{"force", "1"}, out))
+
+    assert.ErrorContains(Run([]string{}, out), "STRATIS-1037")
+    assert.ErrorContains(Run([]string{"sideways"}, out), "STRATIS-1037")
+    assert.ErrorContains(Run([]string{"down", "x"}, out), "STRATIS-1037")
+    assert.ErrorContains(Run([]string{"goto"}, out), "STRATIS-1037")
+}
+
+func TestCreate(t *testing.T) {
+    assert := assert.New(t)
+    dir := filepath.Join(t.TempDir(), "migrations")
+    now := time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC)
+
+    // when
+    files, err := Create(dir, "add_orders", now)
+
+    // then
+    assert.Nil(err)
+    assert.Equal([]string{filepath.Join(dir, "20250102150405_add_orders.up.sql"), filepath.Join(dir, "20250102150405_add_orders.down.sql")}, files)
+    for _, file := range files {
+        assert.FileExists(file)
+    }
+
+    // existing files are not overwritten
+    _, err = Create(dir, "add_orders", now)
+    assert.ErrorIs(err, os.ErrExist)
+
+    _, err = Create(dir, "add orders; rm -rf", now)
+    assert.ErrorContains(err, "STRATIS-1037")
+
+    out := &bytes.Buffer{}
+    assert.Nil(Run([]string{"-dir", dir, "create", "add_customers"}, out))
+    assert.Contains(out.String(), "_add_customers.up.sql")
+}
+
+func TestLock_waitsForOtherInstance(t *testing.T) {
+    assert := assert.New(t)
+    setupMigrations(t)
+    pollInterval = 10 * time.Millisecond
+    defer func() { pollInterval = time.Second }()
+    first, err := New()
+    assert.Nil(err)
+    defer first.Close()
+    second, err := New()
+    assert.Nil(err)
+    defer second.Close()
+    second.LockTimeout = 50 * time.Millisecond
+
+    // when another instance holds the lock
+    unlock, err := first.lock()
+    assert.Nil(err)
+    err = second.Up(0)
+
+    // then
+    assert.ErrorContains(err, "STRATIS-1040")
+    assert.Equal(NO_VERSION, mustStatus(t, second).Version)
+
+    // when it is released while waiting
+    second.LockTimeout = time.Minute
+    go func() {
+        time.Sleep(30 * time.Millisecond)
+        unlock()
+    }()
+    err = second.Up(0)
+
+    // then
+    assert.Nil(err)
+    assert.Equal(3, mustStatus(t, second).Version)
+}
+
+func TestNewAdvisoryLock_mysqlNameIsShortEnough(t *testing.T) {
+    assert := assert.New(t)
+    host := "orders-production-cluster.cluster-c1a2b3c4d5e6.eu-central-1.rds.amazonaws.com:3306"
+
+    // when
+    lock := newAdvisoryLock(database.DRIVER_MYSQL, "stratis-migrate-"+host+"/orders").(*mysqlLock)
+    other := newAdvisoryLock(database.DRIVER_MYSQL, "stratis-migrate-"+host+"/customers").(*mysqlLock)
+
+    // then
+    assert.LessOrEqual(len(lock.name), 64)
+    assert.Regexp("^stratis-migrate-[0-9a-f]{16}$", lock.name)
+    assert.NotEqual(lock.name, other.name)
+}
+
+func TestMigrate_waitMode(t *testing.T) {
+    assert := assert.New(t)
+    setupMigrations(t)
+    pollInterval = 10 * time.Millisecond
+    defer func() { pollInterval = time.Second }()
+    t.Setenv(STRATIS_DB_MIGRATION_MODE, MODE_WAIT)
+    t.Setenv(STRATIS_DB_MIGRATION_LOCK_TIMEOUT, "50ms")
+
+    // when no other instance migrates
+    err := Migrate()
+
+    // then
+    assert.ErrorContains(err, "STRATIS-1040")
+    assert.False(IsMigrating())
+
+    // when the migrator does so in the meantime
+    t.Setenv(STRATIS_DB_MIGRATION_LOCK_TIMEOUT, "1m")
+    migrator, err := New()
+    assert.Nil(err)
+    defer migrator.Close()
+    done := make(chan error)
+    go func() { done <- Migrate() }()
+    time.Sleep(30 * time.Millisecond)
+    assert.True(IsMigrating())
+    assert.Nil(migrator.Up(0))
+
+    // then
+    assert.Nil(<-done)
+    assert.False(IsMigrating())
+}
+
+func TestMigrate_invalidMode(t *testing.T) {
+    setupMigrations(t)
+    t.Setenv(STRATIS_DB_MIGRATION_MODE, "sometimes")
+    assert.ErrorContains(t, Migrate(), "STRATIS-1035")
+}
+
+func mustStatus(t *testing.T, m *Migrator) Status {
+    status, err := m.Status()
+    assert.Nil(t, err)
+    return status
+}
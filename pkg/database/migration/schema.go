@@ -0,0 +1,275 @@
+package migration
+
+// compares the models with the schema of the database, since the migrations are written by hand and can drift apart
+// from the models, e.g. at start up, after migrating:
+//
+//     if err := migration.VerifySchema(&Order{}, &Customer{}); err != nil {
+//         log.Warn().Msgf("%+v", err)
+//     }
+//
+// or in a test which runs the migrations. the columns are compared using the same rules as gorm's AutoMigrate.
+
+import (
+    "context"
+    "fmt"
+    "maps"
+    "regexp"
+    "slices"
+    "strings"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database"
+    "gorm.io/gorm"
+    "gorm.io/gorm/logger"
+    "gorm.io/gorm/schema"
+)
+
+const DIFF_MISSING_TABLE = "missing table"
+const DIFF_MISSING_COLUMN = "missing column"
+const DIFF_EXTRA_COLUMN = "extra column"
+const DIFF_TYPE = "type"
+const DIFF_NULLABLE = "nullable"
+const DIFF_MISSING_INDEX = "missing index"
+
+var sizeInType = regexp.MustCompile(`\D*(\d+)\D?`)
+
+// a difference between a model and the database
+type Difference struct {
+    // one of the DIFF_ constants
+    Kind   string
+    Table  string
+    Column string
+    Index  string
+
+    // what the model expects, and what the database has
+    Expected string
+    Actual   string
+
+    // statements which would remove the difference, if they can be suggested
+    SQL []string
+}
+
+func (d Difference) String() string {
+    s := d.Kind + " " + d.Table
+    if len(d.Column) > 0 {
+        s += "." + d.Column
+    }
+    if len(d.Index) > 0 {
+        s += " " + d.Index
+    }
+    if len(d.Expected) > 0 {
+        s += fmt.Sprintf(": expected %s, but is %s", d.Expected, d.Actual)
+    } else if len(d.Actual) > 0 {
+        s += " " + d.Actual
+    }
+    return s
+}
+
+// returned by VerifySchema if the database differs from the models
+type SchemaDriftError struct {
+    Differences []Difference
+}
+
+func (e *SchemaDriftError) Error() string {
+    lines := []string{fmt.Sprintf("STRATIS-1042 the database schema differs from the models in %d ways:", len(e.Differences))}
+    for _, d := range e.Differences {
+        lines = append(lines, "  - "+d.String())
+    }
+    return strings.Join(lines, "\n")
+}
+
+// returns a *SchemaDriftError if the schema of the database set up by the database package differs from the models,
+// see CompareSchema(). the suggested migration can be obtained using SuggestedMigration().
+func VerifySchema(models ...any) error {
+    differences, err := CompareSchema(database.GetDb(), models...)
+    if err != nil {
+        return err
+    }
+    if len(differences) > 0 {
+        return &SchemaDriftError{Differences: differences}
+    }
+    return nil
+}
+
+// compares the tables, columns, types, nullability and indexes of the models with those of the database. tables and
+// indexes which are not part of the models are ignored, since they cannot be expected there, but columns which are
+// not part of a model are reported. indexes are compared by their columns and uniqueness rather than their names.
+func CompareSchema(db *gorm.DB, models ...any) ([]Difference, error) {
+    differences := []Difference{}
+    for _, model := range models {
+        stmt := &gorm.Statement{DB: db}
+        if err := stmt.Parse(model); err != nil {
+            return nil, err
+        }
+        diffs, err := compareTable(db, model, stmt.Schema)
+        if err != nil {
+            return nil, fmt.Errorf("unable to compare the schema of %s: %w", stmt.Schema.Table, err)
+        }
+        differences = append(differences, diffs...)
+    }
+    return differences, nil
+}
+
+func compareTable(db *gorm.DB, model any, s *schema.Schema) ([]Difference, error) {
+    migrator := db.Migrator()
+    if !migrator.HasTable(model) {
+        return []Difference{{Kind: DIFF_MISSING_TABLE, Table: s.Table, SQL: suggest(db, func(tx *gorm.DB) error {
+            return tx.Migrator().CreateTable(model)
+        })}}, nil
+    }
+
+    columnTypes, err := migrator.ColumnTypes(model)
+    if err != nil {
+        return nil, err
+    }
+    columns := map[string]gorm.ColumnType{}
+    for _, ct := range columnTypes {
+        columns[ct.Name()] = ct
+    }
+
+    differences := []Difference{}
+    for _, dbName := range s.DBNames {
+        field := s.FieldsByDBName[dbName]
+        if field.IgnoreMigration {
+            continue
+        }
+        ct, ok := columns[dbName]
+        if !ok {
+            differences = append(differences, Difference{Kind: DIFF_MISSING_COLUMN, Table: s.Table, Column: dbName, SQL: suggest(db, func(tx *gorm.DB) error {
+                return tx.Migrator().AddColumn(model, field.Name)
+            })})
+            continue
+        }
+        differences = append(differences, compareColumn(db, s, field, ct)...)
+    }
+    for _, ct := range columnTypes {
+        if _, ok := s.FieldsByDBName[ct.Name()]; !ok {
+            differences = append(differences, Difference{Kind: DIFF_EXTRA_COLUMN, Table: s.Table, Column: ct.Name(), Actual: strings.ToLower(ct.DatabaseTypeName())})
+        }
+    }
+
+    indexes, err := migrator.GetIndexes(model)
+    if err != nil {
+        return nil, err
+    }
+    expectedIndexes := s.ParseIndexes()
+    for _, name := range slices.Sorted(maps.Keys(expectedIndexes)) {
+        index := expectedIndexes[name]
+        if !hasIndex(indexes, &index) {
+            differences = append(differences, Difference{Kind: DIFF_MISSING_INDEX, Table: s.Table, Index: index.Name, SQL: suggest(db, func(tx *gorm.DB) error {
+                return tx.Migrator().CreateIndex(model, index.Name)
+            })})
+        }
+    }
+    return differences, nil
+}
+
+// the same checks as gorm's Migrator.MigrateColumn, for the type, size and nullability
+func compareColumn(db *gorm.DB, s *schema.Schema, field *schema.Field, ct gorm.ColumnType) []Difference {
+    differences := []Difference{}
+    expected := strings.TrimSpace(strings.ToLower(db.Migrator().FullDataTypeOf(field).SQL))
+    actual := strings.ToLower(ct.DatabaseTypeName())
+    sameType := field.PrimaryKey || strings.HasPrefix(expected, actual) || slices.ContainsFunc(db.Migrator().GetTypeAliases(actual), func(alias string) bool {
+        return strings.HasPrefix(expected, alias)
+    })
+    if length, ok := ct.Length(); sameType && ok && length > 0 && length != int64(field.Size) {
+        // the size is either in the field, or in the type, e.g. varchar(50)
+        sizes := sizeInType.FindAllStringSubmatch(expected, -1)
+        if field.Size > 0 || (!field.PrimaryKey && len(sizes) == 1 && sizes[0][1] != fmt.Sprint(length)) {
+            sameType = false
+            actual = fmt.Sprintf("%s(%d)", actual, length)
+        }
+    }
+    if !sameType {
+        differences = append(differences, Difference{Kind: DIFF_TYPE, Table: s.Table, Column: field.DBName,
+            Expected: db.Dialector.DataTypeOf(field), Actual: actual, SQL: alterColumn(db, s, field)})
+    }
+
+    if nullable, ok := ct.Nullable(); ok && nullable && field.NotNull && !field.PrimaryKey {
+        differences = append(differences, Difference{Kind: DIFF_NULLABLE, Table: s.Table, Column: field.DBName,
+            Expected: "not null", Actual: "null", SQL: alterColumn(db, s, field)})
+    }
+    return differences
+}
+
+func hasIndex(indexes []gorm.Index, expected *schema.Index) bool {
+    columns := []string{}
+    for _, f := range expected.Fields {
+        columns = append(columns, f.DBName)
+    }
+    unique := expected.Class == "UNIQUE"
+    for _, index := range indexes {
+        isUnique, _ := index.Unique()
+        if slices.Equal(index.Columns(), columns) && isUnique == unique {
+            return true
+        }
+    }
+    return false
+}
+
+// the statement for changing the column to match the field. sqlite cannot alter columns, so the table must be
+// recreated.
+func alterColumn(db *gorm.DB, s *schema.Schema, field *schema.Field) []string {
+    table, column := db.Statement.Quote(s.Table), db.Statement.Quote(field.DBName)
+    switch db.Dialector.Name() {
+    case database.DRIVER_MYSQL:
+        return []string{fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s;", table, column, db.Migrator().FullDataTypeOf(field).SQL)}
+    case database.DRIVER_POSTGRES:
+        statements := []string{fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s;", table, column, db.Dialector.DataTypeOf(field))}
+        if field.NotNull {
+            statements = append(statements, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET NOT NULL;", table, column))
+        }
+        return statements
+    default:
+        return []string{fmt.Sprintf("-- %s cannot alter the column %s of %s, so the table must be recreated", db.Dialector.Name(), field.DBName, s.Table)}
+    }
+}
+
+// the SQL which the function would execute, without executing it
+func suggest(db *gorm.DB, f func(tx *gorm.DB) error) (statements []string) {
+    recorder := &sqlRecorder{}
+    defer func() {
+        if r := recover(); r != nil {
+            statements = []string{fmt.Sprintf("-- unable to suggest SQL: %v", r)}
+        }
+    }()
+    if err := f(db.Session(&gorm.Session{DryRun: true, NewDB: true, Logger: recorder})); err != nil {
+        return []string{fmt.Sprintf("-- unable to suggest SQL: %v", err)}
+    }
+    return recorder.statements
+}
+
+// the content of a migration which would remove the differences, as far as they can be suggested. it should be
+// reviewed before being used, e.g. because columns are not dropped.
+func SuggestedMigration(differences []Difference) string {
+    lines := []string{}
+    for _, d := range differences {
+        lines = append(lines, "-- "+d.String())
+        if d.Kind == DIFF_EXTRA_COLUMN {
+            lines = append(lines, "-- add the column to the model, or drop it if it is no longer used")
+        }
+        for _, statement := range d.SQL {
+            if !strings.HasSuffix(statement, ";") {
+                statement += ";"
+            }
+            lines = append(lines, statement)
+        }
+        lines = append(lines, "")
+    }
+    return strings.Join(lines, "\n")
+}
+
+// a gorm logger which records the SQL of each statement
+type sqlRecorder struct {
+    statements []string
+}
+
+func (r *sqlRecorder) LogMode(logger.LogLevel) logger.Interface      { return r }
+func (r *sqlRecorder) Info(context.Context, string, ...interface{})  {}
+func (r *sqlRecorder) Warn(context.Context, string, ...interface{})  {}
+func (r *sqlRecorder) Error(context.Context, string, ...interface{}) {}
+func (r *sqlRecorder) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+    if sql, _ := fc(); len(sql) > 0 {
+        r.statements = append(r.statements, sql)
+    }
+}
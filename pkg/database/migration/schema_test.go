@@ -0,0 +1,88 @@
+package migration
+
+import (
+    "path/filepath"
+    "testing"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database"
+    "github.com/stretchr/testify/assert"
+)
+
+type Widget struct {
+    Id    string `gorm:"primaryKey;type:varchar(36)"`
+    Name  string `gorm:"type:varchar(50);not null;index:idx_widget_name"`
+    Code  string `gorm:"type:varchar(20);uniqueIndex"`
+    Price int64  `gorm:"not null"`
+}
+
+type Gadget struct {
+    Id string `gorm:"primaryKey"`
+}
+
+func setupSchema(t *testing.T, ddl ...string) {
+    t.Setenv(database.STRATIS_DB_DRIVER, database.DRIVER_SQLITE)
+    t.Setenv("STRATIS_DB_NAME", "file:"+filepath.Join(t.TempDir(), "test.db"))
+    database.SetupDb()
+    for _, statement := range ddl {
+        assert.Nil(t, database.GetDb().Exec(statement).Error)
+    }
+}
+
+func TestVerifySchema_matches(t *testing.T) {
+    setupSchema(t)
+    assert.Nil(t, database.GetDb().AutoMigrate(&Widget{}))
+
+    // when
+    err := VerifySchema(&Widget{})
+
+    // then
+    assert.Nil(t, err)
+}
+
+func TestCompareSchema(t *testing.T) {
+    assert := assert.New(t)
+    setupSchema(t,
+        "CREATE TABLE widgets (id varchar(36) PRIMARY KEY, name varchar(40), code varchar(20), colour text)",
+        "CREATE UNIQUE INDEX idx_widgets_code ON widgets (code)",
+    )
+
+    // when
+    differences, err := CompareSchema(database.GetDb(), &Widget{}, &Gadget{})
+
+    // then
+    assert.Nil(err)
+    kinds := []string{}
+    for _, d := range differences {
+        kinds = append(kinds, d.String())
+    }
+    assert.Equal([]string{
+        "type widgets.name: expected varchar(50), but is varchar(40)",
+        "nullable widgets.name: expected not null, but is null",
+        "missing column widgets.price",
+        "extra column widgets.colour text",
+        "missing index widgets idx_widget_name",
+        "missing table gadgets",
+    }, kinds)
+
+    // when
+    err = VerifySchema(&Widget{}, &Gadget{})
+
+    // then
+    assert.ErrorContains(err, "STRATIS-1042 the database schema differs from the models in 6 ways")
+    assert.Equal(differences, err.(*SchemaDriftError).Differences)
+
+    // when
+    sql := SuggestedMigration(differences)
+
+    // then
+    assert.Contains(sql, "-- sqlite cannot alter the column name of widgets, so the table must be recreated;")
+    assert.Contains(sql, "ALTER TABLE `widgets` ADD `price` integer NOT NULL;")
+    assert.Contains(sql, "-- add the column to the model, or drop it if it is no longer used")
+    assert.Contains(sql, "CREATE INDEX `idx_widget_name` ON `widgets`(`name`);")
+    assert.Contains(sql, "CREATE TABLE `gadgets` (`id` text,PRIMARY KEY (`id`));")
+
+    // and nothing was changed
+    differences, err = CompareSchema(database.GetDb(), &Widget{}, &Gadget{})
+    assert.Nil(err)
+    assert.Len(differences, 6)
+}
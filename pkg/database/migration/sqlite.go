@@ -0,0 +1,123 @@
+package migration
+
+// a golang-migrate driver for the pure go sqlite used by the database package. golang-migrate's own sqlite driver
+// cannot be used, because it registers a different sqlite implementation under the same driver name.
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "io"
+    "sync/atomic"
+
+    "github.com/golang-migrate/migrate/v4/database"
+)
+
+const sqliteMigrationsTable = "schema_migrations"
+
+type sqliteDriver struct {
+    db       *sql.DB
+    isLocked atomic.Bool
+}
+
+func newSqliteDriver(db *sql.DB) (database.Driver, error) {
+    if err := db.Ping(); err != nil {
+        return nil, err
+    }
+    _, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (version INTEGER NOT NULL, dirty BOOLEAN NOT NULL);
+        CREATE UNIQUE INDEX IF NOT EXISTS version_unique ON %s (version);`, sqliteMigrationsTable, sqliteMigrationsTable))
+    if err != nil {
+        return nil, err
+    }
+    return &sqliteDriver{db: db}, nil
+}
+
+func (d *sqliteDriver) Open(url string) (database.Driver, error) {
+    return nil, errors.New("STRATIS-1019 the sqlite migration driver can only be used with an existing connection")
+}
+
+// does not close the connection, since it belongs to the database package
+func (d *sqliteDriver) Close() error {
+    return nil
+}
+
+// sqlite databases belong to a single process, so an in process lock suffices
+func (d *sqliteDriver) Lock() error {
+    if !d.isLocked.CompareAndSwap(false, true) {
+        return database.ErrLocked
+    }
+    return nil
+}
+
+func (d *sqliteDriver) Unlock() error {
+    if !d.isLocked.CompareAndSwap(true, false) {
+        return database.ErrNotLocked
+    }
+    return nil
+}
+
+func (d *sqliteDriver) Run(migration io.Reader) error {
+    query, err := io.ReadAll(migration)
+    if err != nil {
+        return err
+    }
+    tx, err := d.db.Begin()
+    if err != nil {
+        return err
+    }
+    if _, err := tx.Exec(string(query)); err != nil {
+        tx.Rollback()
+        return database.Error{OrigErr: err, Query: query}
+    }
+    return tx.Commit()
+}
+
+func (d *sqliteDriver) SetVersion(version int, dirty bool) error {
+    tx, err := d.db.Begin()
+    if err != nil {
+        return err
+    }
+    if _, err := tx.Exec("DELETE FROM " + sqliteMigrationsTable); err != nil {
+        tx.Rollback()
+        return err
+    }
+    // also re-write the schema version for nil dirty versions to prevent empty schema version for failed down migration on the first migration
+    if version >= 0 || (version == database.NilVersion && dirty) {
+        if _, err := tx.Exec("INSERT INTO "+sqliteMigrationsTable+" (version, dirty) VALUES (?, ?)", version, dirty); err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+func (d *sqliteDriver) Version() (version int, dirty bool, err error) {
+    err = d.db.QueryRow("SELECT version, dirty FROM " + sqliteMigrationsTable + " LIMIT 1").Scan(&version, &dirty)
+    if errors.Is(err, sql.ErrNoRows) {
+        return database.NilVersion, false, nil
+    }
+    return version, dirty, err
+}
+
+func (d *sqliteDriver) Drop() error {
+    rows, err := d.db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+    if err != nil {
+        return err
+    }
+    tables := []string{}
+    for rows.Next() {
+        var table string
+        if err := rows.Scan(&table); err != nil {
+            rows.Close()
+            return err
+        }
+        tables = append(tables, table)
+    }
+    rows.Close()
+    for _, table := range tables {
+        if _, err := d.db.Exec(`DROP TABLE "` + table + `"`); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,157 @@
+package paging
+
+// the request and response types for paging through lists, used by `database.Repository`, and by `ICtx.PageRequest()`
+// which parses them from the query params of a call:
+//
+//   - limit - the maximum number of items, between 1 and a maximum set by the service
+//   - cursor - the opaque cursor of the next or previous page, as returned in a Page, for keyset pagination
+//   - offset - the number of items to skip, for offset pagination
+//   - sort - a comma separated list of fields, each optionally prefixed with "-" for descending order, e.g. "-createdAt,name"
+//
+// which fields can be sorted by is decided by the repository, here only their syntax is checked.
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+const _MAX_CURSOR_LENGTH = 2048
+const _MAX_SORT_FIELDS = 5
+
+var ErrorInvalidPageRequest = errors.New("STRATIS-1029 invalid page request")
+
+var validField = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]{0,63}$`)
+
+type Sort struct {
+    Field string
+    Desc  bool
+}
+
+type Request struct {
+    Limit int
+
+    // the cursor of a previous Page, or "" for the first page. only used for keyset pagination.
+    Cursor string
+
+    // only used for offset pagination
+    Offset int
+
+    // empty for the default order of the repository
+    Sort []Sort
+}
+
+// the items of a page, and the cursors for getting the pages either side of it, if there are any
+type Page[T any] struct {
+    Items      []T    `json:"items"`
+    NextCursor string `json:"nextCursor,omitempty"`
+    PrevCursor string `json:"prevCursor,omitempty"`
+
+    // the total number of items, only for offset pagination
+    Total *int64 `json:"total,omitempty"`
+}
+
+// the content of an opaque cursor. it contains the sort order it was created for, so that it can't be used with a
+// different one, and the values of the sort fields of the item at the edge of the page.
+type Cursor struct {
+    Sort     string            `json:"s"`
+    Values   []json.RawMessage `json:"v"`
+    Backward bool              `json:"b,omitempty"`
+}
+
+// parses and validates the limit, cursor, offset and sort query params, using the given function to read them, e.g.
+// `ginCtx.Query`
+func Parse(query func(string) string, defaultLimit int, maxLimit int) (Request, error) {
+    request := Request{Limit: defaultLimit}
+    if s := query("limit"); len(s) > 0 {
+        limit, err := strconv.Atoi(s)
+        if err != nil || limit < 1 || limit > maxLimit {
+            return Request{}, fmt.Errorf("%w: limit must be a number between 1 and %d", ErrorInvalidPageRequest, maxLimit)
+        }
+        request.Limit = limit
+    }
+
+    if s := query("offset"); len(s) > 0 {
+        offset, err := strconv.Atoi(s)
+        if err != nil || offset < 0 {
+            return Request{}, fmt.Errorf("%w: offset must be a positive number", ErrorInvalidPageRequest)
+        }
+        request.Offset = offset
+    }
+
+    request.Cursor = query("cursor")
+    if len(request.Cursor) > 0 {
+        if request.Offset > 0 {
+            return Request{}, fmt.Errorf("%w: cursor and offset can't be used together", ErrorInvalidPageRequest)
+        }
+        if _, err := DecodeCursor(request.Cursor); err != nil {
+            return Request{}, err
+        }
+    }
+
+    sort, err := ParseSort(query("sort"))
+    if err != nil {
+        return Request{}, err
+    }
+    request.Sort = sort
+    return request, nil
+}
+
+// parses e.g. "-createdAt,name"
+func ParseSort(s string) ([]Sort, error) {
+    if len(s) == 0 {
+        return nil, nil
+    }
+    fields := strings.Split(s, ",")
+    if len(fields) > _MAX_SORT_FIELDS {
+        return nil, fmt.Errorf("%w: at most %d sort fields are allowed", ErrorInvalidPageRequest, _MAX_SORT_FIELDS)
+    }
+    sort := []Sort{}
+    for _, field := range fields {
+        field = strings.TrimSpace(field)
+        desc := strings.HasPrefix(field, "-")
+        field = strings.TrimPrefix(field, "-")
+        if !validField.MatchString(field) {
+            return nil, fmt.Errorf("%w: unable to sort by '%s'", ErrorInvalidPageRequest, field)
+        }
+        sort = append(sort, Sort{Field: field, Desc: desc})
+    }
+    return sort, nil
+}
+
+// the inverse of ParseSort
+func FormatSort(sort []Sort) string {
+    fields := []string{}
+    for _, s := range sort {
+        if s.Desc {
+            fields = append(fields, "-"+s.Field)
+        } else {
+            fields = append(fields, s.Field)
+        }
+    }
+    return strings.Join(fields, ",")
+}
+
+func (c Cursor) Encode() string {
+    data, _ := json.Marshal(c) // it only contains strings and JSON
+    return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeCursor(s string) (Cursor, error) {
+    cursor := Cursor{}
+    if len(s) > _MAX_CURSOR_LENGTH {
+        return cursor, fmt.Errorf("%w: the cursor is too long", ErrorInvalidPageRequest)
+    }
+    data, err := base64.RawURLEncoding.DecodeString(s)
+    if err != nil {
+        return cursor, fmt.Errorf("%w: the cursor is malformed", ErrorInvalidPageRequest)
+    }
+    if err := json.Unmarshal(data, &cursor); err != nil || len(cursor.Values) == 0 {
+        return cursor, fmt.Errorf("%w: the cursor is malformed", ErrorInvalidPageRequest)
+    }
+    return cursor, nil
+}
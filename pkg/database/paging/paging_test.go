@@ -0,0 +1,55 @@
+package paging
+
+import (
+    "encoding/json"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+    cursor := Cursor{Sort: "id", Values: []json.RawMessage{[]byte("1")}}.Encode()
+    tests := []struct {
+        name     string
+        params   map[string]string
+        expected Request
+        invalid  bool
+    }{
+        {name: "defaults", params: map[string]string{}, expected: Request{Limit: 20}},
+        {name: "all", params: map[string]string{"limit": "5", "cursor": cursor, "sort": "-createdAt, name"},
+            expected: Request{Limit: 5, Cursor: cursor, Sort: []Sort{{Field: "createdAt", Desc: true}, {Field: "name"}}}},
+        {name: "offset", params: map[string]string{"offset": "40"}, expected: Request{Limit: 20, Offset: 40}},
+        {name: "limit too big", params: map[string]string{"limit": "101"}, invalid: true},
+        {name: "limit zero", params: map[string]string{"limit": "0"}, invalid: true},
+        {name: "limit not a number", params: map[string]string{"limit": "x"}, invalid: true},
+        {name: "negative offset", params: map[string]string{"offset": "-1"}, invalid: true},
+        {name: "cursor and offset", params: map[string]string{"offset": "1", "cursor": cursor}, invalid: true},
+        {name: "malformed cursor", params: map[string]string{"cursor": "!"}, invalid: true},
+        {name: "injection in sort", params: map[string]string{"sort": "name;drop table x"}, invalid: true},
+        {name: "too many sort fields", params: map[string]string{"sort": "a,b,c,d,e,f"}, invalid: true},
+        {name: "empty sort field", params: map[string]string{"sort": "a,"}, invalid: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            assert := assert.New(t)
+            request, err := Parse(func(name string) string { return tt.params[name] }, 20, 100)
+            if tt.invalid {
+                assert.ErrorIs(err, ErrorInvalidPageRequest)
+            } else {
+                assert.Nil(err)
+                assert.Equal(tt.expected, request)
+            }
+        })
+    }
+}
+
+func TestCursor_roundTrip(t *testing.T) {
+    assert := assert.New(t)
+    cursor := Cursor{Sort: "-rank,id", Values: []json.RawMessage{[]byte("3"), []byte(`"x"`)}, Backward: true}
+
+    decoded, err := DecodeCursor(cursor.Encode())
+
+    assert.Nil(err)
+    assert.Equal(cursor, decoded)
+    assert.Equal("-rank,id", FormatSort([]Sort{{Field: "rank", Desc: true}, {Field: "id"}}))
+}
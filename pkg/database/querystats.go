@@ -0,0 +1,82 @@
+package database
+
+import (
+    "errors"
+    "fmt"
+    "slices"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "gorm.io/gorm"
+)
+
+const _QUERY_START = "stratis:query_stats:start"
+
+// records each statement run using `ctx.GetDb()` in the QueryStats of the ctx, so that they can be tied to the call,
+// see ICtx.GetQueryStats(). registered by SetupDb.
+type QueryStatsPlugin struct{}
+
+func (p *QueryStatsPlugin) Name() string {
+    return "stratis:query_stats"
+}
+
+func (p *QueryStatsPlugin) Initialize(db *gorm.DB) error {
+    callbacks := db.Callback()
+    return errors.Join(
+        callbacks.Create().Before("*").Register("stratis:query_stats:before_create", beforeStatement),
+        callbacks.Create().After("*").Register("stratis:query_stats:after_create", afterStatement),
+        callbacks.Query().Before("*").Register("stratis:query_stats:before_query", beforeStatement),
+        callbacks.Query().After("*").Register("stratis:query_stats:after_query", afterStatement),
+        callbacks.Update().Before("*").Register("stratis:query_stats:before_update", beforeStatement),
+        callbacks.Update().After("*").Register("stratis:query_stats:after_update", afterStatement),
+        callbacks.Delete().Before("*").Register("stratis:query_stats:before_delete", beforeStatement),
+        callbacks.Delete().After("*").Register("stratis:query_stats:after_delete", afterStatement),
+        callbacks.Row().Before("*").Register("stratis:query_stats:before_row", beforeStatement),
+        callbacks.Row().After("*").Register("stratis:query_stats:after_row", afterStatement),
+        callbacks.Raw().Before("*").Register("stratis:query_stats:before_raw", beforeStatement),
+        callbacks.Raw().After("*").Register("stratis:query_stats:after_raw", afterStatement),
+    )
+}
+
+func beforeStatement(db *gorm.DB) {
+    db.InstanceSet(_QUERY_START, time.Now())
+}
+
+func afterStatement(db *gorm.DB) {
+    if db.DryRun || db.Statement.SQL.Len() == 0 {
+        return
+    }
+    ctx, ok := fwctx.FromContext(db.Statement.Context)
+    if !ok {
+        return
+    }
+    start, ok := db.InstanceGet(_QUERY_START)
+    if !ok {
+        return
+    }
+    ctx.GetQueryStats().Record(db.Statement.SQL.String(), time.Since(start.(time.Time)))
+}
+
+// returns a warning for each threshold of the config which the statements of a call exceeded, see Config
+func QueryStatsWarnings(stats *fwctx.QueryStats) []string {
+    cfg := getConfig()
+    warnings := []string{}
+    if count := stats.Count(); cfg.RequestMaxQueries > 0 && count > cfg.RequestMaxQueries {
+        warnings = append(warnings, fmt.Sprintf("ran %d statements, more than the maximum of %d", count, cfg.RequestMaxQueries))
+    }
+    if duration := stats.Duration(); cfg.RequestMaxTime > 0 && duration > cfg.RequestMaxTime {
+        warnings = append(warnings, fmt.Sprintf("spent %s running statements, more than the maximum of %s", duration.Round(time.Millisecond), cfg.RequestMaxTime))
+    }
+    if cfg.RequestMaxRepeats > 0 {
+        repeated := stats.Repeated(cfg.RequestMaxRepeats)
+        statements := []string{}
+        for statement := range repeated {
+            statements = append(statements, statement)
+        }
+        slices.Sort(statements)
+        for _, statement := range statements {
+            warnings = append(warnings, fmt.Sprintf("ran the same statement %d times, which may be an N+1 problem: %s", repeated[statement], statement))
+        }
+    }
+    return warnings
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "github.com/glebarez/sqlite"
+    "github.com/stretchr/testify/assert"
+    "gorm.io/gorm"
+)
+
+func TestQueryStatsPlugin(t *testing.T) {
+    assert := assert.New(t)
+    file := filepath.Join(t.TempDir(), "test.db")
+    createThings(t, file, "existing")
+    testDb, err := gorm.Open(sqlite.Open(file), &gorm.Config{SkipDefaultTransaction: true})
+    assert.Nil(err)
+    assert.Nil(testDb.Use(&QueryStatsPlugin{}))
+    ctx := fwctx.BuildTypedCtxForTests(testDb, false)
+
+    // when
+    for i := 0; i < 3; i++ {
+        assert.Nil(ctx.GetDb().Create(&thing{Name: "new"}).Error)
+    }
+    readThings(ctx)
+    var count int64
+    assert.Nil(ctx.GetDb().Raw("SELECT COUNT(*) FROM things").Scan(&count).Error)
+    assert.Nil(testDb.Create(&thing{Name: "without ctx"}).Error)
+
+    // then
+    stats := ctx.GetQueryStats()
+    assert.Equal(5, stats.Count())
+    assert.Greater(stats.Duration(), time.Duration(0))
+    assert.Equal(map[string]int{"INSERT INTO `things` (`name`) VALUES (?) RETURNING `id`": 3}, stats.Repeated(2))
+    assert.Len(stats.Repeated(1), 3)
+}
+
+func TestQueryStatsWarnings(t *testing.T) {
+    previous := config
+    t.Cleanup(func() { config = previous })
+    stats := &fwctx.QueryStats{}
+    for i := 0; i < 3; i++ {
+        stats.Record("SELECT * FROM orders WHERE id = ?", 100*time.Millisecond)
+    }
+    stats.Record("SELECT * FROM customers", time.Millisecond)
+    tests := []struct {
+        name     string
+        config   Config
+        expected []string
+    }{
+        {name: "within the thresholds", config: Config{RequestMaxQueries: 4, RequestMaxTime: time.Second, RequestMaxRepeats: 4}, expected: []string{}},
+        {name: "disabled", config: Config{}, expected: []string{}},
+        {name: "exceeded", config: Config{RequestMaxQueries: 3, RequestMaxTime: 300 * time.Millisecond, RequestMaxRepeats: 3}, expected: []string{
+            "ran 4 statements, more than the maximum of 3",
+            "spent 301ms running statements, more than the maximum of 300ms",
+            "ran the same statement 3 times, which may be an N+1 problem: SELECT * FROM orders WHERE id = ?",
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            config = &tt.config
+
+            // when
+            warnings := QueryStatsWarnings(stats)
+
+            // then
+            assert.Equal(t, tt.expected, warnings)
+        })
+    }
+}
@@ -0,0 +1,245 @@
+package database
+
+// optional read replicas. if STRATIS_DB_REPLICAS is set, reads made with a non-transactional connection (e.g. one set up
+// by `NonTx` / `framework_gin.NonTxMiddleware`, or `GetDb()`) are sent to a healthy replica, while writes and everything
+// within `WithTx` go to the primary. e.g.
+//
+//     STRATIS_DB_REPLICAS=replica1.local,replica2.local:3307
+//
+// the username, password, name and params of the replicas are the same as those of the primary.
+//
+//   - STRATIS_DB_REPLICA_HEALTH_INTERVAL - how often the replicas are pinged, default "10s". a replica which fails
+//     is no longer used until it succeeds again. if no replica is healthy, the primary is used for reads.
+//   - STRATIS_DB_REPLICA_PIN_AFTER_WRITE - how long a client is pinned to the primary after a transactional call
+//     which wrote rows, e.g. "5s", so that it reads its own writes, despite replication lag. default "0", i.e. not
+//     pinned. see PinAfterWrite().
+//
+// within a single call, reads are automatically sent to the primary after a non-transactional write. use
+// `UsePrimary(ctx)` to do so explicitly.
+
+import (
+    "context"
+    "database/sql"
+    "math/rand"
+    "os"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "gorm.io/gorm"
+    "gorm.io/plugin/dbresolver"
+)
+
+const STRATIS_DB_REPLICAS = "STRATIS_DB_REPLICAS"
+
+// the name of the cookie used to pin a client to the primary, see PinAfterWrite()
+const PRIMARY_COOKIE_NAME = "stratis_db_primary"
+
+type replica struct {
+    address string
+    db      *sql.DB
+
+    // nil if healthy
+    lastError atomic.Pointer[error]
+}
+
+// the replicas of the current setup, replaced as a whole when the database is set up again, since they are read
+// concurrently, e.g. by the health checks and the resolver
+type replicaSet struct {
+    replicas      []*replica
+    pinAfterWrite time.Duration
+}
+
+var currentReplicas atomic.Pointer[replicaSet]
+
+// stops the periodic health checks of the replicas, so that they do not outlive a setup
+var stopHealthChecks context.CancelFunc
+
+// closed once the health checks have stopped
+var healthChecksDone chan struct{}
+
+func getReplicaAddresses() []string {
+    addresses := []string{}
+    for _, address := range strings.Split(os.Getenv(STRATIS_DB_REPLICAS), ",") {
+        if address = strings.TrimSpace(address); len(address) > 0 {
+            addresses = append(addresses, address)
+        }
+    }
+    return addresses
+}
+
+// opens the replicas and registers the resolver, which must happen before other plugins are registered, since
+// it opens a gorm.DB per replica, which would otherwise also initialise those plugins.
+func setupReplicas(db2 *gorm.DB, primary *sql.DB, dialect Dialect, openPool func(dsn string) *sql.DB) error {
+    if stopHealthChecks != nil {
+        stopHealthChecks() // those of the previous setup
+        stopHealthChecks = nil
+    }
+    addresses := getReplicaAddresses()
+    if len(addresses) == 0 {
+        currentReplicas.Store(nil)
+        return nil
+    }
+
+    set := &replicaSet{pinAfterWrite: getEnvDuration("STRATIS_DB_REPLICA_PIN_AFTER_WRITE", 0)}
+    dialectors := []gorm.Dialector{}
+    for _, address := range addresses {
+        r := &replica{address: address, db: openPool(dialect.ReplicaDSN(address))}
+        configurePool(r.db, getConfig(), address, "replica")
+        set.replicas = append(set.replicas, r)
+        dialectors = append(dialectors, dialect.Dialector(r.db))
+    }
+    // the primary is the last "replica", so that the policy can fall back to it
+    dialectors = append(dialectors, dialect.Dialector(primary))
+    currentReplicas.Store(set)
+
+    interval := getEnvDuration("STRATIS_DB_REPLICA_HEALTH_INTERVAL", 10*time.Second)
+
+    err := db2.Use(dbresolver.Register(dbresolver.Config{
+        Replicas: dialectors,
+        Policy:   dbresolver.PolicyFunc(resolveReplica),
+    }))
+    if err != nil {
+        return err
+    }
+
+    // pin the call or the client to the primary after a write, see afterWrite
+    if err := db2.Callback().Create().After("gorm:create").Register("stratis:replicas:create", afterWrite); err != nil {
+        return err
+    }
+    if err := db2.Callback().Update().After("gorm:update").Register("stratis:replicas:update", afterWrite); err != nil {
+        return err
+    }
+    if err := db2.Callback().Delete().After("gorm:delete").Register("stratis:replicas:delete", afterWrite); err != nil {
+        return err
+    }
+
+    CheckReplicas()
+    var ctx context.Context
+    ctx, stopHealthChecks = context.WithCancel(context.Background())
+    healthChecksDone = make(chan struct{})
+    go checkReplicasPeriodically(ctx, interval, healthChecksDone)
+    log.Info().Msgf("using %d read replicas %v", len(set.replicas), addresses)
+    return nil
+}
+
+func checkReplicasPeriodically(ctx context.Context, interval time.Duration, done chan struct{}) {
+    defer close(done)
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            CheckReplicas()
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+// the replicas of the current setup, nil if there are none
+func getReplicas() []*replica {
+    if set := currentReplicas.Load(); set != nil {
+        return set.replicas
+    }
+    return nil
+}
+
+// chooses a random healthy replica, or the primary, which is always last, if there are none
+func resolveReplica(pools []gorm.ConnPool) gorm.ConnPool {
+    healthy := []gorm.ConnPool{}
+    for _, r := range getReplicas() {
+        if r.lastError.Load() == nil {
+            healthy = append(healthy, r.db)
+        }
+    }
+    if len(healthy) == 0 {
+        return pools[len(pools)-1]
+    }
+    return healthy[rand.Intn(len(healthy))]
+}
+
+// pings all replicas and updates their health. called periodically, but can also be called e.g. by tests.
+func CheckReplicas() {
+    for _, r := range getReplicas() {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        err := r.db.PingContext(ctx)
+        cancel()
+
+        wasHealthy := r.lastError.Load() == nil
+        if err != nil {
+            r.lastError.Store(&err)
+            if wasHealthy {
+                log.Warn().Msgf("replica %s is unhealthy and will not be used: %+v", r.address, err)
+            }
+        } else {
+            r.lastError.Store(nil)
+            if !wasHealthy {
+                log.Info().Msgf("replica %s is healthy again", r.address)
+            }
+        }
+    }
+}
+
+// the health of each replica, "ok" or the error of the last check, by address. empty if there are no replicas.
+func ReplicaHealth() map[string]string {
+    health := map[string]string{}
+    for _, r := range getReplicas() {
+        if err := r.lastError.Load(); err != nil {
+            health[r.address] = (*err).Error()
+        } else {
+            health[r.address] = "ok"
+        }
+    }
+    return health
+}
+
+// the duration for which clients should be pinned to the primary after a transactional call which wrote rows, or zero
+// if they should not be, e.g. because there are no replicas. `framework_gin.TxMiddleware` sets the cookie when the
+// handler writes the status, if the transaction has written rows so far, the status is below 400, and it is not
+// marked as rollback only. since the headers are written before the transaction is committed, a client is also pinned
+// if the commit fails. writes made in a transaction of their own, e.g. with REQUIRES_NEW, are not seen by the
+// middleware, so handlers making them should call `framework_gin.PinToPrimary()`.
+func PinAfterWrite() time.Duration {
+    set := currentReplicas.Load()
+    if set == nil {
+        return 0
+    }
+    return set.pinAfterWrite
+}
+
+// sends all further reads of the ctx to the primary, so that it reads its own writes. does nothing if the ctx
+// is transactional, since transactions always use the primary.
+func UsePrimary(ctx fwctx.ICtx) {
+    if len(getReplicas()) > 0 && ctx.GetTx() == nil {
+        ctx.SetDb(db.Clauses(dbresolver.Write), false)
+    }
+}
+
+// marks the transaction as having written rows, so that the client can be pinned to the primary, see PinAfterWrite(),
+// or, outside of a transaction, sends the rest of the call to the primary
+func afterWrite(db *gorm.DB) {
+    if db.Error != nil {
+        return
+    }
+    ctx, ok := fwctx.FromContext(db.Statement.Context)
+    if !ok {
+        return
+    }
+    if isTransaction(db.Statement.ConnPool) {
+        if tx := ctx.GetTx(); tx != nil && db.RowsAffected > 0 {
+            tx.MarkWritten()
+        }
+        return
+    }
+    if _, pinned := db.Statement.Settings.Load("gorm:db_resolver:write"); !pinned {
+        log.Debug().Msgf("using the primary for the rest of the call, after a write to %s", db.Statement.Table)
+        UsePrimary(ctx)
+    }
+}
+
+func isTransaction(connPool gorm.ConnPool) bool {
+    _, ok := connPool.(gorm.TxCommitter)
+    return ok
+}
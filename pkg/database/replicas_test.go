@@ -0,0 +1,134 @@
+package database
+
+import (
+    "database/sql"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "github.com/stretchr/testify/assert"
+)
+
+type thing struct {
+    Id   int
+    Name string
+}
+
+func createThings(t *testing.T, file string, name string) {
+    sqlDb, err := sql.Open("sqlite", file)
+    assert.Nil(t, err)
+    defer sqlDb.Close()
+    _, err = sqlDb.Exec("CREATE TABLE things (id INTEGER PRIMARY KEY, name TEXT NOT NULL); INSERT INTO things (name) VALUES ('" + name + "');")
+    assert.Nil(t, err)
+}
+
+func readThings(ctx fwctx.ICtx) []string {
+    names := []string{}
+    ctx.GetDb().Model(&thing{}).Order("id").Pluck("name", &names)
+    return names
+}
+
+func TestReplicas(t *testing.T) {
+    assert := assert.New(t)
+    dir := t.TempDir()
+    primaryFile := filepath.Join(dir, "primary.db")
+    replicaFile := filepath.Join(dir, "replica.db")
+    createThings(t, primaryFile, "primary")
+    createThings(t, replicaFile, "replica")
+    t.Setenv(STRATIS_DB_DRIVER, DRIVER_SQLITE)
+    t.Setenv("STRATIS_DB_NAME", primaryFile)
+    t.Setenv(STRATIS_DB_REPLICAS, replicaFile)
+    t.Setenv("STRATIS_DB_REPLICA_HEALTH_INTERVAL", "1h")
+    t.Setenv("STRATIS_DB_REPLICA_PIN_AFTER_WRITE", "5s")
+    SetupDb()
+    assert.Equal(map[string]string{replicaFile: "ok"}, ReplicaHealth())
+    assert.Equal(5000000000, int(PinAfterWrite()))
+
+    // reads go to the replica
+    ctx := fwctx.BuildTypedCtxForTests(nil, false)
+    NonTx(ctx)
+    assert.Equal([]string{"replica"}, readThings(ctx))
+
+    // writes go to the primary, after which the call reads from the primary
+    assert.Nil(ctx.GetDb().Create(&thing{Name: "written"}).Error)
+    assert.Equal([]string{"primary", "written"}, readThings(ctx))
+
+    // transactions use the primary
+    ctx = fwctx.BuildTypedCtxForTests(nil, false)
+    _, err := WithTx(ctx, func() (any, error) {
+        return nil, ctx.GetDb().Create(&thing{Name: "tx"}).Error
+    })
+    assert.Nil(err)
+    ctx = fwctx.BuildTypedCtxForTests(nil, false)
+    NonTx(ctx)
+    assert.Equal([]string{"replica"}, readThings(ctx))
+    UsePrimary(ctx)
+    assert.Equal([]string{"primary", "written", "tx"}, readThings(ctx))
+
+    // unhealthy replicas are not used
+    getReplicas()[0].db.Close()
+    CheckReplicas()
+    assert.Equal(map[string]string{replicaFile: "sql: database is closed"}, ReplicaHealth())
+    ctx = fwctx.BuildTypedCtxForTests(nil, false)
+    NonTx(ctx)
+    assert.Equal([]string{"primary", "written", "tx"}, readThings(ctx))
+}
+
+func TestReplicas_healthChecksStopWhenSetUpAgain(t *testing.T) {
+    assert := assert.New(t)
+    dir := t.TempDir()
+    replicaFile := filepath.Join(dir, "replica.db")
+    createThings(t, replicaFile, "replica")
+    t.Setenv(STRATIS_DB_DRIVER, DRIVER_SQLITE)
+    t.Setenv("STRATIS_DB_NAME", filepath.Join(dir, "primary.db"))
+    t.Setenv(STRATIS_DB_REPLICAS, replicaFile)
+    t.Setenv("STRATIS_DB_REPLICA_HEALTH_INTERVAL", "10ms")
+    SetupDb()
+    done := healthChecksDone
+
+    // when
+    t.Setenv(STRATIS_DB_REPLICAS, "")
+    SetupDb()
+
+    // then
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        assert.Fail("the health checks of the previous setup are still running")
+    }
+    assert.Empty(ReplicaHealth())
+}
+
+func TestReplicas_setUpAgainWhileInUse(t *testing.T) {
+    dir := t.TempDir()
+    replicaFile := filepath.Join(dir, "replica.db")
+    createThings(t, replicaFile, "replica")
+    t.Setenv(STRATIS_DB_DRIVER, DRIVER_SQLITE)
+    t.Setenv("STRATIS_DB_NAME", filepath.Join(dir, "primary.db"))
+    t.Setenv(STRATIS_DB_REPLICAS, replicaFile)
+    t.Setenv("STRATIS_DB_REPLICA_HEALTH_INTERVAL", "1ms")
+    SetupDb()
+    stop := make(chan struct{})
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        for {
+            select {
+            case <-stop:
+                return
+            default:
+                ReplicaHealth()
+                PinAfterWrite()
+            }
+        }
+    }()
+
+    // when, e.g. in tests, which is reported by the race detector if it is not synchronised
+    SetupDb()
+    close(stop)
+    <-done
+
+    // then
+    assert.Equal(t, map[string]string{replicaFile: "ok"}, ReplicaHealth())
+}
@@ -0,0 +1,329 @@
+package database
+
+// a generic repository, for the CRUD code which every service would otherwise write against `ctx.GetDb()`, e.g.
+//
+//     var orders = database.NewRepository[Order, uint64]("CreatedAt", "Customer")
+//     ...
+//     request, err := ctx.PageRequest(20, 100)
+//     if err != nil { ... }
+//     page, err := orders.FindPage(ctx, request, database.Where("status = ?", "OPEN"))
+//
+// it uses the connection of the ctx, so that it takes part in the current transaction, and the tenancy plugin applies.
+// lists can be sorted by the fields which are whitelisted when the repository is created, plus the primary key, which
+// is always used as the final sort field, so that the order is stable. fields are identified by their go or json
+// name. sort fields used with keyset pagination should not be nullable.
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "reflect"
+    "slices"
+    "strings"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database/paging"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+    "gorm.io/gorm/schema"
+)
+
+const _DEFAULT_PAGE_LIMIT = 20
+
+// restricts the rows found by a repository, e.g. `database.Where("status = ?", "OPEN")`. any gorm scope can be used.
+type Filter = func(*gorm.DB) *gorm.DB
+
+func Where(query any, args ...any) Filter {
+    return func(db *gorm.DB) *gorm.DB {
+        return db.Where(query, args...)
+    }
+}
+
+type Repository[T any, ID comparable] struct {
+    // the go names of the fields which may be sorted by
+    sortable []string
+}
+
+// creates a repository for the model T, whose primary key is of type ID, and which can be sorted by the given fields,
+// identified by their go names
+func NewRepository[T any, ID comparable](sortable ...string) *Repository[T, ID] {
+    return &Repository[T, ID]{sortable: sortable}
+}
+
+// returns gorm.ErrRecordNotFound if there is no such entity
+func (r *Repository[T, ID]) FindByID(ctx fwctx.ICtx, id ID) (*T, error) {
+    db := ctx.GetDb()
+    pk, err := r.primaryKey(db)
+    if err != nil {
+        return nil, err
+    }
+    entity := new(T)
+    if err := db.Where(clause.Eq{Column: column(pk), Value: id}).First(entity).Error; err != nil {
+        return nil, err
+    }
+    return entity, nil
+}
+
+// returns all the entities matching the filters, ordered by their primary key
+func (r *Repository[T, ID]) FindAll(ctx fwctx.ICtx, filters ...Filter) ([]T, error) {
+    db := ctx.GetDb()
+    pk, err := r.primaryKey(db)
+    if err != nil {
+        return nil, err
+    }
+    entities := []T{}
+    err = db.Scopes(filters...).Order(clause.OrderByColumn{Column: column(pk)}).Find(&entities).Error
+    return entities, err
+}
+
+// inserts the entity if its primary key is zero, otherwise updates all its fields
+func (r *Repository[T, ID]) Save(ctx fwctx.ICtx, entity *T) error {
+    return ctx.GetDb().Save(entity).Error
+}
+
+// returns gorm.ErrRecordNotFound if there is no such entity
+func (r *Repository[T, ID]) Delete(ctx fwctx.ICtx, id ID) error {
+    db := ctx.GetDb()
+    pk, err := r.primaryKey(db)
+    if err != nil {
+        return err
+    }
+    result := db.Where(clause.Eq{Column: column(pk), Value: id}).Delete(new(T))
+    if result.Error != nil {
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        return gorm.ErrRecordNotFound
+    }
+    return nil
+}
+
+// returns a page of the entities matching the filters, using keyset pagination, i.e. the cursor of the request is
+// turned into a condition on the sort fields, which unlike an offset, is efficient and stable while rows are added
+// and removed. the offset of the request is ignored.
+func (r *Repository[T, ID]) FindPage(ctx fwctx.ICtx, request paging.Request, filters ...Filter) (paging.Page[T], error) {
+    page := paging.Page[T]{Items: []T{}}
+    db := ctx.GetDb()
+    columns, err := r.sortColumns(db, request.Sort)
+    if err != nil {
+        return page, err
+    }
+    spec := sortSpec(columns)
+    limit := pageLimit(request)
+
+    query := db.Model(new(T)).Scopes(filters...)
+    backward := false
+    if len(request.Cursor) > 0 {
+        cursor, err := paging.DecodeCursor(request.Cursor)
+        if err != nil {
+            return page, err
+        }
+        if cursor.Sort != spec {
+            return page, fmt.Errorf("%w: the cursor was created for a different sort order", paging.ErrorInvalidPageRequest)
+        }
+        values, err := cursorValues(columns, cursor)
+        if err != nil {
+            return page, err
+        }
+        backward = cursor.Backward
+        query = query.Where(keyset(columns, values, backward))
+    }
+
+    // one more than the limit, to find out whether there are more
+    items := []T{}
+    if err := query.Order(orderBy(columns, backward)).Limit(limit + 1).Find(&items).Error; err != nil {
+        return page, err
+    }
+    hasMore := len(items) > limit
+    if hasMore {
+        items = items[:limit]
+    }
+    if backward {
+        slices.Reverse(items)
+    }
+    page.Items = items
+    if len(items) == 0 {
+        return page, nil
+    }
+
+    if hasMore || backward {
+        if page.NextCursor, err = cursorOf(ctx, columns, spec, &items[len(items)-1], false); err != nil {
+            return page, err
+        }
+    }
+    if (len(request.Cursor) > 0 && !backward) || (backward && hasMore) {
+        if page.PrevCursor, err = cursorOf(ctx, columns, spec, &items[0], true); err != nil {
+            return page, err
+        }
+    }
+    return page, nil
+}
+
+// returns a page of the entities matching the filters, using the offset of the request, together with the total
+// number of matching entities. simpler for clients which jump to a page number, but slow for large offsets. the
+// cursor of the request is ignored.
+func (r *Repository[T, ID]) FindPageByOffset(ctx fwctx.ICtx, request paging.Request, filters ...Filter) (paging.Page[T], error) {
+    page := paging.Page[T]{Items: []T{}}
+    db := ctx.GetDb()
+    columns, err := r.sortColumns(db, request.Sort)
+    if err != nil {
+        return page, err
+    }
+
+    var total int64
+    if err := db.Model(new(T)).Scopes(filters...).Count(&total).Error; err != nil {
+        return page, err
+    }
+    page.Total = &total
+
+    err = db.Model(new(T)).Scopes(filters...).
+        Order(orderBy(columns, false)).
+        Offset(request.Offset).
+        Limit(pageLimit(request)).
+        Find(&page.Items).Error
+    return page, err
+}
+
+// ================================================================================================
+
+type sortColumn struct {
+    field *schema.Field
+    desc  bool
+}
+
+func (r *Repository[T, ID]) schema(db *gorm.DB) (*schema.Schema, error) {
+    stmt := &gorm.Statement{DB: db}
+    if err := stmt.Parse(new(T)); err != nil {
+        return nil, err
+    }
+    return stmt.Schema, nil
+}
+
+func (r *Repository[T, ID]) primaryKey(db *gorm.DB) (*schema.Field, error) {
+    s, err := r.schema(db)
+    if err != nil {
+        return nil, err
+    }
+    if s.PrioritizedPrimaryField == nil {
+        return nil, fmt.Errorf("STRATIS-1030 %s needs a single primary key to be used with a repository", s.Name)
+    }
+    return s.PrioritizedPrimaryField, nil
+}
+
+// resolves the requested sort fields against the whitelist, and adds the primary key as the final one
+func (r *Repository[T, ID]) sortColumns(db *gorm.DB, sort []paging.Sort) ([]sortColumn, error) {
+    pk, err := r.primaryKey(db)
+    if err != nil {
+        return nil, err
+    }
+    s, _ := r.schema(db) // already parsed successfully
+
+    columns := []sortColumn{}
+    hasPk := false
+    for _, requested := range sort {
+        field := r.sortableField(s, pk, requested.Field)
+        if field == nil {
+            return nil, fmt.Errorf("%w: unable to sort by '%s'", paging.ErrorInvalidPageRequest, requested.Field)
+        }
+        columns = append(columns, sortColumn{field: field, desc: requested.Desc})
+        if field == pk {
+            hasPk = true
+            break // it is unique, so further fields would make no difference
+        }
+    }
+    if !hasPk {
+        columns = append(columns, sortColumn{field: pk})
+    }
+    return columns, nil
+}
+
+// the field with the given go or json name, if it may be sorted by, otherwise nil
+func (r *Repository[T, ID]) sortableField(s *schema.Schema, pk *schema.Field, name string) *schema.Field {
+    for _, field := range s.Fields {
+        if len(field.DBName) == 0 || (field != pk && !slices.Contains(r.sortable, field.Name)) {
+            continue
+        }
+        jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+        if strings.EqualFold(field.Name, name) || (len(jsonName) > 0 && jsonName == name) {
+            return field
+        }
+    }
+    return nil
+}
+
+func column(field *schema.Field) clause.Column {
+    return clause.Column{Table: clause.CurrentTable, Name: field.DBName}
+}
+
+// identifies the sort order in cursors
+func sortSpec(columns []sortColumn) string {
+    sort := []paging.Sort{}
+    for _, c := range columns {
+        sort = append(sort, paging.Sort{Field: c.field.DBName, Desc: c.desc})
+    }
+    return paging.FormatSort(sort)
+}
+
+func pageLimit(request paging.Request) int {
+    if request.Limit <= 0 {
+        return _DEFAULT_PAGE_LIMIT
+    }
+    return request.Limit
+}
+
+// when paging backward, the order is reversed, and the results are reversed again afterwards
+func orderBy(columns []sortColumn, backward bool) clause.OrderBy {
+    orderBy := clause.OrderBy{}
+    for _, c := range columns {
+        orderBy.Columns = append(orderBy.Columns, clause.OrderByColumn{Column: column(c.field), Desc: c.desc != backward})
+    }
+    return orderBy
+}
+
+// the condition for rows after the given values, in the order of the columns, i.e. for columns a, b:
+// `a > ? OR (a = ? AND b > ?)`
+func keyset(columns []sortColumn, values []any, backward bool) clause.Expression {
+    or := []clause.Expression{}
+    for i, c := range columns {
+        and := []clause.Expression{}
+        for j := 0; j < i; j++ {
+            and = append(and, clause.Eq{Column: column(columns[j].field), Value: values[j]})
+        }
+        if c.desc != backward {
+            and = append(and, clause.Lt{Column: column(c.field), Value: values[i]})
+        } else {
+            and = append(and, clause.Gt{Column: column(c.field), Value: values[i]})
+        }
+        or = append(or, clause.And(and...))
+    }
+    return clause.Or(or...)
+}
+
+// decodes the values of the cursor into the types of the fields, so that they are bound correctly
+func cursorValues(columns []sortColumn, cursor paging.Cursor) ([]any, error) {
+    if len(cursor.Values) != len(columns) {
+        return nil, fmt.Errorf("%w: the cursor is malformed", paging.ErrorInvalidPageRequest)
+    }
+    values := []any{}
+    for i, c := range columns {
+        value := reflect.New(c.field.FieldType)
+        if err := json.Unmarshal(cursor.Values[i], value.Interface()); err != nil {
+            return nil, errors.Join(fmt.Errorf("%w: the cursor is malformed", paging.ErrorInvalidPageRequest), err)
+        }
+        values = append(values, value.Elem().Interface())
+    }
+    return values, nil
+}
+
+func cursorOf[T any](ctx fwctx.ICtx, columns []sortColumn, spec string, item *T, backward bool) (string, error) {
+    cursor := paging.Cursor{Sort: spec, Backward: backward}
+    for _, c := range columns {
+        value, _ := c.field.ValueOf(ctx.GetDb().Statement.Context, reflect.ValueOf(item).Elem())
+        data, err := json.Marshal(value)
+        if err != nil {
+            return "", err
+        }
+        cursor.Values = append(cursor.Values, data)
+    }
+    return cursor.Encode(), nil
+}
@@ -0,0 +1,137 @@
+package database
+
+import (
+    "encoding/json"
+    "path/filepath"
+    "testing"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database/paging"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "github.com/glebarez/sqlite"
+    "github.com/stretchr/testify/assert"
+    "gorm.io/gorm"
+)
+
+type item struct {
+    Id     uint64
+    Name   string
+    Rank   int `json:"rank"`
+    Secret string
+}
+
+var items = NewRepository[item, uint64]("Name", "Rank")
+
+// a ctx with a new database containing items a to g, where some ranks are the same
+func setupItems(t *testing.T) fwctx.ICtx {
+    testDb, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{SkipDefaultTransaction: true})
+    assert.Nil(t, err)
+    assert.Nil(t, testDb.AutoMigrate(&item{}))
+    ctx := fwctx.BuildTypedCtxForTests(testDb, false)
+    for i, rank := range []int{3, 1, 2, 3, 1, 3, 2} {
+        assert.Nil(t, items.Save(ctx, &item{Name: string(rune('a' + i)), Rank: rank}))
+    }
+    return ctx
+}
+
+func names(page paging.Page[item]) []string {
+    names := []string{}
+    for _, i := range page.Items {
+        names = append(names, i.Name)
+    }
+    return names
+}
+
+func TestRepository_crud(t *testing.T) {
+    assert := assert.New(t)
+    ctx := setupItems(t)
+
+    found, err := items.FindByID(ctx, 2)
+    assert.Nil(err)
+    assert.Equal("b", found.Name)
+
+    found.Name = "B"
+    assert.Nil(items.Save(ctx, found))
+    all, err := items.FindAll(ctx, Where("rank = ?", 1))
+    assert.Nil(err)
+    assert.Equal([]item{{Id: 2, Name: "B", Rank: 1}, {Id: 5, Name: "e", Rank: 1}}, all)
+
+    assert.Nil(items.Delete(ctx, 2))
+    _, err = items.FindByID(ctx, 2)
+    assert.ErrorIs(err, gorm.ErrRecordNotFound)
+    assert.ErrorIs(items.Delete(ctx, 2), gorm.ErrRecordNotFound)
+}
+
+func TestRepository_findPage(t *testing.T) {
+    assert := assert.New(t)
+    ctx := setupItems(t)
+    sort, err := paging.ParseSort("-rank")
+    assert.Nil(err)
+
+    // when paging forward
+    first, err := items.FindPage(ctx, paging.Request{Limit: 3, Sort: sort})
+    assert.Nil(err)
+    second, err := items.FindPage(ctx, paging.Request{Limit: 3, Sort: sort, Cursor: first.NextCursor})
+    assert.Nil(err)
+    third, err := items.FindPage(ctx, paging.Request{Limit: 3, Sort: sort, Cursor: second.NextCursor})
+    assert.Nil(err)
+
+    // then ties are broken by the id
+    assert.Equal([]string{"a", "d", "f"}, names(first))
+    assert.Empty(first.PrevCursor)
+    assert.Equal([]string{"c", "g", "b"}, names(second))
+    assert.Equal([]string{"e"}, names(third))
+    assert.Empty(third.NextCursor)
+    assert.Nil(third.Total)
+
+    // when paging backward
+    back, err := items.FindPage(ctx, paging.Request{Limit: 3, Sort: sort, Cursor: third.PrevCursor})
+    assert.Nil(err)
+    assert.Equal([]string{"c", "g", "b"}, names(back))
+    back, err = items.FindPage(ctx, paging.Request{Limit: 3, Sort: sort, Cursor: back.PrevCursor})
+    assert.Nil(err)
+    assert.Equal([]string{"a", "d", "f"}, names(back))
+    assert.Empty(back.PrevCursor)
+    assert.Equal(first.NextCursor, back.NextCursor)
+
+    // with a filter
+    filtered, err := items.FindPage(ctx, paging.Request{Limit: 3, Sort: sort}, Where("rank < ?", 3))
+    assert.Nil(err)
+    assert.Equal([]string{"c", "g", "b"}, names(filtered))
+}
+
+func TestRepository_findPage_invalid(t *testing.T) {
+    ctx := setupItems(t)
+    byName, _ := paging.ParseSort("name")
+    bySecret, _ := paging.ParseSort("secret")
+    first, err := items.FindPage(ctx, paging.Request{Limit: 1, Sort: byName})
+    assert.Nil(t, err)
+
+    tests := []struct {
+        name    string
+        request paging.Request
+    }{
+        {name: "not whitelisted", request: paging.Request{Sort: bySecret}},
+        {name: "cursor for another sort order", request: paging.Request{Cursor: first.NextCursor}},
+        {name: "malformed cursor", request: paging.Request{Cursor: "nonsense"}},
+        {name: "tampered cursor", request: paging.Request{Sort: byName, Cursor: paging.Cursor{Sort: "name,id", Values: []json.RawMessage{[]byte(`{}`), []byte(`1`)}}.Encode()}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := items.FindPage(ctx, tt.request)
+            assert.ErrorIs(t, err, paging.ErrorInvalidPageRequest)
+        })
+    }
+}
+
+func TestRepository_findPageByOffset(t *testing.T) {
+    assert := assert.New(t)
+    ctx := setupItems(t)
+    sort, _ := paging.ParseSort("rank,-name")
+
+    page, err := items.FindPageByOffset(ctx, paging.Request{Limit: 2, Offset: 2, Sort: sort})
+
+    assert.Nil(err)
+    assert.Equal([]string{"g", "c"}, names(page))
+    assert.Equal(int64(7), *page.Total)
+    assert.Empty(page.NextCursor)
+}
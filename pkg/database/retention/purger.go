@@ -0,0 +1,143 @@
+package retention
+
+import (
+    "context"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/tenancy"
+    "github.com/prometheus/client_golang/prometheus"
+    "gorm.io/gorm"
+)
+
+type PurgerOptions struct {
+    // how often the policies are applied, default 24h
+    Interval time.Duration
+
+    // the maximum number of rows changed in one transaction, default 500
+    BatchSize int
+}
+
+func (o PurgerOptions) withDefaults() PurgerOptions {
+    if o.Interval <= 0 {
+        o.Interval = 24 * time.Hour
+    }
+    if o.BatchSize <= 0 {
+        o.BatchSize = 500
+    }
+    return o
+}
+
+// applies the retention policies of the given models. several purgers, e.g. one per instance of the service, can run
+// at the same time, since a row which has already been changed by another one no longer matches the stage.
+type Purger struct {
+    policies []*policy
+    opts     PurgerOptions
+}
+
+// returns an error wrapping ErrorInvalidPolicy if the policy of a model cannot be applied to it
+func NewPurger(opts PurgerOptions, models ...Retained) (*Purger, error) {
+    p := &Purger{opts: opts.withDefaults()}
+    for _, model := range models {
+        policy, err := newPolicy(database.GetDb(), model)
+        if err != nil {
+            return nil, err
+        }
+        p.policies = append(p.policies, policy)
+    }
+    return p, nil
+}
+
+// applies the policies every interval, starting immediately, until the context is done
+func (p *Purger) Start(ctx context.Context) {
+    log.Info().Msgf("starting retention purger with interval %s", p.opts.Interval)
+    ticker := time.NewTicker(p.opts.Interval)
+    defer ticker.Stop()
+    for {
+        if _, err := p.Run(ctx); err != nil {
+            log.Error().Msgf("unable to apply the retention policies: %+v", err)
+        }
+        select {
+        case <-ctx.Done():
+            log.Info().Msg("stopping retention purger")
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// applies each stage of each policy, in batches, and returns the number of rows each one affected. a policy which
+// fails does not stop the others from being applied, and the first error is returned.
+func (p *Purger) Run(ctx context.Context) ([]Result, error) {
+    return p.run(ctx, false)
+}
+
+// returns the number of rows which each stage of each policy would affect, without changing anything. since the
+// stages build on each other, e.g. rows are only hard deleted some time after being soft deleted, the rows of later
+// stages are counted as they are now.
+func (p *Purger) DryRun(ctx context.Context) ([]Result, error) {
+    return p.run(ctx, true)
+}
+
+func (p *Purger) run(ctx context.Context, dryRun bool) ([]Result, error) {
+    results := []Result{}
+    var firstErr error
+    now := time.Now().UTC()
+    for _, policy := range p.policies {
+        for _, action := range policy.actions() {
+            var rows int64
+            var err error
+            if dryRun {
+                err = policy.scope(tenancy.CrossTenant(database.GetDb().WithContext(ctx)), action, now).Count(&rows).Error
+            } else {
+                rows, err = p.apply(ctx, policy, action, now)
+            }
+            results = append(results, Result{Policy: policy.Name, Action: action, Rows: rows})
+            if err != nil {
+                log.Error().Msgf("unable to %s %s after %d rows: %+v", action, policy.Name, rows, err)
+                if failuresCounter != nil {
+                    failuresCounter.With(prometheus.Labels{"policy": policy.Name, "action": action}).Inc()
+                }
+                if firstErr == nil {
+                    firstErr = err
+                }
+            } else if rows > 0 && !dryRun {
+                log.Info().Msgf("retention policy %s: %s %d rows", policy.Name, action, rows)
+            }
+        }
+    }
+    return results, firstErr
+}
+
+// applies the stage in batches until no rows are left, returning the number of rows which were changed
+func (p *Purger) apply(ctx context.Context, policy *policy, action string, now time.Time) (int64, error) {
+    fwCtx := fwctx.BuildTypedCtxNoDbNoGin("retention", "retention", []string{})
+    total := int64(0)
+    for ctx.Err() == nil {
+        result, err := database.WithTx(fwCtx, func() (any, error) {
+            ids := []any{}
+            // the policies apply to all tenants. a new session, since the db is used for several statements
+            db := tenancy.CrossTenant(fwCtx.GetDb()).Session(&gorm.Session{})
+            if err := policy.scope(db, action, now).Order(policy.pk.DBName).Limit(p.opts.BatchSize).Pluck(policy.pk.DBName, &ids).Error; err != nil {
+                return int64(0), err
+            }
+            if len(ids) == 0 {
+                return int64(0), nil
+            }
+            return policy.apply(db, action, ids, now)
+        })
+        if err != nil {
+            return total, err
+        }
+        n := result.(int64)
+        total += n
+        if rowsCounter != nil && n > 0 {
+            rowsCounter.With(prometheus.Labels{"policy": policy.Name, "action": action}).Add(float64(n))
+        }
+        if n < int64(p.opts.BatchSize) {
+            break
+        }
+    }
+    return total, ctx.Err()
+}
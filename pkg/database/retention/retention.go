@@ -0,0 +1,242 @@
+package retention
+
+// data retention, e.g. to delete or anonymise personal data after a period, as required by the GDPR. an entity
+// declares its policy by implementing Retained, e.g.
+//
+//     type Customer struct {
+//         Id        uint64
+//         Email     *string
+//         Name      string
+//         CreatedAt time.Time
+//         DeletedAt gorm.DeletedAt
+//     }
+//
+//     func (Customer) RetentionPolicy() retention.Policy {
+//         return retention.Policy{
+//             AnonymiseAfter:  90 * 24 * time.Hour,
+//             Anonymise:       map[string]any{"email": nil, "name": "anonymous"},
+//             SoftDeleteAfter: 365 * 24 * time.Hour,
+//             HardDeleteAfter: 30 * 24 * time.Hour,
+//         }
+//     }
+//
+// and a Purger runs the policies in the background, e.g.
+//
+//     retention.SetupMetrics("myservice")
+//     purger, err := retention.NewPurger(retention.PurgerOptions{}, &Customer{}, &Order{})
+//     ...
+//     go purger.Start(context.Background())
+//
+// each stage of a policy is applied in batches of rows, each in its own transaction using `database.WithTx()`, so that
+// locks are only held briefly, and the entity plugin sees the changes. the audit plugin only records soft deletes,
+// since it would otherwise keep the values which are anonymised or deleted. the statements are cross tenant, so that
+// the policies apply to the rows of all tenants if the tenancy plugin is used. DryRun() reports how many rows each
+// stage would affect, without changing anything.
+//
+// the audit trail itself can be purged too, e.g.
+//
+//     purger, err := retention.NewPurger(retention.PurgerOptions{}, &Customer{}, retention.AuditEvents(2*365*24*time.Hour))
+
+import (
+    "errors"
+    "fmt"
+    "reflect"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/audit"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+    "gorm.io/gorm"
+    "gorm.io/gorm/schema"
+)
+
+// the stages of a policy, in the order in which they are applied
+const ACTION_ANONYMISE = "anonymise"
+const ACTION_SOFT_DELETE = "soft-delete"
+const ACTION_HARD_DELETE = "hard-delete"
+
+const _DEFAULT_AGE_COLUMN = "created_at"
+
+var ErrorInvalidPolicy = errors.New("STRATIS-1043 invalid retention policy")
+
+var log = logging.GetLog("retention")
+
+var rowsCounter *prometheus.CounterVec
+var failuresCounter *prometheus.CounterVec
+
+// enables the retention metrics
+func SetupMetrics(prefix string) {
+    rowsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: prefix + "_retention_rows_count",
+        Help: "The total number of rows which were anonymised or deleted by retention policies",
+    }, []string{"policy", "action"})
+
+    failuresCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: prefix + "_retention_failed_count",
+        Help: "The total number of times a retention policy failed to be applied",
+    }, []string{"policy", "action"})
+}
+
+// implemented by entities which have a retention policy
+type Retained interface {
+    RetentionPolicy() Policy
+}
+
+// how long the rows of an entity are kept. each stage is optional, but at least one is needed.
+type Policy struct {
+    // used in logs, metrics and reports, default the name of the table
+    Name string
+
+    // the column containing the time from which the age of a row is measured, default "created_at"
+    AgeColumn string
+
+    // only rows matching this condition are affected, e.g. "status = ?" with the args "CLOSED", optional
+    Where string
+    Args  []any
+
+    // the columns which are set to the given values, e.g. nil, once a row is older than AnonymiseAfter. rows which
+    // already have those values are not changed again.
+    Anonymise      map[string]any
+    AnonymiseAfter time.Duration
+
+    // rows older than this are soft deleted, which needs a field of type gorm.DeletedAt
+    SoftDeleteAfter time.Duration
+
+    // rows are deleted for good this long after being soft deleted, or, for entities without a gorm.DeletedAt field,
+    // once they are older than this
+    HardDeleteAfter time.Duration
+}
+
+// the number of rows which a stage of a policy affected, or would affect in a dry run
+type Result struct {
+    Policy string `json:"policy"`
+    Action string `json:"action"`
+    Rows   int64  `json:"rows"`
+}
+
+// a policy of a model, validated against its schema
+type policy struct {
+    Policy
+    model     any
+    schema    *schema.Schema
+    pk        *schema.Field
+    deletedAt *schema.Field
+}
+
+var deletedAtType = reflect.TypeOf(gorm.DeletedAt{})
+
+func newPolicy(db *gorm.DB, model Retained) (*policy, error) {
+    stmt := &gorm.Statement{DB: db}
+    if err := stmt.Parse(model); err != nil {
+        return nil, err
+    }
+    p := &policy{Policy: model.RetentionPolicy(), model: model, schema: stmt.Schema, pk: stmt.Schema.PrioritizedPrimaryField}
+    if len(p.Name) == 0 {
+        p.Name = stmt.Schema.Table
+    }
+    if len(p.AgeColumn) == 0 {
+        p.AgeColumn = _DEFAULT_AGE_COLUMN
+    }
+    for _, field := range stmt.Schema.Fields {
+        if field.FieldType == deletedAtType {
+            p.deletedAt = field
+        }
+    }
+
+    switch {
+    case p.pk == nil:
+        return nil, fmt.Errorf("%w %s: the entity needs a single primary key", ErrorInvalidPolicy, p.Name)
+    case stmt.Schema.LookUpField(p.AgeColumn) == nil:
+        return nil, fmt.Errorf("%w %s: the entity has no column %s", ErrorInvalidPolicy, p.Name, p.AgeColumn)
+    case p.AnonymiseAfter <= 0 && p.SoftDeleteAfter <= 0 && p.HardDeleteAfter <= 0:
+        return nil, fmt.Errorf("%w %s: it has no stages", ErrorInvalidPolicy, p.Name)
+    case p.AnonymiseAfter > 0 && len(p.Anonymise) == 0:
+        return nil, fmt.Errorf("%w %s: the columns to anonymise are missing", ErrorInvalidPolicy, p.Name)
+    case p.SoftDeleteAfter > 0 && p.deletedAt == nil:
+        return nil, fmt.Errorf("%w %s: soft deleting needs a field of type gorm.DeletedAt", ErrorInvalidPolicy, p.Name)
+    }
+    for column := range p.Anonymise {
+        if stmt.Schema.LookUpField(column) == nil {
+            return nil, fmt.Errorf("%w %s: the entity has no column %s to anonymise", ErrorInvalidPolicy, p.Name, column)
+        }
+    }
+    return p, nil
+}
+
+// the stages of the policy, in the order in which they are applied
+func (p *policy) actions() []string {
+    actions := []string{}
+    if p.AnonymiseAfter > 0 {
+        actions = append(actions, ACTION_ANONYMISE)
+    }
+    if p.SoftDeleteAfter > 0 {
+        actions = append(actions, ACTION_SOFT_DELETE)
+    }
+    if p.HardDeleteAfter > 0 {
+        actions = append(actions, ACTION_HARD_DELETE)
+    }
+    return actions
+}
+
+// the rows affected by the given stage, including soft deleted ones, since their data is still there
+func (p *policy) scope(db *gorm.DB, action string, now time.Time) *gorm.DB {
+    query := db.Model(p.model).Unscoped()
+    if len(p.Where) > 0 {
+        query = query.Where(p.Where, p.Args...)
+    }
+    age := p.schema.LookUpField(p.AgeColumn).DBName
+    switch action {
+    case ACTION_ANONYMISE:
+        query = query.Where(fmt.Sprintf("%s < ?", age), now.Add(-p.AnonymiseAfter))
+        // only rows which are not anonymised yet
+        notAnonymised := db.Session(&gorm.Session{NewDB: true})
+        for column, value := range p.Anonymise {
+            name := p.schema.LookUpField(column).DBName
+            if value == nil {
+                notAnonymised = notAnonymised.Or(fmt.Sprintf("%s IS NOT NULL", name))
+            } else {
+                notAnonymised = notAnonymised.Or(fmt.Sprintf("%s <> ?", name), value)
+            }
+        }
+        query = query.Where(notAnonymised)
+    case ACTION_SOFT_DELETE:
+        query = query.Where(fmt.Sprintf("%s < ? AND %s IS NULL", age, p.deletedAt.DBName), now.Add(-p.SoftDeleteAfter))
+    case ACTION_HARD_DELETE:
+        if p.deletedAt != nil {
+            query = query.Where(fmt.Sprintf("%s < ?", p.deletedAt.DBName), now.Add(-p.HardDeleteAfter))
+        } else {
+            query = query.Where(fmt.Sprintf("%s < ?", age), now.Add(-p.HardDeleteAfter))
+        }
+    }
+    return query
+}
+
+// applies the stage to the rows with the given primary keys
+func (p *policy) apply(db *gorm.DB, action string, ids []any, now time.Time) (int64, error) {
+    query := db.Model(p.model).Unscoped().Where(fmt.Sprintf("%s IN ?", p.pk.DBName), ids)
+    var result *gorm.DB
+    switch action {
+    case ACTION_ANONYMISE:
+        result = audit.Skip(query).Updates(p.Anonymise)
+    case ACTION_SOFT_DELETE:
+        result = query.Update(p.deletedAt.DBName, now)
+    default:
+        result = audit.Skip(query).Delete(p.model)
+    }
+    return result.RowsAffected, result.Error
+}
+
+// the events of the audit trail, which are deleted once they are older than the given period
+func AuditEvents(after time.Duration) Retained {
+    return &auditEvents{after: after}
+}
+
+type auditEvents struct {
+    audit.Event
+    after time.Duration
+}
+
+func (a auditEvents) RetentionPolicy() Policy {
+    return Policy{Name: "audit", AgeColumn: "time", HardDeleteAfter: a.after}
+}
@@ -0,0 +1,240 @@
+package retention
+
+import (
+    "context"
+    "fmt"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/audit"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/tenancy"
+    "github.com/stretchr/testify/assert"
+    "gorm.io/gorm"
+)
+
+const day = 24 * time.Hour
+
+type customer struct {
+    Id        uint64
+    Email     *string
+    Name      string
+    CreatedAt time.Time
+    DeletedAt gorm.DeletedAt
+    database.Versioned
+}
+
+func (customer) RetentionPolicy() Policy {
+    return Policy{
+        Anonymise:       map[string]any{"email": nil, "name": "anonymous"},
+        AnonymiseAfter:  90 * day,
+        SoftDeleteAfter: 365 * day,
+        HardDeleteAfter: 30 * day,
+    }
+}
+
+type event struct {
+    Id         uint64
+    Kind       string
+    OccurredAt time.Time
+}
+
+func (event) RetentionPolicy() Policy {
+    return Policy{Name: "old events", AgeColumn: "occurred_at", Where: "kind = ?", Args: []any{"login"}, HardDeleteAfter: 7 * day}
+}
+
+type note struct {
+    Id        uint64
+    TenantId  string
+    CreatedAt time.Time
+}
+
+func (note) RetentionPolicy() Policy {
+    return Policy{HardDeleteAfter: 7 * day}
+}
+
+type invalid struct {
+    Id        uint64
+    CreatedAt time.Time
+    policy    Policy
+}
+
+func (i invalid) RetentionPolicy() Policy {
+    return i.policy
+}
+
+func setupRetention(t *testing.T) {
+    t.Setenv(database.STRATIS_DB_DRIVER, database.DRIVER_SQLITE)
+    t.Setenv("STRATIS_DB_NAME", "file:"+filepath.Join(t.TempDir(), "test.db"))
+    database.SetupDb()
+    assert.Nil(t, database.GetDb().AutoMigrate(&customer{}, &event{}))
+
+    now := time.Now().UTC()
+    for i, age := range []time.Duration{10 * day, 100 * day, 200 * day, 400 * day, 500 * day} {
+        email := fmt.Sprintf("c%d@example.com", i)
+        c := customer{Email: &email, Name: fmt.Sprintf("customer %d", i), CreatedAt: now.Add(-age)}
+        assert.Nil(t, database.GetDb().Create(&c).Error)
+    }
+    // soft deleted long ago
+    assert.Nil(t, database.GetDb().Model(&customer{}).Where("id = 5").Update("deleted_at", now.Add(-40*day)).Error)
+
+    for _, e := range []event{{Kind: "login", OccurredAt: now.Add(-8 * day)}, {Kind: "login", OccurredAt: now}, {Kind: "order", OccurredAt: now.Add(-8 * day)}} {
+        assert.Nil(t, database.GetDb().Create(&e).Error)
+    }
+}
+
+func TestPurger(t *testing.T) {
+    assert := assert.New(t)
+    setupRetention(t)
+    purger, err := NewPurger(PurgerOptions{BatchSize: 2}, &customer{}, &event{})
+    assert.Nil(err)
+    expected := []Result{
+        {Policy: "customers", Action: ACTION_ANONYMISE, Rows: 4},
+        {Policy: "customers", Action: ACTION_SOFT_DELETE, Rows: 1},
+        {Policy: "customers", Action: ACTION_HARD_DELETE, Rows: 1},
+        {Policy: "old events", Action: ACTION_HARD_DELETE, Rows: 1},
+    }
+
+    // when
+    results, err := purger.DryRun(context.Background())
+
+    // then nothing is changed
+    assert.Nil(err)
+    assert.Equal(expected, results)
+    var count int64
+    assert.Nil(database.GetDb().Unscoped().Model(&customer{}).Where("email IS NOT NULL").Count(&count).Error)
+    assert.Equal(int64(5), count)
+
+    // when
+    results, err = purger.Run(context.Background())
+
+    // then
+    assert.Nil(err)
+    assert.Equal(expected, results)
+    customers := []customer{}
+    assert.Nil(database.GetDb().Unscoped().Order("id").Find(&customers).Error)
+    assert.Len(customers, 4)
+    assert.Equal("customer 0", customers[0].Name)
+    assert.NotNil(customers[0].Email)
+    for _, c := range customers[1:] {
+        assert.Equal("anonymous", c.Name)
+        assert.Nil(c.Email)
+    }
+    // changed using the entity plugin
+    assert.Equal([]int64{1, 2, 2, 3}, []int64{customers[0].Version, customers[1].Version, customers[2].Version, customers[3].Version})
+    assert.False(customers[2].DeletedAt.Valid)
+    assert.True(customers[3].DeletedAt.Valid)
+    kinds := []string{}
+    assert.Nil(database.GetDb().Model(&event{}).Order("id").Pluck("kind", &kinds).Error)
+    assert.Equal([]string{"login", "order"}, kinds)
+
+    // when run again
+    results, err = purger.Run(context.Background())
+
+    // then there is nothing left to do
+    assert.Nil(err)
+    for _, r := range results {
+        assert.Equal(int64(0), r.Rows, r.Policy+" "+r.Action)
+    }
+}
+
+func TestNewPurger_invalidPolicies(t *testing.T) {
+    tests := []struct {
+        name     string
+        policy   Policy
+        expected string
+    }{
+        {name: "no stages", policy: Policy{}, expected: "it has no stages"},
+        {name: "unknown age column", policy: Policy{AgeColumn: "updated_at", HardDeleteAfter: day}, expected: "the entity has no column updated_at"},
+        {name: "nothing to anonymise", policy: Policy{AnonymiseAfter: day}, expected: "the columns to anonymise are missing"},
+        {name: "unknown column to anonymise", policy: Policy{AnonymiseAfter: day, Anonymise: map[string]any{"email": nil}}, expected: "the entity has no column email to anonymise"},
+        {name: "soft delete without DeletedAt", policy: Policy{SoftDeleteAfter: day}, expected: "soft deleting needs a field of type gorm.DeletedAt"},
+    }
+    setupRetention(t)
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            // when
+            _, err := NewPurger(PurgerOptions{}, invalid{policy: tt.policy})
+
+            // then
+            assert.ErrorIs(t, err, ErrorInvalidPolicy)
+            assert.ErrorContains(t, err, "STRATIS-1043 invalid retention policy invalids: "+tt.expected)
+        })
+    }
+}
+
+func TestPurger_personalDataIsNotAudited(t *testing.T) {
+    assert := assert.New(t)
+    setupRetention(t)
+    s := &audit.MemorySink{}
+    previous := audit.GetSink()
+    audit.SetSink(s)
+    defer audit.SetSink(previous)
+    assert.Nil(database.GetDb().Use(&audit.Plugin{Entities: []any{&customer{}}}))
+    purger, err := NewPurger(PurgerOptions{}, &customer{})
+    assert.Nil(err)
+
+    // when
+    _, err = purger.Run(context.Background())
+
+    // then only the soft delete is recorded, without the anonymised values
+    assert.Nil(err)
+    events := s.Events()
+    assert.Len(events, 1)
+    assert.Equal(audit.ACTION_UPDATE, events[0].Action)
+    assert.Equal("4", events[0].EntityId)
+    assert.Contains(events[0].Changes, "deleted_at")
+    assert.NotContains(events[0].Changes, "email")
+    assert.NotContains(events[0].Changes, "name")
+}
+
+func TestPurger_appliesToAllTenants(t *testing.T) {
+    assert := assert.New(t)
+    setupRetention(t)
+    assert.Nil(database.GetDb().AutoMigrate(&note{}))
+    now := time.Now().UTC()
+    for _, n := range []note{{TenantId: "t1", CreatedAt: now.Add(-8 * day)}, {TenantId: "t2", CreatedAt: now.Add(-8 * day)}, {TenantId: "t2", CreatedAt: now}} {
+        assert.Nil(database.GetDb().Create(&n).Error)
+    }
+    assert.Nil(database.GetDb().Use(&tenancy.Plugin{Column: "tenant_id"}))
+    purger, err := NewPurger(PurgerOptions{}, &note{})
+    assert.Nil(err)
+
+    // when
+    dryRun, err := purger.DryRun(context.Background())
+    assert.Nil(err)
+    results, err := purger.Run(context.Background())
+
+    // then
+    assert.Nil(err)
+    assert.Equal([]Result{{Policy: "notes", Action: ACTION_HARD_DELETE, Rows: 2}}, dryRun)
+    assert.Equal(dryRun, results)
+    var count int64
+    assert.Nil(tenancy.CrossTenant(database.GetDb()).Model(&note{}).Count(&count).Error)
+    assert.Equal(int64(1), count)
+}
+
+func TestAuditEvents(t *testing.T) {
+    assert := assert.New(t)
+    setupRetention(t)
+    up, _, err := audit.MigrationSQL(database.DRIVER_SQLITE)
+    assert.Nil(err)
+    assert.Nil(database.GetDb().Exec(up).Error)
+    now := time.Now().UTC()
+    for _, e := range []audit.Event{{Time: now.Add(-400 * day), Kind: audit.KIND_DATA}, {Time: now, Kind: audit.KIND_DATA}} {
+        assert.Nil(database.GetDb().Create(&e).Error)
+    }
+    purger, err := NewPurger(PurgerOptions{}, AuditEvents(365*day))
+    assert.Nil(err)
+
+    // when
+    results, err := purger.Run(context.Background())
+
+    // then
+    assert.Nil(err)
+    assert.Equal([]Result{{Policy: "audit", Action: ACTION_HARD_DELETE, Rows: 1}}, results)
+    var count int64
+    assert.Nil(database.GetDb().Model(&audit.Event{}).Count(&count).Error)
+    assert.Equal(int64(1), count)
+}
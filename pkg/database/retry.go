@@ -0,0 +1,121 @@
+package database
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math/rand"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "github.com/glebarez/go-sqlite"
+    "github.com/go-sql-driver/mysql"
+    "github.com/jackc/pgx/v5/pgconn"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/trace"
+)
+
+const _DEFAULT_RETRY_BACKOFF = 20 * time.Millisecond
+const _MAX_RETRY_BACKOFF = 2 * time.Second
+
+var retriesCounter *prometheus.CounterVec
+var retriesExhaustedCounter *prometheus.CounterVec
+
+// enables the database metrics
+func SetupMetrics(prefix string) {
+    retriesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: prefix + "_db_tx_retry_count",
+        Help: "The total number of times a transaction was retried, by the code of the error which caused it",
+    }, []string{"code"})
+
+    retriesExhaustedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: prefix + "_db_tx_retries_exhausted_count",
+        Help: "The total number of transactions which still failed after being retried, by the code of the last error",
+    }, []string{"code"})
+}
+
+// returns true if the error is a transient one, where the transaction was rolled back by the database and can simply be
+// run again, i.e. a deadlock, a lock wait timeout or a serialization failure
+func IsRetryable(err error) bool {
+    _, retryable := retryableCode(err)
+    return retryable
+}
+
+// returns the code of a retryable error, used as a metrics label
+func retryableCode(err error) (string, bool) {
+    var mysqlErr *mysql.MySQLError
+    var pgErr *pgconn.PgError
+    var sqliteErr *sqlite.Error
+    switch {
+    case errors.As(err, &mysqlErr):
+        // 1213 deadlock, 1205 lock wait timeout
+        return fmt.Sprintf("mysql-%d", mysqlErr.Number), mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+    case errors.As(err, &pgErr):
+        // 40001 serialization_failure, 40P01 deadlock_detected
+        return "postgres-" + pgErr.Code, pgErr.Code == "40001" || pgErr.Code == "40P01"
+    case errors.As(err, &sqliteErr):
+        // 5 SQLITE_BUSY, 6 SQLITE_LOCKED
+        code := sqliteErr.Code() & 0xff // without the extended code
+        return fmt.Sprintf("sqlite-%d", code), code == 5 || code == 6
+    }
+    return "", false
+}
+
+// starts a new transaction, and starts another one to run the function again, if it fails with a retryable error,
+// up to opts.Retries times
+func withNewTxRetrying(ctx fwctx.ICtx, opts TxOptions, f func() (any, error)) (any, error) {
+    backoff := opts.RetryBackoff
+    if backoff <= 0 {
+        backoff = _DEFAULT_RETRY_BACKOFF
+    }
+    goCtx := context.Background()
+    if ctx.GetGinCtx() != nil {
+        goCtx = ctx.GetGinCtx().Request.Context()
+    }
+
+    for attempt := 1; ; attempt++ {
+        result, err := withNewTx(ctx, opts, f)
+        code, retryable := retryableCode(err)
+        if err == nil || !retryable {
+            return result, err
+        }
+
+        if attempt > opts.Retries {
+            if opts.Retries == 0 {
+                return nil, err // retrying is not enabled
+            }
+            if retriesExhaustedCounter != nil {
+                retriesExhaustedCounter.With(prometheus.Labels{"code": code}).Inc()
+            }
+            return nil, fmt.Errorf("STRATIS-1024 transaction failed after %d attempts: %w", attempt, err)
+        }
+
+        // exponential, with jitter, so that the transactions which deadlocked don't simply do so again
+        wait := backoff
+        for i := 1; i < attempt && wait < _MAX_RETRY_BACKOFF; i++ {
+            wait *= 2
+        }
+        wait = min(wait, _MAX_RETRY_BACKOFF)
+        wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+
+        ctx.Warn("retrying transaction in %s after attempt %d failed with %s: %+v", wait, attempt, code, err)
+        if retriesCounter != nil {
+            retriesCounter.With(prometheus.Labels{"code": code}).Inc()
+        }
+        trace.SpanFromContext(goCtx).AddEvent("db.tx.retry", trace.WithAttributes(
+            attribute.Int("attempt", attempt),
+            attribute.String("code", code),
+            attribute.String("backoff", wait.String()),
+        ))
+
+        timer := time.NewTimer(wait)
+        select {
+        case <-goCtx.Done():
+            timer.Stop()
+            return nil, errors.Join(err, goCtx.Err())
+        case <-timer.C:
+        }
+    }
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+    "errors"
+    "fmt"
+    "testing"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "github.com/go-sql-driver/mysql"
+    "github.com/jackc/pgx/v5/pgconn"
+    "github.com/stretchr/testify/assert"
+)
+
+func TestIsRetryable(t *testing.T) {
+    tests := []struct {
+        err      error
+        expected bool
+    }{
+        {&mysql.MySQLError{Number: 1213}, true},
+        {&mysql.MySQLError{Number: 1205}, true},
+        {fmt.Errorf("wrapped: %w", &mysql.MySQLError{Number: 1213}), true},
+        {&mysql.MySQLError{Number: 1062}, false},
+        {&pgconn.PgError{Code: "40001"}, true},
+        {&pgconn.PgError{Code: "40P01"}, true},
+        {&pgconn.PgError{Code: "23505"}, false},
+        {errors.New("other"), false},
+        {nil, false},
+    }
+    for _, test := range tests {
+        assert.Equal(t, test.expected, IsRetryable(test.err), "%v", test.err)
+    }
+}
+
+func TestWithTxOpts_retries(t *testing.T) {
+    deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}
+    tests := []struct {
+        name             string
+        retries          int
+        failures         int
+        err              error
+        joined           bool
+        expectedAttempts int
+        expectedErr      string
+        expected         []string
+    }{
+        {name: "succeeds after retrying", retries: 2, failures: 2, err: deadlock, expectedAttempts: 3, expected: []string{"existing", "attempt 3"}},
+        {name: "retries exhausted", retries: 1, failures: 5, err: deadlock, expectedAttempts: 2, expectedErr: "STRATIS-1024 transaction failed after 2 attempts: Error 1213: Deadlock found", expected: []string{"existing"}},
+        {name: "not enabled", retries: 0, failures: 1, err: deadlock, expectedAttempts: 1, expectedErr: "Error 1213: Deadlock found", expected: []string{"existing"}},
+        {name: "not retryable", retries: 2, failures: 1, err: errorForTest, expectedAttempts: 1, expectedErr: "for test", expected: []string{"existing"}},
+        {name: "not retried when joined", retries: 2, failures: 1, err: deadlock, joined: true, expectedAttempts: 1, expectedErr: "Error 1213: Deadlock found", expected: []string{"existing"}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            assert := assert.New(t)
+            setupTestDb(t)
+            ctx := fwctx.BuildTypedCtxForTests(db, false)
+            opts := TxOptions{Retries: test.retries, RetryBackoff: 1}
+
+            attempts := 0
+            unitOfWork := func() (any, error) {
+                attempts++
+                assert.Nil(ctx.GetDb().Create(&thing{Name: fmt.Sprintf("attempt %d", attempts)}).Error)
+                if attempts <= test.failures {
+                    return nil, test.err
+                }
+                return attempts, nil
+            }
+
+            var err error
+            if test.joined {
+                WithTx(ctx, func() (any, error) {
+                    _, err = WithTxOpts(ctx, opts, unitOfWork)
+                    return nil, nil // i.e. the error is handled, but the transaction is rolled back anyway
+                })
+            } else {
+                _, err = WithTxOpts(ctx, opts, unitOfWork)
+            }
+
+            assert.Equal(test.expectedAttempts, attempts)
+            if len(test.expectedErr) > 0 {
+                assert.EqualError(err, test.expectedErr)
+            } else {
+                assert.Nil(err)
+            }
+            assert.Equal(test.expected, readThings(ctx))
+        })
+    }
+}
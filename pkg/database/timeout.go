@@ -0,0 +1,49 @@
+package database
+
+import (
+    "fmt"
+    "time"
+
+    "gorm.io/gorm"
+    "gorm.io/hints"
+)
+
+const _MAX_EXECUTION_TIME_SETTING = "stratis:max_execution_time"
+
+// returns the timeouts to use for the transaction, taking the defaults from the Config. zero means none.
+func (opts TxOptions) timeouts() (time.Duration, time.Duration) {
+    cfg := getConfig()
+    timeout, statementTimeout := opts.Timeout, opts.StatementTimeout
+    if timeout == 0 {
+        timeout = cfg.TxTimeout
+    }
+    if statementTimeout == 0 {
+        statementTimeout = cfg.StatementTimeout
+    }
+    return max(timeout, 0), max(statementTimeout, 0)
+}
+
+// limits the duration of each statement of the new transaction. with postgres, `statement_timeout` is set for the
+// transaction. with mysql, the `MAX_EXECUTION_TIME` optimizer hint is added to each select, see registerMaxExecutionTime.
+// not supported by sqlite.
+func applyStatementTimeout(conn *gorm.DB, timeout time.Duration) (*gorm.DB, error) {
+    switch conn.Dialector.Name() {
+    case DRIVER_MYSQL:
+        return conn.Set(_MAX_EXECUTION_TIME_SETTING, timeout.Milliseconds()), nil
+    case DRIVER_POSTGRES:
+        return conn, conn.Session(&gorm.Session{}).Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", timeout.Milliseconds())).Error
+    default:
+        log.Debug().Msgf("statement timeouts are not supported by %s", conn.Dialector.Name())
+        return conn, nil
+    }
+}
+
+// registers a callback which adds the `MAX_EXECUTION_TIME` optimizer hint to selects made within a transaction which has
+// a statement timeout. mysql only supports it for selects.
+func registerMaxExecutionTime(db *gorm.DB) error {
+    return db.Callback().Query().Before("gorm:query").Register("stratis:max_execution_time", func(db *gorm.DB) {
+        if ms, ok := db.Get(_MAX_EXECUTION_TIME_SETTING); ok {
+            hints.New(fmt.Sprintf("MAX_EXECUTION_TIME(%d)", ms)).ModifyStatement(db.Statement)
+        }
+    })
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+    "context"
+    "errors"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "github.com/gin-gonic/gin"
+    "github.com/stretchr/testify/assert"
+    gorm_mysql "gorm.io/driver/mysql"
+    "gorm.io/gorm"
+)
+
+func TestTxOptions_timeouts(t *testing.T) {
+    previous := config
+    config = &Config{TxTimeout: 30 * time.Second, StatementTimeout: 5 * time.Second}
+    t.Cleanup(func() { config = previous })
+    tests := []struct {
+        opts                     TxOptions
+        expectedTimeout          time.Duration
+        expectedStatementTimeout time.Duration
+    }{
+        {TxOptions{}, 30 * time.Second, 5 * time.Second},
+        {TxOptions{Timeout: time.Second, StatementTimeout: time.Millisecond}, time.Second, time.Millisecond},
+        {TxOptions{Timeout: -1, StatementTimeout: -1}, 0, 0},
+    }
+    for _, test := range tests {
+        timeout, statementTimeout := test.opts.timeouts()
+        assert.Equal(t, test.expectedTimeout, timeout)
+        assert.Equal(t, test.expectedStatementTimeout, statementTimeout)
+    }
+}
+
+func TestWithTxOpts_timeout(t *testing.T) {
+    tests := []struct {
+        name            string
+        writeAfterSleep bool
+        expectedErr     string
+    }{
+        {name: "exceeded while busy", expectedErr: "STRATIS-1025 the transaction timed out after 20ms"},
+        {name: "exceeded before a statement", writeAfterSleep: true, expectedErr: "STRATIS-1025 the transaction timed out after 20ms: context deadline exceeded"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            assert := assert.New(t)
+            setupTestDb(t)
+            ctx := fwctx.BuildTypedCtxForTests(db, false)
+
+            _, err := WithTxOpts(ctx, TxOptions{Timeout: 20 * time.Millisecond}, func() (any, error) {
+                if err := ctx.GetDb().Create(&thing{Name: "before"}).Error; err != nil {
+                    return nil, err
+                }
+                time.Sleep(50 * time.Millisecond)
+                if test.writeAfterSleep {
+                    return nil, ctx.GetDb().Create(&thing{Name: "after"}).Error
+                }
+                return nil, nil
+            })
+
+            assert.True(errors.Is(err, ErrorTxTimeout))
+            assert.EqualError(err, test.expectedErr)
+            assert.Equal([]string{"existing"}, readThings(ctx))
+        })
+    }
+}
+
+func TestWithTxOpts_withinTimeout(t *testing.T) {
+    assert := assert.New(t)
+    setupTestDb(t)
+    ctx := fwctx.BuildTypedCtxForTests(db, false)
+
+    _, err := WithTxOpts(ctx, TxOptions{Timeout: time.Minute}, func() (any, error) {
+        return nil, ctx.GetDb().Create(&thing{Name: "written"}).Error
+    })
+
+    assert.Nil(err)
+    assert.Equal([]string{"existing", "written"}, readThings(ctx))
+}
+
+func TestWithTxOpts_timeoutIgnoresCancelledRequest(t *testing.T) {
+    assert := assert.New(t)
+    setupTestDb(t)
+    gin.SetMode(gin.TestMode)
+    c, _ := gin.CreateTestContext(httptest.NewRecorder())
+    requestCtx, cancel := context.WithCancel(context.Background())
+    c.Request = httptest.NewRequest("POST", "/things", nil).WithContext(requestCtx)
+    ctx := fwctx.BuildTypedCtx(c, nil)
+    ctx.SetDb(db, false)
+
+    // when the client disconnects during the transaction
+    _, err := WithTxOpts(ctx, TxOptions{Timeout: time.Minute}, func() (any, error) {
+        cancel()
+        return nil, ctx.GetDb().Create(&thing{Name: "written"}).Error
+    })
+
+    // then
+    assert.Nil(err)
+    assert.Equal([]string{"existing", "written"}, readThings(fwctx.BuildTypedCtxForTests(db, false)))
+}
+
+func TestMaxExecutionTime(t *testing.T) {
+    assert := assert.New(t)
+    mysqlDb, err := gorm.Open(gorm_mysql.New(gorm_mysql.Config{DSN: "user:password@tcp(localhost:3306)/app", SkipInitializeWithVersion: true}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+    assert.Nil(err)
+    assert.Nil(registerMaxExecutionTime(mysqlDb))
+
+    withTimeout, err := applyStatementTimeout(mysqlDb, 1500*time.Millisecond)
+    assert.Nil(err)
+    stmt := withTimeout.Find(&[]thing{}).Statement
+    assert.Equal("SELECT /*+ MAX_EXECUTION_TIME(1500) */ * FROM `things`", stmt.SQL.String())
+
+    stmt = mysqlDb.Find(&[]thing{}).Statement
+    assert.Equal("SELECT * FROM `things`", stmt.SQL.String())
+}
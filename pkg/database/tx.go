@@ -0,0 +1,265 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "gorm.io/gorm"
+)
+
+// how a call to WithTxOpts relates to the transaction which the ctx is already taking part in, if any. modelled on
+// JTA / Quarkus `@Transactional`.
+type Propagation int
+
+const (
+    // joins the current transaction, or starts a new one if there is none. the default.
+    REQUIRED Propagation = iota
+
+    // suspends the current transaction, if there is one, and starts a new one, which is committed or rolled back
+    // independently. the current transaction is resumed afterwards.
+    REQUIRES_NEW
+
+    // creates a savepoint in the current transaction, which is rolled back to if the function fails or calls
+    // SetRollbackOnly(), without rolling back the current transaction. starts a new transaction if there is none.
+    NESTED
+
+    // joins the current transaction, and fails with ErrorNoTransaction if there is none
+    MANDATORY
+
+    // runs without a transaction, and fails with ErrorTransactionExists if there is one
+    NEVER
+)
+
+var ErrorNoTransaction = errors.New("STRATIS-1021 a transaction is mandatory, but there is none")
+var ErrorTransactionExists = errors.New("STRATIS-1022 a transaction is not allowed, but there is one")
+var ErrorTxTimeout = errors.New("STRATIS-1025 the transaction timed out")
+
+type TxOptions struct {
+    Propagation Propagation
+
+    // the maximum number of times a new transaction is retried, if it fails with an error for which IsRetryable() is
+    // true, e.g. a deadlock. only use this for functions which can safely be run again, i.e. which have no side effects
+    // outside of the transaction. ignored when the transaction is joined or nested, since only the whole transaction
+    // can be retried, by whoever started it.
+    Retries int
+
+    // the wait before the first retry, which doubles for each further retry, plus jitter. default 20ms.
+    RetryBackoff time.Duration
+
+    // the maximum duration of a new transaction, after which it is rolled back and ErrorTxTimeout is returned. zero
+    // means the default from Config.TxTimeout is used, and a negative value means there is no timeout. ignored when the
+    // transaction is joined or nested. the deadline is applied to the context of the transaction's statements.
+    Timeout time.Duration
+
+    // the maximum duration of each statement of a new transaction, see applyStatementTimeout. zero means the default
+    // from Config.StatementTimeout is used, and a negative value means there is no timeout.
+    StatementTimeout time.Duration
+}
+
+// calls the function with the given transaction propagation. the state of each transaction is kept in an fwctx.Tx,
+// which is set into the ctx while the function runs, so that `ctx.GetDb()` returns the transaction.
+//
+// when joining a transaction, an error returned by the function marks the transaction as rollback only, as a runtime
+// exception does with JTA, so that its partial changes are not committed, even if the caller handles the error. use
+// NESTED for a call whose failure the caller may recover from. a panic always causes the transaction to be rolled back.
+func WithTxOpts(ctx fwctx.ICtx, opts TxOptions, f func() (any, error)) (any, error) {
+    current := ctx.GetTx()
+    switch opts.Propagation {
+    case REQUIRED:
+        if current != nil {
+            return join(current, f)
+        }
+        return withNewTxRetrying(ctx, opts, f)
+    case REQUIRES_NEW:
+        return withNewTxRetrying(ctx, opts, f)
+    case NESTED:
+        if current != nil {
+            return withSavepoint(ctx, current, f)
+        }
+        return withNewTxRetrying(ctx, opts, f)
+    case MANDATORY:
+        if current == nil {
+            return nil, ErrorNoTransaction
+        }
+        return join(current, f)
+    case NEVER:
+        if current != nil {
+            return nil, ErrorTransactionExists
+        }
+        return f()
+    default:
+        return nil, fmt.Errorf("STRATIS-1023 unknown transaction propagation %d", opts.Propagation)
+    }
+}
+
+// calls the function in the current transaction, which is marked as rollback only if the function fails
+func join(current *fwctx.Tx, f func() (any, error)) (any, error) {
+    result, err := f()
+    if err != nil {
+        current.SetRollbackOnly()
+    }
+    return result, err
+}
+
+// starts a new transaction, suspending the current one if there is one, until the function has completed
+func withNewTx(ctx fwctx.ICtx, opts TxOptions, f func() (any, error)) (result any, err error) {
+    // https://gorm.io/docs/transactions.html#A-Specific-Example
+
+    timeout, statementTimeout := opts.timeouts()
+    parent := context.Background()
+    if ctx.GetGinCtx() != nil {
+        parent = ctx.GetGinCtx().Request.Context()
+    }
+
+    // Note the use of tx as the database handle once you are within a transaction
+    var conn *gorm.DB
+    var timeoutCtx context.Context
+    if timeout > 0 {
+        // database/sql rolls the transaction back as soon as the deadline is exceeded, releasing its locks, even if
+        // the function is busy doing something else. only the deadline applies, not the cancellation of the request,
+        // e.g. when the client disconnects, just as without a timeout.
+        var cancel context.CancelFunc
+        timeoutCtx, cancel = context.WithTimeout(context.WithoutCancel(parent), timeout)
+        defer cancel()
+        conn = db.WithContext(timeoutCtx).Begin()
+    } else {
+        conn = Begin()
+
+        // propagate otel context from request to statement, so that when db is called, it results in child spans.
+        // I found this: https://dev.to/vmihailenco/monitoring-gin-and-gorm-with-opentelemetry-53o0
+        //   tx.WithContext(c.Request.Context())
+        // But it doesn't work
+        // so go with home brewed version, discovered by debugging:
+        conn.Statement.Context = parent
+    }
+    if conn.Error != nil {
+        return nil, conn.Error
+    }
+    if statementTimeout > 0 {
+        if conn, err = applyStatementTimeout(conn, statementTimeout); err != nil {
+            Rollback(conn)
+            return nil, err
+        }
+    }
+
+    suspended := ctx.GetTx()
+    tx := fwctx.NewTx(conn)
+    log.Debug().Msgf("begin TX %d", tx.Id)
+    ctx.SetTx(tx)
+    committed := false
+    defer func() {
+        // resume the suspended transaction, or return to the non-transactional connection, before calling the hooks,
+        // so that they can use the ctx
+        ctx.SetTx(suspended)
+        if committed {
+            tx.RunAfterCommitHooks()
+        } else {
+            tx.RunAfterRollbackHooks()
+        }
+    }()
+
+    defer func() {
+        // rollback if there was a panic
+        if r := recover(); r != nil {
+            if err := Rollback(conn); err != nil {
+                log.Error().Msgf("unable to rollback TX %d while handling an error: %+v", tx.Id, err)
+            }
+            panic(r) // propagate the error up to gin, so that it can turn it into a failure
+        }
+    }()
+
+    // call the callback. when called from TxMiddleware, result and err are both nil, because all it does is call c.Next()
+    result, err = f()
+
+    if timeoutCtx != nil && timeoutCtx.Err() == context.DeadlineExceeded {
+        log.Warn().Msgf("rolling back TX %d because it took longer than %s", tx.Id, timeout)
+        if err2 := Rollback(conn); err2 != nil && !errors.Is(err2, sql.ErrTxDone) {
+            log.Error().Msgf("unable to rollback TX %d %+v", tx.Id, err2)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("%w after %s: %w", ErrorTxTimeout, timeout, err)
+        }
+        return nil, fmt.Errorf("%w after %s", ErrorTxTimeout, timeout)
+    } else if tx.IsRollbackOnly() {
+        log.Info().Msgf("rolling back TX %d because ctx.IsRollbackOnly is marked as true", tx.Id)
+        if err2 := Rollback(conn); err2 != nil {
+            log.Error().Msgf("unable to rollback TX %d %+v", tx.Id, err2)
+        }
+        return result, err
+    } else if err != nil { // rollback if there was an error
+        log.Info().Msgf("rolling back TX %d because of error: %+v", tx.Id, err)
+        if err2 := Rollback(conn); err2 != nil {
+            log.Error().Msgf("unable to rollback TX %d %+v", tx.Id, err2)
+        }
+        return nil, err
+    }
+
+    // commit and return any error which occurs
+    err = Commit(conn)
+    if err != nil && timeoutCtx != nil && timeoutCtx.Err() == context.DeadlineExceeded {
+        log.Warn().Msgf("unable to commit TX %d because it took longer than %s", tx.Id, timeout)
+        err = fmt.Errorf("%w after %s: %w", ErrorTxTimeout, timeout, err)
+    } else if err != nil {
+        log.Error().Msgf("unable to commit TX %d %+v", tx.Id, err)
+    } else {
+        committed = true
+        log.Debug().Msgf("committed TX %d", tx.Id)
+    }
+    return result, err
+}
+
+// runs the function within a savepoint of the current transaction, with its own fwctx.Tx, so that it can be rolled
+// back on its own
+func withSavepoint(ctx fwctx.ICtx, parent *fwctx.Tx, f func() (any, error)) (result any, err error) {
+    tx := parent.Nested()
+    savepoint := tx.Savepoint()
+    // a session, so that errors are not added to the parent's connection
+    if err := parent.Db.Session(&gorm.Session{}).SavePoint(savepoint).Error; err != nil {
+        return nil, err
+    }
+    log.Debug().Msgf("created savepoint %s in TX %d", savepoint, parent.Id)
+    ctx.SetTx(tx)
+    released := false
+    defer func() {
+        ctx.SetTx(parent)
+        if released {
+            tx.MergeHooksIntoParent()
+        } else {
+            tx.RunAfterRollbackHooks()
+        }
+    }()
+
+    rollbackTo := func(reason string) {
+        log.Info().Msgf("rolling back to savepoint %s in TX %d because %s", savepoint, parent.Id, reason)
+        if err := parent.Db.Session(&gorm.Session{}).RollbackTo(savepoint).Error; err != nil {
+            log.Error().Msgf("unable to rollback to savepoint %s %+v", savepoint, err)
+        }
+    }
+
+    defer func() {
+        if r := recover(); r != nil {
+            rollbackTo(fmt.Sprintf("of a panic: %v", r))
+            panic(r)
+        }
+    }()
+
+    result, err = f()
+
+    if tx.IsRollbackOnly() {
+        rollbackTo("ctx.IsRollbackOnly is marked as true")
+        return result, err
+    } else if err != nil {
+        rollbackTo(fmt.Sprintf("of error: %+v", err))
+        return nil, err
+    }
+
+    if err := parent.Db.Session(&gorm.Session{}).Exec("RELEASE SAVEPOINT " + savepoint).Error; err != nil {
+        return nil, err
+    }
+    released = true
+    return result, nil
+}
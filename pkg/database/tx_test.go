@@ -0,0 +1,183 @@
+package database
+
+import (
+    "errors"
+    "path/filepath"
+    "testing"
+
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+    "github.com/glebarez/sqlite"
+    "github.com/stretchr/testify/assert"
+    "gorm.io/gorm"
+)
+
+// replaces the global db with a new sqlite database containing the things table
+func setupTestDb(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "test.db")
+    createThings(t, file, "existing")
+    testDb, err := gorm.Open(sqlite.Open(file), &gorm.Config{SkipDefaultTransaction: true})
+    assert.Nil(t, err)
+    previous := db
+    db = testDb
+    t.Cleanup(func() { db = previous })
+}
+
+var errorForTest = errors.New("for test")
+
+func TestWithTxOpts(t *testing.T) {
+    tests := []struct {
+        name          string
+        outer         Propagation
+        inner         Propagation
+        innerFails    bool // after creating a row
+        outerRollback bool
+        expectedErr   error
+        expected      []string
+    }{
+        {name: "required joins", outer: REQUIRED, inner: REQUIRED, expected: []string{"existing", "inner", "outer"}},
+        {name: "required is rolled back with the outer", outer: REQUIRED, inner: REQUIRED, outerRollback: true, expected: []string{"existing"}},
+        {name: "requires new commits independently", outer: REQUIRED, inner: REQUIRES_NEW, outerRollback: true, expected: []string{"existing", "inner"}},
+        {name: "requires new rolls back independently", outer: REQUIRED, inner: REQUIRES_NEW, innerFails: true, expectedErr: errorForTest, expected: []string{"existing", "outer"}},
+        {name: "nested rolls back to savepoint", outer: REQUIRED, inner: NESTED, innerFails: true, expectedErr: errorForTest, expected: []string{"existing", "outer"}},
+        {name: "nested is committed with the outer", outer: REQUIRED, inner: NESTED, expected: []string{"existing", "inner", "outer"}},
+        {name: "nested is rolled back with the outer", outer: REQUIRED, inner: NESTED, outerRollback: true, expected: []string{"existing"}},
+        {name: "mandatory joins", outer: REQUIRED, inner: MANDATORY, expected: []string{"existing", "inner", "outer"}},
+        {name: "required rolls back the outer when it fails", outer: REQUIRED, inner: REQUIRED, innerFails: true, expectedErr: errorForTest, expected: []string{"existing"}},
+        {name: "mandatory rolls back the outer when it fails", outer: REQUIRED, inner: MANDATORY, innerFails: true, expectedErr: errorForTest, expected: []string{"existing"}},
+        {name: "never fails within a transaction", outer: REQUIRED, inner: NEVER, expectedErr: ErrorTransactionExists, expected: []string{"existing", "outer"}},
+        {name: "mandatory fails without a transaction", outer: NEVER, inner: MANDATORY, expectedErr: ErrorNoTransaction, expected: []string{"existing", "outer"}},
+        {name: "nested without a transaction", outer: NEVER, inner: NESTED, expected: []string{"existing", "inner", "outer"}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            assert := assert.New(t)
+            setupTestDb(t)
+            ctx := fwctx.BuildTypedCtxForTests(db, false)
+
+            var innerErr error
+            _, err := WithTxOpts(ctx, TxOptions{Propagation: test.outer}, func() (any, error) {
+                outerTx := ctx.GetTx()
+
+                _, innerErr = WithTxOpts(ctx, TxOptions{Propagation: test.inner}, func() (any, error) {
+                    assert.Nil(ctx.GetDb().Create(&thing{Name: "inner"}).Error)
+                    if test.innerFails {
+                        return nil, errorForTest
+                    }
+                    return nil, nil
+                })
+
+                assert.Same(outerTx, ctx.GetTx(), "the outer transaction is resumed")
+                // after the inner call, since sqlite only allows one transaction to write at a time
+                assert.Nil(ctx.GetDb().Create(&thing{Name: "outer"}).Error)
+                if test.outerRollback {
+                    ctx.SetRollbackOnly()
+                }
+                return nil, nil
+            })
+
+            assert.Nil(err)
+            assert.Equal(test.expectedErr, innerErr)
+            assert.Nil(ctx.GetTx())
+            assert.Equal(test.expected, readThings(ctx))
+        })
+    }
+}
+
+func TestWithTx_panicRollsBack(t *testing.T) {
+    assert := assert.New(t)
+    setupTestDb(t)
+    ctx := fwctx.BuildTypedCtxForTests(db, false)
+
+    assert.Panics(func() {
+        WithTx(ctx, func() (any, error) {
+            ctx.GetDb().Create(&thing{Name: "outer"})
+            WithTxOpts(ctx, TxOptions{Propagation: NESTED}, func() (any, error) {
+                panic("for test")
+            })
+            return nil, nil
+        })
+    })
+
+    assert.Nil(ctx.GetTx())
+    assert.Equal([]string{"existing"}, readThings(ctx))
+}
+
+func TestWithTx_nestedRollbackOnly(t *testing.T) {
+    assert := assert.New(t)
+    setupTestDb(t)
+    ctx := fwctx.BuildTypedCtxForTests(db, false)
+
+    _, err := WithTx(ctx, func() (any, error) {
+        ctx.GetDb().Create(&thing{Name: "outer"})
+        WithTxOpts(ctx, TxOptions{Propagation: NESTED}, func() (any, error) {
+            ctx.GetDb().Create(&thing{Name: "inner"})
+            ctx.SetRollbackOnly()
+            return nil, nil
+        })
+        assert.False(ctx.IsRollbackOnly())
+        return nil, nil
+    })
+
+    assert.Nil(err)
+    assert.Equal([]string{"existing", "outer"}, readThings(ctx))
+}
+
+func TestWithTxOpts_hooks(t *testing.T) {
+    tests := []struct {
+        name     string
+        inner    Propagation
+        innerErr error
+        outerErr error
+        expected []string
+    }{
+        {name: "committed in order of registration", inner: REQUIRED, expected: []string{"outer commit", "inner commit"}},
+        {name: "rolled back in order of registration", inner: REQUIRED, outerErr: errorForTest, expected: []string{"outer rollback", "inner rollback"}},
+        {name: "new committed before outer rolled back", inner: REQUIRES_NEW, outerErr: errorForTest, expected: []string{"inner commit", "outer rollback"}},
+        {name: "nested rolled back before outer committed", inner: NESTED, innerErr: errorForTest, expected: []string{"inner rollback", "outer commit"}},
+        {name: "nested rolled back with outer", inner: NESTED, outerErr: errorForTest, expected: []string{"outer rollback", "inner rollback"}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            assert := assert.New(t)
+            setupTestDb(t)
+            ctx := fwctx.BuildTypedCtxForTests(db, false)
+            calls := []string{}
+            hook := func(name string) func() {
+                return func() {
+                    assert.Nil(ctx.GetTx(), "hooks are called once the transaction is no longer in the ctx")
+                    calls = append(calls, name)
+                }
+            }
+
+            WithTx(ctx, func() (any, error) {
+                ctx.AfterCommit(hook("outer commit"))
+                ctx.AfterRollback(hook("outer rollback"))
+                WithTxOpts(ctx, TxOptions{Propagation: test.inner}, func() (any, error) {
+                    ctx.AfterCommit(func() { calls = append(calls, "inner commit") })
+                    ctx.AfterRollback(func() { calls = append(calls, "inner rollback") })
+                    return nil, test.innerErr
+                })
+                return nil, test.outerErr
+            })
+
+            assert.Equal(test.expected, calls)
+        })
+    }
+}
+
+func TestWithTx_hooksAfterPanic(t *testing.T) {
+    assert := assert.New(t)
+    setupTestDb(t)
+    ctx := fwctx.BuildTypedCtxForTests(db, false)
+    calls := []string{}
+
+    assert.Panics(func() {
+        WithTx(ctx, func() (any, error) {
+            ctx.AfterCommit(func() { calls = append(calls, "commit") })
+            ctx.AfterRollback(func() { calls = append(calls, "rollback") })
+            panic("for test")
+        })
+    })
+
+    assert.Equal([]string{"rollback"}, calls)
+}
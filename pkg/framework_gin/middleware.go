@@ -4,12 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/abstratium-informatique-sarl/stratis/pkg/audit"
 	"github.com/abstratium-informatique-sarl/stratis/pkg/database"
 	"github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
 	"github.com/abstratium-informatique-sarl/stratis/pkg/jwt"
 	"github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/policy"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -21,6 +24,8 @@ import (
 var opsProcessed *prometheus.CounterVec
 var opsHistogramProcessed *prometheus.HistogramVec
 var opsSummaryProcessed *prometheus.SummaryVec
+var dbQueriesHistogram *prometheus.HistogramVec
+var dbTimeHistogram *prometheus.HistogramVec
 
 func Setup(prefix string) {
     // https://github.com/prometheus/client_golang/blob/main/examples/exemplars/main.go
@@ -39,6 +44,18 @@ func Setup(prefix string) {
         Name: prefix + "_response_latency_summary",
         Help: "The response latency in ms of successful calls",
     },[]string{"full_path_with_method"})
+
+    dbQueriesHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Name: prefix + "_db_queries_per_request_histogram",
+        Help: "The number of database statements run by each call",
+        Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+    },[]string{"full_path_with_method"})
+
+    dbTimeHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Name: prefix + "_db_time_per_request_histogram",
+        Help: "The total time in ms taken by the database statements of each call",
+        Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+    },[]string{"full_path_with_method"})
 }
 
 // ================================================================================================
@@ -58,6 +75,11 @@ func (w *timingMiddlewareWriter) WriteHeader(statusCode int) {
         w.ctx.Debug("timer ended after writing statusCode " + fmt.Sprintf("%d", statusCode) + ": " + elapsed.String())
         w.Header().Add("x-time", fmt.Sprintf("%v", elapsed.Milliseconds()))
 
+        // the statements run so far, i.e. without e.g. the commit of the TxMiddleware
+        stats := w.ctx.GetQueryStats()
+        w.Header().Set("x-db-queries", fmt.Sprintf("%d", stats.Count()))
+        w.Header().Set("x-db-time", fmt.Sprintf("%v", stats.Duration().Milliseconds()))
+
         fp := w.ctx.GetGinCtx().FullPath()
         fpwm := w.ctx.GetGinCtx().Request.Method + " " + fp
         code := fmt.Sprintf("%d", w.Status())
@@ -80,6 +102,7 @@ func (w *timingMiddlewareWriter) WriteHeader(statusCode int) {
 
         traceId := spanCtx.TraceID().String()
         w.Header().Add("x-trace-id", traceId)
+        w.Header().Set("x-request-id", w.ctx.GetRequestId())
         w.ResponseWriter.WriteHeader(statusCode)
     } // else sometimes the framework calls this when the status isn't actually set to a proper number
 }
@@ -89,20 +112,44 @@ func TimingMiddleware(c *gin.Context) {
     ctx.Debug("=========================")
     ctx.Debug("timer starting '" + c.Request.Method + " " + c.Request.URL.String() + "'...")
 
+    stats := ctx.GetQueryStats() // shared by all ICtx of the call, since it is stored in the gin context
     c.Writer = &timingMiddlewareWriter{ c.Writer, time.Now(), ctx}
     c.Next()
     ctx.Debug("timer ended after next()") // too late to add headers here, if the handler has already written the status code
+
+    fpwm := c.Request.Method + " " + c.FullPath()
+    if dbQueriesHistogram != nil {
+        dbQueriesHistogram.With(prometheus.Labels{"full_path_with_method": fpwm}).Observe(float64(stats.Count()))
+        dbTimeHistogram.With(prometheus.Labels{"full_path_with_method": fpwm}).Observe(float64(stats.Duration().Milliseconds()))
+    }
+    for _, warning := range database.QueryStatsWarnings(stats) {
+        ctx.Warn("%s %s", fpwm, warning)
+    }
 }
 
 // =========================================================================================================================
 // normal middleware that encapsulates a transaction (cannot write headers after call to .next() -> see timing middleware
 // =========================================================================================================================
 func TxMiddleware() gin.HandlerFunc {
+    return TxMiddlewareWithOpts(database.TxOptions{})
+}
+
+// like TxMiddleware, but with options, e.g. a timeout for the transactions of a particular route. retries are not
+// supported, since the handler cannot be run again, once it has written the response.
+func TxMiddlewareWithOpts(opts database.TxOptions) gin.HandlerFunc {
+    opts.Retries = 0
     return func(c *gin.Context) {
         ctx := fwctx.BuildTypedCtx(c, nil)
 
+        // pin the client to the primary for a while, if the handler writes rows, so that it reads its own writes,
+        // despite replication lag. decided when the status is written, because headers cannot be written once the
+        // handler has run.
+        if database.PinAfterWrite() > 0 {
+            c.Writer = &pinningWriter{c.Writer, ctx}
+        }
+
         // ignore return, since we return nil,nil in 3 lines time
-        _, err := database.WithTx(ctx, func() (any, error) {
+        _, err := database.WithTxOpts(ctx, opts, func() (any, error) {
             c.Next()
             return nil, nil
         })
@@ -120,6 +167,31 @@ func TxMiddleware() gin.HandlerFunc {
     }
 }
 
+// sets the cookie which pins the client to the primary, see database.PinAfterWrite(), before the status is written, if
+// the transaction has written rows and the call succeeds
+type pinningWriter struct {
+    gin.ResponseWriter
+    ctx fwctx.ICtx
+}
+
+func (w *pinningWriter) WriteHeader(statusCode int) {
+    if statusCode > 0 && statusCode < 400 && !w.Written() {
+        if tx := w.ctx.GetTx(); tx != nil && tx.HasWritten() && !tx.IsRollbackOnly() {
+            PinToPrimary(w.ctx)
+        }
+    }
+    w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// pins the client to the primary for the duration given by database.PinAfterWrite(), so that its following calls read
+// its own writes, e.g. after writing in a transaction of its own. does nothing if there are no replicas, or once the
+// status has been written.
+func PinToPrimary(ctx fwctx.ICtx) {
+    if pin := database.PinAfterWrite(); pin > 0 && ctx.GetGinCtx() != nil {
+        ctx.GetGinCtx().SetCookie(database.PRIMARY_COOKIE_NAME, "true", int(pin.Seconds()+1), "/", "", false, true)
+    }
+}
+
 // ================================================================================================================================
 // normal middleware that encapsulates a non-transaction call, but still puts the DB into the context, just without a transaction
 // ================================================================================================================================
@@ -128,7 +200,10 @@ func NonTxMiddleware() gin.HandlerFunc {
         ctx := fwctx.BuildTypedCtx(c, nil)
 
         database.NonTx(ctx)
-        
+        if _, err := c.Cookie(database.PRIMARY_COOKIE_NAME); err == nil {
+            database.UsePrimary(ctx) // the client recently wrote something, see TxMiddleware
+        }
+
         c.Next()
     }
 }
@@ -144,6 +219,7 @@ func SecurityMiddleware(rolesAllowed []string, contextProvider func(fwctx.ICtx,
         ok, err := ctx.UserHasARole(rolesAllowed)
         if err != nil {
             if errors.Is(err, fwctx.ErrorTokenNotFound) || errors.Is(err, fwctx.ErrorTokenWrong) {
+                audit.Security(ctx, audit.ACTION_INVALID_TOKEN, map[string]string{"reason": err.Error()})
                 c.AbortWithError(http.StatusUnauthorized, err)
             } else {
                 secLog.Error().Msgf("failed to check roles %+v", err)
@@ -151,6 +227,7 @@ func SecurityMiddleware(rolesAllowed []string, contextProvider func(fwctx.ICtx,
             }
             return
         } else if ok {
+            logImpersonation(ctx, c)
             c.Next()
         } else { // role missing
             user, err := ctx.GetUser() // ignore error - it was non-nil when we just queried the roles, and is cached in the ctx
@@ -161,8 +238,63 @@ func SecurityMiddleware(rolesAllowed []string, contextProvider func(fwctx.ICtx,
             } else if user.IsAnonymous() {
                 c.AbortWithStatus(http.StatusUnauthorized) // sign in
             } else {
+                audit.Security(ctx, audit.ACTION_ACCESS_DENIED, map[string]string{"rolesAllowed": strings.Join(rolesAllowed, ",")})
                 c.AbortWithStatus(http.StatusForbidden) // missing role
             }
         }
     }
 }
+
+// ================================================================================================================================
+// policy middleware that ensures the user in the ICtx has the given permission according to `policy.Default()`.
+// An optional resourceProvider can be given to load the resource that the call accesses, so that attribute based rules
+// can be applied to it. Otherwise the rules are given a nil resource. An optional contextProvider can be provided to handle
+// service users.
+// ================================================================================================================================
+func PolicyMiddleware(permission string, resourceProvider func(fwctx.ICtx) (any, error), contextProvider func(fwctx.ICtx, string) (jwt.UserContext, string, string, []string, error)) gin.HandlerFunc {
+    secLog := logging.GetLog("sec-middleware")
+    return func(c *gin.Context) {
+        ctx := fwctx.BuildTypedCtx(c, contextProvider)
+        user, err := ctx.GetUser()
+        if err != nil {
+            if errors.Is(err, fwctx.ErrorTokenNotFound) || errors.Is(err, fwctx.ErrorTokenWrong) {
+                audit.Security(ctx, audit.ACTION_INVALID_TOKEN, map[string]string{"reason": err.Error()})
+                c.AbortWithError(http.StatusUnauthorized, err)
+            } else {
+                secLog.Error().Msgf("failed to get user %+v", err)
+                c.AbortWithError(http.StatusInternalServerError, err)
+            }
+            return
+        }
+
+        var resource any
+        if resourceProvider != nil {
+            resource, err = resourceProvider(ctx)
+            if err != nil {
+                secLog.Error().Msgf("failed to get resource for permission %s %+v", permission, err)
+                c.AbortWithError(http.StatusInternalServerError, err)
+                return
+            }
+        }
+
+        if policy.Authorize(user, permission, resource).Allowed {
+            logImpersonation(ctx, c)
+            c.Next()
+        } else if user.IsAnonymous() {
+            c.AbortWithStatus(http.StatusUnauthorized) // sign in
+        } else {
+            audit.Security(ctx, audit.ACTION_ACCESS_DENIED, map[string]string{"permission": permission})
+            c.AbortWithStatus(http.StatusForbidden) // missing permission
+        }
+    }
+}
+
+// every action taken while impersonating a user is logged, with the ids of both the impersonated user and the real user
+func logImpersonation(ctx fwctx.ICtx, c *gin.Context) {
+    user, err := ctx.GetUser() // cached in the ctx
+    if err == nil && user.IsImpersonated() {
+        secLog := logging.GetLog("sec-middleware")
+        secLog.Info().Msgf("IMPERSONATION: user %s (%s) acting as user %s (%s) calls %s %s", user.Actor.UserId, user.Actor.Username, user.UserId, user.Username, c.Request.Method, c.Request.RequestURI)
+        audit.Security(ctx, audit.ACTION_IMPERSONATED_CALL, nil)
+    }
+}
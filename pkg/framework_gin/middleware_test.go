@@ -4,14 +4,21 @@ import (
     "net/http"
     "net/http/httptest"
     "os"
+    "path/filepath"
     "testing"
+    "time"
 
+    "github.com/abstratium-informatique-sarl/stratis/pkg/audit"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/database"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
     "github.com/abstratium-informatique-sarl/stratis/pkg/jwt"
+    "github.com/abstratium-informatique-sarl/stratis/pkg/policy"
     "github.com/gin-gonic/gin"
     "github.com/stretchr/testify/assert"
 )
 
 func TestMain(m *testing.M) {
+    Setup("framework_gin_test")
 
     code := m.Run() // Run all tests in the package
 
@@ -23,7 +30,11 @@ func TestMain(m *testing.M) {
 func TestSecurityMiddleware_wrongRoles(t *testing.T) {
     assert := assert.New(t)
 
-    sut := SecurityMiddleware([]string{"role1"})
+    sut := SecurityMiddleware([]string{"role1"}, nil)
+    sink := &audit.MemorySink{}
+    previous := audit.GetSink()
+    audit.SetSink(sink)
+    defer audit.SetSink(previous)
 
     // https://stackoverflow.com/questions/41742988/make-mock-gin-context
     gin.SetMode(gin.TestMode)
@@ -42,12 +53,17 @@ func TestSecurityMiddleware_wrongRoles(t *testing.T) {
 
     // then
     assert.Equal(http.StatusForbidden, w.Code)
+    events := sink.Events()
+    assert.Len(events, 1)
+    assert.Equal(audit.ACTION_ACCESS_DENIED, events[0].Action)
+    assert.Equal("1", events[0].UserId)
+    assert.Equal("role1", events[0].Details["rolesAllowed"])
 }
 
 func TestSecurityMiddleware_anonymous(t *testing.T) {
     assert := assert.New(t)
 
-    sut := SecurityMiddleware([]string{"role1"})
+    sut := SecurityMiddleware([]string{"role1"}, nil)
     gin.SetMode(gin.TestMode)
     w := httptest.NewRecorder()
     c, _ := gin.CreateTestContext(w)
@@ -69,7 +85,7 @@ func TestSecurityMiddleware_anonymous(t *testing.T) {
 func TestSecurityMiddleware_rightRoles(t *testing.T) {
     assert := assert.New(t)
 
-    sut := SecurityMiddleware([]string{"role1"})
+    sut := SecurityMiddleware([]string{"role1"}, nil)
     gin.SetMode(gin.TestMode)
     w := httptest.NewRecorder()
     c, _ := gin.CreateTestContext(w)
@@ -87,3 +103,121 @@ func TestSecurityMiddleware_rightRoles(t *testing.T) {
     // then
     assert.Equal(http.StatusOK, w.Code)
 }
+
+func TestPolicyMiddleware(t *testing.T) {
+    policy.Setup(policy.NewEngine().Grant("thing:read", "role1"))
+    defer policy.Setup(policy.NewEngine())
+
+    testCases := []struct {
+        name     string
+        user     *jwt.User
+        expected int
+    }{
+        {"granted", &jwt.User{Username: "john.smith", UserId: "1", Roles: []string{"role1"}, UserContext: map[string]string{}}, http.StatusOK},
+        {"denied", &jwt.User{Username: "john.smith", UserId: "1", Roles: []string{"role2"}, UserContext: map[string]string{}}, http.StatusForbidden},
+        {"anonymous", &jwt.User{Username: jwt.ANONYMOUS, UserId: "0", Roles: []string{}, UserContext: map[string]string{}}, http.StatusUnauthorized},
+    }
+
+    for _, tc := range testCases {
+        t.Run(tc.name, func(t *testing.T) {
+            sut := PolicyMiddleware("thing:read", nil, nil)
+            gin.SetMode(gin.TestMode)
+            w := httptest.NewRecorder()
+            c, _ := gin.CreateTestContext(w)
+            c.Set("user", tc.user)
+
+            // when
+            sut(c)
+
+            // then
+            assert.Equal(t, tc.expected, w.Code)
+        })
+    }
+}
+
+func TestTimingMiddleware_queryStats(t *testing.T) {
+    assert := assert.New(t)
+
+    gin.SetMode(gin.TestMode)
+    r := gin.New()
+    r.Use(TimingMiddleware)
+    r.GET("/orders", func(c *gin.Context) {
+        // e.g. recorded by the QueryStatsPlugin
+        stats := fwctx.BuildTypedCtx(c, nil).GetQueryStats()
+        stats.Record("SELECT * FROM orders", 2*time.Millisecond)
+        stats.Record("SELECT * FROM customers WHERE id = ?", time.Millisecond)
+        stats.Record("SELECT * FROM customers WHERE id = ?", time.Millisecond)
+        c.Status(http.StatusOK)
+    })
+    w := httptest.NewRecorder()
+
+    // when
+    r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders", nil))
+
+    // then
+    assert.Equal(http.StatusOK, w.Code)
+    assert.Equal("3", w.Header().Get("x-db-queries"))
+    assert.Equal("4", w.Header().Get("x-db-time"))
+}
+
+type note struct {
+    Id   int
+    Name string
+}
+
+func TestTxMiddleware_pinsOnlyAfterWrites(t *testing.T) {
+    dir := t.TempDir()
+    t.Setenv(database.STRATIS_DB_DRIVER, database.DRIVER_SQLITE)
+    t.Setenv("STRATIS_DB_NAME", filepath.Join(dir, "primary.db"))
+    t.Setenv(database.STRATIS_DB_REPLICAS, filepath.Join(dir, "replica.db"))
+    t.Setenv("STRATIS_DB_REPLICA_HEALTH_INTERVAL", "1h")
+    t.Setenv("STRATIS_DB_REPLICA_PIN_AFTER_WRITE", "5s")
+    database.SetupDb()
+    assert.Nil(t, database.GetDb().AutoMigrate(&note{}))
+
+    gin.SetMode(gin.TestMode)
+    r := gin.New()
+    r.Use(TxMiddleware())
+    write := func(status int) gin.HandlerFunc {
+        return func(c *gin.Context) {
+            assert.Nil(t, fwctx.BuildTypedCtx(c, nil).GetDb().Create(&note{Name: "a"}).Error)
+            c.Status(status)
+        }
+    }
+    r.GET("/notes", func(c *gin.Context) {
+        assert.Nil(t, fwctx.BuildTypedCtx(c, nil).GetDb().Find(&[]note{}).Error)
+        c.Status(http.StatusOK)
+    })
+    r.POST("/notes", write(http.StatusCreated))
+    r.POST("/invalid", write(http.StatusBadRequest))
+    r.POST("/explicit", func(c *gin.Context) {
+        PinToPrimary(fwctx.BuildTypedCtx(c, nil))
+        c.Status(http.StatusOK)
+    })
+
+    tests := []struct {
+        method   string
+        path     string
+        expected bool
+    }{
+        {http.MethodGet, "/notes", false},
+        {http.MethodPost, "/notes", true},
+        {http.MethodPost, "/invalid", false},
+        {http.MethodPost, "/explicit", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+            w := httptest.NewRecorder()
+
+            // when
+            r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+            // then
+            pinned := false
+            for _, cookie := range w.Result().Cookies() {
+                pinned = pinned || cookie.Name == database.PRIMARY_COOKIE_NAME
+            }
+            assert.Equal(t, tt.expected, pinned)
+        })
+    }
+}
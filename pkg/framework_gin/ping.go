@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/abstratium-informatique-sarl/stratis/pkg/database"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database/migration"
 	"github.com/gin-gonic/gin"
 )
 
@@ -75,6 +76,15 @@ Feature Flags: Status of any feature flags.
             resp["database"] = err.Error()
             resp["live"] = "nok"
         }
+        // unhealthy replicas are not used, so they are reported, but don't affect liveness
+        if replicas := database.ReplicaHealth(); len(replicas) > 0 {
+            resp["database-replicas"] = replicas
+        }
+        // e.g. while waiting for another instance to apply the migrations
+        if migration.IsMigrating() {
+            resp["migrations"] = "in progress"
+            resp["ready"] = "nok"
+        }
 
         c.JSON(http.StatusOK, resp)
     })
@@ -5,18 +5,24 @@ package fwctx
 // see https://www.reddit.com/r/golang/comments/1c03tz6/how_to_use_context_implicitly_in_go/
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database/paging"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/httpclient"
 	"github.com/abstratium-informatique-sarl/stratis/pkg/jwt"
 	"github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/policy"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
@@ -34,18 +40,61 @@ const _USER_KEY = "user"
 // and GetUser() to get the user from the JWT token if it was sent to the call. Also contains helper methods
 // to log debug, info, warn and error messages, as well as to check if the user has a role and to get query parameters.
 type ICtx interface {
+	// sets the connection. if isTransactional is true, it is a transaction, for which a new Tx is set, otherwise it is
+	// the non-transactional connection, and any Tx is removed.
 	SetDb(conn *gorm.DB, isTransactional bool)
+
+	// returns the connection of the current Tx, if there is one, otherwise the one set with SetDb(). its statement
+	// context contains this ICtx, see FromContext()
 	GetDb() *gorm.DB
+
+	// returns the state of the current transaction, or nil if there is none
+	GetTx() *Tx
+
+	// sets the current transaction, or with nil, returns to the non-transactional connection that was set using SetDb()
+	SetTx(tx *Tx)
+
+	// returns true, if SetRollbackOnly() has been called during the current transaction
 	IsRollbackOnly() bool
 	SetRollbackOnly()
+
+	// registers a function which is called after the current transaction has been committed, e.g. to send an email or
+	// publish an event, only once the data is definitely saved. if there is no transaction, the function is called
+	// immediately. functions are called in the order they are registered, and a panic in one of them is logged and
+	// does not affect the others, or the result of the transaction.
+	AfterCommit(f func())
+
+	// registers a function which is called after the current transaction has been rolled back, e.g. to undo a side
+	// effect. if there is no transaction, the function is never called. see AfterCommit()
+	AfterRollback(f func())
+
+	// publishes an event via the transactional outbox, by inserting it within the current transaction, so that it is
+	// only published if the transaction is committed. fails with outbox.ErrorNoTransaction if there is none. see package
+	// outbox
+	Publish(topic string, payload any) error
 	GetGinCtx() *gin.Context
 	QueryParamAsBooleanWithDefault(string, bool) bool
 	QueryParamAsString(string) string
 	QueryParamAsInt(string) (int, error)
+
+	// parses the limit, cursor, offset and sort query params into a request for a page of a `database.Repository`. the
+	// limit defaults to defaultLimit, and may not exceed maxLimit. see package paging
+	PageRequest(defaultLimit int, maxLimit int) (paging.Request, error)
 	RequestBodyAsString() (string, error)
 	UnmarshalRequestBody(o any) error
 	GetUser() (*jwt.User, error)
+
+	// returns the user who is really behind the call. that is the same as the user returned by GetUser(), unless
+	// that user is being impersonated, in which case it is the actor who is doing the impersonation.
+	GetRealUser() (*jwt.User, error)
 	UserHasARole(rolesAllowed []string) (bool, error)
+
+	// the tenant on whose behalf the call is being made, or "" if there is none. see package tenancy
+	GetTenant() string
+	SetTenant(tenant string)
+
+	// returns true if the user has the permission for the resource, which may be nil, according to `policy.Default()`
+	Authorize(permission string, resource any) (bool, error)
 	Info(format string, a ...any)
 	Debug(format string, a ...any)
 	Warn(format string, a ...any)
@@ -54,15 +103,62 @@ type ICtx interface {
 	// TODO why hand over a logger, rather than simply calling getLog()?
 	HandleError(err error, msg string, log zerolog.Logger)
 	StartSpan(name string, isRemote bool) trace.Span
+
+	// returns a client for making outbound calls on behalf of this call, see package httpclient
+	HTTPClient() *http.Client
+
+	// the id used to correlate everything done on behalf of a call, including outbound calls and background jobs.
+	// it is taken from the X-Request-Id header of the call, or generated.
+	GetRequestId() string
+
+	// the statistics of the database statements run on behalf of this call, e.g. reported by TimingMiddleware
+	GetQueryStats() *QueryStats
+}
+
+// only used for debugging
+var highestId atomic.Int64
+
+func nextId() int {
+	return int(highestId.Add(1) - 1)
 }
 
-var highestId int = 0
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+// request ids which are passed in by callers are only accepted if they match this, in order to avoid log injection
+var validRequestId = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,128}$`)
+
+type contextKey struct {
+	name string
+}
+
+var contextKeyICtx = &contextKey{"ICtx"}
+
+// returns a copy of the given context which contains the ICtx, so that code which only has access to a context.Context,
+// e.g. GORM callbacks, can get at it using FromContext()
+func ContextWithICtx(parent context.Context, c ICtx) context.Context {
+	return context.WithValue(parent, contextKeyICtx, c)
+}
+
+// returns the ICtx that was put into the context with ContextWithICtx(), e.g. by ICtx.GetDb()
+func FromContext(c context.Context) (ICtx, bool) {
+	if c == nil {
+		return nil, false
+	}
+	ictx, ok := c.Value(contextKeyICtx).(ICtx)
+	return ictx, ok
+}
+
+// puts the ICtx into the statement context of the connection
+func withICtx(conn *gorm.DB, c ICtx) *gorm.DB {
+	return conn.WithContext(ContextWithICtx(conn.Statement.Context, c))
+}
 
 var ErrorTokenNotFound = errors.New("STRATIS-1002 no valid matching token found")
 var ErrorTokenWrong = errors.New("STRATIS-1001 token and hash do not match")
 
 type ctx struct {
 	id int
+	requestId string
 	ginCtx *gin.Context
 	
 	// a function that provides the context if any, userId, userName, roles, or an error.
@@ -76,36 +172,66 @@ func(c *ctx) setContextProviderIfNotSet(contextProvider func(ICtx, string) (user
 }
 
 func (c *ctx) SetDb(conn *gorm.DB, isTransactional bool) {
-	c.ginCtx.Set("DB_CONN", conn)
-	c.ginCtx.Set("DB_CONN_IS_TRANSACTIONAL", isTransactional)
+	if isTransactional {
+		c.SetTx(NewTx(conn))
+	} else {
+		c.ginCtx.Set("DB_CONN", conn)
+		c.SetTx(nil)
+	}
 }
 
 func (c *ctx) GetDb() *gorm.DB {
+	if tx := c.GetTx(); tx != nil {
+		return withICtx(tx.Db, c)
+	}
 	conn, _ := c.ginCtx.Get("DB_CONN")
 	if conn == nil {
 		panic("use TxMiddleware or NonTxMiddleware to setup the database for this call")
 	}
-	return conn.(*gorm.DB)
+	return withICtx(conn.(*gorm.DB), c)
+}
+
+func (c *ctx) GetTx() *Tx {
+	tx, _ := c.ginCtx.Get("DB_TX")
+	if tx == nil {
+		return nil
+	}
+	return tx.(*Tx)
+}
+
+func (c *ctx) SetTx(tx *Tx) {
+	c.ginCtx.Set("DB_TX", tx)
 }
 
 // returns true, if #SetRollbackOnly() has been called
 func (c *ctx) IsRollbackOnly() bool {
-	return c.ginCtx.GetBool("IS_ROLLBACK_ONLY")
+	tx := c.GetTx()
+	return tx != nil && tx.IsRollbackOnly()
 }
 
 // sets up the transaction to be rolled back
 func (c *ctx) SetRollbackOnly() {
-	if _, ok := c.ginCtx.Get("DB_CONN"); !ok {
+	if tx := c.GetTx(); tx != nil {
+		tx.SetRollbackOnly()
+	} else if _, ok := c.ginCtx.Get("DB_CONN"); !ok {
 		// ignore
 	} else {
-		if !c.ginCtx.GetBool("DB_CONN_IS_TRANSACTIONAL") {
-			panic("unable to rollback non-transactional database connection - use TxMiddleware() for this call or call database.WithTx() if not in the context of an http call")
-		} else {
-			c.ginCtx.Set("IS_ROLLBACK_ONLY", true)
-		}
+		panic("unable to rollback non-transactional database connection - use TxMiddleware() for this call or call database.WithTx() if not in the context of an http call")
 	}
 }
 
+func (c *ctx) AfterCommit(f func()) {
+	afterCommit(c, f)
+}
+
+func (c *ctx) AfterRollback(f func()) {
+	afterRollback(c, f)
+}
+
+func (c *ctx) Publish(topic string, payload any) error {
+	return publish(c, topic, payload)
+}
+
 func (c *ctx) GetGinCtx() *gin.Context {
 	return c.ginCtx
 }
@@ -126,6 +252,10 @@ func (c *ctx) QueryParamAsInt(name string) (int, error) {
 	return int(i), e
 }
 
+func (c *ctx) PageRequest(defaultLimit int, maxLimit int) (paging.Request, error) {
+	return paging.Parse(c.ginCtx.Query, defaultLimit, maxLimit)
+}
+
 func (c *ctx) RequestBodyAsString() (string, error) {
 	defer c.ginCtx.Request.Body.Close()
 	reqBody, err := io.ReadAll(c.ginCtx.Request.Body)
@@ -189,6 +319,14 @@ func (c *ctx) GetUser() (*jwt.User, error) {
 	}
 }
 
+func (c *ctx) GetRealUser() (*jwt.User, error) {
+	user, err := c.GetUser()
+	if err != nil {
+		return nil, err
+	}
+	return RealUser(user), nil
+}
+
 func (c *ctx) UserHasARole(rolesAllowed []string) (bool, error) {
 	user, err := c.GetUser()
 	if err != nil {
@@ -197,6 +335,22 @@ func (c *ctx) UserHasARole(rolesAllowed []string) (bool, error) {
 	return UserHasARole(rolesAllowed, user), nil
 }
 
+func (c *ctx) Authorize(permission string, resource any) (bool, error) {
+	user, err := c.GetUser()
+	if err != nil {
+		return false, err
+	}
+	return policy.Authorize(user, permission, resource).Allowed, nil
+}
+
+func (c *ctx) GetTenant() string {
+	return c.ginCtx.GetString("TENANT")
+}
+
+func (c *ctx) SetTenant(tenant string) {
+	c.ginCtx.Set("TENANT", tenant)
+}
+
 func (c *ctx) StartSpan(name string, isRemote bool) trace.Span {
 	tp := otel.GetTracerProvider()
 	tracer := tp.Tracer(name)
@@ -208,6 +362,14 @@ func (c *ctx) StartSpan(name string, isRemote bool) trace.Span {
 	return span
 }
 
+func (c *ctx) HTTPClient() *http.Client {
+	credentials := httpclient.Credentials{Authorization: c.ginCtx.GetHeader("Authorization")}
+	if token, err := c.ginCtx.Cookie(TOKEN_COOKIE_NAME); err == nil {
+		credentials.TokenCookie = token
+	}
+	return httpclient.New(c.ginCtx.Request.Context(), c.StartSpan, c.requestId, credentials)
+}
+
 func UserHasARole(rolesAllowed []string, user *jwt.User) bool {
 	for _, role := range user.Roles {
 		if lo.Contains(rolesAllowed, role) {
@@ -217,6 +379,20 @@ func UserHasARole(rolesAllowed []string, user *jwt.User) bool {
 	return false
 }
 
+// returns the actor as a user, if the given user is being impersonated, otherwise the given user
+func RealUser(user *jwt.User) *jwt.User {
+	if !user.IsImpersonated() {
+		return user
+	}
+	return &jwt.User{
+		Username: user.Actor.Username,
+		UserId: user.Actor.UserId,
+		Expires: user.Expires,
+		Roles: user.Actor.Roles,
+		UserContext: map[string]string{},
+	}
+}
+
 func BuildTypedCtx(c *gin.Context, contextProvider func(ICtx, string) (jwt.UserContext, string, string, []string, error)) ICtx {
 	// reuse the wrapper if it is already in the gin context
 	key := "fwctx"
@@ -226,16 +402,36 @@ func BuildTypedCtx(c *gin.Context, contextProvider func(ICtx, string) (jwt.UserC
 		context = a.(*ctx)
 		context.setContextProviderIfNotSet(contextProvider)
 	} else {
-		// is this thread safe? well... id is only fo debugging
-		id := highestId
-		highestId++
-
-		context = &ctx{id, c, contextProvider}
+		context = &ctx{nextId(), requestIdOf(c), c, contextProvider}
 		c.Set(key, context)
 	}
 	return ICtx(context)
 }
 
+// uses the request id sent by the caller, or generates a new one
+func requestIdOf(c *gin.Context) string {
+	if c.Request != nil {
+		requestId := c.GetHeader(REQUEST_ID_HEADER)
+		if validRequestId.MatchString(requestId) {
+			return requestId
+		}
+	}
+	return uuid.NewString()
+}
+
+func (c *ctx) GetRequestId() string {
+	return c.requestId
+}
+
+func (c *ctx) GetQueryStats() *QueryStats {
+	if stats, ok := c.ginCtx.Get("DB_QUERY_STATS"); ok {
+		return stats.(*QueryStats)
+	}
+	stats := &QueryStats{}
+	c.ginCtx.Set("DB_QUERY_STATS", stats)
+	return stats
+}
+
 func (c *ctx) Debug(format string, a ...any) {
 	l := c.getLog()
 	l.Debug().Msgf(format, a...)
@@ -264,10 +460,20 @@ func (c *ctx) HandleError(err error, msg string, log zerolog.Logger) {
 	}
 	c.SetRollbackOnly()
 	log.Warn().Msgf("%s %s: %+v", id, msg, err)
-	c.ginCtx.JSON(http.StatusBadRequest, resp)
+	c.ginCtx.JSON(statusOf(err), resp)
 }
 
 
+// the http status for an error, which is 400 unless the error has a method `HTTPStatus() int`, like
+// database.ErrorConflict
+func statusOf(err error) int {
+	var withStatus interface{ HTTPStatus() int }
+	if errors.As(err, &withStatus) {
+		return withStatus.HTTPStatus()
+	}
+	return http.StatusBadRequest
+}
+
 func (c *ctx) getLog() zerolog.Logger {
 	packageName, _/*funcName*/ := getCallerInfo(3)
 
@@ -277,7 +483,16 @@ func (c *ctx) getLog() zerolog.Logger {
 	traceId := spanCtx.TraceID().String()
 	// spanId := spanCtx.SpanID().String()
 
-	return logging.GetLog(packageName).With().Str("traceId", "tid:" + traceId).Logger()
+	l := logging.GetLog(packageName).With().Str("traceId", "tid:" + traceId).Str("requestId", "rid:" + c.requestId)
+
+	// only use the user if it has already been resolved, since resolving it might itself log
+	if obj, ok := c.ginCtx.Get(_USER_KEY); ok && obj != nil {
+		if user := obj.(*jwt.User); user.IsImpersonated() {
+			l = l.Str("userId", user.UserId).Str("actorId", user.Actor.UserId)
+		}
+	}
+
+	return l.Logger()
 }
 
 func getCallerInfo(skip int) (packageName, funcName string) {
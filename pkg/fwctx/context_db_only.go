@@ -4,9 +4,13 @@ package fwctx
 
 import (
 	"context"
+	"net/http"
 
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database/paging"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/httpclient"
 	"github.com/abstratium-informatique-sarl/stratis/pkg/jwt"
 	"github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/policy"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
@@ -17,51 +21,85 @@ import (
 
 type ctxWithOnlyDb struct {
 	id              int
+	requestId       string
 	db              *gorm.DB
-	rollbackOnly    bool
-	isTransactional bool
+	tx              *Tx
 	username        string
 	userId          string
 	roles           []string
+	tenant          string
+	queryStats      *QueryStats
 }
 
 // designed for using for background tasks with a service user and in combination with database.WithTx() or database.NoTx()
 func BuildTypedCtxNoDbNoGin(username string, userId string, roles []string) ICtx {
-	id := highestId
-	highestId++
-
-	var context = &ctxWithOnlyDb{id, nil, false, true, username, userId, roles}
+	var context = &ctxWithOnlyDb{nextId(), uuid.NewString(), nil, nil, username, userId, roles, "", &QueryStats{}}
 	var ictx = context
 	return ICtx(ictx)
 }
 
+// like BuildTypedCtxNoDbNoGin, but for background tasks started while handling a call, so that the task uses the
+// same request id and tenant as the call
+func BuildTypedCtxNoDbNoGinFrom(parent ICtx, username string, userId string, roles []string) ICtx {
+	var context = &ctxWithOnlyDb{nextId(), parent.GetRequestId(), nil, nil, username, userId, roles, parent.GetTenant(), &QueryStats{}}
+	return ICtx(context)
+}
+
 func (c *ctxWithOnlyDb) SetDb(conn *gorm.DB, isTransactional bool) {
-	c.db = conn
-	c.isTransactional = isTransactional
+	if isTransactional {
+		c.tx = NewTx(conn)
+	} else {
+		c.db = conn
+		c.tx = nil
+	}
 }
 
 func (c *ctxWithOnlyDb) GetDb() *gorm.DB {
-	return c.db
+	if c.tx != nil {
+		return withICtx(c.tx.Db, c)
+	}
+	if c.db == nil {
+		return nil
+	}
+	return withICtx(c.db, c)
+}
+
+func (c *ctxWithOnlyDb) GetTx() *Tx {
+	return c.tx
+}
+
+func (c *ctxWithOnlyDb) SetTx(tx *Tx) {
+	c.tx = tx
 }
 
 // returns true, if #SetRollbackOnly() has been called
 func (c *ctxWithOnlyDb) IsRollbackOnly() bool {
-	return c.rollbackOnly
+	return c.tx != nil && c.tx.IsRollbackOnly()
 }
 
 // sets up the transaction to be rolled back
 func (c *ctxWithOnlyDb) SetRollbackOnly() {
-	if c.db == nil {
+	if c.tx != nil {
+		c.tx.SetRollbackOnly()
+	} else if c.db == nil {
 		// ignore
 	} else {
-		if !c.isTransactional {
-			panic("unable to rollback non-transactional database connection - call database.WithTx()")
-		} else {
-			c.rollbackOnly = true
-		}
+		panic("unable to rollback non-transactional database connection - call database.WithTx()")
 	}
 }
 
+func (c *ctxWithOnlyDb) AfterCommit(f func()) {
+	afterCommit(c, f)
+}
+
+func (c *ctxWithOnlyDb) AfterRollback(f func()) {
+	afterRollback(c, f)
+}
+
+func (c *ctxWithOnlyDb) Publish(topic string, payload any) error {
+	return publish(c, topic, payload)
+}
+
 func (c *ctxWithOnlyDb) GetGinCtx() *gin.Context {
 	return nil
 }
@@ -79,6 +117,11 @@ func (c *ctxWithOnlyDb) QueryParamAsInt(name string) (int, error) {
 	panic("not supported")
 }
 
+// there are no query params, so it is the first page with the default limit
+func (c *ctxWithOnlyDb) PageRequest(defaultLimit int, maxLimit int) (paging.Request, error) {
+	return paging.Parse(func(string) string { return "" }, defaultLimit, maxLimit)
+}
+
 func (c *ctxWithOnlyDb) RequestBodyAsString() (string, error) {
 	panic("not supported")
 }
@@ -91,11 +134,31 @@ func (c *ctxWithOnlyDb) GetUser() (*jwt.User, error) {
 	return &jwt.User{Username: c.username, UserId: c.userId, Expires: 0, Roles: c.roles, UserContext: map[string]string{}}, nil
 }
 
+func (c *ctxWithOnlyDb) GetRealUser() (*jwt.User, error) {
+	return c.GetUser()
+}
+
 func (c *ctxWithOnlyDb) UserHasARole(rolesAllowed []string) (bool, error) {
 	user, err := c.GetUser()
 	return UserHasARole(rolesAllowed, user), err
 }
 
+func (c *ctxWithOnlyDb) Authorize(permission string, resource any) (bool, error) {
+	user, err := c.GetUser()
+	if err != nil {
+		return false, err
+	}
+	return policy.Authorize(user, permission, resource).Allowed, nil
+}
+
+func (c *ctxWithOnlyDb) GetTenant() string {
+	return c.tenant
+}
+
+func (c *ctxWithOnlyDb) SetTenant(tenant string) {
+	c.tenant = tenant
+}
+
 func (c *ctxWithOnlyDb) StartSpan(name string, isRemote bool) trace.Span {
 	tp := otel.GetTracerProvider()
 	tracer := tp.Tracer(name)
@@ -107,6 +170,19 @@ func (c *ctxWithOnlyDb) StartSpan(name string, isRemote bool) trace.Span {
 	return span
 }
 
+// a background task has no caller whose credentials could be forwarded
+func (c *ctxWithOnlyDb) HTTPClient() *http.Client {
+	return httpclient.New(context.Background(), c.StartSpan, c.requestId, httpclient.Credentials{})
+}
+
+func (c *ctxWithOnlyDb) GetRequestId() string {
+	return c.requestId
+}
+
+func (c *ctxWithOnlyDb) GetQueryStats() *QueryStats {
+	return c.queryStats
+}
+
 func (c *ctxWithOnlyDb) Debug(format string, a ...any) {
 	l := c.getLog()
 	l.Debug().Msgf(format, a...)
@@ -142,5 +218,5 @@ func (c *ctxWithOnlyDb) getLog() zerolog.Logger {
 	traceId := spanCtx.TraceID().String()
 	// spanId := spanCtx.SpanID().String()
 
-	return logging.GetLog(packageName).With().Str("traceId", "tid:"+traceId).Logger()
+	return logging.GetLog(packageName).With().Str("traceId", "tid:"+traceId).Str("requestId", "rid:"+c.requestId).Logger()
 }
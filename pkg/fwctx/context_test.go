@@ -0,0 +1,126 @@
+package fwctx
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database/paging"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func buildCtx(requestId string) ICtx {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	if len(requestId) > 0 {
+		c.Request.Header.Set(REQUEST_ID_HEADER, requestId)
+	}
+	return BuildTypedCtx(c, nil)
+}
+
+func TestGetRequestId(t *testing.T) {
+	testCases := []struct {
+		name   string
+		header string
+		isKept bool
+	}{
+		{"valid", "abc-123_x.y:z", true},
+		{"missing", "", false},
+		{"log injection", "abc\n123", false},
+		{"too long", strings.Repeat("a", 129), false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			requestId := buildCtx(tc.header).GetRequestId()
+			if tc.isKept {
+				assert.Equal(t, tc.header, requestId)
+			} else {
+				assert.Len(t, requestId, 36) // a uuid
+			}
+		})
+	}
+}
+
+func TestBuildTypedCtxNoDbNoGinFrom_usesRequestIdOfParent(t *testing.T) {
+	assert := assert.New(t)
+	parent := buildCtx("abc")
+	parent.SetTenant("t1")
+
+	// when
+	ctx := BuildTypedCtxNoDbNoGinFrom(parent, "job", "1", []string{})
+
+	// then
+	assert.Equal("abc", ctx.GetRequestId())
+	assert.Equal("t1", ctx.GetTenant())
+	assert.NotEqual(BuildTypedCtxNoDbNoGin("job", "1", []string{}).GetRequestId(), BuildTypedCtxNoDbNoGin("job", "1", []string{}).GetRequestId())
+}
+
+func TestNextId_isThreadSafe(t *testing.T) {
+	ids := sync.Map{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, duplicate := ids.LoadOrStore(nextId(), true)
+				assert.False(t, duplicate)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPageRequest(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/?limit=5&sort=-name", nil)
+	ctx := BuildTypedCtx(c, nil)
+
+	request, err := ctx.PageRequest(20, 100)
+
+	assert.Nil(err)
+	assert.Equal(paging.Request{Limit: 5, Sort: []paging.Sort{{Field: "name", Desc: true}}}, request)
+
+	// without query params, e.g. in a background job
+	request, err = BuildTypedCtxNoDbNoGin("job", "1", []string{}).PageRequest(20, 100)
+	assert.Nil(err)
+	assert.Equal(paging.Request{Limit: 20}, request)
+}
+
+type errorWithStatus struct{}
+
+func (e errorWithStatus) Error() string   { return "for test" }
+func (e errorWithStatus) HTTPStatus() int { return http.StatusConflict }
+
+func TestHandleError_status(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{name: "default", err: errors.New("for test"), expected: http.StatusBadRequest},
+		{name: "with status", err: fmt.Errorf("wrapped: %w", errorWithStatus{}), expected: http.StatusConflict},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("GET", "/", nil)
+
+			BuildTypedCtx(c, nil).HandleError(tc.err, "for test", logging.GetLog("test"))
+
+			assert.Equal(t, tc.expected, w.Code)
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package fwctx
+
+import (
+	"sync"
+	"time"
+)
+
+// the database statements run on behalf of a call, recorded by `database.QueryStatsPlugin`, see ICtx.GetQueryStats().
+// safe for concurrent use, e.g. by goroutines started by the handler.
+type QueryStats struct {
+	mutex    sync.Mutex
+	count    int
+	duration time.Duration
+
+	// the number of times each statement was run, by its SQL with placeholders rather than values
+	statements map[string]int
+}
+
+func (s *QueryStats) Record(statement string, duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.statements == nil {
+		s.statements = map[string]int{}
+	}
+	s.count++
+	s.duration += duration
+	s.statements[statement]++
+}
+
+// the number of statements
+func (s *QueryStats) Count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.count
+}
+
+// the total time taken by the statements
+func (s *QueryStats) Duration() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.duration
+}
+
+// returns the statements which were run at least n times, with the number of times, e.g. the same select for each
+// row of a list, known as the N+1 problem
+func (s *QueryStats) Repeated(n int) map[string]int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	repeated := map[string]int{}
+	for statement, count := range s.statements {
+		if count >= n {
+			repeated[statement] = count
+		}
+	}
+	return repeated
+}
@@ -1,10 +1,15 @@
 package fwctx
 
 import (
+	"context"
+	"net/http"
 	"time"
 
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database/paging"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/httpclient"
 	"github.com/abstratium-informatique-sarl/stratis/pkg/jwt"
 	"github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/policy"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
 	"go.opentelemetry.io/otel/trace"
@@ -21,40 +26,66 @@ var user jwt.User = jwt.User{
 
 type testCtx struct {
 	db *gorm.DB
-	isRollbackOnly bool
-	isTransactional bool
+	tx *Tx
+	tenant string
+	queryStats QueryStats
 }
 
 func (c *testCtx) SetDb(db *gorm.DB, isTransactional bool) {
-	c.db = db
-	c.isTransactional = isTransactional
+	if isTransactional {
+		c.tx = NewTx(db)
+	} else {
+		c.db = db
+		c.tx = nil
+	}
 }
 
 func (c *testCtx) GetDb() *gorm.DB {
+	if c.tx != nil {
+		return withICtx(c.tx.Db, c)
+	}
 	if c.db == nil {
 		panic("call SetDb for this test")
 	}
-	return c.db
+	return withICtx(c.db, c)
+}
+
+func (c *testCtx) GetTx() *Tx {
+	return c.tx
+}
+
+func (c *testCtx) SetTx(tx *Tx) {
+	c.tx = tx
 }
 
 // returns true, if #SetRollbackOnly() has been called
 func (c *testCtx) IsRollbackOnly() bool {
-	return c.isRollbackOnly
+	return c.tx != nil && c.tx.IsRollbackOnly()
 }
 
 // sets up the transaction to be rolled back
 func (c *testCtx) SetRollbackOnly() {
-	if c.db == nil {
+	if c.tx != nil {
+		c.tx.SetRollbackOnly()
+	} else if c.db == nil {
 		// ignore
 	} else {
-		if !c.isTransactional {
-			panic("unable to rollback non-transactional connection")
-		} else {
-			c.isRollbackOnly = true
-		}
+		panic("unable to rollback non-transactional connection")
 	}
 }
 
+func (c *testCtx) AfterCommit(f func()) {
+	afterCommit(c, f)
+}
+
+func (c *testCtx) AfterRollback(f func()) {
+	afterRollback(c, f)
+}
+
+func (c *testCtx) Publish(topic string, payload any) error {
+	return publish(c, topic, payload)
+}
+
 func (c *testCtx) GetGinCtx() *gin.Context {
 	return nil
 }
@@ -71,6 +102,10 @@ func (c *testCtx) QueryParamAsInt(name string) (int, error) {
 	return 0, nil
 }
 
+func (c *testCtx) PageRequest(defaultLimit int, maxLimit int) (paging.Request, error) {
+	return paging.Parse(c.QueryParamAsString, defaultLimit, maxLimit)
+}
+
 func (c *testCtx) RequestBodyAsString() (string, error) {
 	panic("not supported yet")
 }
@@ -83,6 +118,10 @@ func (c *testCtx) GetUser() (*jwt.User, error) {
 	return &user, nil
 }
 
+func (c *testCtx) GetRealUser() (*jwt.User, error) {
+	return RealUser(&user), nil
+}
+
 func (c *testCtx) UserHasARole(rolesAllowed []string) (bool, error) {
 	user, err := c.GetUser()
 	if err != nil {
@@ -91,6 +130,22 @@ func (c *testCtx) UserHasARole(rolesAllowed []string) (bool, error) {
 	return UserHasARole(rolesAllowed, user), nil
 }
 
+func (c *testCtx) Authorize(permission string, resource any) (bool, error) {
+	user, err := c.GetUser()
+	if err != nil {
+		panic("how did that happen?")
+	}
+	return policy.Authorize(user, permission, resource).Allowed, nil
+}
+
+func (c *testCtx) GetTenant() string {
+	return c.tenant
+}
+
+func (c *testCtx) SetTenant(tenant string) {
+	c.tenant = tenant
+}
+
 func (c *testCtx) Debug(format string, a ...any) {
 	packageName, _/*funcName*/ := getCallerInfo(0)
 	l := logging.GetLog(packageName).With().Logger()
@@ -124,7 +179,22 @@ func (c *testCtx) StartSpan(name string, isRemote bool) trace.Span {
 	return nil
 }
 
+func (c *testCtx) HTTPClient() *http.Client {
+	return httpclient.New(context.Background(), nil, c.GetRequestId(), httpclient.Credentials{})
+}
+
+func (c *testCtx) GetRequestId() string {
+	return "test"
+}
+
+func (c *testCtx) GetQueryStats() *QueryStats {
+	return &c.queryStats
+}
+
 func BuildTypedCtxForTests(db *gorm.DB, isTransactional bool) ICtx {
-	var ctx = &testCtx{db, false, isTransactional}
+	var ctx = &testCtx{}
+	if db != nil {
+		ctx.SetDb(db, isTransactional)
+	}
 	return ICtx(ctx)
 }
@@ -0,0 +1,152 @@
+package fwctx
+
+import (
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/outbox"
+	"gorm.io/gorm"
+)
+
+var highestTxId atomic.Int64
+
+// the state of a database transaction. it is set into the ICtx while the transaction is active, and is shared by all
+// the nested calls to `database.WithTx` which take part in it, so that e.g. SetRollbackOnly() applies to all of them.
+// a nested transaction is a savepoint within its parent's transaction, and has its own state.
+type Tx struct {
+	Id int64
+
+	// the transaction, i.e. the connection to use
+	Db *gorm.DB
+
+	// the transaction this one is nested in, or nil
+	Parent *Tx
+
+	rollbackOnly bool
+
+	// true once rows have been written in the transaction, or one nested in it
+	wroteRows bool
+
+	afterCommit   []func()
+	afterRollback []func()
+}
+
+// creates the state of a new transaction which uses the given connection
+func NewTx(db *gorm.DB) *Tx {
+	return &Tx{Id: highestTxId.Add(1), Db: db}
+}
+
+// creates the state of a transaction nested in this one, which uses the same connection
+func (t *Tx) Nested() *Tx {
+	nested := NewTx(t.Db)
+	nested.Parent = t
+	return nested
+}
+
+// the name of the savepoint of a nested transaction
+func (t *Tx) Savepoint() string {
+	return "stratis_sp_" + strconv.FormatInt(t.Id, 10)
+}
+
+func (t *Tx) IsRollbackOnly() bool {
+	return t.rollbackOnly
+}
+
+// marks the transaction so that it is rolled back rather than committed, once the outermost call to `database.WithTx`
+// which takes part in it, completes
+func (t *Tx) SetRollbackOnly() {
+	t.rollbackOnly = true
+}
+
+// marks that rows have been written in the transaction, and the ones it is nested in. called by the database package,
+// if there are read replicas, so that the client can be pinned to the primary.
+func (t *Tx) MarkWritten() {
+	for tx := t; tx != nil; tx = tx.Parent {
+		tx.wroteRows = true
+	}
+}
+
+// true if rows have been written in the transaction, or one nested in it, so far
+func (t *Tx) HasWritten() bool {
+	return t.wroteRows
+}
+
+// registers a function to be called once the transaction has been committed, e.g. to send an email
+func (t *Tx) AfterCommit(f func()) {
+	t.afterCommit = append(t.afterCommit, f)
+}
+
+// registers a function to be called once the transaction has been rolled back. for a nested transaction, that is
+// when it is rolled back to its savepoint, or when its parent is rolled back.
+func (t *Tx) AfterRollback(f func()) {
+	t.afterRollback = append(t.afterRollback, f)
+}
+
+// called by `database.WithTx` once the transaction has been committed. calls the functions registered with AfterCommit(),
+// in order. a panic in one of them is logged, and does not stop the others from being called.
+func (t *Tx) RunAfterCommitHooks() {
+	hooks := t.afterCommit
+	t.afterCommit, t.afterRollback = nil, nil
+	for _, hook := range hooks {
+		runHook("after commit", t.Id, hook)
+	}
+}
+
+// called by `database.WithTx` once the transaction has been rolled back, see RunAfterCommitHooks()
+func (t *Tx) RunAfterRollbackHooks() {
+	hooks := t.afterRollback
+	t.afterCommit, t.afterRollback = nil, nil
+	for _, hook := range hooks {
+		runHook("after rollback", t.Id, hook)
+	}
+}
+
+// called by `database.WithTx` once a nested transaction has been released, so that its functions are called once the
+// parent transaction completes
+func (t *Tx) MergeHooksIntoParent() {
+	t.Parent.afterCommit = append(t.Parent.afterCommit, t.afterCommit...)
+	t.Parent.afterRollback = append(t.Parent.afterRollback, t.afterRollback...)
+	t.afterCommit, t.afterRollback = nil, nil
+}
+
+func runHook(kind string, txId int64, hook func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log := logging.GetLog("ctx")
+			log.Error().Msgf("%s hook of TX %d panicked: %v\n%s", kind, txId, r, debug.Stack())
+		}
+	}()
+	hook()
+}
+
+// the implementation of ICtx.AfterCommit(), common to all contexts
+func afterCommit(c ICtx, f func()) {
+	if tx := c.GetTx(); tx != nil {
+		tx.AfterCommit(f)
+	} else {
+		runHook("after commit", 0, f) // there is nothing to wait for
+	}
+}
+
+// the implementation of ICtx.AfterRollback(), common to all contexts
+func afterRollback(c ICtx, f func()) {
+	if tx := c.GetTx(); tx != nil {
+		tx.AfterRollback(f)
+	}
+}
+
+// the implementation of ICtx.Publish(), common to all contexts. the relays are woken up once the transaction has been
+// committed, so that the message is published promptly.
+func publish(c ICtx, topic string, payload any) error {
+	tx := c.GetTx()
+	if tx == nil {
+		return outbox.ErrorNoTransaction
+	}
+	if err := outbox.Insert(c.GetDb(), topic, payload, c.GetRequestId(), c.GetTenant()); err != nil {
+		return err
+	}
+	tx.AfterCommit(outbox.Notify)
+	return nil
+}
@@ -0,0 +1,69 @@
+package fwctx
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestTx_hooksAreCalledInOrderAndIsolated(t *testing.T) {
+	assert := assert.New(t)
+	tx := NewTx(&gorm.DB{})
+	calls := []string{}
+	tx.AfterCommit(func() { calls = append(calls, "commit 1") })
+	tx.AfterCommit(func() { panic("for test") })
+	tx.AfterCommit(func() { calls = append(calls, "commit 2") })
+	tx.AfterRollback(func() { calls = append(calls, "rollback") })
+
+	// when
+	tx.RunAfterCommitHooks()
+	tx.RunAfterCommitHooks()
+	tx.RunAfterRollbackHooks()
+
+	// then
+	assert.Equal([]string{"commit 1", "commit 2"}, calls)
+}
+
+func TestTx_mergeHooksIntoParent(t *testing.T) {
+	assert := assert.New(t)
+	parent := NewTx(&gorm.DB{})
+	nested := parent.Nested()
+	calls := []string{}
+	parent.AfterRollback(func() { calls = append(calls, "parent") })
+	nested.AfterRollback(func() { calls = append(calls, "nested") })
+
+	// when
+	nested.MergeHooksIntoParent()
+	parent.RunAfterRollbackHooks()
+
+	// then
+	assert.Equal([]string{"parent", "nested"}, calls)
+}
+
+func TestAfterCommit_consistentAcrossContexts(t *testing.T) {
+	contexts := map[string]ICtx{
+		"gin":        buildCtx(""),
+		"background": BuildTypedCtxNoDbNoGin("job", "1", []string{}),
+		"test":       BuildTypedCtxForTests(nil, false),
+	}
+	for name, ctx := range contexts {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			calls := []string{}
+
+			// without a transaction, after commit hooks are called immediately and after rollback hooks never
+			ctx.AfterCommit(func() { calls = append(calls, "immediately") })
+			ctx.AfterRollback(func() { calls = append(calls, "never") })
+			assert.Equal([]string{"immediately"}, calls)
+
+			// with one, they are registered with it
+			ctx.SetTx(NewTx(&gorm.DB{}))
+			ctx.AfterCommit(func() { calls = append(calls, "commit") })
+			ctx.AfterRollback(func() { calls = append(calls, "rollback") })
+			assert.Equal([]string{"immediately"}, calls)
+			ctx.GetTx().RunAfterRollbackHooks()
+			assert.Equal([]string{"immediately", "rollback"}, calls)
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package httpclient
+
+// an http client for outbound calls made while handling a call or running a background job. it is normally obtained
+// using `ctx.HTTPClient()` and
+//
+//   - uses the context of the call, so that its deadline and cancellation apply to the outbound call
+//   - creates a client span and injects the W3C `traceparent` header, so that traces continue in the called service
+//   - sets the X-Request-Id header, so that logs can be correlated across services
+//   - forwards the caller's token to trusted hosts, or exchanges it, see SetTokenExchanger()
+//   - records prometheus metrics, if Setup() was called
+//   - logs requests and responses with sensitive headers redacted, if STRATIS_HTTP_CLIENT_LOG is "true"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/samber/lo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const _STRATIS_HTTP_CLIENT_TIMEOUT = "STRATIS_HTTP_CLIENT_TIMEOUT"
+const _STRATIS_HTTP_CLIENT_LOG = "STRATIS_HTTP_CLIENT_LOG"
+const _STRATIS_HTTP_CLIENT_FORWARD_TOKEN_HOSTS = "STRATIS_HTTP_CLIENT_FORWARD_TOKEN_HOSTS"
+
+const _TOKEN_COOKIE_NAME = "token"
+const _REQUEST_ID_HEADER = "X-Request-Id"
+
+var log = logging.GetLog("httpclient")
+
+var requestsProcessed *prometheus.CounterVec
+var requestsHistogram *prometheus.HistogramVec
+
+// the credentials of the caller, in the form they arrived in
+type Credentials struct {
+	// the value of the Authorization header, used by service users
+	Authorization string
+
+	// the value of the token cookie, used by normal users
+	TokenCookie string
+}
+
+func (c Credentials) isEmpty() bool {
+	return len(c.Authorization) == 0 && len(c.TokenCookie) == 0
+}
+
+// exchanges the caller's credentials for credentials to use when calling the given host, e.g. for a service token
+var tokenExchanger func(ctx context.Context, host string, credentials Credentials) (Credentials, error)
+
+// enables the http client metrics
+func Setup(prefix string) {
+	requestsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_http_client_request_count",
+		Help: "The total number of outbound calls made, regardless of status code",
+	}, []string{"code", "method", "host"})
+
+	requestsHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    prefix + "_http_client_latency_histogram",
+		Help:    "The latency in ms of outbound calls",
+		Buckets: prometheus.ExponentialBuckets(4, 2, 8),
+	}, []string{"method", "host"})
+}
+
+// sets a function which is called before each outbound call, to exchange the caller's credentials for ones to use for
+// the called host. if none is set, the credentials are only forwarded as they are to the hosts listed in
+// STRATIS_HTTP_CLIENT_FORWARD_TOKEN_HOSTS (comma separated), and never to any other host.
+func SetTokenExchanger(exchanger func(ctx context.Context, host string, credentials Credentials) (Credentials, error)) {
+	tokenExchanger = exchanger
+}
+
+// creates a new client.
+//
+// `parent` is the context of the call or job, whose deadline and cancellation are applied to every request
+// `startSpan` is used to create the client span, and may be nil or return nil
+// `requestId` is the id of the call or job, sent in the X-Request-Id header
+// `credentials` are those of the caller, to be forwarded or exchanged
+func New(parent context.Context, startSpan func(name string, isRemote bool) trace.Span, requestId string, credentials Credentials) *http.Client {
+	var base http.RoundTripper = http.DefaultTransport
+	if os.Getenv(_STRATIS_HTTP_CLIENT_LOG) == "true" {
+		base = &logging.Transport{Transport: base}
+	}
+	return &http.Client{
+		Transport: &Transport{
+			Transport:   base,
+			parent:      parent,
+			startSpan:   startSpan,
+			requestId:   requestId,
+			credentials: credentials,
+		},
+		Timeout: getTimeout(),
+	}
+}
+
+// Transport implements http.RoundTripper
+type Transport struct {
+	Transport   http.RoundTripper
+	parent      context.Context
+	startSpan   func(name string, isRemote bool) trace.Span
+	requestId   string
+	credentials Credentials
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, release := t.withParent(req.Context())
+	req = req.Clone(ctx) // a RoundTripper must not modify the request it is given
+
+	var span trace.Span
+	if t.startSpan != nil {
+		span = t.startSpan(req.Method+" "+req.URL.Host, true)
+	}
+	if span != nil {
+		defer span.End()
+		span.SetAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.Redacted()),
+		)
+		ctx = trace.ContextWithSpan(ctx, span)
+	}
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if len(t.requestId) > 0 && len(req.Header.Get(_REQUEST_ID_HEADER)) == 0 {
+		req.Header.Set(_REQUEST_ID_HEADER, t.requestId)
+	}
+
+	if err := t.addCredentials(req); err != nil {
+		release()
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := t.Transport.RoundTrip(req)
+	elapsed := time.Since(start)
+	if err != nil {
+		release()
+	} else {
+		resp.Body = &releasingBody{resp.Body, release} // the context must live until the body has been read
+	}
+
+	code := "error"
+	if err == nil {
+		code = fmt.Sprintf("%d", resp.StatusCode)
+	}
+	if requestsProcessed != nil {
+		requestsProcessed.With(prometheus.Labels{"code": code, "method": req.Method, "host": req.URL.Host}).Inc()
+		requestsHistogram.With(prometheus.Labels{"method": req.Method, "host": req.URL.Host}).Observe(float64(elapsed.Milliseconds()))
+	}
+	if span != nil {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+			if resp.StatusCode >= 500 {
+				span.SetStatus(codes.Error, code)
+			}
+		}
+	}
+	log.Debug().Msgf("%s %s => %s after %s", req.Method, req.URL.Redacted(), code, elapsed)
+
+	return resp, err
+}
+
+// returns a context which is cancelled when either the request's context or the parent context is done, e.g. because the
+// deadline of the call being handled has been exceeded. the returned function must be called once the response is no
+// longer needed.
+func (t *Transport) withParent(ctx context.Context) (context.Context, func()) {
+	if t.parent == nil {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	if deadline, ok := t.parent.Deadline(); ok {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithDeadline(ctx, deadline)
+		cancelBoth := cancel
+		cancel = func() { cancelDeadline(); cancelBoth() }
+	}
+	stop := context.AfterFunc(t.parent, func() {
+		if !errors.Is(t.parent.Err(), context.DeadlineExceeded) {
+			cancel() // otherwise leave it to the deadline set above, so that the error is the same as the parent's
+		}
+	})
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
+
+func (t *Transport) addCredentials(req *http.Request) error {
+	if t.credentials.isEmpty() || len(req.Header.Get("Authorization")) > 0 {
+		return nil // nothing to forward, or the caller has set their own credentials
+	}
+
+	credentials := t.credentials
+	if tokenExchanger != nil {
+		var err error
+		credentials, err = tokenExchanger(req.Context(), req.URL.Host, credentials)
+		if err != nil {
+			return fmt.Errorf("STRATIS-1018 failed to exchange token for call to %s: %w", req.URL.Host, err)
+		}
+	} else if !lo.Contains(getForwardTokenHosts(), req.URL.Host) {
+		return nil // never leak tokens to hosts which are not trusted
+	}
+
+	if len(credentials.Authorization) > 0 {
+		req.Header.Set("Authorization", credentials.Authorization)
+	}
+	if len(credentials.TokenCookie) > 0 {
+		req.AddCookie(&http.Cookie{Name: _TOKEN_COOKIE_NAME, Value: credentials.TokenCookie})
+	}
+	return nil
+}
+
+func getForwardTokenHosts() []string {
+	hosts := os.Getenv(_STRATIS_HTTP_CLIENT_FORWARD_TOKEN_HOSTS)
+	if len(hosts) == 0 {
+		return []string{}
+	}
+	return lo.Map(strings.Split(hosts, ","), func(h string, _ int) string {
+		return strings.TrimSpace(h)
+	})
+}
+
+// the overall timeout of a call, from STRATIS_HTTP_CLIENT_TIMEOUT, e.g. "10s", default 30 seconds.
+// the deadline of the context is applied in addition.
+func getTimeout() time.Duration {
+	s := os.Getenv(_STRATIS_HTTP_CLIENT_TIMEOUT)
+	if len(s) == 0 {
+		return 30 * time.Second
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		panic("please set env var for http client timeout to a duration like 10s")
+	}
+	return d
+}
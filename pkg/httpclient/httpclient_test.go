@@ -0,0 +1,115 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newServer(t *testing.T, requests chan *http.Request) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTransport_injectsTraceparent(t *testing.T) {
+	assert := assert.New(t)
+	requests := make(chan *http.Request, 1)
+	server := newServer(t, requests)
+	tracer := sdktrace.NewTracerProvider().Tracer("test")
+	var span trace.Span
+	startSpan := func(name string, isRemote bool) trace.Span {
+		_, span = tracer.Start(context.Background(), name, trace.WithSpanKind(trace.SpanKindClient))
+		return span
+	}
+
+	// when
+	_, err := New(context.Background(), startSpan, "r1", Credentials{}).Get(server.URL)
+
+	// then
+	assert.Nil(err)
+	r := <-requests
+	expected := "00-" + span.SpanContext().TraceID().String() + "-" + span.SpanContext().SpanID().String() + "-01"
+	assert.Equal(expected, r.Header.Get("traceparent"))
+	assert.Equal("r1", r.Header.Get("X-Request-Id"))
+}
+
+func TestTransport_forwardsTokenOnlyToTrustedHosts(t *testing.T) {
+	assert := assert.New(t)
+	requests := make(chan *http.Request, 1)
+	server := newServer(t, requests)
+	host, _ := url.Parse(server.URL)
+	credentials := Credentials{Authorization: "secret", TokenCookie: "jwt"}
+
+	// when
+	os.Setenv(_STRATIS_HTTP_CLIENT_FORWARD_TOKEN_HOSTS, "")
+	_, err := New(context.Background(), nil, "", credentials).Get(server.URL)
+
+	// then
+	assert.Nil(err)
+	r := <-requests
+	assert.Empty(r.Header.Get("Authorization"))
+	assert.Empty(r.Cookies())
+
+	// when
+	os.Setenv(_STRATIS_HTTP_CLIENT_FORWARD_TOKEN_HOSTS, "other:1234, "+host.Host)
+	defer os.Unsetenv(_STRATIS_HTTP_CLIENT_FORWARD_TOKEN_HOSTS)
+	_, err = New(context.Background(), nil, "", credentials).Get(server.URL)
+
+	// then
+	assert.Nil(err)
+	r = <-requests
+	assert.Equal("secret", r.Header.Get("Authorization"))
+	cookie, err := r.Cookie(_TOKEN_COOKIE_NAME)
+	assert.Nil(err)
+	assert.Equal("jwt", cookie.Value)
+}
+
+func TestTransport_exchangesToken(t *testing.T) {
+	assert := assert.New(t)
+	requests := make(chan *http.Request, 1)
+	server := newServer(t, requests)
+	SetTokenExchanger(func(ctx context.Context, host string, credentials Credentials) (Credentials, error) {
+		return Credentials{Authorization: "exchanged-" + credentials.TokenCookie}, nil
+	})
+	defer SetTokenExchanger(nil)
+
+	// when
+	_, err := New(context.Background(), nil, "", Credentials{TokenCookie: "jwt"}).Get(server.URL)
+
+	// then
+	assert.Nil(err)
+	r := <-requests
+	assert.Equal("exchanged-jwt", r.Header.Get("Authorization"))
+	assert.Empty(r.Cookies())
+}
+
+func TestTransport_usesDeadlineOfParent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+	parent, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// when
+	_, err := New(parent, nil, "", Credentials{}).Get(server.URL)
+
+	// then
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%+v", err)
+}
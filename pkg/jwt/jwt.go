@@ -24,12 +24,28 @@ type User struct {
 	Expires float64 `json:"expires"`
 	Roles []string `json:"roles"`
 	UserContext UserContext `json:"usercontext"`
+
+	// set if the user is being impersonated, in which case it contains the real user, i.e. the one who is acting as this user.
+	// it comes out of the `act` (actor) claim of the token, see https://datatracker.ietf.org/doc/html/rfc8693#section-4.1
+	Actor *Actor `json:"actor,omitempty"`
+}
+
+// the real user behind an impersonated user
+type Actor struct {
+	Username string `json:"username"`
+	UserId string `json:"userid"`
+	Roles []string `json:"roles"`
 }
 
 func (u *User) IsAnonymous() bool {
 	return u.Username == ANONYMOUS
 }
 
+// true if the user is being impersonated by someone else, see `Actor`
+func (u *User) IsImpersonated() bool {
+	return u.Actor != nil
+}
+
 var log zerolog.Logger
 
 func Setup() {
@@ -73,6 +89,28 @@ func CreateSignedToken(accountId string, accountUsername string, roles []string)
 	return token.SignedString([]byte(os.Getenv(_STRATIS_JWT_KEY_ENV_NAME)))
 }
 
+// creates a token for the given account, but which also contains an `act` claim containing the actor, i.e. the real user who
+// is impersonating the account. the actor must not itself be impersonated, i.e. impersonation cannot be chained.
+func CreateSignedTokenActingAs(actor *User, accountId string, accountUsername string, roles []string) (tokenString string, err error) {
+	if actor.IsImpersonated() {
+		return "", fmt.Errorf("STRATIS-1012 user %s is already impersonating %s", actor.Actor.UserId, actor.UserId)
+	}
+	token := gljwt.NewWithClaims(gljwt.SigningMethodHS256, gljwt.MapClaims{
+		"exp": time.Now().Add(60*time.Minute).Unix()*1_000, // ms
+		"uid": accountId,
+		"sub": accountUsername,
+		"iss": os.Getenv(_STRATIS_JWT_ISSUER_ENV_NAME),
+		"roles": roles,
+		"act": map[string]any{
+			"uid": actor.UserId,
+			"sub": actor.Username,
+			"roles": actor.Roles,
+		},
+	})
+
+	return token.SignedString([]byte(os.Getenv(_STRATIS_JWT_KEY_ENV_NAME)))
+}
+
 // https://pkg.go.dev/github.com/golang-jwt/jwt/v5#example-Parse-Hmac
 func VerifyToken(jwToken string) (*User, error) {
 	token, err := gljwt.Parse(jwToken, func(token *gljwt.Token) (any, error) {
@@ -107,14 +145,40 @@ func VerifyToken(jwToken string) (*User, error) {
 		return fmt.Sprint(e)
 	})
 
+	var actor *Actor
+	if act, ok := t["act"]; ok {
+		actor, err = parseActor(act)
+		if err != nil { return nil, err }
+	}
+
 	user := &User{
 		Username: username,
 		UserId:   userid,
 		Expires:  expiry,
 		Roles:    roles,
 		UserContext: map[string]string{}, // currently, we don't support adding any context from a jwt token, that is reserved for service users and their tokens where the context is the application and organisation
+		Actor:    actor,
 	}
 
 	return user, nil
 }
 
+func parseActor(act any) (*Actor, error) {
+	m, ok := act.(map[string]any)
+	if !ok { return nil, fmt.Errorf("token contains an invalid act claim: %+v", act) }
+
+	username, ok := m["sub"].(string)
+	if !ok { return nil, fmt.Errorf("act claim does not contain a sub: %+v", m) }
+
+	userid, ok := m["uid"].(string)
+	if !ok { return nil, fmt.Errorf("act claim does not contain a uid: %+v", m) }
+
+	slice, ok := m["roles"].([]any)
+	if !ok { return nil, fmt.Errorf("act claim does not contain roles as expected: %+v", m) }
+	roles := lo.Map(slice, func(e any, i int) string {
+		return fmt.Sprint(e)
+	})
+
+	return &Actor{Username: username, UserId: userid, Roles: roles}, nil
+}
+
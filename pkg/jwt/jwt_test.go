@@ -0,0 +1,65 @@
+package jwt
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv(_STRATIS_JWT_ISSUER_ENV_NAME, "test-issuer")
+	os.Setenv(_STRATIS_JWT_KEY_ENV_NAME, "test-key")
+	Setup()
+
+	os.Exit(m.Run())
+}
+
+func TestVerifyToken_withoutActor(t *testing.T) {
+	assert := assert.New(t)
+
+	token, err := CreateSignedToken("1", "john.smith", []string{"role1"})
+	assert.Nil(err)
+
+	// when
+	user, err := VerifyToken(token)
+
+	// then
+	assert.Nil(err)
+	assert.Equal("1", user.UserId)
+	assert.Equal("john.smith", user.Username)
+	assert.Equal([]string{"role1"}, user.Roles)
+	assert.False(user.IsImpersonated())
+	assert.Nil(user.Actor)
+}
+
+func TestVerifyToken_withActor(t *testing.T) {
+	assert := assert.New(t)
+
+	admin := &User{Username: "jane.admin", UserId: "2", Roles: []string{"admin"}}
+	token, err := CreateSignedTokenActingAs(admin, "1", "john.smith", []string{"customer"})
+	assert.Nil(err)
+
+	// when
+	user, err := VerifyToken(token)
+
+	// then
+	assert.Nil(err)
+	assert.Equal("1", user.UserId)
+	assert.Equal("john.smith", user.Username)
+	assert.Equal([]string{"customer"}, user.Roles)
+	assert.True(user.IsImpersonated())
+	assert.Equal(&Actor{Username: "jane.admin", UserId: "2", Roles: []string{"admin"}}, user.Actor)
+}
+
+func TestCreateSignedTokenActingAs_cannotBeChained(t *testing.T) {
+	assert := assert.New(t)
+
+	impersonated := &User{Username: "john.smith", UserId: "1", Roles: []string{"customer"}, Actor: &Actor{Username: "jane.admin", UserId: "2", Roles: []string{"admin"}}}
+
+	// when
+	_, err := CreateSignedTokenActingAs(impersonated, "3", "someone.else", []string{"customer"})
+
+	// then
+	assert.ErrorContains(err, "STRATIS-1012")
+}
@@ -56,9 +56,9 @@ func setupLog() {
 		output := zerolog.ConsoleWriter{
 			Out: os.Stdout, 
 			TimeFormat: "2006-01-02T15:04:05.000",
-			PartsOrder: []string{"time", "level", "component", "traceId", "message"},
+			PartsOrder: []string{"time", "level", "component", "traceId", "requestId", "message"},
 			PartsExclude: []string{},
-			FieldsExclude: []string{"component", "traceId"},
+			FieldsExclude: []string{"component", "traceId", "requestId"},
 		}
 		output.FormatLevel = func(i any) string {
 			if i == nil {
@@ -90,6 +90,8 @@ func setupLog() {
 					return abbreviateIfNecessary(s[4:])
 				} else if strings.HasPrefix(s, "tid:") {
 					return fmt.Sprintf("|%straceId: %s%s", COLOR_CYAN, s[4:], COLOR_NONE)
+				} else if strings.HasPrefix(s, "rid:") {
+					return fmt.Sprintf("|%srequestId: %s%s", COLOR_CYAN, s[4:], COLOR_NONE)
 				} else {
 					return strings.ToUpper(s)
 				}
@@ -0,0 +1,155 @@
+package oauth
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/audit"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/framework_gin"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/jwt"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+	"gorm.io/gorm"
+)
+
+// maps a role held by the actor (the real user), to the roles which an account may have, in order for it to be
+// impersonated by that actor. an account may only be impersonated if ALL of its roles are allowed, so that e.g.
+// support staff cannot impersonate an administrator and so gain their roles. an account without any roles may only be
+// impersonated if NO_ROLES is allowed, since nothing is known about it. e.g.
+//
+//     oauth.SetupImpersonation(oauth.ImpersonationRules{
+//         "admin":   {"support", "customer", oauth.NO_ROLES},
+//         "support": {"customer"},
+//     })
+type ImpersonationRules map[string][]string
+
+// allows accounts which have no roles at all to be impersonated, see ImpersonationRules
+const NO_ROLES = ""
+
+type ImpersonationRequest struct {
+	Username string `json:"username"`
+}
+
+var _impersonationRules ImpersonationRules
+
+// enables the impersonation endpoints which are added by AddAll:
+//
+//   - POST /oauth/impersonate with an `ImpersonationRequest` body, which replaces the token cookie with one for the given user,
+//     containing the actor in its `act` claim
+//   - POST /oauth/impersonate/end which replaces the token cookie with one for the actor again
+func SetupImpersonation(rules ImpersonationRules) {
+	_impersonationRules = rules
+}
+
+// returns true if the actor may impersonate the target account
+func (r ImpersonationRules) Allows(actor *jwt.User, target Account) bool {
+	if actor.IsAnonymous() || actor.IsImpersonated() || actor.UserId == target.Id {
+		return false
+	}
+	for _, role := range actor.Roles {
+		impersonatable, ok := r[role]
+		if !ok {
+			continue
+		}
+		if len(target.Roles) == 0 {
+			if lo.Contains(impersonatable, NO_ROLES) {
+				return true
+			}
+		} else if lo.Every(impersonatable, target.Roles) {
+			return true
+		}
+	}
+	return false
+}
+
+// the roles which are allowed to impersonate anyone at all
+func (r ImpersonationRules) actorRoles() []string {
+	return lo.Keys(r)
+}
+
+func addImpersonation(api gin.IRoutes, accountProvider func(fwctx.ICtx, string) (Account, error)) {
+	api.POST("/impersonate", framework_gin.SecurityMiddleware(_impersonationRules.actorRoles(), nil), func(c *gin.Context) {
+		postImpersonate(c, accountProvider)
+	})
+	api.POST("/impersonate/end", func(c *gin.Context) {
+		postEndImpersonation(c, accountProvider)
+	})
+}
+
+func postImpersonate(c *gin.Context, accountProvider func(fwctx.ICtx, string) (Account, error)) {
+	log := logging.GetLog("oauth")
+	ctx := fwctx.BuildTypedCtx(c, nil)
+	actor, err := ctx.GetUser()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	o := &ImpersonationRequest{}
+	if err := ctx.UnmarshalRequestBody(o); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	account, err := accountProvider(ctx, o.Username)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.Status(http.StatusBadRequest)
+		} else {
+			c.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	if !_impersonationRules.Allows(actor, account) {
+		log.Warn().Msgf("IMPERSONATION: user %s (%s) with roles %v is not allowed to impersonate user %s (%s) with roles %v", actor.UserId, actor.Username, actor.Roles, account.Id, account.Username, account.Roles)
+		audit.Security(ctx, audit.ACTION_IMPERSONATION_DENIED, map[string]string{"impersonatedId": account.Id, "impersonatedUsername": account.Username})
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	jwToken, err := jwt.CreateSignedTokenActingAs(actor, account.Id, account.Username, account.Roles)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	setCookie(c, fwctx.TOKEN_COOKIE_NAME, jwToken)
+
+	log.Info().Msgf("IMPERSONATION: user %s (%s) started acting as user %s (%s)", actor.UserId, actor.Username, account.Id, account.Username)
+	audit.Security(ctx, audit.ACTION_IMPERSONATION_STARTED, map[string]string{"impersonatedId": account.Id, "impersonatedUsername": account.Username})
+	c.Status(http.StatusNoContent)
+}
+
+func postEndImpersonation(c *gin.Context, accountProvider func(fwctx.ICtx, string) (Account, error)) {
+	log := logging.GetLog("oauth")
+	ctx := fwctx.BuildTypedCtx(c, nil)
+	user, err := ctx.GetUser()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if !user.IsImpersonated() {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	// read the actor again, rather than trusting the roles in the token, in case they have changed in the meantime
+	account, err := accountProvider(ctx, user.Actor.Username)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	jwToken, err := jwt.CreateSignedToken(account.Id, account.Username, account.Roles)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	setCookie(c, fwctx.TOKEN_COOKIE_NAME, jwToken)
+
+	log.Info().Msgf("IMPERSONATION: user %s (%s) stopped acting as user %s (%s)", user.Actor.UserId, user.Actor.Username, user.UserId, user.Username)
+	audit.Security(ctx, audit.ACTION_IMPERSONATION_ENDED, nil) // the user in the ctx is still the impersonated one
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,49 @@
+package oauth
+
+import (
+	"testing"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImpersonationRules_Allows(t *testing.T) {
+	rules := ImpersonationRules{
+		"admin":   {"support", "customer"},
+		"support": {"customer"},
+		"root":    {NO_ROLES},
+	}
+	admin := &jwt.User{Username: "admin", UserId: "1", Roles: []string{"admin"}}
+	support := &jwt.User{Username: "support", UserId: "2", Roles: []string{"support"}}
+	impersonatedAdmin := &jwt.User{Username: "customer", UserId: "3", Roles: []string{"customer"}, Actor: &jwt.Actor{Username: "admin", UserId: "1", Roles: []string{"admin"}}}
+	anonymous := &jwt.User{Username: jwt.ANONYMOUS, UserId: "0", Roles: []string{}}
+
+	customerAccount := Account{Id: "3", Username: "customer", Roles: []string{"customer"}}
+	supportAccount := Account{Id: "2", Username: "support", Roles: []string{"support"}}
+	mixedAccount := Account{Id: "4", Username: "mixed", Roles: []string{"customer", "admin"}}
+	accountWithoutRoles := Account{Id: "5", Username: "new", Roles: []string{}}
+
+	testCases := []struct {
+		name     string
+		actor    *jwt.User
+		target   Account
+		expected bool
+	}{
+		{"admin impersonates customer", admin, customerAccount, true},
+		{"admin impersonates support", admin, supportAccount, true},
+		{"support impersonates customer", support, customerAccount, true},
+		{"support cannot impersonate support", support, supportAccount, false},
+		{"nobody can impersonate an account with a role that is not allowed", admin, mixedAccount, false},
+		{"impersonation cannot be chained", impersonatedAdmin, supportAccount, false},
+		{"anonymous cannot impersonate", anonymous, customerAccount, false},
+		{"nobody can impersonate an account without roles unless it is allowed", support, accountWithoutRoles, false},
+		{"an account without roles can be impersonated if it is allowed", &jwt.User{Username: "root", UserId: "6", Roles: []string{"root"}}, accountWithoutRoles, true},
+		{"cannot impersonate oneself", support, Account{Id: "2", Username: "support", Roles: []string{"customer"}}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, rules.Allows(tc.actor, tc.target))
+		})
+	}
+}
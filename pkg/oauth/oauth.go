@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/abstratium-informatique-sarl/stratis/pkg/audit"
 	"github.com/abstratium-informatique-sarl/stratis/pkg/framework_gin"
 	"github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
 	"github.com/abstratium-informatique-sarl/stratis/pkg/jwt"
@@ -139,6 +140,10 @@ func AddAll(router *gin.Engine, accountProvider func(fwctx.ICtx, string) (Accoun
 		})
 	}
 
+	if _impersonationRules != nil {
+		addImpersonation(api, accountProvider)
+	}
+
 	api.GET("/user", GetUser)
 	api.GET("/sign-out", getSignOut)
 }
@@ -164,6 +169,7 @@ func getSignInOwn(c *gin.Context, accountProvider func(fwctx.ICtx, string) (Acco
 	account, err := accountProvider(ctx, o.Username)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
+			audit.Security(ctx, audit.ACTION_SIGN_IN_FAILED, map[string]string{"provider": "own", "username": o.Username, "reason": "unknown user"})
 			c.Status(http.StatusBadRequest)
 			return
 		} else {
@@ -183,6 +189,7 @@ func getSignInOwn(c *gin.Context, accountProvider func(fwctx.ICtx, string) (Acco
 	err = bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(o.Password))
 	if err != nil {
 		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			audit.Security(ctx, audit.ACTION_SIGN_IN_FAILED, map[string]string{"provider": "own", "username": o.Username, "reason": "wrong password"})
 			// StatusBadRequest and not 40x, so that user cannot try and guess usernames
 			c.Status(http.StatusBadRequest)
 			return
@@ -382,7 +389,9 @@ func getRedirect(c *gin.Context, provider string, accountProvider func(fwctx.ICt
 		}
 	}
 	if account.Provider != provider {
+		audit.Security(fwc, audit.ACTION_SIGN_IN_FAILED, map[string]string{"provider": provider, "username": username, "reason": "wrong provider " + account.Provider})
 		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("signed in with non-%s account but username '%s' was found: %s", provider, username, account.Provider))
+		return
 	}
 
 	jwToken, err := jwt.CreateSignedToken(account.Id, account.Username, account.Roles)
@@ -396,6 +405,10 @@ func getRedirect(c *gin.Context, provider string, accountProvider func(fwctx.ICt
 	// TODO compare our timeout, to maxAge of provider token, and use lower one?
 	setCookie(c, fwctx.TOKEN_COOKIE_NAME, jwToken)
 
+	event := audit.SecurityEvent(fwc, audit.ACTION_SIGN_IN, map[string]string{"provider": provider})
+	event.UserId, event.Username = account.Id, account.Username
+	audit.Record(event)
+
 	c.Redirect(http.StatusTemporaryRedirect, state.TargetUrl)
 }
 
@@ -430,6 +443,7 @@ func GetUser(c *gin.Context) {
 }
 
 func getSignOut(c *gin.Context) {
+	audit.Security(fwctx.BuildTypedCtx(c, nil), audit.ACTION_SIGN_OUT, nil)
 	// TODO sign out of provider too
 	unsetCookie(c, fwctx.TOKEN_COOKIE_NAME)
 	c.Redirect(http.StatusTemporaryRedirect, "/")
@@ -0,0 +1,16 @@
+CREATE TABLE stratis_outbox (
+    id              BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    topic           VARCHAR(255) NOT NULL,
+    payload         LONGTEXT NOT NULL,
+    request_id      VARCHAR(128) NOT NULL,
+    tenant          VARCHAR(255) NOT NULL DEFAULT '',
+    status          VARCHAR(16) NOT NULL,
+    attempts        INT NOT NULL DEFAULT 0,
+    last_error      TEXT NULL,
+    created_at      DATETIME(6) NOT NULL,
+    next_attempt_at DATETIME(6) NOT NULL,
+    published_at    DATETIME(6) NULL,
+    claimed_by      VARCHAR(36) NULL,
+    locked_until    DATETIME(6) NULL,
+    INDEX idx_stratis_outbox_pending (status, next_attempt_at)
+);
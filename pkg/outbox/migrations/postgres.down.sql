@@ -0,0 +1 @@
+DROP TABLE stratis_outbox;
@@ -0,0 +1,16 @@
+CREATE TABLE stratis_outbox (
+    id              BIGSERIAL PRIMARY KEY,
+    topic           VARCHAR(255) NOT NULL,
+    payload         TEXT NOT NULL,
+    request_id      VARCHAR(128) NOT NULL,
+    tenant          VARCHAR(255) NOT NULL DEFAULT '',
+    status          VARCHAR(16) NOT NULL,
+    attempts        INT NOT NULL DEFAULT 0,
+    last_error      TEXT NULL,
+    created_at      TIMESTAMPTZ NOT NULL,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    published_at    TIMESTAMPTZ NULL,
+    claimed_by      VARCHAR(36) NULL,
+    locked_until    TIMESTAMPTZ NULL
+);
+CREATE INDEX idx_stratis_outbox_pending ON stratis_outbox (status, next_attempt_at);
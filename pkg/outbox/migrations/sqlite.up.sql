@@ -0,0 +1,16 @@
+CREATE TABLE stratis_outbox (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    topic           TEXT NOT NULL,
+    payload         TEXT NOT NULL,
+    request_id      TEXT NOT NULL,
+    tenant          TEXT NOT NULL DEFAULT '',
+    status          TEXT NOT NULL,
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    last_error      TEXT NULL,
+    created_at      DATETIME NOT NULL,
+    next_attempt_at DATETIME NOT NULL,
+    published_at    DATETIME NULL,
+    claimed_by      TEXT NULL,
+    locked_until    DATETIME NULL
+);
+CREATE INDEX idx_stratis_outbox_pending ON stratis_outbox (status, next_attempt_at);
@@ -0,0 +1,158 @@
+package outbox
+
+// a transactional outbox, for reliably publishing events about changes to the database. an event is published using
+// `ctx.Publish(topic, payload)`, which inserts it into the outbox table within the current transaction, so that it is
+// only ever published if the transaction is committed, and is never lost if it is. a Relay running in the background
+// then reads the pending events and hands them to a Publisher, e.g.
+//
+//     database.SetupDb()
+//     outbox.Setup("myservice")
+//     relay := outbox.NewRelay(database.GetDb(), &outbox.WebhookPublisher{URL: "https://events.local/in"}, outbox.RelayOptions{})
+//     go relay.Start(context.Background())
+//     ...
+//     database.WithTx(ctx, func() (any, error) {
+//         ...
+//         return nil, ctx.Publish("order.created", order)
+//     })
+//
+// events are published at least once, so consumers must be idempotent, e.g. using the id of the message. an event
+// which fails to be published is retried with an exponential backoff, and is moved to the dead status once it has
+// failed RelayOptions.MaxAttempts times. dead events can be published again using Redrive().
+//
+// the outbox table must be created by the migrations of the service. the SQL for each dialect can be copied from
+// the files in pkg/outbox/migrations, or obtained using MigrationSQL().
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gorm.io/gorm"
+)
+
+const STATUS_PENDING = "PENDING"
+const STATUS_PUBLISHED = "PUBLISHED"
+const STATUS_DEAD = "DEAD"
+
+var ErrorNoTransaction = errors.New("STRATIS-1026 events can only be published within a transaction, see database.WithTx()")
+
+var log = logging.GetLog("outbox")
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+var publishedCounter *prometheus.CounterVec
+var failedCounter *prometheus.CounterVec
+var deadCounter *prometheus.CounterVec
+
+// a row of the outbox table
+type Message struct {
+	Id uint64 `gorm:"primaryKey"`
+
+	Topic string
+
+	// the JSON of the payload
+	Payload string
+
+	// the id of the call which published the message, see `ICtx.GetRequestId()`
+	RequestId string
+
+	// the tenant of the call which published the message, or ""
+	Tenant string
+
+	// one of the STATUS_ constants
+	Status string
+
+	// the number of failed attempts to publish the message
+	Attempts int
+
+	// the error of the last failed attempt, or nil
+	LastError *string
+
+	CreatedAt time.Time
+
+	// the message is not published before this time, used to back off after a failed attempt
+	NextAttemptAt time.Time
+
+	PublishedAt *time.Time
+
+	// the relay which is publishing the message, or nil
+	ClaimedBy *string
+
+	// the time until which the message is claimed by that relay
+	LockedUntil *time.Time
+}
+
+func (Message) TableName() string {
+	return "stratis_outbox"
+}
+
+// enables the outbox metrics
+func Setup(prefix string) {
+	publishedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_outbox_published_count",
+		Help: "The total number of outbox messages which were published",
+	}, []string{"topic"})
+
+	failedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_outbox_failed_count",
+		Help: "The total number of failed attempts to publish outbox messages",
+	}, []string{"topic"})
+
+	deadCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_outbox_dead_count",
+		Help: "The total number of outbox messages which were given up on after too many failed attempts",
+	}, []string{"topic"})
+}
+
+// inserts a message into the outbox, using the given connection, which should be a transaction. the payload is
+// marshalled to JSON, unless it is a json.RawMessage. normally called via `ctx.Publish()`.
+func Insert(db *gorm.DB, topic string, payload any, requestId string, tenant string) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("STRATIS-1027 unable to marshal the payload of an outbox message for topic %s: %w", topic, err)
+	}
+	now := time.Now().UTC()
+	message := Message{
+		Topic:         topic,
+		Payload:       string(data),
+		RequestId:     requestId,
+		Tenant:        tenant,
+		Status:        STATUS_PENDING,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}
+	if err := db.Create(&message).Error; err != nil {
+		return err
+	}
+	log.Debug().Msgf("inserted outbox message %d for topic %s", message.Id, topic)
+	return nil
+}
+
+// moves the given dead messages back to pending, so that they are published again, e.g. once the reason for their
+// failure has been fixed. returns the number of messages which were moved.
+func Redrive(db *gorm.DB, ids ...uint64) (int64, error) {
+	result := db.Model(&Message{}).
+		Where("status = ? AND id IN ?", STATUS_DEAD, ids).
+		Updates(map[string]any{"status": STATUS_PENDING, "attempts": 0, "next_attempt_at": time.Now().UTC()})
+	return result.RowsAffected, result.Error
+}
+
+// returns the SQL for creating (up) and dropping (down) the outbox table, for the given driver, i.e. "mysql",
+// "postgres" or "sqlite", to be added to the migrations of the service
+func MigrationSQL(driver string) (up string, down string, err error) {
+	upBytes, err := migrations.ReadFile("migrations/" + driver + ".up.sql")
+	if err != nil {
+		return "", "", fmt.Errorf("STRATIS-1028 there is no outbox migration for driver %s", driver)
+	}
+	downBytes, err := migrations.ReadFile("migrations/" + driver + ".down.sql")
+	if err != nil {
+		return "", "", fmt.Errorf("STRATIS-1028 there is no outbox migration for driver %s", driver)
+	}
+	return string(upBytes), string(downBytes), nil
+}
@@ -0,0 +1,240 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+func setupTestDb(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{SkipDefaultTransaction: true})
+	assert.Nil(t, err)
+	up, _, err := MigrationSQL("sqlite")
+	assert.Nil(t, err)
+	assert.Nil(t, db.Exec(up).Error)
+	return db
+}
+
+func TestMigrationSQL(t *testing.T) {
+	assert := assert.New(t)
+	for _, driver := range []string{"mysql", "postgres", "sqlite"} {
+		up, down, err := MigrationSQL(driver)
+		assert.Nil(err)
+		assert.Contains(up, "CREATE TABLE stratis_outbox")
+		assert.Contains(down, "DROP TABLE stratis_outbox")
+	}
+	_, _, err := MigrationSQL("oracle")
+	assert.ErrorContains(err, "STRATIS-1028")
+}
+
+func TestRelay_publishesInOrder(t *testing.T) {
+	assert := assert.New(t)
+	db := setupTestDb(t)
+	assert.Nil(Insert(db, "a", map[string]int{"n": 1}, "r1", "t1"))
+	assert.Nil(Insert(db, "b", json.RawMessage(`{"n":2}`), "r2", ""))
+	publisher := &MemoryPublisher{}
+	relay := NewRelay(db, publisher, RelayOptions{})
+
+	// when
+	n, err := relay.RelayBatch(context.Background())
+
+	// then
+	assert.Nil(err)
+	assert.Equal(2, n)
+	messages := publisher.Messages()
+	assert.Len(messages, 2)
+	assert.Equal("a", messages[0].Topic)
+	assert.Equal(`{"n":1}`, messages[0].Payload)
+	assert.Equal("r1", messages[0].RequestId)
+	assert.Equal("t1", messages[0].Tenant)
+	assert.Equal(`{"n":2}`, messages[1].Payload)
+
+	stored := []Message{}
+	assert.Nil(db.Order("id").Find(&stored).Error)
+	assert.Equal(STATUS_PUBLISHED, stored[0].Status)
+	assert.NotNil(stored[0].PublishedAt)
+
+	// nothing is published twice
+	n, err = relay.RelayBatch(context.Background())
+	assert.Nil(err)
+	assert.Equal(0, n)
+	assert.Len(publisher.Messages(), 2)
+}
+
+func TestRelay_retriesAndDeadLetters(t *testing.T) {
+	assert := assert.New(t)
+	db := setupTestDb(t)
+	assert.Nil(Insert(db, "a", "payload", "r1", ""))
+	fail := true
+	publisher := &MemoryPublisher{Fail: func(Message) error {
+		if fail {
+			return errors.New("for test")
+		}
+		return nil
+	}}
+	relay := NewRelay(db, publisher, RelayOptions{MaxAttempts: 2, Backoff: time.Hour})
+
+	// when the first attempt fails
+	_, err := relay.RelayBatch(context.Background())
+
+	// then it is retried later
+	assert.Nil(err)
+	message := Message{}
+	assert.Nil(db.First(&message).Error)
+	assert.Equal(STATUS_PENDING, message.Status)
+	assert.Equal(1, message.Attempts)
+	assert.Equal("for test", *message.LastError)
+	assert.True(message.NextAttemptAt.After(time.Now().Add(59 * time.Minute)))
+
+	// and not before it is due
+	n, err := relay.RelayBatch(context.Background())
+	assert.Nil(err)
+	assert.Equal(0, n)
+
+	// when the second attempt also fails
+	assert.Nil(db.Model(&message).Update("next_attempt_at", time.Now().UTC()).Error)
+	_, err = relay.RelayBatch(context.Background())
+
+	// then it is dead
+	assert.Nil(err)
+	assert.Nil(db.First(&message).Error)
+	assert.Equal(STATUS_DEAD, message.Status)
+	assert.Equal(2, message.Attempts)
+
+	// until it is redriven
+	fail = false
+	moved, err := Redrive(db, message.Id)
+	assert.Nil(err)
+	assert.Equal(int64(1), moved)
+	_, err = relay.RelayBatch(context.Background())
+	assert.Nil(err)
+	assert.Len(publisher.Messages(), 1)
+}
+
+func TestRelay_publishesOutsideOfTransaction(t *testing.T) {
+	assert := assert.New(t)
+	db := setupTestDb(t)
+	assert.Nil(Insert(db, "a", "payload", "r1", ""))
+	publisher := &MemoryPublisher{Fail: func(m Message) error {
+		// the message is claimed, but not locked, so that e.g. other messages can be written meanwhile
+		claimed := Message{}
+		assert.Nil(db.First(&claimed, m.Id).Error)
+		assert.NotNil(claimed.ClaimedBy)
+		assert.True(claimed.LockedUntil.After(time.Now().Add(4 * time.Minute)))
+		assert.Nil(Insert(db, "b", "payload", "r2", ""))
+		return nil
+	}}
+	relay := NewRelay(db, publisher, RelayOptions{BatchSize: 1})
+
+	// when
+	n, err := relay.RelayBatch(context.Background())
+
+	// then
+	assert.Nil(err)
+	assert.Equal(1, n)
+	message := Message{}
+	assert.Nil(db.First(&message).Error)
+	assert.Equal(STATUS_PUBLISHED, message.Status)
+	assert.Nil(message.ClaimedBy)
+	assert.Nil(message.LockedUntil)
+}
+
+func TestRelay_skipsClaimedMessages(t *testing.T) {
+	assert := assert.New(t)
+	db := setupTestDb(t)
+	assert.Nil(Insert(db, "a", "payload", "r1", ""))
+	assert.Nil(db.Model(&Message{}).Where("id = 1").Updates(map[string]any{"claimed_by": "other", "locked_until": time.Now().UTC().Add(time.Minute)}).Error)
+	publisher := &MemoryPublisher{}
+	relay := NewRelay(db, publisher, RelayOptions{})
+
+	// when
+	n, err := relay.RelayBatch(context.Background())
+
+	// then it is left to the other relay
+	assert.Nil(err)
+	assert.Equal(0, n)
+
+	// when the claim of the other relay times out, e.g. because it died
+	assert.Nil(db.Model(&Message{}).Where("id = 1").Update("locked_until", time.Now().UTC().Add(-time.Second)).Error)
+	n, err = relay.RelayBatch(context.Background())
+
+	// then
+	assert.Nil(err)
+	assert.Equal(1, n)
+	assert.Len(publisher.Messages(), 1)
+}
+
+func TestRelay_readsClaimedMessagesFromPrimary(t *testing.T) {
+	assert := assert.New(t)
+	db := setupTestDb(t)
+	assert.Nil(Insert(db, "a", "payload", "r1", ""))
+	// a replica which lags behind, so that it has no messages yet
+	replica := setupTestDb(t)
+	assert.Nil(db.Use(dbresolver.Register(dbresolver.Config{Replicas: []gorm.Dialector{replica.Dialector}})))
+	publisher := &MemoryPublisher{}
+	relay := NewRelay(db, publisher, RelayOptions{})
+
+	// when
+	n, err := relay.RelayBatch(context.Background())
+
+	// then
+	assert.Nil(err)
+	assert.Equal(1, n)
+	assert.Len(publisher.Messages(), 1)
+}
+
+func TestRelay_backoff(t *testing.T) {
+	assert := assert.New(t)
+	relay := NewRelay(nil, nil, RelayOptions{Backoff: time.Second, MaxBackoff: 5 * time.Second})
+	assert.Equal(time.Second, relay.backoff(1))
+	assert.Equal(2*time.Second, relay.backoff(2))
+	assert.Equal(4*time.Second, relay.backoff(3))
+	assert.Equal(5*time.Second, relay.backoff(4))
+	assert.Equal(5*time.Second, relay.backoff(40))
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	assert := assert.New(t)
+	var received *http.Request
+	var body string
+	status := http.StatusAccepted
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	publisher := &WebhookPublisher{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer x"}}
+	message := Message{Id: 3, Topic: "order.created", Payload: `{"id":1}`, RequestId: "r1"}
+
+	// when
+	err := publisher.Publish(context.Background(), message)
+
+	// then
+	assert.Nil(err)
+	assert.Equal(http.MethodPost, received.Method)
+	assert.Equal(`{"id":1}`, body)
+	assert.Equal("3", received.Header.Get("X-Outbox-Id"))
+	assert.Equal("order.created", received.Header.Get("X-Outbox-Topic"))
+	assert.Equal("r1", received.Header.Get("X-Request-Id"))
+	assert.Equal("Bearer x", received.Header.Get("Authorization"))
+
+	// when the webhook fails
+	status = http.StatusServiceUnavailable
+	err = publisher.Publish(context.Background(), message)
+
+	// then
+	assert.ErrorContains(err, "returned 503")
+}
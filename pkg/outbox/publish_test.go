@@ -0,0 +1,48 @@
+package outbox_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublish_onlyWithinCommittedTx(t *testing.T) {
+	assert := assert.New(t)
+	t.Setenv(database.STRATIS_DB_DRIVER, database.DRIVER_SQLITE)
+	t.Setenv("STRATIS_DB_NAME", "file:"+filepath.Join(t.TempDir(), "test.db"))
+	database.SetupDb()
+	up, _, err := outbox.MigrationSQL("sqlite")
+	assert.Nil(err)
+	assert.Nil(database.GetDb().Exec(up).Error)
+	ctx := fwctx.BuildTypedCtxForTests(database.GetDb(), false)
+	errorForTest := errors.New("for test")
+
+	// when published without a transaction
+	err = ctx.Publish("a", "without")
+
+	// then
+	assert.Equal(outbox.ErrorNoTransaction, err)
+
+	// when published in a transaction that is rolled back, and one that is committed
+	_, err = database.WithTx(ctx, func() (any, error) {
+		assert.Nil(ctx.Publish("a", "rolled back"))
+		return nil, errorForTest
+	})
+	assert.Equal(errorForTest, err)
+	_, err = database.WithTx(ctx, func() (any, error) {
+		return nil, ctx.Publish("a", "committed")
+	})
+	assert.Nil(err)
+
+	// then
+	messages := []outbox.Message{}
+	assert.Nil(database.GetDb().Find(&messages).Error)
+	assert.Len(messages, 1)
+	assert.Equal(`"committed"`, messages[0].Payload)
+	assert.Equal(outbox.STATUS_PENDING, messages[0].Status)
+}
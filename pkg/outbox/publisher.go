@@ -0,0 +1,100 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/httpclient"
+)
+
+// publishes messages read from the outbox by the Relay. an error causes the message to be retried later.
+type Publisher interface {
+	Publish(ctx context.Context, message Message) error
+}
+
+// ================================================================================================
+
+// POSTs the payload of each message to a URL, with the headers X-Outbox-Id and X-Outbox-Topic, and X-Request-Id
+// set to the id of the call which published it. any status other than 2xx is a failure.
+type WebhookPublisher struct {
+	URL string
+
+	// additional headers, e.g. for authorization
+	Headers map[string]string
+
+	// the client to use, or nil for one created by httpclient.New()
+	Client *http.Client
+}
+
+func (p *WebhookPublisher) Publish(ctx context.Context, message Message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewBufferString(message.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Outbox-Id", strconv.FormatUint(message.Id, 10))
+	req.Header.Set("X-Outbox-Topic", message.Topic)
+	for name, value := range p.Headers {
+		req.Header.Set(name, value)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = httpclient.New(ctx, nil, message.RequestId, httpclient.Credentials{})
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook %s returned %d: %s", p.URL, resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// ================================================================================================
+
+// logs each message, e.g. for development
+type LogPublisher struct{}
+
+func (p *LogPublisher) Publish(ctx context.Context, message Message) error {
+	log.Info().Msgf("published outbox message %d for topic %s with request id %s: %s", message.Id, message.Topic, message.RequestId, message.Payload)
+	return nil
+}
+
+// ================================================================================================
+
+// keeps the published messages in memory, for tests
+type MemoryPublisher struct {
+	// if set, it is called before each message is published, and an error it returns causes the attempt to fail
+	Fail func(message Message) error
+
+	mutex    sync.Mutex
+	messages []Message
+}
+
+func (p *MemoryPublisher) Publish(ctx context.Context, message Message) error {
+	if p.Fail != nil {
+		if err := p.Fail(message); err != nil {
+			return err
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.messages = append(p.messages, message)
+	return nil
+}
+
+// returns a copy of the messages published so far, in order
+func (p *MemoryPublisher) Messages() []Message {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]Message{}, p.messages...)
+}
@@ -0,0 +1,232 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const _MAX_ERROR_LENGTH = 1000
+
+// wakes up the relays in this process, so that messages are published without waiting for the next interval
+var wake = make(chan struct{}, 1)
+
+type RelayOptions struct {
+	// how often the outbox is polled for pending messages, default 1s
+	Interval time.Duration
+
+	// the maximum number of messages claimed and published at once, default 100
+	BatchSize int
+
+	// how long a batch of messages is claimed by a relay, after which other relays may publish them, e.g. if the
+	// relay died. it should be longer than publishing a whole batch can take. default 5m.
+	ClaimTimeout time.Duration
+
+	// the number of failed attempts after which a message is moved to the dead status, default 10
+	MaxAttempts int
+
+	// the wait before the first retry of a failed message, which doubles for each further retry, up to MaxBackoff.
+	// default 1s.
+	Backoff time.Duration
+
+	// default 1h
+	MaxBackoff time.Duration
+}
+
+func (o RelayOptions) withDefaults() RelayOptions {
+	if o.Interval <= 0 {
+		o.Interval = time.Second
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+	if o.ClaimTimeout <= 0 {
+		o.ClaimTimeout = 5 * time.Minute
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 10
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = time.Second
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = time.Hour
+	}
+	return o
+}
+
+// reads pending messages from the outbox and hands them to a Publisher. several relays, e.g. one per instance of
+// the service, can safely run at the same time, because each batch of messages is first claimed in a short
+// transaction, using `SELECT ... FOR UPDATE SKIP LOCKED` (except with sqlite, where writers are serialised anyway).
+// the messages are then published without holding any locks or connections, and each one is marked as published or
+// failed on its own.
+type Relay struct {
+	db        *gorm.DB
+	publisher Publisher
+	opts      RelayOptions
+}
+
+func NewRelay(db *gorm.DB, publisher Publisher, opts RelayOptions) *Relay {
+	return &Relay{db: db, publisher: publisher, opts: opts.withDefaults()}
+}
+
+// publishes pending messages every interval, and whenever Notify() is called, until the context is done
+func (r *Relay) Start(ctx context.Context) {
+	log.Info().Msgf("starting outbox relay with interval %s", r.opts.Interval)
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("stopping outbox relay")
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+
+		// keep going while batches are full, so that a backlog is worked off without waiting for the interval
+		for {
+			n, err := r.RelayBatch(ctx)
+			if err != nil {
+				log.Error().Msgf("unable to relay outbox messages: %+v", err)
+				break
+			}
+			if n < r.opts.BatchSize || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+}
+
+// publishes one batch of pending messages whose next attempt is due, and returns the number of messages which were
+// claimed, whether or not they could be published
+func (r *Relay) RelayBatch(ctx context.Context) (int, error) {
+	claim, messages, err := r.claim(ctx)
+	if err != nil || len(messages) == 0 {
+		return 0, err
+	}
+	// messages which are not published, e.g. because the context is done, become available to other relays again
+	defer r.release(context.WithoutCancel(ctx), claim)
+
+	for _, message := range messages {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := r.relay(ctx, claim, message); err != nil {
+			return len(messages), err
+		}
+	}
+	return len(messages), nil
+}
+
+// claims a batch of pending messages for this relay, by setting their claimed_by and locked_until columns, and
+// returns them, without keeping the transaction open
+func (r *Relay) claim(ctx context.Context) (string, []Message, error) {
+	claim := uuid.NewString()
+	now := time.Now().UTC()
+	messages := []Message{}
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		query := tx.Model(&Message{}).
+			Where("status = ? AND next_attempt_at <= ? AND (locked_until IS NULL OR locked_until <= ?)", STATUS_PENDING, now, now).
+			Order("id").
+			Limit(r.opts.BatchSize)
+		if tx.Dialector.Name() != "sqlite" {
+			query = query.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+		}
+		ids := []uint64{}
+		if err := query.Pluck("id", &ids).Error; err != nil || len(ids) == 0 {
+			return err
+		}
+		// the condition is repeated, so that messages claimed by another relay in the meantime are left alone
+		err := tx.Model(&Message{}).
+			Where("id IN ? AND (locked_until IS NULL OR locked_until <= ?)", ids, now).
+			Updates(map[string]any{"claimed_by": claim, "locked_until": now.Add(r.opts.ClaimTimeout)}).Error
+		if err != nil {
+			return err
+		}
+		// read in the transaction, i.e. from the primary, since a replica may not have the claim yet
+		return tx.Where("claimed_by = ?", claim).Order("id").Find(&messages).Error
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return claim, messages, nil
+}
+
+func (r *Relay) release(ctx context.Context, claim string) {
+	err := r.db.WithContext(ctx).Model(&Message{}).
+		Where("claimed_by = ?", claim).
+		Updates(map[string]any{"claimed_by": nil, "locked_until": nil}).Error
+	if err != nil {
+		log.Warn().Msgf("unable to release outbox messages, they will be published once the claim times out: %+v", err)
+	}
+}
+
+// publishes one message and updates its row, if it is still claimed by this relay. only errors when updating the
+// row are returned.
+func (r *Relay) relay(ctx context.Context, claim string, message Message) error {
+	now := time.Now().UTC()
+	publishErr := r.publisher.Publish(ctx, message)
+	if publishErr == nil {
+		if publishedCounter != nil {
+			publishedCounter.With(prometheus.Labels{"topic": message.Topic}).Inc()
+		}
+		return r.update(ctx, claim, message, map[string]any{"status": STATUS_PUBLISHED, "published_at": now})
+	}
+
+	if failedCounter != nil {
+		failedCounter.With(prometheus.Labels{"topic": message.Topic}).Inc()
+	}
+	attempts := message.Attempts + 1
+	lastError := publishErr.Error()
+	if len(lastError) > _MAX_ERROR_LENGTH {
+		lastError = lastError[:_MAX_ERROR_LENGTH]
+	}
+	updates := map[string]any{"attempts": attempts, "last_error": lastError}
+	if attempts >= r.opts.MaxAttempts {
+		log.Error().Msgf("giving up on outbox message %d for topic %s after %d attempts: %+v", message.Id, message.Topic, attempts, publishErr)
+		if deadCounter != nil {
+			deadCounter.With(prometheus.Labels{"topic": message.Topic}).Inc()
+		}
+		updates["status"] = STATUS_DEAD
+	} else {
+		wait := r.backoff(attempts)
+		log.Warn().Msgf("unable to publish outbox message %d for topic %s, retrying in %s: %+v", message.Id, message.Topic, wait, publishErr)
+		updates["next_attempt_at"] = now.Add(wait)
+	}
+	return r.update(ctx, claim, message, updates)
+}
+
+func (r *Relay) update(ctx context.Context, claim string, message Message, updates map[string]any) error {
+	updates["claimed_by"] = nil
+	updates["locked_until"] = nil
+	result := r.db.WithContext(context.WithoutCancel(ctx)).Model(&Message{}).
+		Where("id = ? AND claimed_by = ?", message.Id, claim).
+		Updates(updates)
+	if result.Error == nil && result.RowsAffected == 0 {
+		log.Warn().Msgf("the claim on outbox message %d timed out before it was published, so it may be published again", message.Id)
+	}
+	return result.Error
+}
+
+// the wait after the given number of failed attempts
+func (r *Relay) backoff(attempts int) time.Duration {
+	wait := r.opts.Backoff
+	for i := 1; i < attempts && wait < r.opts.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, r.opts.MaxBackoff)
+}
+
+// wakes up the relays running in this process, e.g. once a transaction which published messages has been committed.
+// does not block.
+func Notify() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,153 @@
+package policy
+
+// a layer on top of roles, where endpoints and code check named permissions rather than lists of roles.
+// permissions are granted to roles, roles can inherit the permissions of other roles, and attribute based
+// rules can additionally restrict a permission, based on the user, its context (e.g. organisation) and the
+// resource being accessed. e.g.
+//
+//     policy.Default().
+//         Inherit("admin", "user").
+//         Grant("order:read", "user").
+//         Grant("order:delete", "admin").
+//         Require("order:read", func(user *jwt.User, userContext jwt.UserContext, resource any) bool {
+//             order, ok := resource.(*Order)
+//             return !ok || order.OrganisationId == userContext["organisationId"]
+//         })
+//
+// and then either use `framework_gin.PolicyMiddleware("order:delete", nil, nil)` or `ctx.Authorize("order:read", order)`.
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/jwt"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+	"github.com/samber/lo"
+)
+
+// a permission granted to this pseudo role is granted to every user who is not anonymous
+const ANY_AUTHENTICATED_USER = "*"
+
+var log = logging.GetLog("policy")
+
+// an attribute based rule which must be true, in order for a permission to be granted.
+// the resource is whatever the caller passes to `Decide`, and is nil when checked by the middleware.
+type Rule func(user *jwt.User, userContext jwt.UserContext, resource any) bool
+
+type Decision struct {
+	Permission string
+	Allowed    bool
+	Reason     string
+}
+
+type Engine struct {
+	mutex       sync.RWMutex
+	permissions map[string][]string // permission => roles which are granted it
+	parents     map[string][]string // role => roles whose permissions it inherits
+	rules       map[string][]Rule   // permission => rules which must all be true
+}
+
+// replaced atomically, since Setup() may be called, e.g. by tests, while requests are being authorized
+var defaultEngine atomic.Pointer[Engine]
+
+func init() {
+	defaultEngine.Store(NewEngine())
+}
+
+func NewEngine() *Engine {
+	return &Engine{
+		permissions: map[string][]string{},
+		parents:     map[string][]string{},
+		rules:       map[string][]Rule{},
+	}
+}
+
+// the engine used by `fwctx.ICtx.Authorize()` and `framework_gin.PolicyMiddleware()`
+func Default() *Engine {
+	return defaultEngine.Load()
+}
+
+// replaces the default engine, e.g. with one built by a test
+func Setup(engine *Engine) {
+	defaultEngine.Store(engine)
+}
+
+// grants the permission to the given roles
+func (e *Engine) Grant(permission string, roles ...string) *Engine {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.permissions[permission] = lo.Uniq(append(e.permissions[permission], roles...))
+	return e
+}
+
+// the role is given all the permissions of the inherited roles, e.g. `Inherit("admin", "user")`
+func (e *Engine) Inherit(role string, inheritedRoles ...string) *Engine {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.parents[role] = lo.Uniq(append(e.parents[role], inheritedRoles...))
+	return e
+}
+
+// adds a rule which must be true in order for the permission to be granted, in addition to the user having a role
+// which is granted the permission
+func (e *Engine) Require(permission string, rule Rule) *Engine {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.rules[permission] = append(e.rules[permission], rule)
+	return e
+}
+
+// decides whether the user has the permission for the resource, which may be nil
+func (e *Engine) Decide(user *jwt.User, permission string, resource any) Decision {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	granted, ok := e.permissions[permission]
+	if !ok {
+		return Decision{permission, false, "unknown permission"}
+	}
+
+	roles := e.effectiveRoles(user.Roles)
+	role, found := lo.Find(granted, func(r string) bool {
+		return lo.Contains(roles, r) || (r == ANY_AUTHENTICATED_USER && !user.IsAnonymous())
+	})
+	if !found {
+		return Decision{permission, false, fmt.Sprintf("none of the roles %v are granted the permission", user.Roles)}
+	}
+
+	for i, rule := range e.rules[permission] {
+		if !rule(user, user.UserContext, resource) {
+			return Decision{permission, false, fmt.Sprintf("rule %d denied access to resource %+v", i, resource)}
+		}
+	}
+
+	return Decision{permission, true, fmt.Sprintf("granted via role %s", role)}
+}
+
+// the roles of the user, plus all the roles they inherit
+func (e *Engine) effectiveRoles(roles []string) []string {
+	result := []string{}
+	toVisit := append([]string{}, roles...)
+	for len(toVisit) > 0 {
+		role := toVisit[0]
+		toVisit = toVisit[1:]
+		if lo.Contains(result, role) {
+			continue // handles cycles
+		}
+		result = append(result, role)
+		toVisit = append(toVisit, e.parents[role]...)
+	}
+	return result
+}
+
+// decides using the default engine, and logs the decision
+func Authorize(user *jwt.User, permission string, resource any) Decision {
+	decision := Default().Decide(user, permission, resource)
+	if decision.Allowed {
+		log.Debug().Msgf("ALLOWED user %s permission %s: %s", user.UserId, permission, decision.Reason)
+	} else {
+		log.Info().Msgf("DENIED user %s permission %s: %s", user.UserId, permission, decision.Reason)
+	}
+	return decision
+}
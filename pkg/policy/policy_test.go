@@ -0,0 +1,74 @@
+package policy_test
+
+import (
+	"testing"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/jwt"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/policy"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/test/policytest"
+	"github.com/stretchr/testify/assert"
+)
+
+type order struct {
+	OrganisationId string
+}
+
+func TestEngine_Decide(t *testing.T) {
+	engine := policy.NewEngine().
+		Inherit("admin", "user").
+		Inherit("superadmin", "admin").
+		Inherit("auditor", "reviewer").
+		Inherit("reviewer", "auditor"). // a cycle, which must not cause problems
+		Grant("order:read", "user").
+		Grant("order:delete", "admin").
+		Grant("profile:read", policy.ANY_AUTHENTICATED_USER).
+		Require("order:read", func(user *jwt.User, userContext jwt.UserContext, resource any) bool {
+			o, ok := resource.(*order)
+			return !ok || o.OrganisationId == userContext["organisationId"]
+		})
+
+	user := &jwt.User{Username: "user", UserId: "1", Roles: []string{"user"}, UserContext: jwt.UserContext{"organisationId": "o1"}}
+	admin := &jwt.User{Username: "admin", UserId: "2", Roles: []string{"admin"}, UserContext: jwt.UserContext{"organisationId": "o2"}}
+	guest := &jwt.User{Username: "guest", UserId: "3", Roles: []string{"guest"}, UserContext: jwt.UserContext{}}
+	auditor := &jwt.User{Username: "auditor", UserId: "4", Roles: []string{"auditor"}, UserContext: jwt.UserContext{}}
+	superadmin := &jwt.User{Username: "superadmin", UserId: "5", Roles: []string{"superadmin"}, UserContext: jwt.UserContext{"organisationId": "o1"}}
+	anonymous := &jwt.User{Username: jwt.ANONYMOUS, UserId: "0", Roles: []string{}, UserContext: jwt.UserContext{}}
+
+	policytest.AssertDecisions(t, engine, []policytest.Case{
+		{Name: "user reads without resource", User: user, Permission: "order:read", Resource: nil, Allowed: true},
+		{Name: "user reads own organisation's order", User: user, Permission: "order:read", Resource: &order{"o1"}, Allowed: true},
+		{Name: "user cannot read other organisation's order", User: user, Permission: "order:read", Resource: &order{"o2"}, Allowed: false},
+		{Name: "admin inherits read from user", User: admin, Permission: "order:read", Resource: &order{"o2"}, Allowed: true},
+		{Name: "admin cannot read other organisation's order", User: admin, Permission: "order:read", Resource: &order{"o1"}, Allowed: false},
+		{Name: "admin deletes", User: admin, Permission: "order:delete", Resource: nil, Allowed: true},
+		{Name: "user cannot delete", User: user, Permission: "order:delete", Resource: nil, Allowed: false},
+		{Name: "guest cannot read", User: guest, Permission: "order:read", Resource: nil, Allowed: false},
+		{Name: "guest reads profile", User: guest, Permission: "profile:read", Resource: nil, Allowed: true},
+		{Name: "anonymous cannot read profile", User: anonymous, Permission: "profile:read", Resource: nil, Allowed: false},
+		{Name: "superadmin inherits transitively", User: superadmin, Permission: "order:read", Resource: &order{"o1"}, Allowed: true},
+		{Name: "cyclic inheritance", User: auditor, Permission: "order:delete", Resource: nil, Allowed: false},
+		{Name: "unknown permission", User: admin, Permission: "unknown", Resource: nil, Allowed: false},
+	})
+}
+
+func TestSetup_whileAuthorizing(t *testing.T) {
+	previous := policy.Default()
+	t.Cleanup(func() { policy.Setup(previous) })
+	user := &jwt.User{Username: "user", UserId: "1", Roles: []string{"user"}, UserContext: jwt.UserContext{}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			policy.Setup(policy.NewEngine().Grant("order:read", "user"))
+		}
+	}()
+
+	// when the engine is replaced while requests are authorized, which the race detector checks
+	for i := 0; i < 100; i++ {
+		policy.Authorize(user, "order:read", nil)
+	}
+	<-done
+
+	// then
+	assert.True(t, policy.Authorize(user, "order:read", nil).Allowed)
+}
@@ -0,0 +1,317 @@
+package tenancy
+
+// multi-tenancy, where every row of a tenant scoped table belongs to a tenant, identified by a tenant column.
+// the tenant of a call is resolved by the Middleware and stored in the ICtx, and the Plugin then ensures that
+// every query made through `ctx.GetDb()` on a model with the tenant column is filtered by that tenant, and that
+// every row which is created is stamped with it. e.g.
+//
+//     database.SetupDb()
+//     database.GetDb().Use(&tenancy.Plugin{Column: "tenant_id"})
+//     ...
+//     router.Use(tenancy.Middleware(tenancy.FirstOf(tenancy.FromUserContext("organisationId"), tenancy.FromHeader("X-Tenant-Id")), nil))
+//
+// queries on tenant scoped models fail with ErrorNoTenant if there is no tenant, unless they are explicitly
+// marked with CrossTenant(), e.g. for admin jobs which work across all tenants. updates cannot move rows to
+// another tenant.
+//
+// statements which cannot be filtered, because they have no model, i.e. `db.Table()` or raw SQL using `db.Raw()`
+// or `db.Exec()`, fail with ErrorUnscopedStatement when they are made on behalf of a call, i.e. using
+// `ctx.GetDb()`, unless they are marked with CrossTenant(). statements made without an ICtx, e.g. by the
+// migrator, are not checked.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/jwt"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const _CROSS_TENANT_SETTING = "stratis:tenancy:cross-tenant"
+const _TENANT_SETTING = "stratis:tenancy:tenant"
+
+var ErrorNoTenant = errors.New("STRATIS-1013 no tenant is set for a query on a tenant scoped model")
+var ErrorWrongTenant = errors.New("STRATIS-1014 attempt to write a row belonging to a different tenant")
+var ErrorUnscopedStatement = errors.New("STRATIS-1048 a statement without a model cannot be filtered by tenant, use a model or CrossTenant()")
+
+// statements which the framework runs within transactions, and which cannot touch the rows of a tenant
+var transactionControl = regexp.MustCompile(`(?i)^\s*(SAVEPOINT|RELEASE SAVEPOINT|ROLLBACK TO|SET)\s`)
+
+var log = logging.GetLog("tenancy")
+
+// ================================================================================================
+// resolvers
+// ================================================================================================
+
+// a function which determines the tenant of the call, returning "" if it cannot
+type Resolver func(ctx fwctx.ICtx) (string, error)
+
+// takes the tenant out of the user context of the user, i.e. for service users
+func FromUserContext(key string) Resolver {
+	return func(ctx fwctx.ICtx) (string, error) {
+		user, err := ctx.GetUser()
+		if err != nil {
+			return "", err
+		}
+		return user.UserContext[key], nil
+	}
+}
+
+// takes the tenant out of the given request header. the header can be set by the caller, so either ensure that it is
+// set by a trusted proxy, or combine it with a policy rule that checks the user actually belongs to the tenant.
+func FromHeader(name string) Resolver {
+	return func(ctx fwctx.ICtx) (string, error) {
+		return ctx.GetGinCtx().GetHeader(name), nil
+	}
+}
+
+// takes the tenant out of the subdomain of the host that was called, e.g. "acme" when "acme.example.com" is called and the
+// baseDomain is "example.com"
+func FromSubdomain(baseDomain string) Resolver {
+	return func(ctx fwctx.ICtx) (string, error) {
+		host := ctx.GetGinCtx().Request.Host
+		if i := strings.LastIndexByte(host, ':'); i >= 0 {
+			host = host[:i] // remove port
+		}
+		subdomain, found := strings.CutSuffix(host, "."+baseDomain)
+		if !found || strings.Contains(subdomain, ".") {
+			return "", nil
+		}
+		return subdomain, nil
+	}
+}
+
+// uses the first resolver that returns a tenant
+func FirstOf(resolvers ...Resolver) Resolver {
+	return func(ctx fwctx.ICtx) (string, error) {
+		for _, resolver := range resolvers {
+			tenant, err := resolver(ctx)
+			if err != nil || len(tenant) > 0 {
+				return tenant, err
+			}
+		}
+		return "", nil
+	}
+}
+
+// ================================================================================================================================
+// middleware which resolves the tenant and stores it in the ICtx. aborts with a 400 if no tenant can be resolved.
+// An optional contextProvider can be provided to handle service users.
+// ================================================================================================================================
+func Middleware(resolver Resolver, contextProvider func(fwctx.ICtx, string) (jwt.UserContext, string, string, []string, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := fwctx.BuildTypedCtx(c, contextProvider)
+		tenant, err := resolver(ctx)
+		if err != nil {
+			if errors.Is(err, fwctx.ErrorTokenNotFound) || errors.Is(err, fwctx.ErrorTokenWrong) {
+				c.AbortWithError(http.StatusUnauthorized, err)
+			} else {
+				log.Error().Msgf("failed to resolve tenant %+v", err)
+				c.AbortWithError(http.StatusInternalServerError, err)
+			}
+			return
+		}
+		if len(tenant) == 0 {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("STRATIS-1015 unable to determine the tenant for %s %s", c.Request.Method, c.Request.RequestURI))
+			return
+		}
+		ctx.SetTenant(tenant)
+		c.Next()
+	}
+}
+
+// ================================================================================================
+// escape hatches
+// ================================================================================================
+
+// marks the query as one that works across all tenants, i.e. it is not filtered and rows are not stamped.
+// only use this for admin jobs! e.g.
+//
+//     tenancy.CrossTenant(ctx.GetDb()).Find(&allOrders)
+func CrossTenant(db *gorm.DB) *gorm.DB {
+	return db.Set(_CROSS_TENANT_SETTING, true)
+}
+
+// uses the given tenant for the query, rather than the one in the ICtx, e.g. for background jobs processing
+// each tenant in turn
+func ForTenant(db *gorm.DB, tenant string) *gorm.DB {
+	return db.Set(_TENANT_SETTING, tenant)
+}
+
+// ================================================================================================
+// gorm plugin
+// ================================================================================================
+
+// a GORM plugin which filters and stamps models which have the tenant column
+type Plugin struct {
+	// the name of the tenant column, e.g. "tenant_id"
+	Column string
+}
+
+func (p *Plugin) Name() string {
+	return "stratis:tenancy"
+}
+
+func (p *Plugin) Initialize(db *gorm.DB) error {
+	if len(p.Column) == 0 {
+		return errors.New("STRATIS-1016 the tenancy plugin needs a column name")
+	}
+	if err := db.Callback().Create().Before("gorm:create").Register("stratis:tenancy:create", p.stamp); err != nil {
+		return err
+	}
+	if err := db.Callback().Query().Before("gorm:query").Register("stratis:tenancy:query", p.filter); err != nil {
+		return err
+	}
+	if err := db.Callback().Update().Before("gorm:update").Register("stratis:tenancy:update", p.update); err != nil {
+		return err
+	}
+	if err := db.Callback().Delete().Before("gorm:delete").Register("stratis:tenancy:delete", p.filter); err != nil {
+		return err
+	}
+	if err := db.Callback().Row().Before("gorm:row").Register("stratis:tenancy:row", p.filter); err != nil {
+		return err
+	}
+	return db.Callback().Raw().Before("gorm:raw").Register("stratis:tenancy:raw", p.filter)
+}
+
+// returns the tenant column field, or nil if the model is not tenant scoped. fails with ErrorUnscopedStatement
+// if the statement cannot be filtered, and returns nil.
+func (p *Plugin) field(db *gorm.DB) *schema.Field {
+	if db.Statement.Schema == nil || db.Statement.SQL.Len() > 0 {
+		p.rejectUnscoped(db) // e.g. db.Table() or db.Raw(), which cannot be handled
+		return nil
+	}
+	return db.Statement.Schema.LookUpField(p.Column)
+}
+
+func (p *Plugin) rejectUnscoped(db *gorm.DB) {
+	if _, ok := fwctx.FromContext(db.Statement.Context); !ok {
+		return // not made on behalf of a call, e.g. by the migrator
+	}
+	if transactionControl.MatchString(db.Statement.SQL.String()) {
+		return
+	}
+	if _, crossTenant := tenantOf(db); crossTenant {
+		if len(db.Statement.Table) > 0 {
+			log.Warn().Msgf("cross tenant statement without a model on table %s", db.Statement.Table)
+		} else {
+			log.Warn().Msgf("cross tenant statement %s", db.Statement.SQL.String())
+		}
+		return
+	}
+	db.AddError(ErrorUnscopedStatement)
+}
+
+// returns the tenant to use, or "" with true, if the query is cross tenant
+func tenantOf(db *gorm.DB) (string, bool) {
+	if crossTenant, ok := db.Get(_CROSS_TENANT_SETTING); ok && crossTenant.(bool) {
+		return "", true
+	}
+	if tenant, ok := db.Get(_TENANT_SETTING); ok {
+		return tenant.(string), false
+	}
+	if ctx, ok := fwctx.FromContext(db.Statement.Context); ok {
+		return ctx.GetTenant(), false
+	}
+	return "", false
+}
+
+func (p *Plugin) filter(db *gorm.DB) {
+	field := p.field(db)
+	if field == nil || db.Error != nil {
+		return
+	}
+	tenant, crossTenant := tenantOf(db)
+	if crossTenant {
+		log.Warn().Msgf("cross tenant query on table %s", db.Statement.Table)
+		return
+	} else if len(tenant) == 0 {
+		db.AddError(ErrorNoTenant)
+		return
+	}
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: tenant},
+	}})
+}
+
+// filters the update, and ensures that it does not move the rows to another tenant
+func (p *Plugin) update(db *gorm.DB) {
+	p.filter(db)
+	if db.Error != nil || db.Statement.Schema == nil || db.Statement.SQL.Len() > 0 {
+		return
+	}
+	field := db.Statement.Schema.LookUpField(p.Column)
+	if field == nil {
+		return
+	}
+	tenant, crossTenant := tenantOf(db)
+	if crossTenant {
+		return // e.g. an admin moving rows to another tenant
+	}
+
+	var value any
+	isSet := false
+	switch dest := db.Statement.Dest.(type) {
+	case map[string]any:
+		if value, isSet = dest[field.DBName]; !isSet {
+			value, isSet = dest[field.Name]
+		}
+	default:
+		rv := reflect.Indirect(reflect.ValueOf(dest))
+		if rv.Kind() == reflect.Struct && rv.Type() == db.Statement.Schema.ModelType {
+			var isZero bool
+			value, isZero = field.ValueOf(db.Statement.Context, rv)
+			isSet = !isZero
+		}
+	}
+	if isSet && value != tenant {
+		db.AddError(fmt.Errorf("%w: %v instead of %s", ErrorWrongTenant, value, tenant))
+		return
+	}
+	db.Statement.Omits = append(db.Statement.Omits, field.DBName)
+}
+
+func (p *Plugin) stamp(db *gorm.DB) {
+	field := p.field(db)
+	if field == nil || db.Error != nil {
+		return
+	}
+	tenant, crossTenant := tenantOf(db)
+	if crossTenant {
+		log.Warn().Msgf("cross tenant insert into table %s", db.Statement.Table)
+		return
+	} else if len(tenant) == 0 {
+		db.AddError(ErrorNoTenant)
+		return
+	}
+
+	stampOne := func(rv reflect.Value) {
+		current, isZero := field.ValueOf(db.Statement.Context, rv)
+		if !isZero && current != tenant {
+			db.AddError(fmt.Errorf("%w: %v instead of %s", ErrorWrongTenant, current, tenant))
+		} else if err := field.Set(db.Statement.Context, rv, tenant); err != nil {
+			db.AddError(err)
+		}
+	}
+
+	rv := db.Statement.ReflectValue
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			stampOne(reflect.Indirect(rv.Index(i)))
+		}
+	case reflect.Struct:
+		stampOne(rv)
+	default:
+		db.AddError(fmt.Errorf("STRATIS-1017 unable to stamp the tenant onto a %s, use a struct", rv.Kind()))
+	}
+}
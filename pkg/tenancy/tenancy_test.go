@@ -0,0 +1,211 @@
+package tenancy
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/utils/tests"
+)
+
+type order struct {
+	ID       uint
+	TenantId string
+	Name     string
+}
+
+type country struct {
+	ID   uint
+	Name string
+}
+
+func setup(t *testing.T, tenant string) fwctx.ICtx {
+	db, err := gorm.Open(tests.DummyDialector{}, &gorm.Config{DryRun: true})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Use(&Plugin{Column: "tenant_id"}))
+	ctx := fwctx.BuildTypedCtxForTests(db, false)
+	ctx.SetTenant(tenant)
+	return ctx
+}
+
+func TestPlugin_queriesAreFiltered(t *testing.T) {
+	assert := assert.New(t)
+	ctx := setup(t, "t1")
+
+	// when
+	stmt := ctx.GetDb().Where("name = ?", "a").Find(&[]order{}).Statement
+
+	// then
+	assert.Nil(stmt.Error)
+	assert.Equal("SELECT * FROM `orders` WHERE name = ? AND `orders`.`tenant_id` = ?", stmt.SQL.String())
+	assert.Equal([]any{"a", "t1"}, stmt.Vars)
+}
+
+func TestPlugin_updatesAndDeletesAreFiltered(t *testing.T) {
+	assert := assert.New(t)
+	ctx := setup(t, "t1")
+
+	// when
+	update := ctx.GetDb().Model(&order{}).Where("id = ?", 1).Update("name", "b").Statement
+	del := ctx.GetDb().Delete(&order{ID: 1}).Statement
+
+	// then
+	assert.Nil(update.Error)
+	assert.Equal("UPDATE `orders` SET `name`=? WHERE id = ? AND `orders`.`tenant_id` = ?", update.SQL.String())
+	assert.Nil(del.Error)
+	assert.Equal("DELETE FROM `orders` WHERE `orders`.`tenant_id` = ? AND `orders`.`id` = ?", del.SQL.String())
+}
+
+func TestPlugin_noQueryWithoutTenant(t *testing.T) {
+	assert := assert.New(t)
+	ctx := setup(t, "")
+
+	assert.ErrorIs(ctx.GetDb().Find(&[]order{}).Error, ErrorNoTenant)
+	assert.ErrorIs(ctx.GetDb().Model(&order{}).Where("id = ?", 1).Update("name", "b").Error, ErrorNoTenant)
+	assert.ErrorIs(ctx.GetDb().Delete(&order{ID: 1}).Error, ErrorNoTenant)
+	assert.ErrorIs(ctx.GetDb().Create(&order{Name: "a"}).Error, ErrorNoTenant)
+	var count int64
+	assert.ErrorIs(ctx.GetDb().Model(&order{}).Count(&count).Error, ErrorNoTenant)
+}
+
+func TestPlugin_noStatementWithoutModel(t *testing.T) {
+	assert := assert.New(t)
+	ctx := setup(t, "t1")
+
+	assert.ErrorIs(ctx.GetDb().Table("orders").Find(&[]map[string]any{}).Error, ErrorUnscopedStatement)
+	assert.ErrorIs(ctx.GetDb().Table("orders").Where("id = ?", 1).Updates(map[string]any{"name": "b"}).Error, ErrorUnscopedStatement)
+	assert.ErrorIs(ctx.GetDb().Table("orders").Create(map[string]any{"name": "a"}).Error, ErrorUnscopedStatement)
+	assert.ErrorIs(ctx.GetDb().Raw("SELECT * FROM orders").Scan(&[]order{}).Error, ErrorUnscopedStatement)
+	assert.ErrorIs(ctx.GetDb().Raw("SELECT * FROM orders").Find(&[]order{}).Error, ErrorUnscopedStatement)
+	assert.ErrorIs(ctx.GetDb().Exec("DELETE FROM orders").Error, ErrorUnscopedStatement)
+
+	// unless they are explicitly cross tenant, or used to control the transaction
+	assert.Nil(CrossTenant(ctx.GetDb()).Exec("DELETE FROM orders").Error)
+	assert.Nil(ctx.GetDb().Exec("SAVEPOINT sp1").Error)
+	assert.Nil(ctx.GetDb().Exec("SET LOCAL statement_timeout = 100").Error)
+
+	// statements which are not made on behalf of a call are not checked, e.g. those of the migrator
+	db := ctx.GetDb().WithContext(context.Background())
+	assert.Nil(db.Exec("DELETE FROM orders").Error)
+}
+
+func TestPlugin_updatesCannotChangeTheTenant(t *testing.T) {
+	assert := assert.New(t)
+	ctx := setup(t, "t1")
+
+	// when
+	stmt := ctx.GetDb().Model(&order{ID: 1}).Updates(order{Name: "b", TenantId: "t1"}).Statement
+	save := ctx.GetDb().Save(&order{ID: 1, Name: "b", TenantId: "t1"}).Statement
+
+	// then
+	assert.Nil(stmt.Error)
+	assert.Equal("UPDATE `orders` SET `name`=? WHERE `orders`.`tenant_id` = ? AND `id` = ?", stmt.SQL.String())
+	assert.Nil(save.Error)
+	assert.NotContains(save.SQL.String(), "SET `tenant_id`")
+	assert.NotContains(save.SQL.String(), ",`tenant_id`=")
+
+	// when
+	err := ctx.GetDb().Model(&order{ID: 1}).Update("tenant_id", "t2").Error
+	err2 := ctx.GetDb().Model(&order{ID: 1}).Updates(order{Name: "b", TenantId: "t2"}).Error
+	err3 := ctx.GetDb().Model(&order{ID: 1}).Updates(map[string]any{"TenantId": "t2"}).Error
+
+	// then
+	assert.ErrorIs(err, ErrorWrongTenant)
+	assert.ErrorIs(err2, ErrorWrongTenant)
+	assert.ErrorIs(err3, ErrorWrongTenant)
+}
+
+func TestPlugin_modelsWithoutTenantColumnAreNotFiltered(t *testing.T) {
+	assert := assert.New(t)
+	ctx := setup(t, "")
+
+	// when
+	stmt := ctx.GetDb().Find(&[]country{}).Statement
+
+	// then
+	assert.Nil(stmt.Error)
+	assert.Equal("SELECT * FROM `countries`", stmt.SQL.String())
+}
+
+func TestPlugin_crossTenant(t *testing.T) {
+	assert := assert.New(t)
+	ctx := setup(t, "")
+
+	// when
+	stmt := CrossTenant(ctx.GetDb()).Find(&[]order{}).Statement
+
+	// then
+	assert.Nil(stmt.Error)
+	assert.Equal("SELECT * FROM `orders`", stmt.SQL.String())
+}
+
+func TestPlugin_forTenant(t *testing.T) {
+	assert := assert.New(t)
+	ctx := setup(t, "")
+
+	// when
+	stmt := ForTenant(ctx.GetDb(), "t2").Find(&[]order{}).Statement
+
+	// then
+	assert.Nil(stmt.Error)
+	assert.Equal([]any{"t2"}, stmt.Vars)
+}
+
+func TestPlugin_createIsStamped(t *testing.T) {
+	assert := assert.New(t)
+	ctx := setup(t, "t1")
+	o := &order{Name: "a"}
+	os := []order{{Name: "b"}, {Name: "c", TenantId: "t1"}}
+
+	// when
+	err := ctx.GetDb().Create(o).Error
+	err2 := ctx.GetDb().Create(&os).Error
+
+	// then
+	assert.Nil(err)
+	assert.Equal("t1", o.TenantId)
+	assert.Nil(err2)
+	assert.Equal("t1", os[0].TenantId)
+	assert.Equal("t1", os[1].TenantId)
+}
+
+func TestPlugin_createForOtherTenantFails(t *testing.T) {
+	ctx := setup(t, "t1")
+
+	// when
+	err := ctx.GetDb().Create(&order{Name: "a", TenantId: "t2"}).Error
+
+	// then
+	assert.ErrorIs(t, err, ErrorWrongTenant)
+}
+
+func TestFromSubdomain(t *testing.T) {
+	testCases := []struct {
+		host     string
+		expected string
+	}{
+		{"acme.example.com", "acme"},
+		{"acme.example.com:8080", "acme"},
+		{"example.com", ""},
+		{"a.b.example.com", ""},
+		{"acme.other.com", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/", nil)
+			c.Request.Host = tc.host
+
+			tenant, err := FromSubdomain("example.com")(fwctx.BuildTypedCtx(c, nil))
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, tenant)
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package dbtest
+
+// helpers for testing code which uses the database
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/tenancy"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// simulates another caller updating the row of the given entity, which embeds `database.Versioned`, between the time
+// it was read and the time it is saved, by applying the changes, if any, to the row and incrementing its version. the
+// entity itself is not changed, so that saving it afterwards fails with `database.ErrorConflict`. e.g.
+//
+//     order, _ := orders.FindByID(ctx, 1)
+//     err := dbtest.ConcurrentUpdate(db, order, map[string]any{"status": "CANCELLED"})
+//     ...
+//     err = orders.Save(ctx, order)
+//     assert.ErrorIs(err, database.ErrorConflict)
+func ConcurrentUpdate(db *gorm.DB, entity any, changes map[string]any) error {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(entity); err != nil {
+		return err
+	}
+	version := stmt.Schema.LookUpField("Version")
+	pk := stmt.Schema.PrioritizedPrimaryField
+	if version == nil || pk == nil {
+		return fmt.Errorf("%s needs a version and a single primary key to be updated concurrently", stmt.Schema.Name)
+	}
+	id, _ := pk.ValueOf(db.Statement.Context, reflect.Indirect(reflect.ValueOf(entity)))
+
+	updates := map[string]any{}
+	for column, value := range changes {
+		updates[column] = value
+	}
+	updates[version.DBName] = gorm.Expr("? + 1", clause.Column{Name: version.DBName})
+
+	// using the table rather than the model, so that it is done exactly as given, without any callbacks interfering
+	result := tenancy.CrossTenant(db.Session(&gorm.Session{NewDB: true})).Table(stmt.Schema.Table).Where(clause.Eq{Column: clause.Column{Name: pk.DBName}, Value: id}).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("there is no row to update concurrently")
+	}
+	return nil
+}
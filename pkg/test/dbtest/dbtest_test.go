@@ -0,0 +1,136 @@
+package dbtest
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/test/dbtest/harness"
+	"github.com/stretchr/testify/assert"
+)
+
+type customer struct {
+	Id   uint64
+	Name string
+}
+
+type order struct {
+	Id         uint64
+	CustomerId uint64
+	Status     string
+	database.Versioned
+	database.Audited
+}
+
+var customers = NewFactory(func(n int) customer {
+	return customer{Name: fmt.Sprintf("customer %d", n)}
+})
+
+func TestMain(m *testing.M) {
+	os.Setenv(database.STRATIS_DB_DRIVER, database.DRIVER_SQLITE)
+	os.Setenv("STRATIS_DB_MIGRATION_LOCATION", "testdata/migrations")
+	os.Exit(harness.Run(m))
+}
+
+func count(t *testing.T, ctx fwctx.ICtx, table string) int64 {
+	var n int64
+	assert.Nil(t, ctx.GetDb().Table(table).Count(&n).Error)
+	return n
+}
+
+func TestCtx_rollsBack(t *testing.T) {
+	assert := assert.New(t)
+	rolledBack := false
+
+	t.Run("in a transaction", func(t *testing.T) {
+		ctx := harness.Ctx(t)
+		ctx.AfterRollback(func() { rolledBack = true })
+
+		// when
+		_, err := database.WithTx(ctx, func() (any, error) {
+			return customers.Create(ctx)
+		})
+
+		// then the transaction of the test was joined
+		assert.Nil(err)
+		assert.Equal(int64(1), count(t, ctx, "customers"))
+	})
+
+	// then
+	assert.True(rolledBack)
+	assert.Equal(int64(0), count(t, fwctx.BuildTypedCtxForTests(database.GetDb(), false), "customers"))
+}
+
+func TestLoadFixtures(t *testing.T) {
+	assert := assert.New(t)
+	ctx := harness.Ctx(t)
+
+	// when
+	err := LoadFixtures(ctx, "testdata/orders.yaml", "testdata/customers.json")
+
+	// then
+	assert.Nil(err)
+	names := []string{}
+	assert.Nil(ctx.GetDb().Table("customers").Order("id").Pluck("name", &names).Error)
+	assert.Equal([]string{"Jane", "John", "Joan"}, names)
+	o := order{}
+	assert.Nil(ctx.GetDb().First(&o, 2).Error)
+	assert.Equal(order{Id: 2, CustomerId: 1, Status: "PAID"}, o)
+}
+
+func TestLoadFixtures_errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		expected string
+	}{
+		{name: "missing file", file: "testdata/missing.yaml", expected: "no such file"},
+		{name: "unsupported format", file: "testdata/migrations/000001_create_customers.up.sql", expected: "only .yaml, .yml and .json files are supported"},
+		{name: "foreign key", file: "testdata/orphans.yaml", expected: "row 1 of orders: violates foreign key constraint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := harness.Ctx(t)
+
+			// when
+			err := LoadFixtures(ctx, tt.file)
+
+			// then
+			assert.ErrorContains(t, err, "unable to load the fixture "+tt.file)
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
+
+func TestFactory(t *testing.T) {
+	assert := assert.New(t)
+	ctx := harness.Ctx(t)
+	orders := NewFactory(func(n int) order {
+		return order{Status: "NEW"}
+	})
+
+	// when
+	jane, err := customers.Create(ctx, func(c *customer) { c.Name = "Jane" })
+	assert.Nil(err)
+	others, err := customers.CreateMany(ctx, 2)
+	assert.Nil(err)
+	o, err := orders.Create(ctx, func(o *order) { o.CustomerId = jane.Id })
+	assert.Nil(err)
+
+	// then
+	assert.Equal("Jane", jane.Name)
+	assert.NotEqual(others[0].Name, others[1].Name)
+	assert.Equal(int64(3), count(t, ctx, "customers"))
+	assert.Equal(int64(1), o.Version)
+	assert.Equal("c606cb7f-9ac5-4f10-8403-db2e83b1ae0f", o.CreatedBy) // the user of the test ctx
+
+	// when
+	built := orders.Build(func(o *order) { o.Status = "PAID" })
+
+	// then it is not saved
+	assert.Equal("PAID", built.Status)
+	assert.Equal(uint64(0), built.Id)
+	assert.Equal(int64(1), count(t, ctx, "orders"))
+}
@@ -0,0 +1,57 @@
+package dbtest
+
+import (
+	"sync/atomic"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+)
+
+// builds entities with valid defaults, which each test only changes where it matters, e.g.
+//
+//     var customers = dbtest.NewFactory(func(n int) Customer {
+//         return Customer{Name: fmt.Sprintf("customer %d", n), Email: fmt.Sprintf("customer%d@example.com", n)}
+//     })
+//
+//     customer, err := customers.Create(ctx, func(c *Customer) { c.Name = "Jane" })
+//
+// n is a sequence number, starting at 1, which is unique per factory, e.g. for unique columns.
+type Factory[T any] struct {
+	defaults func(n int) T
+	sequence atomic.Int64
+}
+
+func NewFactory[T any](defaults func(n int) T) *Factory[T] {
+	return &Factory[T]{defaults: defaults}
+}
+
+// returns an entity with the defaults, changed by the given functions, without saving it
+func (f *Factory[T]) Build(changes ...func(*T)) *T {
+	entity := f.defaults(int(f.sequence.Add(1)))
+	for _, change := range changes {
+		change(&entity)
+	}
+	return &entity
+}
+
+// builds an entity and inserts it using the ctx, e.g. in the transaction of the test, see Ctx(). the model's
+// callbacks are run, so e.g. audit columns are set.
+func (f *Factory[T]) Create(ctx fwctx.ICtx, changes ...func(*T)) (*T, error) {
+	entity := f.Build(changes...)
+	if err := ctx.GetDb().Create(entity).Error; err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+
+// creates the given number of entities, each changed by the given functions
+func (f *Factory[T]) CreateMany(ctx fwctx.ICtx, count int, changes ...func(*T)) ([]*T, error) {
+	entities := []*T{}
+	for i := 0; i < count; i++ {
+		entity, err := f.Create(ctx, changes...)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, entity)
+	}
+	return entities, nil
+}
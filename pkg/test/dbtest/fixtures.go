@@ -0,0 +1,73 @@
+package dbtest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/tenancy"
+	"gopkg.in/yaml.v3"
+)
+
+// inserts the rows of the given YAML or JSON files, using the ctx, e.g. in the transaction of the test, see Ctx().
+// each file maps table names to lists of rows, which map column names to values, e.g.
+//
+//     customers:
+//       - id: 1
+//         name: Jane
+//     orders:
+//       - id: 1
+//         customer_id: 1
+//         status: NEW
+//
+// or the same in JSON. the tables are filled in the order in which they appear, so that foreign keys can be
+// satisfied, and the rows are inserted as they are, without using the models, so e.g. audit columns must be given if
+// they are needed.
+func LoadFixtures(ctx fwctx.ICtx, files ...string) error {
+	for _, file := range files {
+		if err := loadFixture(ctx, file); err != nil {
+			return fmt.Errorf("unable to load the fixture %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+func loadFixture(ctx fwctx.ICtx, file string) error {
+	switch filepath.Ext(file) {
+	case ".yaml", ".yml", ".json":
+	default:
+		return fmt.Errorf("only .yaml, .yml and .json files are supported")
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	// JSON is YAML, and a node keeps the order of the tables, which a map would not
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	tables := doc.Content[0]
+	if tables.Kind != yaml.MappingNode {
+		return fmt.Errorf("expected a map of table names to rows at line %d", tables.Line)
+	}
+	for i := 0; i < len(tables.Content); i += 2 {
+		table := tables.Content[i].Value
+		rows := []map[string]any{}
+		if err := tables.Content[i+1].Decode(&rows); err != nil {
+			return fmt.Errorf("the rows of %s: %w", table, err)
+		}
+		for n, row := range rows {
+			// the rows are given exactly, including e.g. their tenant
+			if err := tenancy.CrossTenant(ctx.GetDb()).Table(table).Create(row).Error; err != nil {
+				return fmt.Errorf("row %d of %s: %w", n+1, table, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package harness
+
+// a database for tests, which is set up once per test binary and migrated, and in which each test runs in its own
+// transaction, which is always rolled back, e.g.
+//
+//     func TestMain(m *testing.M) {
+//         os.Exit(harness.Run(m))
+//     }
+//
+//     func TestOrders(t *testing.T) {
+//         ctx := harness.Ctx(t)
+//         assert.Nil(t, dbtest.LoadFixtures(ctx, "testdata/orders.yaml"))
+//         ...
+//     }
+//
+// the database server configured using the STRATIS_DB_ env vars is used if it is local and reachable, e.g. a MySQL
+// on localhost, otherwise a SQLite database is created in a temporary directory, and the env vars are changed to point
+// to it. since the tests migrate the database, a server on another host is only used if the env var
+// STRATIS_DBTEST_USE_SERVER is "true", so that a shell pointing at e.g. staging does not migrate it by accident. the
+// migrations are read from STRATIS_DB_MIGRATION_LOCATION, which is relative to the package being tested, or from the
+// fs set using `migration.SetFS()`. it is a package of its own, rather than part of dbtest, so that the database
+// package can use dbtest in its own tests.
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/database/migration"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/fwctx"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/logging"
+)
+
+// set to "true" to run the tests against the configured database server, even if it is not on the local machine
+const STRATIS_DBTEST_USE_SERVER = "STRATIS_DBTEST_USE_SERVER"
+
+var log = logging.GetLog("dbtest")
+
+var startOnce sync.Once
+var startErr error
+var tempDir string
+
+// sets up the database, see Start(), runs the tests and removes the temporary database, if one was created.
+// returns the exit code, for use in TestMain.
+func Run(m *testing.M) int {
+	if err := Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer Stop()
+	return m.Run()
+}
+
+// sets up the database and applies the migrations, the first time it is called. returns the same error each time, if
+// that failed.
+func Start() error {
+	startOnce.Do(func() {
+		if !serverReachable() {
+			dir, err := os.MkdirTemp("", "dbtest")
+			if err != nil {
+				startErr = fmt.Errorf("unable to create a directory for the test database: %w", err)
+				return
+			}
+			tempDir = dir
+			os.Setenv(database.STRATIS_DB_DRIVER, database.DRIVER_SQLITE)
+			os.Setenv("STRATIS_DB_NAME", "file:"+filepath.Join(dir, "test.db"))
+		}
+		log.Info().Msgf("using %s database %s for tests", database.GetDialect().Name(), database.GetDialect().DatabaseName())
+		database.SetupDb()
+		if err := migration.Migrate(); err != nil {
+			startErr = fmt.Errorf("unable to migrate the test database: %w", err)
+		}
+	})
+	return startErr
+}
+
+// removes the temporary database, if one was created
+func Stop() {
+	if len(tempDir) > 0 {
+		if sqlDb, err := database.GetDb().DB(); err == nil {
+			sqlDb.Close()
+		}
+		os.RemoveAll(tempDir)
+	}
+}
+
+// true if a database server is configured, may be used, and can be connected to
+func serverReachable() bool {
+	driver := os.Getenv(database.STRATIS_DB_DRIVER)
+	host := os.Getenv("STRATIS_DB_HOST")
+	if driver == database.DRIVER_SQLITE || len(host) == 0 {
+		return false
+	}
+	if !serverAllowed(host, os.Getenv(STRATIS_DBTEST_USE_SERVER) == "true") {
+		log.Warn().Msgf("the %s server at %s is not local, so sqlite is used. set %s=true to use it anyway", driver, host, STRATIS_DBTEST_USE_SERVER)
+		return false
+	}
+	port := os.Getenv("STRATIS_DB_PORT")
+	if len(port) == 0 {
+		port = "3306"
+		if driver == database.DRIVER_POSTGRES {
+			port = "5432"
+		}
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), time.Second)
+	if err != nil {
+		log.Info().Msgf("the %s server at %s:%s is not reachable, so sqlite is used: %+v", driver, host, port, err)
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// true if the host is on the local machine, or the use of other hosts was explicitly allowed
+func serverAllowed(host string, allowed bool) bool {
+	if allowed || host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// returns a ctx for the test, with a transaction which is rolled back when the test ends, together with its after
+// rollback hooks. the after commit hooks are never run. `database.WithTx()` joins the transaction, but code which
+// uses `database.GetDb()` directly, or the REQUIRES_NEW propagation, does not, so its changes are not rolled back,
+// and with sqlite it waits for the transaction, since sqlite only allows one writer at a time. for the same reason,
+// tests using sqlite should not run in parallel.
+func Ctx(t testing.TB) fwctx.ICtx {
+	t.Helper()
+	if err := Start(); err != nil {
+		t.Fatal(err)
+	}
+	tx := database.Begin()
+	if tx.Error != nil {
+		t.Fatalf("unable to begin the test transaction: %+v", tx.Error)
+	}
+	ctx := fwctx.BuildTypedCtxForTests(tx, true)
+	current := ctx.GetTx()
+	t.Cleanup(func() {
+		if err := database.Rollback(tx); err != nil {
+			t.Errorf("unable to roll back the test transaction: %+v", err)
+		}
+		current.RunAfterRollbackHooks()
+	})
+	return ctx
+}
@@ -0,0 +1,28 @@
+package harness
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerAllowed(t *testing.T) {
+	testCases := []struct {
+		host     string
+		allowed  bool
+		expected bool
+	}{
+		{"localhost", false, true},
+		{"127.0.0.1", false, true},
+		{"::1", false, true},
+		{"db.staging.example.com", false, false},
+		{"10.0.0.5", false, false},
+		{"db.staging.example.com", true, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			assert.Equal(t, tc.expected, serverAllowed(tc.host, tc.allowed))
+		})
+	}
+}
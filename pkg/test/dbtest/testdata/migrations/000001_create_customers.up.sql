@@ -0,0 +1,15 @@
+CREATE TABLE customers (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE orders (
+    id INTEGER PRIMARY KEY,
+    customer_id INTEGER NOT NULL REFERENCES customers (id),
+    status TEXT NOT NULL,
+    version INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME,
+    created_by TEXT,
+    updated_at DATETIME,
+    updated_by TEXT
+);
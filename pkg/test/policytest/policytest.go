@@ -0,0 +1,35 @@
+package policytest
+
+import (
+	"testing"
+
+	"github.com/abstratium-informatique-sarl/stratis/pkg/jwt"
+	"github.com/abstratium-informatique-sarl/stratis/pkg/policy"
+)
+
+// a row in an allow/deny table
+type Case struct {
+	Name       string
+	User       *jwt.User
+	Permission string
+	Resource   any
+	Allowed    bool
+}
+
+// runs each case as a sub-test and fails it, if the engine's decision differs from the expected one. e.g.
+//
+//     policytest.AssertDecisions(t, engine, []policytest.Case{
+//         {Name: "admin can delete", User: admin, Permission: "order:delete", Allowed: true},
+//         {Name: "user cannot delete", User: user, Permission: "order:delete", Allowed: false},
+//     })
+func AssertDecisions(t *testing.T, engine *policy.Engine, cases []Case) {
+	t.Helper()
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			decision := engine.Decide(c.User, c.Permission, c.Resource)
+			if decision.Allowed != c.Allowed {
+				t.Errorf("expected allowed=%t for permission %s but got %t: %s", c.Allowed, c.Permission, decision.Allowed, decision.Reason)
+			}
+		})
+	}
+}